@@ -0,0 +1,110 @@
+// Package audit records the registration decisions of mesos-consul, and
+// their reasons, as newline delimited JSON apart from the operational
+// logs.
+//
+// Decisions are dropped until Open is called with a destination, so that
+// callers don't check whether the audit log is enabled.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/logging"
+)
+
+// Logger of the audit subsystem, see --log-levels
+var log = logging.New("audit")
+
+// Actions of the decisions
+const (
+	Register   = "register"
+	Deregister = "deregister"
+	Skip       = "skip"
+)
+
+// Decision is one record of the audit log. Only the fields known where
+// the decision is made are set.
+type Decision struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Reason    string    `json:"reason"`
+	Task      string    `json:"task,omitempty"`
+	Framework string    `json:"framework,omitempty"`
+	Host      string    `json:"host,omitempty"`
+	Service   string    `json:"service,omitempty"`
+
+	// Mesos and Consul clusters, when mesos-consul manages several
+	MesosCluster  string `json:"mesos_cluster,omitempty"`
+	ConsulCluster string `json:"consul_cluster,omitempty"`
+}
+
+var (
+	lock sync.Mutex
+	out  io.Writer
+)
+
+// Open appends the decisions to the file at path, or writes them to the
+// standard output if path is "-". An empty path disables the audit log.
+func Open(path string) error {
+	var w io.Writer
+	switch path {
+	case "":
+	case "-":
+		w = os.Stdout
+	default:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+
+	SetOutput(w)
+	return nil
+}
+
+// SetOutput writes the decisions to w, or drops them if w is nil.
+func SetOutput(w io.Writer) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	out = w
+}
+
+// Enabled returns whether the decisions are recorded.
+func Enabled() bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return out != nil
+}
+
+// Record writes a decision on its own line, timestamped now if its time
+// is not set.
+func Record(d Decision) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if out == nil {
+		return
+	}
+
+	if d.Time.IsZero() {
+		d.Time = time.Now().UTC()
+	}
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		log.Errorf("Unable to encode audit decision %+v: %s", d, err)
+		return
+	}
+
+	// A single write per line keeps the records whole in the file
+	if _, err := out.Write(append(b, '\n')); err != nil {
+		log.Errorf("Unable to write audit decision %+v: %s", d, err)
+	}
+}
@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecord(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(nil)
+
+	Record(Decision{Action: Register, Reason: "new service", Task: "web.1", Service: "mesos-consul:web:31000"})
+	Record(Decision{Action: Skip, Reason: "no IP address", Task: "db.1"})
+
+	var decisions []Decision
+	s := bufio.NewScanner(&buf)
+	for s.Scan() {
+		var d Decision
+		if err := json.Unmarshal(s.Bytes(), &d); err != nil {
+			t.Fatalf("Record() wrote %q: %s", s.Text(), err)
+		}
+		decisions = append(decisions, d)
+	}
+
+	if len(decisions) != 2 || decisions[0].Service != "mesos-consul:web:31000" || decisions[1].Action != Skip {
+		t.Fatalf("Record() => %+v, want the 2 decisions", decisions)
+	}
+	if decisions[0].Time.IsZero() {
+		t.Errorf("Record() => %+v, want a timestamp", decisions[0])
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetOutput(nil)
+
+	path := filepath.Join(dir, "audit.log")
+	if err := ioutil.WriteFile(path, []byte("{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Open(path); err != nil || !Enabled() {
+		t.Fatalf("Open(%s) => %v, enabled %t, want nil, true", path, err, Enabled())
+	}
+	Record(Decision{Action: Deregister, Reason: "task TASK_KILLED"})
+
+	b, _ := ioutil.ReadFile(path)
+	if lines := bytes.Count(b, []byte("\n")); lines != 2 {
+		t.Errorf("Open(%s) then Record() => %q, want the decision appended", path, b)
+	}
+
+	if err := Open(""); err != nil || Enabled() {
+		t.Errorf("Open() => %v, enabled %t, want nil, false", err, Enabled())
+	}
+	if err := Open(filepath.Join(dir, "missing", "audit.log")); err == nil {
+		t.Error("Open() in a missing directory => nil, want error")
+	}
+}
@@ -5,42 +5,222 @@ import (
 )
 
 type Config struct {
-	Refresh         time.Duration
-	Zk              string
-	LogLevel        string
-	MesosIpOrder    string
-	Healthcheck     bool
-	HealthcheckIp   string
-	HealthcheckPort string
-	TaskWhiteList   []string
-	TaskBlackList   []string
-	FwWhiteList     []string
-	FwBlackList     []string
-	TaskTag         []string
-	Separator       string
-
-	// Mesos service name and tags
-	ServiceName     string
-	ServiceTags     string
-	ServiceIdPrefix string
+	ConfigFile          string
+	Refresh             time.Duration
+	MinAge              time.Duration
+	DeregisterGrace     time.Duration
+	ReconcileInterval   time.Duration
+	StateFetchAttempts  int
+	StateFetchDelay     time.Duration
+	Zk                  string
+	MesosClusters       []string
+	Cluster             string
+	RequireConsul       bool
+	EventStream         bool
+	LogLevel            string
+	LogLevels           string
+	MesosIpOrder        string
+	AddressFamily       string
+	AddressFallback     bool
+	SkipNoIp            bool
+	SkipNonRoutable     bool
+	RegisterPrimaryPort bool
+	RegistrationPolicy  string
+	LegacyConsulLabel   string
+	DuplicatePortNames  string
+	NamedPortCheck      string
+	RegistrationLabel   string
+	RegisterFilter      string
+	DockerChecks        bool
+	BodyCheck           bool
+	ProbeBeforeRegister bool
+	ProbeTimeout        time.Duration
+	RegisterWorkers     int
+	RegisterWorkersMax  int
+	RegisterBacklog     int
+	CheckSchemeDetect   bool
+	CheckOutputMaxSize  int
+	CheckOwnerNotes     bool
+	CheckTimeoutRatio   float64
+	CheckIntervalMin    time.Duration
+	CheckIntervalMax    time.Duration
+	DefaultCheck        string
+	IpStatusStates      string
+	Healthcheck         bool
+	HealthcheckIp       string
+	HealthcheckPort     string
+	AdminToken          string
+	TaskWhiteList       []string
+	TaskBlackList       []string
+	FwWhiteList         []string
+	FwBlackList         []string
+	AgentExclude        []string
+	MasterExclude       []string
+	RegisterLeaderOnly  bool
+	TaskTag             []string
+	FrameworkIpOrder    []string
+	Separator           string
+	NameSanitizer       string
+	NameSanitizerRegex  string
+	NameCase            string
+	SrvSafeNames        bool
+
+	// Register tasks whose cleaned name is empty under their task ID
+	EmptyNameFallback bool
+
+	// Mesos service name and tags. The agent and master service names
+	// default to ServiceName when empty.
+	ServiceName        string
+	AgentServiceName   string
+	MasterServiceName  string
+	ServiceTags        string
+	AgentAttributeTags string
+	DefaultTags        string
+	ServiceIdPrefix    string
+	AdoptPrefixes      string
+	AgentNodeCheck     bool
+	AgentResourcesMeta bool
+	ServiceIdSeparator string
+	StableIds          bool
+
+	// Prefix applied to every tag registered in Consul
+	TagPrefix string
+
+	// Prefix of the task labels turned into tags, and the format of
+	// these tags: key, key=value or key:value
+	LabelTagPrefix string
+	LabelTagFormat string
+
+	// Templates of task tags, e.g. version-${label:VERSION}, and whether
+	// the templates with unresolved references are dropped or rendered
+	// with empty values
+	TagTemplates       []string
+	TagTemplateMissing string
+
+	// Tag task services with the Consul agent they are registered on
+	TagNode bool
+
+	// Tag task services with the Mesos roles of the task
+	TagRole bool
+
+	// Add the Mesos sandbox URL of tasks to their service meta
+	TagSandboxURL bool
+
+	// Add the container image of tasks to their service meta
+	TagImage bool
+
+	// Register and compare the tags sorted
+	SortTags bool
+
+	// Suffix of the service name of tasks with the consul_canary label
+	CanarySuffix string
+
+	// Task service names longer than this are truncated
+	MaxNameLength int
+
+	// Consul KV prefix to mirror the Mesos frameworks under, and
+	// whether the Mesos version and cluster name are written there too
+	KVPrefix      string
+	KVClusterInfo bool
+
+	// Consul KV key pausing the registrations while set
+	PauseKVKey string
+
+	// OTLP/HTTP endpoint to export the sync cycle traces to
+	OtlpEndpoint string
+
+	// File to append the registration decisions to, "-" for the
+	// standard output, disabled if empty
+	AuditLog string
 }
 
 func DefaultConfig() *Config {
 	return &Config{
-		Refresh:         time.Minute,
-		Zk:              "zk://127.0.0.1:2181/mesos",
-		MesosIpOrder:    "netinfo,mesos,host",
-		Healthcheck:     false,
-		HealthcheckIp:   "127.0.0.1",
-		HealthcheckPort: "24476",
-		TaskWhiteList:   []string{},
-		TaskBlackList:   []string{},
-		FwWhiteList:     []string{},
-		FwBlackList:     []string{},
-		TaskTag:         []string{},
-		Separator:       "",
-		ServiceName:     "mesos",
-		ServiceTags:     "",
-		ServiceIdPrefix: "mesos-consul",
+		Refresh:             time.Minute,
+		MinAge:              0,
+		DeregisterGrace:     0,
+		ReconcileInterval:   0,
+		StateFetchAttempts:  3,
+		StateFetchDelay:     time.Second,
+		Zk:                  "zk://127.0.0.1:2181/mesos",
+		MesosClusters:       []string{},
+		Cluster:             "",
+		RequireConsul:       false,
+		EventStream:         false,
+		MesosIpOrder:        "netinfo,mesos,host",
+		AddressFamily:       "any",
+		AddressFallback:     false,
+		SkipNoIp:            true,
+		SkipNonRoutable:     true,
+		RegisterPrimaryPort: true,
+		RegistrationPolicy:  "all",
+		LegacyConsulLabel:   "ignore",
+		DuplicatePortNames:  "index",
+		NamedPortCheck:      "inherit",
+		RegistrationLabel:   "consul_register",
+		RegisterFilter:      "",
+		DockerChecks:        false,
+		ProbeBeforeRegister: false,
+		ProbeTimeout:        2 * time.Second,
+		RegisterWorkers:     1,
+		RegisterWorkersMax:  0,
+		RegisterBacklog:     50,
+		CheckSchemeDetect:   false,
+		BodyCheck:           false,
+		CheckOutputMaxSize:  0,
+		CheckOwnerNotes:     false,
+		CheckTimeoutRatio:   0,
+		CheckIntervalMin:    0,
+		CheckIntervalMax:    0,
+		DefaultCheck:        "",
+		IpStatusStates:      "TASK_RUNNING",
+		Healthcheck:         false,
+		HealthcheckIp:       "127.0.0.1",
+		HealthcheckPort:     "24476",
+		AdminToken:          "",
+		TaskWhiteList:       []string{},
+		TaskBlackList:       []string{},
+		FwWhiteList:         []string{},
+		FwBlackList:         []string{},
+		AgentExclude:        []string{},
+		MasterExclude:       []string{},
+		RegisterLeaderOnly:  false,
+		TaskTag:             []string{},
+		FrameworkIpOrder:    []string{},
+		Separator:           "",
+		NameSanitizer:       "default",
+		NameSanitizerRegex:  `[^\w-]`,
+		NameCase:            "lower",
+		SrvSafeNames:        false,
+		EmptyNameFallback:   false,
+		ServiceName:         "mesos",
+		AgentServiceName:    "",
+		MasterServiceName:   "",
+		ServiceTags:         "",
+		AgentAttributeTags:  "",
+		DefaultTags:         "",
+		ServiceIdPrefix:     "mesos-consul",
+		AdoptPrefixes:       "",
+		ServiceIdSeparator:  ":",
+		StableIds:           false,
+		AgentNodeCheck:      false,
+		AgentResourcesMeta:  false,
+		TagPrefix:           "",
+		LabelTagPrefix:      "",
+		LabelTagFormat:      "key=value",
+		TagTemplates:        []string{},
+		TagTemplateMissing:  "drop",
+		TagNode:             false,
+		TagRole:             false,
+		TagSandboxURL:       false,
+		TagImage:            false,
+		SortTags:            false,
+		CanarySuffix:        "-canary",
+		MaxNameLength:       256,
+		KVPrefix:            "",
+		KVClusterInfo:       false,
+		PauseKVKey:          "",
+		OtlpEndpoint:        "",
+		AuditLog:            "",
 	}
 }
@@ -1,19 +1,28 @@
 package consul
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"regexp"
 	"strings"
 
+	"github.com/CiscoCloud/mesos-consul/audit"
 	"github.com/CiscoCloud/mesos-consul/registry"
 
 	consulapi "github.com/hashicorp/consul/api"
-	log "github.com/sirupsen/logrus"
 )
 
 type cacheEntry struct {
 	service         *consulapi.AgentServiceRegistration
 	agent           string
 	validityCounter int
+
+	// Never deregistered by the sweep, see --pin-service-ids
+	pinned bool
+
+	// Marked by the refresh before the last sweep
+	marked bool
 }
 
 func newCacheEntry(service *consulapi.AgentServiceRegistration, agent string) *cacheEntry {
@@ -24,61 +33,252 @@ func newCacheEntry(service *consulapi.AgentServiceRegistration, agent string) *c
 	}
 }
 
-// Service cache
-var serviceCache map[string]*cacheEntry
 var cacheEntryValidityThreshold int = 1
 
 // CacheCreate()
 //
 func (c *Consul) CacheCreate() bool {
-	if serviceCache == nil {
-		serviceCache = make(map[string]*cacheEntry)
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	if c.cache == nil {
+		c.cache = make(map[string]*cacheEntry)
+		c.checks = make(map[string]*checkCacheEntry)
 		return true
 	}
 
 	return false
 }
 
-// Initialize the service cache
+// Initialize the service cache with the services whose ID
+// starts with one of idPrefixes
 //
-func (c *Consul) CacheLoad(host, serviceIdPrefix string) error {
-	client := c.client(host).Catalog()
+func (c *Consul) CacheLoad(host string, idPrefixes ...string) error {
+	c.idPrefixes = idPrefixes
 
-	serviceList, _, err := client.Services(nil)
+	found, _, err := c.catalogServices(host)
 	if err != nil {
 		return err
 	}
 
-	searchStr := fmt.Sprintf("%s:", serviceIdPrefix)
+	c.cacheLock.Lock()
+	for id, e := range found {
+		c.cache[id] = e
+	}
+	c.cacheLock.Unlock()
+
+	return c.checkCacheLoad(host)
+}
+
+// catalogPartitions()
+//   Admin partitions to read the catalog of: all of them with Consul
+//   Enterprise, as the consul_partition label registers services
+//   outside of --consul-partition, otherwise the --consul-partition one
+//
+func (c *Consul) catalogPartitions(client *consulapi.Client) []string {
+	c.throttle()
+	partitions, _, err := client.Partitions().List(context.Background(), nil)
+	if err != nil {
+		if se, ok := err.(consulapi.StatusError); !ok || se.Code != http.StatusNotFound {
+			log.WithField("cluster", c.name).Warnf("Unable to list the admin partitions, only loading partition '%s': %s", c.config.partition, err.Error())
+		}
+		return []string{c.config.partition}
+	}
+	if len(partitions) == 0 {
+		return []string{c.config.partition}
+	}
 
-	for service, _ := range serviceList {
-		catalogServices, _, err := client.Service(service, "", nil)
+	var names []string
+	for _, p := range partitions {
+		names = append(names, p.Name)
+	}
+
+	return names
+}
+
+// catalogServices()
+//   Read the services with a managed ID and name from the Consul
+//   catalog of every admin partition, as cache entries keyed by service
+//   ID, and the partitions read. The names --managed-service-names
+//   refuses are left out, so the sweep doesn't refuse them again after
+//   every load or reconciliation.
+//
+func (c *Consul) catalogServices(host string) (map[string]*cacheEntry, map[string]bool, error) {
+	client := c.client(host)
+	if client == nil {
+		return nil, nil, fmt.Errorf("no consul agent address")
+	}
+	catalog := client.Catalog()
+
+	// Services without a partition are in the agent one
+	read := map[string]bool{"": true, c.config.partition: true}
+	found := make(map[string]*cacheEntry)
+	for _, partition := range c.catalogPartitions(client) {
+		q := &consulapi.QueryOptions{Partition: partition}
+		read[partition] = true
+
+		c.throttle()
+		serviceList, _, err := catalog.Services(q)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
-		for _, s := range catalogServices {
-			if strings.HasPrefix(s.ServiceID, searchStr) {
-				log.Debugf("Found '%s' with ID '%s'", s.ServiceName, s.ServiceID)
-				serviceCache[s.ServiceID] = newCacheEntry(&consulapi.AgentServiceRegistration{
-					ID:      s.ServiceID,
-					Name:    s.ServiceName,
-					Port:    s.ServicePort,
-					Address: s.ServiceAddress,
-					Tags:    s.ServiceTags,
-				}, s.Address)
+		for service, _ := range serviceList {
+			c.throttle()
+			catalogServices, _, err := catalog.Service(service, "", q)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			for _, s := range catalogServices {
+				if c.managed(s.ServiceID) && !c.manages(s.ServiceName) {
+					log.WithField("cluster", c.name).Debugf("Ignoring '%s' with ID '%s', not in --managed-service-names", s.ServiceName, s.ServiceID)
+				} else if c.managed(s.ServiceID) {
+					log.Debugf("Found '%s' with ID '%s'", s.ServiceName, s.ServiceID)
+					e := newCacheEntry(&consulapi.AgentServiceRegistration{
+						ID:        s.ServiceID,
+						Name:      s.ServiceName,
+						Port:      s.ServicePort,
+						Address:   s.ServiceAddress,
+						Tags:      withoutDCTags(s.ServiceTags, c.dcTags()),
+						Meta:      s.ServiceMeta,
+						Partition: partition,
+					}, s.Address)
+					e.pinned = c.pinned(s.ServiceID)
+					found[s.ServiceID] = e
+				}
 			}
 		}
 	}
 
+	return found, read, nil
+}
+
+// CacheReconcile()
+//   Compare the service cache with the Consul catalog and repair the
+//   drift. Services that vanished from Consul are removed from the
+//   cache, so that the next registration pass registers them again.
+//   Managed services missing from the cache, or registered elsewhere
+//   than cached, are cached as Consul has them, so that the pass
+//   registers them again where they belong and the sweep removes the
+//   ones no task registers.
+//
+func (c *Consul) CacheReconcile(host string) error {
+	found, read, err := c.catalogServices(host)
+	if err != nil {
+		return err
+	}
+
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	var vanished, unknown, moved int
+	for id, b := range c.cache {
+		// Without Consul Enterprise, only the --consul-partition catalog
+		// is read
+		if !read[b.service.Partition] {
+			continue
+		}
+		if _, ok := found[id]; !ok {
+			log.WithField("cluster", c.name).Warnf("Cache drift: %s vanished from Consul. Registering it again", id)
+			delete(c.cache, id)
+			vanished++
+		}
+	}
+
+	for id, e := range found {
+		b, ok := c.cache[id]
+		switch {
+		case !ok:
+			log.WithField("cluster", c.name).Warnf("Cache drift: %s is in Consul but not in the cache. Caching it", id)
+			c.cache[id] = e
+			unknown++
+		case b.agent != e.agent || b.service.Address != e.service.Address || b.service.Port != e.service.Port:
+			log.WithField("cluster", c.name).Warnf("Cache drift: %s is on %s at %s:%d in Consul, cached on %s at %s:%d", id, e.agent, e.service.Address, e.service.Port, b.agent, b.service.Address, b.service.Port)
+			e.marked = b.marked
+			e.validityCounter = b.validityCounter
+			c.cache[id] = e
+			moved++
+		}
+	}
+
+	cacheDrift.Add(c.name, int64(vanished+unknown+moved))
+	log.WithField("cluster", c.name).Infof("Cache reconciliation: %d services in Consul, %d vanished, %d not cached, %d moved", len(found), vanished, unknown, moved)
+
+	// Look for orphaned checks on every agent with the next sweep
+	c.agentsLock.Lock()
+	c.orphanAgents = nil
+	c.agentsLock.Unlock()
+
 	return nil
 }
 
+// managed()
+//   Whether the ID starts with one of the prefixes of the loaded cache
+//
+func (c *Consul) managed(id string) bool {
+	for _, p := range c.idPrefixes {
+		if strings.HasPrefix(id, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pinned()
+//   Whether the service ID is listed in --pin-service-ids
+//
+func (c *Consul) pinned(id string) bool {
+	if c.config.pinServiceIDs == "" {
+		return false
+	}
+
+	for _, p := range strings.Split(c.config.pinServiceIDs, ",") {
+		if p == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compileManagedNames()
+//   Compile the --managed-service-names regexes into one matching the
+//   whole service names, nil if none is set
+//
+func compileManagedNames(names []string) (*regexp.Regexp, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	return regexp.Compile("^(?:" + strings.Join(names, ")$|^(?:") + ")$")
+}
+
+// manages()
+//   Whether the service name matches --managed-service-names
+//
+func (c *Consul) manages(name string) bool {
+	return c.managedNames == nil || c.managedNames.MatchString(name)
+}
+
+// refuse()
+//   Log and count a refused registration or deregistration
+//
+func (c *Consul) refuse(action, id, name string) {
+	log.WithField("cluster", c.name).Warnf("Refusing to %s %s: service name %s does not match --managed-service-names", action, id, name)
+	refusedServices.Add(c.name, 1)
+	c.audit(audit.Decision{Action: audit.Skip, Reason: "refused to " + action + ", name not in --managed-service-names", Service: id})
+}
+
 // CacheLookup()
 //
 func (c *Consul) CacheLookup(id string) *registry.Service {
-	if _, ok := serviceCache[id]; ok {
-		s := serviceCache[id].service
+	c.cacheLock.RLock()
+	defer c.cacheLock.RUnlock()
+
+	if _, ok := c.cache[id]; ok {
+		s := c.cache[id].service
 
 		return &registry.Service{
 			ID:      s.ID,
@@ -86,17 +286,36 @@ func (c *Consul) CacheLookup(id string) *registry.Service {
 			Port:    s.Port,
 			Address: s.Address,
 			Tags:    s.Tags,
+			Meta:    s.Meta,
 		}
 	}
 
 	return nil
 }
 
+// CacheIDs()
+//   Return the IDs of the cached services
+//
+func (c *Consul) CacheIDs() []string {
+	c.cacheLock.RLock()
+	defer c.cacheLock.RUnlock()
+
+	var ids []string
+	for id := range c.cache {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
 // CacheDelete()
 //
 func (c *Consul) CacheDelete(id string) {
-	if _, ok := serviceCache[id]; ok {
-		delete(serviceCache, id)
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	if _, ok := c.cache[id]; ok {
+		delete(c.cache, id)
 	}
 }
 
@@ -104,8 +323,29 @@ func (c *Consul) CacheDelete(id string) {
 //   Mark the service ID as valid
 //
 func (c *Consul) CacheMark(id string) {
-	if _, ok := serviceCache[id]; ok {
-		serviceCache[id].validityCounter = 0
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	c.cacheMark(id)
+}
+
+// CacheMarked()
+//   Whether the service ID was marked by the refresh before the last
+//   cache sweep
+//
+func (c *Consul) CacheMarked(id string) bool {
+	c.cacheLock.RLock()
+	defer c.cacheLock.RUnlock()
+
+	if e, ok := c.cache[id]; ok {
+		return e.marked
+	}
+	return false
+}
+
+func (c *Consul) cacheMark(id string) {
+	if _, ok := c.cache[id]; ok {
+		c.cache[id].validityCounter = 0
 	}
 }
 
@@ -113,14 +353,28 @@ func (c *Consul) CacheMark(id string) {
 //   Calculate the validity of the entry
 //
 func (c *Consul) CacheProcessDeregister(id string) {
-	if _, ok := serviceCache[id]; ok {
-		serviceCache[id].validityCounter++
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	c.cacheProcessDeregister(id)
+}
+
+func (c *Consul) cacheProcessDeregister(id string) {
+	if _, ok := c.cache[id]; ok {
+		c.cache[id].validityCounter++
 	}
 }
 
 func (c *Consul) CacheIsValid(id string) bool {
-	if _, ok := serviceCache[id]; ok {
-		return serviceCache[id].validityCounter < cacheEntryValidityThreshold
+	c.cacheLock.RLock()
+	defer c.cacheLock.RUnlock()
+
+	return c.cacheIsValid(id)
+}
+
+func (c *Consul) cacheIsValid(id string) bool {
+	if _, ok := c.cache[id]; ok {
+		return c.cache[id].validityCounter < cacheEntryValidityThreshold
 	}
 	return false
 }
@@ -0,0 +1,249 @@
+package consul
+
+import (
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+type checkCacheEntry struct {
+	check           *consulapi.AgentCheckRegistration
+	agent           string
+	validityCounter int
+}
+
+func newCheckCacheEntry(check *consulapi.AgentCheckRegistration, agent string) *checkCacheEntry {
+	return &checkCacheEntry{
+		agent:           agent,
+		check:           check,
+		validityCounter: 0,
+	}
+}
+
+// checkCacheLoad()
+//   Add the node checks with a managed ID to the check cache
+//
+func (c *Consul) checkCacheLoad(host string) error {
+	client := c.client(host)
+
+	c.throttle()
+	nodes, _, err := client.Catalog().Nodes(nil)
+	if err != nil {
+		return err
+	}
+
+	addresses := make(map[string]string)
+	for _, n := range nodes {
+		addresses[n.Node] = n.Address
+	}
+
+	c.throttle()
+	checks, _, err := client.Health().State(consulapi.HealthAny, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, hc := range checks {
+		if hc.ServiceID != "" || !c.managed(hc.CheckID) {
+			continue
+		}
+
+		log.Debugf("Found node check '%s' with ID '%s'", hc.Name, hc.CheckID)
+		e := newCheckCacheEntry(&consulapi.AgentCheckRegistration{
+			ID:   hc.CheckID,
+			Name: hc.Name,
+		}, addresses[hc.Node])
+
+		c.cacheLock.Lock()
+		c.checks[hc.CheckID] = e
+		c.cacheLock.Unlock()
+	}
+
+	return nil
+}
+
+// RegisterCheck()
+//   Register a node check on the agent
+//
+func (c *Consul) RegisterCheck(check *registry.NodeCheck) {
+	c.cacheLock.Lock()
+	if _, ok := c.checks[check.ID]; ok {
+		log.Debugf("Node check found. Not registering: %s", check.ID)
+		c.checks[check.ID].validityCounter = 0
+		c.cacheLock.Unlock()
+		return
+	}
+	c.cacheLock.Unlock()
+
+	log.WithField("cluster", c.name).Info("Registering node check ", check.ID)
+
+	r := &consulapi.AgentCheckRegistration{
+		ID:                check.ID,
+		Name:              check.Name,
+		AgentServiceCheck: *toAgentCheck(check.Check),
+	}
+
+	client := c.client(check.Agent)
+	if client == nil {
+		return
+	}
+
+	c.throttle()
+	err := client.Agent().CheckRegister(r)
+	if err != nil {
+		log.WithField("cluster", c.name).Warnf("Unable to register node check %s: %s", r.ID, err.Error())
+		return
+	}
+
+	c.cacheLock.Lock()
+	c.checks[r.ID] = newCheckCacheEntry(r, check.Agent)
+	c.cacheLock.Unlock()
+}
+
+// UpdateTTL()
+//   Push the status of the TTL check of a registered service
+//
+func (c *Consul) UpdateTTL(id string, pass bool, output string) {
+	c.cacheLock.RLock()
+	e, ok := c.cache[id]
+	c.cacheLock.RUnlock()
+	if !ok {
+		return
+	}
+
+	status := "fail"
+	if pass {
+		status = "pass"
+	}
+
+	client := c.client(e.agent)
+	if client == nil {
+		return
+	}
+
+	c.throttle()
+	err := client.Agent().UpdateTTL(serviceCheckID(id), output, status)
+	if err != nil {
+		log.WithField("cluster", c.name).Warnf("Unable to update check of %s: %s", id, err.Error())
+	}
+}
+
+// deregisterChecks()
+//   Deregister node checks that were not registered again since the
+//   last heartbeats-before-remove refreshes
+//
+func (c *Consul) deregisterChecks() {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	for id, e := range c.checks {
+		if e.validityCounter < cacheEntryValidityThreshold {
+			e.validityCounter++
+			continue
+		}
+
+		log.WithField("cluster", c.name).Infof("Deregistering node check %s", id)
+		client := c.client(e.agent)
+		if client == nil {
+			continue
+		}
+
+		c.throttle()
+		err := client.Agent().CheckDeregister(id)
+		if err != nil {
+			log.WithField("cluster", c.name).Info("Deregistration error ", err)
+		} else {
+			delete(c.checks, id)
+		}
+	}
+}
+
+// orphanChecks()
+//   List the IDs of the checks on the agent that belong to a managed
+//   service the agent no longer has
+//
+func (c *Consul) orphanChecks(agent string) ([]string, error) {
+	client := c.client(agent)
+	if client == nil {
+		return nil, nil
+	}
+
+	c.throttle()
+	checks, err := client.Agent().Checks()
+	if err != nil {
+		return nil, err
+	}
+
+	c.throttle()
+	services, err := client.Agent().Services()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for id, hc := range checks {
+		if hc.ServiceID == "" || !c.managed(hc.ServiceID) {
+			continue
+		}
+
+		if _, ok := services[hc.ServiceID]; !ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// DeregisterCheck()
+//   Deregister a check from the agent
+//
+func (c *Consul) DeregisterCheck(agent, id string) error {
+	client := c.client(agent)
+	if client == nil {
+		return nil
+	}
+
+	c.throttle()
+	return client.Agent().CheckDeregister(id)
+}
+
+// deregisterOrphanChecks()
+//   Deregister the checks left behind by managed services that were
+//   deregistered, on the agents of the services deregistered since the
+//   last sweep, or on every agent after a cache reconciliation. Runs
+//   once the cache is loaded so unmanaged checks are never touched.
+//
+func (c *Consul) deregisterOrphanChecks() {
+	if len(c.idPrefixes) == 0 {
+		return
+	}
+
+	c.agentsLock.Lock()
+	var agents []string
+	if c.orphanAgents == nil {
+		for agent := range c.agents {
+			agents = append(agents, agent)
+		}
+	} else {
+		for agent := range c.orphanAgents {
+			agents = append(agents, agent)
+		}
+	}
+	c.orphanAgents = make(map[string]bool)
+	c.agentsLock.Unlock()
+
+	for _, agent := range agents {
+		ids, err := c.orphanChecks(agent)
+		if err != nil {
+			log.WithField("cluster", c.name).Warnf("Unable to list checks of %s: %s", agent, err.Error())
+			continue
+		}
+
+		for _, id := range ids {
+			log.WithField("cluster", c.name).Infof("Deregistering orphaned check %s on %s", id, agent)
+			if err := c.DeregisterCheck(agent, id); err != nil {
+				log.WithField("cluster", c.name).Info("Deregistration error ", err)
+			}
+		}
+	}
+}
@@ -3,6 +3,7 @@ package consul
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	flag "github.com/ogier/pflag"
 )
@@ -16,13 +17,37 @@ type consulConfig struct {
 	sslCert                string
 	sslCaCert              string
 	token                  string
+	partition              string
 	timeout                int
+	rps                    float64
+	maxInflight            int
+	maxIdleConns           int
+	idleConnTimeout        time.Duration
 	heartbeatsBeforeRemove int
+	clusters               []cluster
+	dcTagTemplate          string
+	pinServiceIDs          string
+	heartbeatTTL           time.Duration
+	deregisterBatchSize    int
+	deregisterBatchMax     int
+	deregisterScaleBacklog int
+	managedServiceNames    []string
+
+	// Vault secret holding the Consul token
+	vaultAddr      string
+	vaultToken     string
+	vaultRoleID    string
+	vaultSecretID  string
+	vaultTokenPath string
+	vaultRenew     time.Duration
 }
 
 var config consulConfig
 
 func AddCmdFlags(f *flag.FlagSet) {
+	config.clusters = nil
+	config.managedServiceNames = nil
+
 	f.BoolVar(&config.enabled, "consul", false, "")
 	f.StringVar(&config.port, "consul-port", "8500", "")
 	f.Var((*authVar)(&config.auth), "consul-auth", "")
@@ -31,8 +56,27 @@ func AddCmdFlags(f *flag.FlagSet) {
 	f.StringVar(&config.sslCert, "consul-ssl-cert", "", "")
 	f.StringVar(&config.sslCaCert, "consul-ssl-cacert", "", "")
 	f.StringVar(&config.token, "consul-token", "", "")
+	f.StringVar(&config.partition, "consul-partition", "", "")
 	f.IntVar(&config.timeout, "consul-timeout", 0, "")
+	f.Float64Var(&config.rps, "consul-rps", 0, "")
+	f.IntVar(&config.maxInflight, "max-inflight", 0, "")
+	f.IntVar(&config.maxIdleConns, "consul-max-idle-conns", 4, "")
+	f.DurationVar(&config.idleConnTimeout, "consul-idle-conn-timeout", 90*time.Second, "")
 	f.IntVar(&config.heartbeatsBeforeRemove, "heartbeats-before-remove", 1, "")
+	f.Var((*clusterVar)(&config.clusters), "consul-cluster", "")
+	f.StringVar(&config.dcTagTemplate, "dc-tag-template", "", "")
+	f.StringVar(&config.pinServiceIDs, "pin-service-ids", "", "")
+	f.DurationVar(&config.heartbeatTTL, "consul-heartbeat-ttl", 0, "")
+	f.IntVar(&config.deregisterBatchSize, "consul-deregister-batch-size", 1, "")
+	f.IntVar(&config.deregisterBatchMax, "consul-deregister-batch-max", 0, "")
+	f.IntVar(&config.deregisterScaleBacklog, "consul-deregister-scale-backlog", 100, "")
+	f.Var((*stringsVar)(&config.managedServiceNames), "managed-service-names", "")
+	f.StringVar(&config.vaultAddr, "vault-addr", "", "")
+	f.StringVar(&config.vaultToken, "vault-token", "", "")
+	f.StringVar(&config.vaultRoleID, "vault-role-id", "", "")
+	f.StringVar(&config.vaultSecretID, "vault-secret-id", "", "")
+	f.StringVar(&config.vaultTokenPath, "vault-consul-token-path", "", "")
+	f.DurationVar(&config.vaultRenew, "vault-renew-interval", 5*time.Minute, "")
 }
 
 func Help() string {
@@ -58,12 +102,88 @@ Consul Options:
 				(default: not set)
   --consul-token		The Consul ACL token
 				(default: not set)
+  --consul-partition		The Consul Enterprise admin partition to register
+				services into and load the cache from. Can be
+				overridden per task with the 'consul_partition' label
+				(default: not set)
   --consul-timeout		Set a timeout (in seconds) on requests to Consul
 				(default: 0)
+  --consul-rps			Maximum number of Consul API calls per second, per
+				cluster. Calls over the limit are delayed and counted
+				in the consul_throttled_calls metric on /debug/vars
+				(default: 0, unlimited)
+  --max-inflight		Maximum number of Consul API calls in flight at once,
+				across all clusters. Calls over the limit wait for a
+				slot. The current count is the consul_inflight_calls
+				metric on /debug/vars
+				(default: 0, unlimited)
+  --consul-max-idle-conns	Maximum number of idle connections kept open to each
+				Consul agent for reuse. 0 disables keep-alive
+				(default: 4)
+  --consul-idle-conn-timeout	Time after which idle connections to Consul agents
+				are closed. 0 keeps them open
+				(default: 90s)
+  --consul-cluster		A Consul cluster to register services into, in the
+				name:port form where port is the agent API port of
+				that cluster. Can be specified multiple times to
+				register every service into several clusters.
+				(default: a single cluster on --consul-port)
+  --dc-tag-template		Comma delimited list of tags added to the services
+				registered into each cluster, where {dc} is replaced
+				with the cluster name, e.g. dc:{dc}
+				(default: not set)
+  --pin-service-ids		Comma delimited list of service IDs never deregistered
+				by the cache sweep, e.g. hand-maintained services
+				registered under the service ID prefix
+				(default: not set)
+  --consul-heartbeat-ttl	Add a TTL check of this duration to every service,
+				passed every third of the TTL. Consul deregisters
+				the services whose heartbeat stayed critical that
+				long, e.g. after mesos-consul crashed. At least 1m
+				and 3 times --refresh (default: 0, disabled)
+  --consul-deregister-batch-size
+				Number of services the cache sweep deregisters at
+				once, per cluster. A failed deregistration is logged
+				and retried by the next sweep
+				(default: 1)
+  --consul-deregister-batch-max
+				Scale the sweep up to this many deregistrations at
+				once, one more per --consul-deregister-scale-backlog
+				services to deregister
+				(default: 0, fixed at --consul-deregister-batch-size)
+  --consul-deregister-scale-backlog
+				Number of services to deregister per deregistration
+				at once, with --consul-deregister-batch-max
+				(default: 100)
+  --managed-service-names	Regex the names of the services registered and
+				deregistered must fully match, refusing the others
+				with a warning, as a guard in a shared Consul. Can be
+				specified multiple times
+				(default: not set, all names)
   --heartbeats-before-remove	Number of times that registration needs to fail
 				before removing task from Consul
 				(default: 1)
 
+Vault Options:
+
+  --vault-addr			Address of the Vault server to read the Consul token
+				from, e.g. https://vault:8200. Overrides --consul-token
+				(default: not set)
+  --vault-token			The Vault token
+				(default: not set)
+  --vault-role-id		The AppRole role ID to log into Vault with, when
+				--vault-token is not set
+				(default: not set)
+  --vault-secret-id		The AppRole secret ID
+				(default: not set)
+  --vault-consul-token-path	Path of the Vault secret holding the Consul token
+				in its 'token' field, e.g. secret/data/mesos-consul.
+				KV version 1 and 2 secrets are supported
+				(default: not set)
+  --vault-renew-interval	Interval to read the Consul token from Vault again.
+				The last good token is kept when Vault can't be read
+				(default: 5m)
+
 `
 
 	return helpText
@@ -100,3 +220,46 @@ func (a *authVar) String() string {
 
 	return fmt.Sprintf("%s:%s", a.Username, a.Password)
 }
+
+type cluster struct {
+	name string
+	port string
+}
+
+// clusterVar implements the Flag.Value interface and allows the user to
+// specify Consul clusters in the name:port form.
+type clusterVar []cluster
+
+func (cv *clusterVar) Set(value string) error {
+	split := strings.SplitN(value, ":", 2)
+	if len(split) != 2 || split[0] == "" || split[1] == "" {
+		return fmt.Errorf("invalid consul cluster '%s', must be name:port", value)
+	}
+
+	*cv = append(*cv, cluster{name: split[0], port: split[1]})
+
+	return nil
+}
+
+func (cv *clusterVar) String() string {
+	s := make([]string, len(*cv))
+	for i, c := range *cv {
+		s[i] = fmt.Sprintf("%s:%s", c.name, c.port)
+	}
+
+	return strings.Join(s, ",")
+}
+
+// stringsVar implements the Flag.Value interface and allows the user to
+// specify a flag multiple times.
+type stringsVar []string
+
+func (sv *stringsVar) Set(value string) error {
+	*sv = append(*sv, value)
+
+	return nil
+}
+
+func (sv *stringsVar) String() string {
+	return strings.Join(*sv, ",")
+}
@@ -3,26 +3,213 @@ package consul
 import (
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/CiscoCloud/mesos-consul/audit"
 	"github.com/CiscoCloud/mesos-consul/registry"
 
 	consulapi "github.com/hashicorp/consul/api"
-	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
 type Consul struct {
+	name   string
 	agents map[string]*consulapi.Client
 	config consulConfig
+
+	// Protects agents and orphanAgents
+	agentsLock sync.Mutex
+
+	// Agents whose orphaned checks the next sweep looks for, those of
+	// the services deregistered since the last sweep. nil for all the
+	// agents, at startup and after a cache reconciliation.
+	orphanAgents map[string]bool
+
+	// Limits the rate of Consul API calls, nil if unlimited
+	limiter *rate.Limiter
+
+	// Limits the number of Consul API calls in flight, nil if unlimited.
+	// Shared by all the clusters.
+	inflight chan struct{}
+
+	// Consul token read from Vault, nil if --vault-addr is not set
+	vault *vaultToken
+
+	// Transport of the agent clients, pooling their idle connections
+	transport *http.Transport
+
+	// Service and node check caches, protected by cacheLock
+	cacheLock sync.RWMutex
+	cache     map[string]*cacheEntry
+	checks    map[string]*checkCacheEntry
+
+	// Prefixes of the managed service and check IDs, set by CacheLoad
+	idPrefixes []string
+
+	// Names of the services allowed to be registered and deregistered,
+	// nil if all are
+	managedNames *regexp.Regexp
 }
 
 //
 func New() *Consul {
-	return &Consul{
+	c := &Consul{
+		name:   "default",
 		agents: make(map[string]*consulapi.Client),
 		config: config,
 	}
+
+	if config.rps > 0 {
+		burst := int(config.rps)
+		if burst < 1 {
+			burst = 1
+		}
+		c.limiter = rate.NewLimiter(rate.Limit(config.rps), burst)
+	}
+
+	if config.maxInflight > 0 {
+		c.inflight = make(chan struct{}, config.maxInflight)
+	}
+
+	c.transport = newTransport(config)
+	c.managedNames, _ = compileManagedNames(config.managedServiceNames)
+
+	return c
+}
+
+// newTransport()
+//   Return the HTTP transport of the Consul agent clients, keeping up
+//   to --consul-max-idle-conns idle connections per agent for reuse
+//
+func newTransport(c consulConfig) *http.Transport {
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: c.maxIdleConns,
+		IdleConnTimeout:     c.idleConnTimeout,
+		DisableKeepAlives:   c.maxIdleConns == 0,
+	}
+
+	if !c.sslVerify {
+		t.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+
+	return t
+}
+
+// throttle()
+//   Wait until the rate limiter allows another Consul API call
+//
+func (c *Consul) throttle() {
+	if c.limiter == nil {
+		return
+	}
+
+	if d := c.limiter.Reserve().Delay(); d > 0 {
+		throttledCalls.Add(c.name, 1)
+		log.WithField("cluster", c.name).Debugf("Throttling consul call for %s", d)
+		time.Sleep(d)
+	}
+}
+
+// NewRegistry()
+//   Return the registry for the configured Consul clusters. Without
+//   --consul-cluster a single cluster is used, otherwise every service
+//   is registered into each cluster.
+//
+func NewRegistry() registry.Registry {
+	if config.maxIdleConns < 0 {
+		log.Fatalf("Invalid consul max idle conns: %d", config.maxIdleConns)
+	}
+	if config.idleConnTimeout < 0 {
+		log.Fatalf("Invalid consul idle conn timeout: %s", config.idleConnTimeout)
+	}
+	if config.heartbeatTTL != 0 && config.heartbeatTTL < time.Minute {
+		log.Fatalf("Invalid consul heartbeat ttl: %s, must be at least 1m", config.heartbeatTTL)
+	}
+	if config.deregisterBatchSize < 1 {
+		log.Fatalf("Invalid consul deregister batch size: %d", config.deregisterBatchSize)
+	}
+	if config.deregisterBatchMax != 0 && config.deregisterBatchMax < config.deregisterBatchSize {
+		log.Fatalf("Invalid consul deregister batch max: %d, must be at least the batch size %d", config.deregisterBatchMax, config.deregisterBatchSize)
+	}
+	if config.deregisterScaleBacklog < 1 {
+		log.Fatalf("Invalid consul deregister scale backlog: %d", config.deregisterScaleBacklog)
+	}
+	if _, err := compileManagedNames(config.managedServiceNames); err != nil {
+		log.Fatalf("Invalid managed service names: %s", err)
+	}
+
+	var vault *vaultToken
+	if config.vaultAddr != "" {
+		var err error
+		if vault, err = newVaultToken(config); err != nil {
+			log.Fatal("Unable to read the Consul token from Vault: ", err)
+		}
+	}
+
+	if len(config.clusters) == 0 {
+		c := New()
+		c.vault = vault
+		c.heartbeat()
+		return c
+	}
+
+	var rs registry.Multi
+	var inflight chan struct{}
+	for i, cl := range config.clusters {
+		c := New()
+		c.name = cl.name
+		c.vault = vault
+
+		if i == 0 {
+			inflight = c.inflight
+		}
+		c.inflight = inflight
+		c.config.port = cl.port
+
+		log.WithField("cluster", cl.name).Debugf("Using consul cluster on port %s", cl.port)
+		c.heartbeat()
+		rs = append(rs, c)
+	}
+
+	return rs
+}
+
+// Name()
+//   Name of the Consul cluster, default without --consul-cluster
+//
+func (c *Consul) Name() string {
+	return c.name
+}
+
+// Ping()
+//   Check that the Consul agent at the specified address is reachable
+//   and accepts our credentials
+//
+func (c *Consul) Ping(address string) error {
+	client := c.client(address)
+	if client == nil {
+		return fmt.Errorf("no consul agent address")
+	}
+
+	c.throttle()
+	if _, err := client.Agent().Self(); err != nil {
+		return fmt.Errorf("consul cluster %s on %s: %s", c.name, address, err.Error())
+	}
+
+	return nil
 }
 
 // client()
@@ -33,6 +220,9 @@ func (c *Consul) client(address string) *consulapi.Client {
 		return nil
 	}
 
+	c.agentsLock.Lock()
+	defer c.agentsLock.Unlock()
+
 	if _, ok := c.agents[address]; !ok {
 		// Agent connection not saved. Connect.
 		c.agents[address] = c.newAgent(address)
@@ -58,11 +248,16 @@ func (c *Consul) newAgent(address string) *consulapi.Client {
 	config.HttpClient.Timeout = time.Duration(c.config.timeout) * time.Second
 	log.Debugf("consul timeout: %d", config.HttpClient.Timeout)
 
-	if c.config.token != "" {
+	if c.vault == nil && c.config.token != "" {
 		log.Debugf("setting token to %s", c.config.token)
 		config.Token = c.config.token
 	}
 
+	if c.config.partition != "" {
+		log.Debugf("setting partition to %s", c.config.partition)
+		config.Partition = c.config.partition
+	}
+
 	if c.config.sslEnabled {
 		log.Debugf("enabling SSL")
 		config.Scheme = "https"
@@ -70,11 +265,16 @@ func (c *Consul) newAgent(address string) *consulapi.Client {
 
 	if !c.config.sslVerify {
 		log.Debugf("disabled SSL verification")
-		config.HttpClient.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		}
+	}
+	config.HttpClient.Transport = c.transport
+
+	if c.vault != nil {
+		log.Debugf("using the token from vault")
+		config.HttpClient.Transport = newTokenTransport(c.vault, config.HttpClient.Transport)
+	}
+
+	if c.inflight != nil {
+		config.HttpClient.Transport = newInflightTransport(c.inflight, config.HttpClient.Transport)
 	}
 
 	if c.config.auth.Enabled {
@@ -93,70 +293,528 @@ func (c *Consul) newAgent(address string) *consulapi.Client {
 }
 
 func (c *Consul) Register(service *registry.Service) {
-	if _, ok := serviceCache[service.ID]; ok {
-		log.Debugf("Service found. Not registering: %s", service.ID)
-		c.CacheMark(service.ID)
+	if !c.manages(service.Name) {
+		c.refuse("register", service.ID, service.Name)
 		return
 	}
 
-	if _, ok := c.agents[service.Agent]; !ok {
-		// Agent connection not saved. Connect.
-		c.agents[service.Agent] = c.newAgent(service.Agent)
+	c.cacheLock.Lock()
+	if b, ok := c.cache[service.ID]; ok {
+		if !moved(b, service) {
+			log.Debugf("Service found. Not registering: %s", service.ID)
+			c.cacheMark(service.ID)
+			c.cacheLock.Unlock()
+			return
+		}
+
+		// Stable service IDs are kept when a task moves. Consul keeps the
+		// services per agent, so remove it from its previous agent first.
+		log.WithField("cluster", c.name).Infof("Service %s moved from %s:%d to %s:%d", service.ID, b.service.Address, b.service.Port, service.Address, service.Port)
+		if err := c.deregister(b.agent, b.service); err != nil {
+			log.WithField("cluster", c.name).Warnf("Unable to deregister %s from agent %s: %s", service.ID, b.agent, err.Error())
+		}
+		delete(c.cache, service.ID)
 	}
+	c.cacheLock.Unlock()
 
-	log.Info("Registering ", service.ID)
+	client := c.client(service.Agent)
+	if client == nil {
+		return
+	}
+
+	log.WithField("cluster", c.name).Info("Registering ", service.ID)
 
 	s := &consulapi.AgentServiceRegistration{
-		ID:      service.ID,
-		Name:    service.Name,
-		Port:    service.Port,
-		Address: service.Address,
-		Check: &consulapi.AgentServiceCheck{
-			TTL:      service.Check.TTL,
-			Script:   service.Check.Script,
-			HTTP:     service.Check.HTTP,
-			Interval: service.Check.Interval,
-		},
+		ID:        service.ID,
+		Name:      service.Name,
+		Port:      service.Port,
+		Address:   service.Address,
+		Check:     toAgentCheck(service.Check),
+		Partition: service.Partition,
+		Kind:      consulapi.ServiceKind(service.Kind),
+
+		SocketPath: service.SocketPath,
+	}
+
+	if hasCheckType(s.Check) {
+		// Consul numbers the checks of a service with several, name the
+		// primary one so that its TTL can be updated
+		s.Check.CheckID = serviceCheckID(service.ID)
+	}
+
+	if tags := withDCTags(service.Tags, c.dcTags()); len(tags) > 0 {
+		s.Tags = tags
 	}
 
-	if len(service.Tags) > 0 {
-		s.Tags = service.Tags
+	if len(service.Meta) > 0 {
+		s.Meta = service.Meta
 	}
 
-	err := c.agents[service.Agent].Agent().ServiceRegister(s)
+	for _, check := range service.Checks {
+		s.Checks = append(s.Checks, toAgentCheck(check))
+	}
+
+	if c.config.heartbeatTTL > 0 {
+		s.Checks = append(s.Checks, &consulapi.AgentServiceCheck{
+			CheckID: heartbeatCheckID(service.ID),
+			Name:    "mesos-consul heartbeat",
+			TTL:     c.config.heartbeatTTL.String(),
+			Status:  consulapi.HealthPassing,
+
+			DeregisterCriticalServiceAfter: c.config.heartbeatTTL.String(),
+		})
+	}
+
+	c.throttle()
+	var err error
+	if r, ok := withOutputMaxSize(s, service); ok {
+		// The API client has no OutputMaxSize field, so send it ourselves
+		_, err = client.Raw().Write("/v1/agent/service/register", r, nil, nil)
+	} else {
+		err = client.Agent().ServiceRegister(s)
+	}
 	if err != nil {
-		log.Warnf("Unable to register %s: %s", s.ID, err.Error())
+		log.WithField("cluster", c.name).Warnf("Unable to register %s: %s", s.ID, err.Error())
 		return
 	}
 
-	serviceCache[s.ID] = newCacheEntry(s, service.Agent)
-	c.CacheMark(s.ID)
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	// Cache the tags without the cluster tags, as callers compare them
+	// with the ones they register
+	cached := *s
+	cached.Tags = service.Tags
+	c.cache[s.ID] = newCacheEntry(&cached, service.Agent)
+	c.cache[s.ID].pinned = c.pinned(s.ID)
+	c.cacheMark(s.ID)
+}
+
+// moved()
+//   Whether a cached service is registered on another agent, address
+//   or port than service
+//
+func moved(b *cacheEntry, service *registry.Service) bool {
+	return b.agent != service.Agent || b.service.Address != service.Address || b.service.Port != service.Port
+}
+
+// dcTags()
+//   Tags of the --dc-tag-template for this cluster
+//
+func (c *Consul) dcTags() []string {
+	if c.config.dcTagTemplate == "" {
+		return nil
+	}
+
+	var tags []string
+	for _, t := range strings.Split(c.config.dcTagTemplate, ",") {
+		tags = append(tags, strings.Replace(t, "{dc}", c.name, -1))
+	}
+
+	return tags
+}
+
+// withDCTags()
+//   Add the cluster tags missing from tags, in a new slice
+//
+func withDCTags(tags []string, dcTags []string) []string {
+	if len(dcTags) == 0 {
+		return tags
+	}
+
+	rval := append([]string{}, tags...)
+	for _, t := range dcTags {
+		found := false
+		for _, tag := range rval {
+			found = found || tag == t
+		}
+		if !found {
+			rval = append(rval, t)
+		}
+	}
+
+	return rval
+}
+
+// withoutDCTags()
+//   Remove the cluster tags from tags, in a new slice
+//
+func withoutDCTags(tags []string, dcTags []string) []string {
+	if len(dcTags) == 0 {
+		return tags
+	}
+
+	var rval []string
+	for _, tag := range tags {
+		found := false
+		for _, t := range dcTags {
+			found = found || tag == t
+		}
+		if !found {
+			rval = append(rval, tag)
+		}
+	}
+
+	return rval
+}
+
+// serviceRegistration is a service registration with checks carrying
+// the fields missing from consulapi.AgentServiceCheck
+type serviceRegistration struct {
+	*consulapi.AgentServiceRegistration
+	Check  *serviceCheck   `json:",omitempty"`
+	Checks []*serviceCheck `json:",omitempty"`
+}
+
+type serviceCheck struct {
+	*consulapi.AgentServiceCheck
+	OutputMaxSize int `json:",omitempty"`
+}
+
+// withOutputMaxSize()
+//   The registration of a service with the OutputMaxSize of its checks,
+//   and whether any check has one. A check without a type is left out,
+//   Consul would reject it.
+//
+func withOutputMaxSize(s *consulapi.AgentServiceRegistration, service *registry.Service) (*serviceRegistration, bool) {
+	r := &serviceRegistration{AgentServiceRegistration: s}
+	set := false
+
+	if hasCheckType(s.Check) {
+		r.Check = &serviceCheck{AgentServiceCheck: s.Check, OutputMaxSize: service.Check.OutputMaxSize}
+		set = service.Check.OutputMaxSize > 0
+	}
+
+	// The heartbeat check follows the checks of the service
+	for i, check := range s.Checks {
+		sc := &serviceCheck{AgentServiceCheck: check}
+		if i < len(service.Checks) {
+			sc.OutputMaxSize = service.Checks[i].OutputMaxSize
+			set = set || sc.OutputMaxSize > 0
+		}
+		r.Checks = append(r.Checks, sc)
+	}
+
+	return r, set
+}
+
+// toAgentCheck()
+//   Convert a registry check to a Consul agent check. Alias checks
+//   derive their status from another service and have no target.
+//
+func toAgentCheck(check *registry.Check) *consulapi.AgentServiceCheck {
+	if check.AliasService != "" {
+		return &consulapi.AgentServiceCheck{
+			Name:         check.Name,
+			AliasService: check.AliasService,
+			Notes:        check.Notes,
+		}
+	}
+
+	return &consulapi.AgentServiceCheck{
+		Name:     check.Name,
+		TTL:      check.TTL,
+		Script:   check.Script,
+		HTTP:     check.HTTP,
+		TCP:      check.TCP,
+		Interval: check.Interval,
+		Timeout:  check.Timeout,
+
+		Method:        check.Method,
+		TLSSkipVerify: check.TLSSkipVerify,
+
+		DockerContainerID: check.DockerContainerID,
+		Shell:             check.Shell,
+		Args:              check.Args,
+
+		FailuresBeforeWarning:  check.FailuresBeforeWarning,
+		FailuresBeforeCritical: check.FailuresBeforeCritical,
+
+		Notes: check.Notes,
+	}
+}
+
+// hasCheckType()
+//   Whether a check has a type, Consul ignores the empty check of a
+//   service without one but rejects other checks without a type
+//
+func hasCheckType(check *consulapi.AgentServiceCheck) bool {
+	return check != nil && (check.HTTP != "" || check.TCP != "" || check.TTL != "" || check.Script != "" || len(check.Args) > 0 || check.AliasService != "")
 }
 
 // Deregister()
 //   Deregister services that no longer exist
 //
 func (c *Consul) Deregister() {
-	for s, b := range serviceCache {
-		if c.CacheIsValid(s) {
-			c.CacheProcessDeregister(s)
+	c.cacheLock.Lock()
+	entries := len(c.cache)
+	marked := 0
+
+	var gone []*cacheEntry
+	for s, b := range c.cache {
+		b.marked = b.validityCounter == 0
+		if b.marked {
+			marked++
+		}
+
+		if b.pinned {
+			log.WithField("cluster", c.name).Debugf("Keeping pinned service %s", s)
+		} else if c.cacheIsValid(s) {
+			c.cacheProcessDeregister(s)
+		} else if !c.manages(b.service.Name) {
+			// Forget the service, it is not ours to remove
+			c.refuse("deregister", s, b.service.Name)
+			delete(c.cache, s)
 		} else {
-			log.Infof("Deregistering %s", s)
-			err := c.deregister(b.agent, b.service)
-			if err != nil {
-				log.Info("Deregistration error ", err)
-			} else {
-				delete(serviceCache, s)
+			gone = append(gone, b)
+		}
+	}
+
+	swept := c.deregisterBatch(gone)
+
+	setGauge(cacheEntries, c.name, len(c.cache))
+	setGauge(cacheMarked, c.name, marked)
+	cacheSwept.Add(c.name, int64(swept))
+	log.WithField("cluster", c.name).Infof("Cache sweep: %d entries, %d marked, %d swept", entries, marked, swept)
+	c.cacheLock.Unlock()
+
+	c.deregisterChecks()
+	c.deregisterOrphanChecks()
+	c.pruneAgents()
+}
+
+// pruneAgents()
+//   Forget the agents that host no cached service nor node check, e.g.
+//   of removed Mesos agents, so that sweeps don't keep calling them
+//
+func (c *Consul) pruneAgents() {
+	c.cacheLock.RLock()
+	used := make(map[string]bool)
+	for _, e := range c.cache {
+		used[e.agent] = true
+	}
+	for _, e := range c.checks {
+		used[e.agent] = true
+	}
+	c.cacheLock.RUnlock()
+
+	c.agentsLock.Lock()
+	defer c.agentsLock.Unlock()
+
+	for agent := range c.agents {
+		if !used[agent] && !c.orphanAgents[agent] {
+			log.WithField("cluster", c.name).Debugf("No cached service on agent %s. Forgetting it", agent)
+			delete(c.agents, agent)
+		}
+	}
+}
+
+// deregisterWorkers()
+//   Number of deregistrations run at once for a backlog of services:
+//   --consul-deregister-batch-size, scaled up to
+//   --consul-deregister-batch-max by one per
+//   --consul-deregister-scale-backlog services when set
+//
+func (c *Consul) deregisterWorkers(backlog int) int {
+	workers := c.config.deregisterBatchSize
+	if workers < 1 {
+		workers = 1
+	}
+
+	if c.config.deregisterBatchMax > workers && c.config.deregisterScaleBacklog > 0 {
+		scaled := (backlog + c.config.deregisterScaleBacklog - 1) / c.config.deregisterScaleBacklog
+		if scaled > c.config.deregisterBatchMax {
+			scaled = c.config.deregisterBatchMax
+		}
+		if scaled > workers {
+			workers = scaled
+		}
+	}
+
+	return workers
+}
+
+// deregisterBatch()
+//   Deregister the services of the cache entries, as many at once as
+//   deregisterWorkers() gives, and remove the deregistered ones from
+//   the cache. Failures are logged and left in the cache for the next
+//   sweep. Must be called with the cache lock held.
+//
+func (c *Consul) deregisterBatch(entries []*cacheEntry) int {
+	workers := c.deregisterWorkers(len(entries))
+	setGauge(sweepWorkers, c.name, workers)
+	if len(entries) == 0 {
+		return 0
+	}
+
+	start := time.Now()
+	if workers > c.config.deregisterBatchSize {
+		log.WithField("cluster", c.name).Infof("Scaling the sweep to %d deregistrations at once for %d services", workers, len(entries))
+	}
+
+	jobs := make(chan *cacheEntry)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var done []string
+
+	for i := 0; i < workers && i < len(entries); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range jobs {
+				log.WithField("cluster", c.name).Infof("Deregistering %s", b.service.ID)
+				if err := c.deregister(b.agent, b.service); err != nil {
+					log.WithField("cluster", c.name).Info("Deregistration error ", err)
+					continue
+				}
+
+				c.audit(audit.Decision{Action: audit.Deregister, Reason: "not registered by the last refresh", Service: b.service.ID})
+
+				lock.Lock()
+				done = append(done, b.service.ID)
+				lock.Unlock()
 			}
+		}()
+	}
+
+	for _, b := range entries {
+		jobs <- b
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, id := range done {
+		delete(c.cache, id)
+	}
+
+	setGauge(deregisterBatchSize, c.name, len(entries))
+	setGauge(deregisterBatchDuration, c.name, int(time.Since(start)/time.Millisecond))
+
+	return len(done)
+}
+
+// audit()
+//   Record a registration decision of the Consul cluster
+//
+func (c *Consul) audit(d audit.Decision) {
+	if len(c.config.clusters) > 0 {
+		d.ConsulCluster = c.name
+	}
+	audit.Record(d)
+}
+
+// serviceCheckID()
+//   ID of the primary check of a service
+//
+func serviceCheckID(id string) string {
+	return "service:" + id
+}
+
+// heartbeatCheckID()
+//   ID of the --consul-heartbeat-ttl check of a service
+//
+func heartbeatCheckID(id string) string {
+	return "service:" + id + ":heartbeat"
+}
+
+// HeartbeatTTL()
+//   Return the --consul-heartbeat-ttl duration the registry was started
+//   with, 0 when disabled
+//
+func (c *Consul) HeartbeatTTL() time.Duration {
+	return c.config.heartbeatTTL
+}
+
+// heartbeat()
+//   Pass the heartbeat checks every third of the TTL on their own
+//   ticker, so that slow or paused refreshes don't let them expire
+//
+func (c *Consul) heartbeat() {
+	if c.config.heartbeatTTL <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(c.config.heartbeatTTL / 3) {
+			c.passHeartbeats()
+		}
+	}()
+}
+
+// passHeartbeats()
+//   Pass the heartbeat check of the cached services, so that Consul
+//   only deregisters them once mesos-consul stops
+//
+func (c *Consul) passHeartbeats() {
+	if c.config.heartbeatTTL <= 0 {
+		return
+	}
+
+	c.cacheLock.RLock()
+	agents := make(map[string]string)
+	for id, e := range c.cache {
+		if !e.pinned {
+			agents[id] = e.agent
+		}
+	}
+	c.cacheLock.RUnlock()
+
+	for id, agent := range agents {
+		client := c.client(agent)
+		if client == nil {
+			continue
+		}
+
+		c.throttle()
+		// Services registered before the heartbeat was enabled have no
+		// heartbeat check
+		if err := client.Agent().PassTTL(heartbeatCheckID(id), ""); err != nil {
+			log.WithField("cluster", c.name).Debugf("Unable to pass the heartbeat of %s: %s", id, err.Error())
 		}
 	}
 }
 
+// DeregisterService()
+//   Deregister a single cached service immediately
+//
+func (c *Consul) DeregisterService(id string) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	b, ok := c.cache[id]
+	if !ok {
+		return
+	}
+	if !c.manages(b.service.Name) {
+		c.refuse("deregister", id, b.service.Name)
+		return
+	}
+
+	log.WithField("cluster", c.name).Infof("Deregistering %s", id)
+	err := c.deregister(b.agent, b.service)
+	if err != nil {
+		log.WithField("cluster", c.name).Info("Deregistration error ", err)
+		return
+	}
+
+	delete(c.cache, id)
+}
+
 func (c *Consul) deregister(agent string, service *consulapi.AgentServiceRegistration) error {
-	if _, ok := c.agents[agent]; !ok {
-		// Agent connection not saved. Connect.
-		c.agents[agent] = c.newAgent(agent)
+	client := c.client(agent)
+	if client == nil {
+		return fmt.Errorf("no consul agent address")
 	}
 
-	return c.agents[agent].Agent().ServiceDeregister(service.ID)
+	c.agentsLock.Lock()
+	if c.orphanAgents != nil {
+		c.orphanAgents[agent] = true
+	}
+	c.agentsLock.Unlock()
+
+	c.throttle()
+	if service.Partition != "" {
+		return client.Agent().ServiceDeregisterOpts(service.ID, &consulapi.QueryOptions{Partition: service.Partition})
+	}
+	return client.Agent().ServiceDeregister(service.ID)
 }
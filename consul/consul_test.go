@@ -0,0 +1,1008 @@
+package consul
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestToAgentCheckAlias(t *testing.T) {
+	check := registry.DefaultCheck()
+	check.HTTP = "http://10.0.0.1:8080/health"
+	check.Interval = "10s"
+	check.AliasService = "backend"
+	check.Notes = "managed by mesos-consul for task web.1"
+
+	b, err := json.Marshal(toAgentCheck(check))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got["AliasService"] != "backend" {
+		t.Errorf("toAgentCheck() AliasService => %v, want backend", got["AliasService"])
+	}
+	if got["Notes"] != check.Notes {
+		t.Errorf("toAgentCheck() Notes => %v, want %s", got["Notes"], check.Notes)
+	}
+	for _, k := range []string{"HTTP", "TCP", "Interval"} {
+		if v, ok := got[k]; ok {
+			t.Errorf("toAgentCheck() with alias has %s => %v, want unset", k, v)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	for _, tt := range []struct {
+		status int
+		err    bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusForbidden, true},
+	} {
+		agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1/agent/self" {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(tt.status)
+			w.Write([]byte("{}"))
+		}))
+
+		host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+		c := New()
+		c.config.port = port
+
+		if err := c.Ping(host); (err != nil) != tt.err {
+			t.Errorf("Ping() with status %d => %v, want error %t", tt.status, err, tt.err)
+		}
+		agent.Close()
+	}
+}
+
+func TestDeregisterCacheMetrics(t *testing.T) {
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer agent.Close()
+
+	host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+	c := New()
+	c.name = "metrics-test"
+	c.config.port = port
+	c.CacheCreate()
+
+	c.cache["marked"] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: "marked"}, host)
+	c.cache["gone"] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: "gone"}, host)
+	c.cache["gone"].validityCounter = cacheEntryValidityThreshold
+
+	c.Deregister()
+
+	for _, tt := range []struct {
+		name string
+		v    string
+	}{
+		{"cache_entries", "1"},
+		{"cache_marked", "1"},
+		{"cache_swept", "1"},
+	} {
+		v := expvar.Get(tt.name).(*expvar.Map).Get(c.name)
+		if v == nil || v.String() != tt.v {
+			t.Errorf("Deregister() %s => %v, want %s", tt.name, v, tt.v)
+		}
+	}
+}
+
+func TestDeregisterOrphanChecks(t *testing.T) {
+	var deregistered []string
+	scans := 0
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/agent/checks":
+			scans++
+			w.Write([]byte(`{
+				"service:mesos-consul:a": {"CheckID": "service:mesos-consul:a", "ServiceID": "mesos-consul:a"},
+				"service:mesos-consul:gone": {"CheckID": "service:mesos-consul:gone", "ServiceID": "mesos-consul:gone"},
+				"service:other": {"CheckID": "service:other", "ServiceID": "other"},
+				"serfHealth": {"CheckID": "serfHealth"}
+			}`))
+		case "/v1/agent/services":
+			w.Write([]byte(`{"mesos-consul:a": {"ID": "mesos-consul:a"}}`))
+		default:
+			deregistered = append(deregistered, r.URL.Path)
+		}
+	}))
+	defer agent.Close()
+
+	host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+	c := New()
+	c.config.port = port
+	c.CacheCreate()
+	c.client(host)
+
+	c.deregisterOrphanChecks()
+	if len(deregistered) != 0 {
+		t.Errorf("deregisterOrphanChecks() before the cache load => %v, want none", deregistered)
+	}
+
+	c.idPrefixes = []string{"mesos-consul:"}
+	c.deregisterOrphanChecks()
+
+	want := []string{"/v1/agent/check/deregister/service:mesos-consul:gone"}
+	if len(deregistered) != 1 || deregistered[0] != want[0] {
+		t.Errorf("deregisterOrphanChecks() => %v, want %v", deregistered, want)
+	}
+
+	// Only the agents of deregistered services until the next reconciliation
+	c.deregisterOrphanChecks()
+	if scans != 1 {
+		t.Errorf("deregisterOrphanChecks() without deregistration => %d scans, want 1", scans)
+	}
+
+	c.deregister(host, &consulapi.AgentServiceRegistration{ID: "mesos-consul:b"})
+	c.deregisterOrphanChecks()
+	if scans != 2 {
+		t.Errorf("deregisterOrphanChecks() after a deregistration => %d scans, want 2", scans)
+	}
+
+	c.agentsLock.Lock()
+	c.orphanAgents = nil
+	c.agentsLock.Unlock()
+	c.deregisterOrphanChecks()
+	if scans != 3 {
+		t.Errorf("deregisterOrphanChecks() after a reconciliation => %d scans, want 3", scans)
+	}
+}
+
+func TestPruneAgents(t *testing.T) {
+	c := New()
+	c.CacheCreate()
+	c.client("10.0.0.1")
+	c.client("10.0.0.2")
+	c.client("10.0.0.3")
+	c.cache["mesos-consul:a"] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: "mesos-consul:a"}, "10.0.0.1")
+	c.checks["mesos:10.0.0.2"] = &checkCacheEntry{agent: "10.0.0.2"}
+
+	c.pruneAgents()
+
+	for agent, want := range map[string]bool{"10.0.0.1": true, "10.0.0.2": true, "10.0.0.3": false} {
+		if _, ok := c.agents[agent]; ok != want {
+			t.Errorf("pruneAgents() kept %s => %v, want %v", agent, ok, want)
+		}
+	}
+}
+
+func TestCacheConcurrentAccess(t *testing.T) {
+	c := New()
+	c.CacheCreate()
+
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("mesos-consul:%d", i)
+		c.cache[id] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: id}, "10.0.0.1")
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				id := fmt.Sprintf("mesos-consul:%d", i%10)
+				switch g % 4 {
+				case 0:
+					c.CacheLookup(id)
+				case 1:
+					c.CacheMark(id)
+				case 2:
+					c.CacheProcessDeregister(id)
+					c.CacheIsValid(id)
+				case 3:
+					c.UpdateTTL(fmt.Sprintf("mesos-consul:missing-%d", i), true, "")
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if s := c.CacheLookup("mesos-consul:1"); s == nil {
+		t.Errorf("CacheLookup(mesos-consul:1) => nil after concurrent access")
+	}
+}
+
+func TestMaxInflight(t *testing.T) {
+	var mu sync.Mutex
+	var current, max int
+
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		current++
+		if current > max {
+			max = current
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		current--
+		mu.Unlock()
+		w.Write([]byte("{}"))
+	}))
+	defer agent.Close()
+
+	host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+	c := New()
+	c.config.port = port
+	c.inflight = make(chan struct{}, 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Ping(host)
+		}()
+	}
+	wg.Wait()
+
+	if max > 2 {
+		t.Errorf("Ping() with max-inflight=2 had %d calls in flight", max)
+	}
+	if n := inflightCalls.Value(); n != 0 {
+		t.Errorf("consul_inflight_calls after the calls => %d, want 0", n)
+	}
+}
+
+func TestVaultToken(t *testing.T) {
+	var fail bool
+	secret := "token-1"
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case fail:
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.URL.Path == "/v1/auth/approle/login":
+			w.Write([]byte(`{"auth": {"client_token": "vault-token"}}`))
+		case r.URL.Path == "/v1/secret/data/consul" && r.Header.Get("X-Vault-Token") == "vault-token":
+			fmt.Fprintf(w, `{"data": {"data": {"token": "%s"}}}`, secret)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer vault.Close()
+
+	var got string
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Consul-Token")
+		w.Write([]byte("{}"))
+	}))
+	defer agent.Close()
+
+	v, err := newVaultToken(consulConfig{
+		vaultAddr:      vault.URL,
+		vaultRoleID:    "role",
+		vaultSecretID:  "secret",
+		vaultTokenPath: "/secret/data/consul",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+	c := New()
+	c.config.port = port
+	c.config.token = "ignored"
+	c.vault = v
+
+	for _, tt := range []struct {
+		secret string
+		fail   bool
+		want   string
+	}{
+		{"token-1", false, "token-1"},
+		{"token-2", false, "token-2"},
+		// The last good token is kept
+		{"token-3", true, "token-2"},
+	} {
+		secret, fail = tt.secret, tt.fail
+		if err := v.renew(); (err != nil) != tt.fail {
+			t.Errorf("renew() with secret %s => %v, want error %t", tt.secret, err, tt.fail)
+		}
+		c.Ping(host)
+		if got != tt.want {
+			t.Errorf("Consul token with secret %s => %s, want %s", tt.secret, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterOutputMaxSize(t *testing.T) {
+	for _, tt := range []struct {
+		size int
+		want interface{}
+	}{
+		{0, nil},
+		{1024, float64(1024)},
+	} {
+		var body map[string]interface{}
+		agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v1/agent/service/register" {
+				json.NewDecoder(r.Body).Decode(&body)
+			}
+		}))
+
+		host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+		c := New()
+		c.config.port = port
+		c.CacheCreate()
+
+		check := registry.DefaultCheck()
+		check.HTTP = "http://10.0.0.1:8080/health"
+		check.Interval = "10s"
+		check.OutputMaxSize = tt.size
+		c.Register(&registry.Service{ID: "web", Name: "web", Agent: host, Check: check})
+		agent.Close()
+
+		if body == nil {
+			t.Fatalf("Register() with OutputMaxSize=%d did not register the service", tt.size)
+		}
+		c2, _ := body["Check"].(map[string]interface{})
+		if c2["OutputMaxSize"] != tt.want || c2["HTTP"] != check.HTTP || body["Name"] != "web" {
+			t.Errorf("Register() with OutputMaxSize=%d => %v, want OutputMaxSize %v", tt.size, body, tt.want)
+		}
+		if c2["CheckID"] != "service:web" {
+			t.Errorf("Register() check => %v, want the service:web check ID", c2)
+		}
+		if c.CacheLookup("web") == nil {
+			t.Errorf("Register() with OutputMaxSize=%d did not cache the service", tt.size)
+		}
+	}
+}
+
+func TestRegisterOutputMaxSizeChecks(t *testing.T) {
+	var body map[string]interface{}
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer agent.Close()
+
+	host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+	c := New()
+	c.config.port = port
+	c.CacheCreate()
+
+	check := registry.DefaultCheck()
+	check.OutputMaxSize = 1024
+	c.Register(&registry.Service{ID: "web", Name: "web", Agent: host, Check: check, Checks: []*registry.Check{
+		{TCP: "10.0.0.1:8080", Interval: "10s", OutputMaxSize: 2048},
+	}})
+
+	if c2, _ := body["Check"].(map[string]interface{}); len(c2) > 0 {
+		t.Errorf("Register() of an empty check with OutputMaxSize => check %v, want none", c2)
+	}
+	checks, _ := body["Checks"].([]interface{})
+	if len(checks) != 1 {
+		t.Fatalf("Register() with a check => %v, want 1 check", body["Checks"])
+	}
+	if c0, _ := checks[0].(map[string]interface{}); c0["OutputMaxSize"] != float64(2048) || c0["TCP"] != "10.0.0.1:8080" {
+		t.Errorf("Register() check => %v, want the tcp check with OutputMaxSize 2048", c0)
+	}
+}
+
+func TestRegisterChecks(t *testing.T) {
+	var body map[string]interface{}
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer agent.Close()
+
+	host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+	c := New()
+	c.config.port = port
+	c.CacheCreate()
+
+	c.Register(&registry.Service{ID: "web", Name: "web", Agent: host, Check: registry.DefaultCheck(), Checks: []*registry.Check{
+		{Name: "ready", HTTP: "http://10.0.0.1:8080/ready", Interval: "5s", Method: "HEAD"},
+		{TCP: "10.0.0.1:8080", Interval: "10s"},
+	}})
+
+	checks, _ := body["Checks"].([]interface{})
+	if len(checks) != 2 {
+		t.Fatalf("Register() with 2 checks => %v, want 2 checks", body["Checks"])
+	}
+	if c0, _ := checks[0].(map[string]interface{}); c0["Name"] != "ready" || c0["Method"] != "HEAD" || c0["HTTP"] != "http://10.0.0.1:8080/ready" {
+		t.Errorf("Register() first check => %v, want the ready HTTP check", c0)
+	}
+}
+
+func TestRegisterKind(t *testing.T) {
+	var body map[string]interface{}
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer agent.Close()
+
+	host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+	c := New()
+	c.config.port = port
+	c.CacheCreate()
+
+	c.Register(&registry.Service{ID: "gateway", Name: "gateway", Port: 8443, Agent: host, Kind: "mesh-gateway", Check: registry.DefaultCheck()})
+	if body["Kind"] != "mesh-gateway" || body["Port"] != float64(8443) {
+		t.Errorf("Register() of a mesh gateway => %v, want kind mesh-gateway", body)
+	}
+}
+
+func TestRegisterDCTags(t *testing.T) {
+	var tags []interface{}
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		tags, _ = body["Tags"].([]interface{})
+	}))
+	defer agent.Close()
+
+	host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+	c := New()
+	c.name = "west"
+	c.config.port = port
+	c.config.dcTagTemplate = "dc:{dc},region"
+	c.CacheCreate()
+
+	service := &registry.Service{ID: "web", Name: "web", Agent: host, Tags: []string{"v1", "region"}, Check: registry.DefaultCheck()}
+	c.Register(service)
+
+	want := []interface{}{"v1", "region", "dc:west"}
+	if fmt.Sprint(tags) != fmt.Sprint(want) {
+		t.Errorf("Register() with a dc tag template => tags %v, want %v", tags, want)
+	}
+	if len(service.Tags) != 2 {
+		t.Errorf("Register() changed the service tags to %v", service.Tags)
+	}
+	if s := c.CacheLookup("web"); s == nil || fmt.Sprint(s.Tags) != "[v1 region]" {
+		t.Errorf("CacheLookup() with a dc tag template => %v, want tags [v1 region]", s)
+	}
+}
+
+func TestCacheLoadPrefixes(t *testing.T) {
+	catalog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			w.Write([]byte(`{"web": []}`))
+		case "/v1/catalog/service/web":
+			w.Write([]byte(`[
+				{"Address": "10.0.0.1", "ServiceID": "mesos-consul:a", "ServiceName": "web"},
+				{"Address": "10.0.0.1", "ServiceID": "old:b", "ServiceName": "web"},
+				{"Address": "10.0.0.1", "ServiceID": "other:c", "ServiceName": "web"}
+			]`))
+		default:
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer catalog.Close()
+
+	host, port, _ := net.SplitHostPort(catalog.Listener.Addr().String())
+	c := New()
+	c.config.port = port
+	c.CacheCreate()
+
+	if err := c.CacheLoad(host, "mesos-consul:", "old:"); err != nil {
+		t.Fatalf("CacheLoad() => %s", err)
+	}
+
+	for id, want := range map[string]bool{"mesos-consul:a": true, "old:b": true, "other:c": false} {
+		if got := c.CacheLookup(id) != nil; got != want {
+			t.Errorf("CacheLoad() cached %s => %t, want %t", id, got, want)
+		}
+	}
+}
+
+func TestCacheLoadPartitions(t *testing.T) {
+	catalog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		partition := r.URL.Query().Get("partition")
+		switch r.URL.Path {
+		case "/v1/partitions":
+			w.Write([]byte(`[{"Name": "default"}, {"Name": "tenant1"}]`))
+		case "/v1/catalog/services":
+			w.Write([]byte(`{"web": []}`))
+		case "/v1/catalog/service/web":
+			fmt.Fprintf(w, `[{"Address": "10.0.0.1", "ServiceID": "mesos-consul:%s", "ServiceName": "web"}]`, partition)
+		default:
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer catalog.Close()
+
+	host, port, _ := net.SplitHostPort(catalog.Listener.Addr().String())
+	c := New()
+	c.config.port = port
+	c.CacheCreate()
+
+	if err := c.CacheLoad(host, "mesos-consul:"); err != nil {
+		t.Fatalf("CacheLoad() => %s", err)
+	}
+
+	for _, partition := range []string{"default", "tenant1"} {
+		e, ok := c.cache["mesos-consul:"+partition]
+		if !ok || e.service.Partition != partition {
+			t.Errorf("CacheLoad() cached %+v for partition %s, want the service of the partition", e, partition)
+		}
+	}
+}
+
+func TestCacheReconcile(t *testing.T) {
+	catalog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			w.Write([]byte(`{"web": []}`))
+		case "/v1/catalog/service/web":
+			w.Write([]byte(`[
+				{"Address": "10.0.0.1", "ServiceID": "mesos-consul:same", "ServiceName": "web", "ServiceAddress": "10.0.0.1", "ServicePort": 31000},
+				{"Address": "10.0.0.2", "ServiceID": "mesos-consul:moved", "ServiceName": "web", "ServiceAddress": "10.0.0.2", "ServicePort": 31001},
+				{"Address": "10.0.0.1", "ServiceID": "mesos-consul:leftover", "ServiceName": "web", "ServiceAddress": "10.0.0.1", "ServicePort": 31002},
+				{"Address": "10.0.0.1", "ServiceID": "other:c", "ServiceName": "web"}
+			]`))
+		default:
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer catalog.Close()
+
+	host, port, _ := net.SplitHostPort(catalog.Listener.Addr().String())
+	c := New()
+	c.name = "reconcile"
+	c.config.port = port
+	c.idPrefixes = []string{"mesos-consul:"}
+	c.CacheCreate()
+
+	for _, s := range []*consulapi.AgentServiceRegistration{
+		{ID: "mesos-consul:same", Name: "web", Address: "10.0.0.1", Port: 31000, Tags: []string{"v1"}},
+		{ID: "mesos-consul:moved", Name: "web", Address: "10.0.0.1", Port: 31001},
+		{ID: "mesos-consul:vanished", Name: "web", Address: "10.0.0.1", Port: 31003},
+		{ID: "mesos-consul:partition", Name: "web", Address: "10.0.0.1", Port: 31004, Partition: "tenant1"},
+	} {
+		c.cache[s.ID] = newCacheEntry(s, "10.0.0.1")
+	}
+
+	if err := c.CacheReconcile(host); err != nil {
+		t.Fatalf("CacheReconcile() => %s", err)
+	}
+
+	for id, want := range map[string]string{
+		"mesos-consul:same":      "10.0.0.1",
+		"mesos-consul:moved":     "10.0.0.2",
+		"mesos-consul:leftover":  "10.0.0.1",
+		"mesos-consul:vanished":  "",
+		"mesos-consul:partition": "10.0.0.1",
+		"other:c":                "",
+	} {
+		var got string
+		if s := c.CacheLookup(id); s != nil {
+			got = s.Address
+		}
+		if got != want {
+			t.Errorf("CacheReconcile() cached %s at %q, want %q", id, got, want)
+		}
+	}
+	if s := c.CacheLookup("mesos-consul:same"); s == nil || len(s.Tags) != 1 {
+		t.Errorf("CacheReconcile() replaced the cached %v, want it kept", s)
+	}
+	if n := cacheDrift.Get("reconcile").String(); n != "3" {
+		t.Errorf("CacheReconcile() => %s differences, want 3", n)
+	}
+}
+
+func TestDeregisterPinned(t *testing.T) {
+	var deregistered []string
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deregistered = append(deregistered, r.URL.Path)
+	}))
+	defer agent.Close()
+
+	host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+	c := New()
+	c.config.port = port
+	c.config.pinServiceIDs = "mesos-consul:manual,mesos-consul:other"
+	c.CacheCreate()
+
+	for _, id := range []string{"mesos-consul:manual", "mesos-consul:gone"} {
+		c.cache[id] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: id}, host)
+		c.cache[id].pinned = c.pinned(id)
+		c.cache[id].validityCounter = cacheEntryValidityThreshold
+	}
+
+	c.Deregister()
+
+	if c.CacheLookup("mesos-consul:manual") == nil {
+		t.Error("Deregister() swept the pinned service mesos-consul:manual")
+	}
+	want := "/v1/agent/service/deregister/mesos-consul:gone"
+	if len(deregistered) != 1 || deregistered[0] != want {
+		t.Errorf("Deregister() with a pinned service => %v, want [%s]", deregistered, want)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	var body map[string]interface{}
+	var passed []string
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/agent/service/register":
+			json.NewDecoder(r.Body).Decode(&body)
+		case strings.HasPrefix(r.URL.Path, "/v1/agent/check/"):
+			passed = append(passed, r.URL.Path)
+		}
+	}))
+	defer agent.Close()
+
+	host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+	c := New()
+	c.config.port = port
+	c.config.heartbeatTTL = time.Minute
+	c.CacheCreate()
+
+	c.Register(&registry.Service{ID: "web", Name: "web", Agent: host, Check: registry.DefaultCheck()})
+	checks, _ := body["Checks"].([]interface{})
+	if len(checks) != 1 {
+		t.Fatalf("Register() with a heartbeat => checks %v, want the heartbeat", body["Checks"])
+	}
+	if hb, _ := checks[0].(map[string]interface{}); hb["CheckID"] != "service:web:heartbeat" || hb["TTL"] != "1m0s" || hb["DeregisterCriticalServiceAfter"] != "1m0s" {
+		t.Errorf("Register() heartbeat check => %v, want service:web:heartbeat with a 1m TTL", hb)
+	}
+
+	c.Deregister()
+	if len(passed) != 0 {
+		t.Errorf("Deregister() passed %v, want the heartbeats left to their ticker", passed)
+	}
+
+	c.passHeartbeats()
+	if len(passed) != 1 || !strings.Contains(passed[0], "service:web:heartbeat") {
+		t.Errorf("passHeartbeats() passed %v, want the heartbeat of web", passed)
+	}
+}
+
+func TestIdleConnReuse(t *testing.T) {
+	for _, tt := range []struct {
+		maxIdle int
+		conns   int
+	}{
+		{4, 1},
+		{0, 3},
+	} {
+		var lock sync.Mutex
+		conns := 0
+		agent := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("{}"))
+		}))
+		agent.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+			if s == http.StateNew {
+				lock.Lock()
+				conns++
+				lock.Unlock()
+			}
+		}
+		agent.Start()
+
+		host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+		cfg := config
+		cfg.maxIdleConns = tt.maxIdle
+		cfg.idleConnTimeout = time.Minute
+		c := &Consul{name: "default", agents: make(map[string]*consulapi.Client), config: cfg, transport: newTransport(cfg)}
+		c.config.port = port
+
+		for i := 0; i < 3; i++ {
+			if err := c.Ping(host); err != nil {
+				t.Fatalf("Ping() => %v", err)
+			}
+		}
+		agent.Close()
+
+		if conns != tt.conns {
+			t.Errorf("Ping() x3 with %d max idle conns => %d connections, want %d", tt.maxIdle, conns, tt.conns)
+		}
+	}
+}
+
+func TestRegisterMoved(t *testing.T) {
+	var calls []string
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path)
+	}))
+	defer agent.Close()
+
+	host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+	c := New()
+	c.config.port = port
+	c.CacheCreate()
+
+	for _, s := range []*registry.Service{
+		{ID: "web:1", Name: "web", Address: "10.0.0.1", Port: 31000, Agent: host, Check: registry.DefaultCheck()},
+		{ID: "web:1", Name: "web", Address: "10.0.0.1", Port: 31000, Agent: host, Check: registry.DefaultCheck()},
+		{ID: "web:1", Name: "web", Address: "10.0.0.2", Port: 31000, Agent: host, Check: registry.DefaultCheck()},
+	} {
+		c.Register(s)
+	}
+
+	want := []string{"/v1/agent/service/register", "/v1/agent/service/deregister/web:1", "/v1/agent/service/register"}
+	if strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Errorf("Register() of a moved service => calls %v, want %v", calls, want)
+	}
+	if s := c.CacheLookup("web:1"); s == nil || s.Address != "10.0.0.2" {
+		t.Errorf("CacheLookup(web:1) after a move => %+v, want address 10.0.0.2", s)
+	}
+}
+
+func TestCacheMarked(t *testing.T) {
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer agent.Close()
+
+	host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+	c := New()
+	c.config.port = port
+	c.config.pinServiceIDs = "pinned"
+	c.CacheCreate()
+
+	for _, id := range []string{"marked", "pinned"} {
+		c.cache[id] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: id}, host)
+		c.cache[id].pinned = c.pinned(id)
+	}
+	c.cache["pinned"].validityCounter = cacheEntryValidityThreshold
+
+	if c.CacheMarked("marked") {
+		t.Error("CacheMarked(marked) before the first sweep => true, want false")
+	}
+
+	c.Deregister()
+
+	for _, tt := range []struct {
+		id     string
+		marked bool
+	}{
+		{"marked", true},
+		{"pinned", false},
+		{"missing", false},
+	} {
+		if marked := c.CacheMarked(tt.id); marked != tt.marked {
+			t.Errorf("CacheMarked(%s) => %t, want %t", tt.id, marked, tt.marked)
+		}
+	}
+}
+
+func TestDeregisterBatch(t *testing.T) {
+	for _, tt := range []struct {
+		batchSize int
+		batchMax  int
+		max       int
+	}{
+		{1, 0, 1},
+		{4, 0, 4},
+		// 9 services, one more deregistration per 2 services
+		{1, 4, 4},
+	} {
+		var lock sync.Mutex
+		inflight, max := 0, 0
+		agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			inflight++
+			if inflight > max {
+				max = inflight
+			}
+			lock.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			lock.Lock()
+			inflight--
+			lock.Unlock()
+
+			if strings.HasSuffix(r.URL.Path, "/fail") {
+				http.Error(w, "Unable to deregister", http.StatusInternalServerError)
+			}
+		}))
+
+		host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+		c := New()
+		c.name = "batch-test"
+		c.config.port = port
+		c.config.deregisterBatchSize = tt.batchSize
+		c.config.deregisterBatchMax = tt.batchMax
+		c.config.deregisterScaleBacklog = 2
+		c.CacheCreate()
+
+		ids := []string{"fail"}
+		for i := 0; i < 8; i++ {
+			ids = append(ids, fmt.Sprintf("gone-%d", i))
+		}
+		for _, id := range ids {
+			c.cache[id] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: id}, host)
+			c.cache[id].validityCounter = cacheEntryValidityThreshold
+		}
+
+		c.Deregister()
+		agent.Close()
+
+		if max != tt.max {
+			t.Errorf("Deregister() with batch size %d and max %d => %d deregistrations at once, want %d", tt.batchSize, tt.batchMax, max, tt.max)
+		}
+		if left := c.CacheIDs(); len(left) != 1 || left[0] != "fail" {
+			t.Errorf("Deregister() with batch size %d left %v in the cache, want [fail]", tt.batchSize, left)
+		}
+		if v := expvar.Get("deregister_batch_size").(*expvar.Map).Get(c.name); v == nil || v.String() != "9" {
+			t.Errorf("Deregister() deregister_batch_size => %v, want 9", v)
+		}
+		if v := expvar.Get("deregister_workers").(*expvar.Map).Get(c.name); v == nil || v.String() != strconv.Itoa(tt.max) {
+			t.Errorf("Deregister() deregister_workers => %v, want %d", v, tt.max)
+		}
+	}
+}
+
+func TestDeregisterWorkers(t *testing.T) {
+	for _, tt := range []struct {
+		batchSize, batchMax, scaleBacklog int
+		backlog                           int
+		want                              int
+	}{
+		{1, 0, 100, 5000, 1},
+		{4, 0, 100, 5000, 4},
+		{2, 16, 100, 0, 2},
+		{2, 16, 100, 50, 2},
+		{2, 16, 100, 201, 3},
+		{2, 16, 100, 750, 8},
+		{2, 16, 100, 3000, 16},
+		{2, 2, 100, 3000, 2},
+	} {
+		c := New()
+		c.config.deregisterBatchSize = tt.batchSize
+		c.config.deregisterBatchMax = tt.batchMax
+		c.config.deregisterScaleBacklog = tt.scaleBacklog
+
+		if got := c.deregisterWorkers(tt.backlog); got != tt.want {
+			t.Errorf("deregisterWorkers(%d) with batch size %d, max %d and scale backlog %d => %d, want %d", tt.backlog, tt.batchSize, tt.batchMax, tt.scaleBacklog, got, tt.want)
+		}
+	}
+}
+
+func TestManagedServiceNames(t *testing.T) {
+	var lock sync.Mutex
+	var calls []string
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		calls = append(calls, r.URL.Path)
+		lock.Unlock()
+	}))
+	defer agent.Close()
+
+	host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+	c := New()
+	c.name = "managed-test"
+	c.config.port = port
+	c.managedNames, _ = compileManagedNames([]string{"web-.*", "mesos"})
+	c.CacheCreate()
+
+	for _, tt := range []struct {
+		name    string
+		managed bool
+	}{
+		{"web-api", true},
+		{"mesos", true},
+		{"mesos-dns", false},
+		{"consul", false},
+		{"my-web-api", false},
+	} {
+		if got := c.manages(tt.name); got != tt.managed {
+			t.Errorf("manages(%s) => %t, want %t", tt.name, got, tt.managed)
+		}
+	}
+
+	c.Register(&registry.Service{ID: "mesos-consul:web-api", Name: "web-api", Agent: host, Check: registry.DefaultCheck()})
+	c.Register(&registry.Service{ID: "mesos-consul:consul", Name: "consul", Agent: host, Check: registry.DefaultCheck()})
+	if ids := c.CacheIDs(); len(ids) != 1 || ids[0] != "mesos-consul:web-api" {
+		t.Errorf("Register() of web-api and consul cached %v, want [mesos-consul:web-api]", ids)
+	}
+
+	// The sweep forgets the refused services without deregistering them
+	for _, name := range []string{"web-old", "vault"} {
+		id := "mesos-consul:" + name
+		c.cache[id] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: id, Name: name}, host)
+		c.cache[id].validityCounter = cacheEntryValidityThreshold
+	}
+
+	lock.Lock()
+	calls = nil
+	lock.Unlock()
+	c.DeregisterService("mesos-consul:web-api")
+	c.Deregister()
+
+	lock.Lock()
+	defer lock.Unlock()
+	var deregistered []string
+	for _, p := range calls {
+		if strings.HasPrefix(p, "/v1/agent/service/deregister/") {
+			deregistered = append(deregistered, strings.TrimPrefix(p, "/v1/agent/service/deregister/"))
+		}
+	}
+	sort.Strings(deregistered)
+	if want := []string{"mesos-consul:web-api", "mesos-consul:web-old"}; !reflect.DeepEqual(deregistered, want) {
+		t.Errorf("DeregisterService() and Deregister() deregistered %v, want %v", deregistered, want)
+	}
+	if ids := c.CacheIDs(); len(ids) != 0 {
+		t.Errorf("Deregister() left %v in the cache, want none", ids)
+	}
+	if v := expvar.Get("consul_refused_services").(*expvar.Map).Get(c.name); v == nil || v.String() != "2" {
+		t.Errorf("consul_refused_services => %v, want 2", v)
+	}
+}
+
+func TestManagedServiceNamesReconcile(t *testing.T) {
+	var lock sync.Mutex
+	var deregistered []string
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			w.Write([]byte(`{"web-api": [], "vault": []}`))
+		case "/v1/catalog/service/web-api":
+			w.Write([]byte(`[{"Address": "10.0.0.1", "ServiceID": "mesos-consul:web-api", "ServiceName": "web-api", "ServiceAddress": "10.0.0.1", "ServicePort": 31000}]`))
+		case "/v1/catalog/service/vault":
+			w.Write([]byte(`[{"Address": "10.0.0.1", "ServiceID": "mesos-consul:vault", "ServiceName": "vault", "ServiceAddress": "10.0.0.1", "ServicePort": 8200}]`))
+		case "/v1/agent/checks", "/v1/agent/services":
+			w.Write([]byte(`{}`))
+		default:
+			if strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/") {
+				lock.Lock()
+				deregistered = append(deregistered, r.URL.Path)
+				lock.Unlock()
+			}
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer agent.Close()
+
+	host, port, _ := net.SplitHostPort(agent.Listener.Addr().String())
+	c := New()
+	c.name = "managed-reconcile"
+	c.config.port = port
+	c.idPrefixes = []string{"mesos-consul:"}
+	c.managedNames, _ = compileManagedNames([]string{"web-.*"})
+	c.CacheCreate()
+
+	// Cached before --managed-service-names excluded it
+	c.cache["mesos-consul:vault"] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: "mesos-consul:vault", Name: "vault"}, host)
+	c.cache["mesos-consul:vault"].validityCounter = cacheEntryValidityThreshold
+	c.cache["mesos-consul:web-api"] = newCacheEntry(&consulapi.AgentServiceRegistration{ID: "mesos-consul:web-api", Name: "web-api", Address: "10.0.0.1", Port: 31000}, "10.0.0.1")
+
+	// The refused service is not read back as drift and refused again
+	for i := 0; i < 3; i++ {
+		c.CacheMark("mesos-consul:web-api")
+		c.Deregister()
+		if err := c.CacheReconcile(host); err != nil {
+			t.Fatalf("CacheReconcile() => %s", err)
+		}
+	}
+
+	if ids := c.CacheIDs(); len(ids) != 1 || ids[0] != "mesos-consul:web-api" {
+		t.Errorf("Deregister() and CacheReconcile() cached %v, want [mesos-consul:web-api]", ids)
+	}
+	if v := expvar.Get("consul_refused_services").(*expvar.Map).Get(c.name); v == nil || v.String() != "1" {
+		t.Errorf("consul_refused_services => %v, want 1", v)
+	}
+	if n := cacheDrift.Get(c.name); n != nil && n.String() != "0" {
+		t.Errorf("CacheReconcile() => %s differences, want 0", n)
+	}
+	if len(deregistered) != 0 {
+		t.Errorf("Deregister() deregistered %v, want none", deregistered)
+	}
+}
@@ -0,0 +1,59 @@
+package consul
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// inflightTransport limits the number of Consul HTTP calls in flight. The
+// semaphore slot is held until the response body is closed, so that it
+// also bounds the number of open connections.
+type inflightTransport struct {
+	sem  chan struct{}
+	next http.RoundTripper
+}
+
+func newInflightTransport(sem chan struct{}, next http.RoundTripper) *inflightTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return &inflightTransport{sem: sem, next: next}
+}
+
+func (t *inflightTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.sem <- struct{}{}
+	inflightCalls.Add(1)
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			inflightCalls.Add(-1)
+			<-t.sem
+		})
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		release()
+		return resp, err
+	}
+
+	resp.Body = &inflightBody{ReadCloser: resp.Body, release: release}
+
+	return resp, nil
+}
+
+// inflightBody releases the semaphore slot of its call when closed
+type inflightBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *inflightBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+
+	return err
+}
@@ -0,0 +1,79 @@
+package consul
+
+import (
+	"bytes"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// KVGet()
+//   Read a key, reporting whether it is present
+//
+func (c *Consul) KVGet(host, key string) ([]byte, bool, error) {
+	client := c.client(host)
+	if client == nil {
+		return nil, false, nil
+	}
+
+	c.throttle()
+	pair, _, err := client.KV().Get(key, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if pair == nil {
+		return nil, false, nil
+	}
+
+	return pair.Value, true, nil
+}
+
+// KVSync()
+//   Make the keys under prefix match kv: write keys whose value
+//   changed and delete keys that are no longer present
+//
+func (c *Consul) KVSync(host, prefix string, kv map[string][]byte) error {
+	client := c.client(host)
+	if client == nil {
+		return nil
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+
+	c.throttle()
+	pairs, _, err := client.KV().List(prefix, nil)
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string][]byte)
+	for _, p := range pairs {
+		current[p.Key] = p.Value
+	}
+
+	for k, v := range kv {
+		if cv, ok := current[k]; ok && bytes.Equal(cv, v) {
+			continue
+		}
+
+		log.WithField("cluster", c.name).Debugf("Writing key %s", k)
+		c.throttle()
+		if _, err := client.KV().Put(&consulapi.KVPair{Key: k, Value: v}, nil); err != nil {
+			log.WithField("cluster", c.name).Warnf("Unable to write key %s: %s", k, err.Error())
+		}
+	}
+
+	for k := range current {
+		if _, ok := kv[k]; ok {
+			continue
+		}
+
+		log.WithField("cluster", c.name).Infof("Deleting key %s", k)
+		c.throttle()
+		if _, err := client.KV().Delete(k, nil); err != nil {
+			log.WithField("cluster", c.name).Warnf("Unable to delete key %s: %s", k, err.Error())
+		}
+	}
+
+	return nil
+}
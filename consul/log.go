@@ -0,0 +1,8 @@
+package consul
+
+import (
+	"github.com/CiscoCloud/mesos-consul/logging"
+)
+
+// Logger of the registry subsystem, see --log-levels
+var log = logging.New("registry")
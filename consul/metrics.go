@@ -0,0 +1,48 @@
+package consul
+
+import (
+	"expvar"
+)
+
+// Metrics are published with expvar and served on /debug/vars by the
+// healthcheck endpoint. They are keyed by Consul cluster name.
+var (
+	// Number of Consul API calls delayed by the --consul-rps limiter
+	throttledCalls = expvar.NewMap("consul_throttled_calls")
+
+	// Number of Consul API calls currently in flight, for all clusters
+	inflightCalls = expvar.NewInt("consul_inflight_calls")
+
+	// Services in the cache and services marked during the last refresh
+	cacheEntries = expvar.NewMap("cache_entries")
+	cacheMarked  = expvar.NewMap("cache_marked")
+
+	// Number of services deregistered by the cache sweep
+	cacheSwept = expvar.NewMap("cache_swept")
+
+	// Number of differences between the cache and Consul repaired by
+	// the --reconcile-interval reconciliations
+	cacheDrift = expvar.NewMap("cache_drift")
+
+	// Number of registrations and deregistrations refused by
+	// --managed-service-names
+	refusedServices = expvar.NewMap("consul_refused_services")
+
+	// Services to deregister in the last sweep that had any, and the
+	// time taken to deregister them in milliseconds
+	deregisterBatchSize     = expvar.NewMap("deregister_batch_size")
+	deregisterBatchDuration = expvar.NewMap("deregister_batch_duration_ms")
+
+	// Deregistrations run at once by the last sweep, scaled with
+	// --consul-deregister-batch-max
+	sweepWorkers = expvar.NewMap("deregister_workers")
+)
+
+// setGauge()
+//   Set the value of a cluster in a gauge map
+//
+func setGauge(m *expvar.Map, cluster string, n int) {
+	v := new(expvar.Int)
+	v.Set(int64(n))
+	m.Set(cluster, v)
+}
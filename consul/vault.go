@@ -0,0 +1,179 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultToken holds the Consul ACL token read from Vault. The token is
+// read again every renew interval, and the last good token is kept
+// when Vault can't be read.
+type vaultToken struct {
+	addr     string
+	token    string
+	roleID   string
+	secretID string
+	path     string
+
+	client *http.Client
+
+	sync.RWMutex
+	consulToken string
+}
+
+// newVaultToken()
+//   Read the Consul token from Vault and start renewing it
+//
+func newVaultToken(c consulConfig) (*vaultToken, error) {
+	v := &vaultToken{
+		addr:     strings.TrimRight(c.vaultAddr, "/"),
+		token:    c.vaultToken,
+		roleID:   c.vaultRoleID,
+		secretID: c.vaultSecretID,
+		path:     strings.Trim(c.vaultTokenPath, "/"),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if v.path == "" {
+		return nil, fmt.Errorf("--vault-consul-token-path is required with --vault-addr")
+	}
+	if v.token == "" && v.roleID == "" {
+		return nil, fmt.Errorf("--vault-token or --vault-role-id is required with --vault-addr")
+	}
+
+	if err := v.renew(); err != nil {
+		return nil, err
+	}
+
+	if c.vaultRenew > 0 {
+		go func() {
+			for range time.Tick(c.vaultRenew) {
+				if err := v.renew(); err != nil {
+					log.Errorf("Unable to renew the Consul token from Vault, keeping the last good token: %s", err)
+				}
+			}
+		}()
+	}
+
+	return v, nil
+}
+
+// get()
+//   Return the last good Consul token
+//
+func (v *vaultToken) get() string {
+	v.RLock()
+	defer v.RUnlock()
+
+	return v.consulToken
+}
+
+// renew()
+//   Read the Consul token from Vault, logging in with the AppRole
+//   first when no Vault token is set
+//
+func (v *vaultToken) renew() error {
+	token := v.token
+	if token == "" {
+		var login struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		body, _ := json.Marshal(map[string]string{"role_id": v.roleID, "secret_id": v.secretID})
+		if err := v.do("POST", "auth/approle/login", "", body, &login); err != nil {
+			return err
+		}
+		token = login.Auth.ClientToken
+	}
+
+	// KV version 2 nests the secret in a second data field
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := v.do("GET", v.path, token, nil, &secret); err != nil {
+		return err
+	}
+
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	consulToken, _ := data["token"].(string)
+	if consulToken == "" {
+		return fmt.Errorf("no token field in vault secret %s", v.path)
+	}
+
+	v.Lock()
+	changed := v.consulToken != consulToken
+	v.consulToken = consulToken
+	v.Unlock()
+
+	if changed {
+		log.Infof("Renewed the Consul token from vault secret %s", v.path)
+	}
+
+	return nil
+}
+
+// do()
+//   Send a request to the Vault API and decode the response into out
+//
+func (v *vaultToken) do(method, path, token string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s", v.addr, path), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault %s %s: %s", method, path, resp.Status)
+	}
+
+	return json.Unmarshal(b, out)
+}
+
+// tokenTransport sets the Consul token from Vault on every Consul call
+type tokenTransport struct {
+	tokens *vaultToken
+	next   http.RoundTripper
+}
+
+func newTokenTransport(tokens *vaultToken, next http.RoundTripper) *tokenTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return &tokenTransport{tokens: tokens, next: next}
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("X-Consul-Token", t.tokens.get())
+
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,99 @@
+// Package logging provides the named loggers of the mesos-consul
+// subsystems so that their level can be set independently.
+package logging
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	lock    sync.Mutex
+	loggers = make(map[string]*logrus.Logger)
+)
+
+// New returns the logger of the named subsystem, creating it at the level
+// of the standard logger if needed.
+func New(name string) *logrus.Logger {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if l, ok := loggers[name]; ok {
+		return l
+	}
+
+	l := logrus.New()
+	l.Out = logrus.StandardLogger().Out
+	l.Formatter = logrus.StandardLogger().Formatter
+	l.Level = logrus.GetLevel()
+
+	loggers[name] = l
+	return l
+}
+
+// Subsystems returns the names of the subsystem loggers.
+func Subsystems() []string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	names := make([]string, 0, len(loggers))
+	for name := range loggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ParseLevels parses a list of subsystem=level pairs separated by commas,
+// e.g. mesos=info,registry=debug.
+func ParseLevels(s string) (map[string]logrus.Level, error) {
+	levels := make(map[string]logrus.Level)
+	if s == "" {
+		return levels, nil
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid log level '%s', must be subsystem=level", pair)
+		}
+
+		name := strings.TrimSpace(kv[0])
+		if _, ok := loggers[name]; !ok {
+			return nil, fmt.Errorf("unknown log subsystem '%s'", name)
+		}
+
+		l, err := logrus.ParseLevel(strings.ToLower(strings.TrimSpace(kv[1])))
+		if err != nil {
+			return nil, err
+		}
+		levels[name] = l
+	}
+
+	return levels, nil
+}
+
+// SetLevels sets the level of the standard logger and of every subsystem
+// logger. Subsystems missing from levels use the global level.
+func SetLevels(global logrus.Level, levels map[string]logrus.Level) {
+	logrus.SetLevel(global)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	for name, l := range loggers {
+		if level, ok := levels[name]; ok {
+			l.Level = level
+		} else {
+			l.Level = global
+		}
+	}
+}
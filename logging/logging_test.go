@@ -0,0 +1,37 @@
+package logging
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSetLevels(t *testing.T) {
+	mesos := New("mesos")
+	registry := New("registry")
+
+	levels, err := ParseLevels("mesos=info, registry=DEBUG")
+	if err != nil {
+		t.Fatalf("ParseLevels() => %v", err)
+	}
+
+	SetLevels(logrus.WarnLevel, levels)
+	if mesos.Level != logrus.InfoLevel || registry.Level != logrus.DebugLevel {
+		t.Errorf("SetLevels(%v) => mesos %s, registry %s, want info, debug", levels, mesos.Level, registry.Level)
+	}
+
+	SetLevels(logrus.ErrorLevel, nil)
+	if mesos.Level != logrus.ErrorLevel || registry.Level != logrus.ErrorLevel {
+		t.Errorf("SetLevels(nil) => mesos %s, registry %s, want error", mesos.Level, registry.Level)
+	}
+}
+
+func TestParseLevelsInvalid(t *testing.T) {
+	New("mesos")
+
+	for _, s := range []string{"mesos", "unknown=info", "mesos=loud"} {
+		if _, err := ParseLevels(s); err == nil {
+			t.Errorf("ParseLevels(%s) => nil, want error", s)
+		}
+	}
+}
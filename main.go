@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/CiscoCloud/mesos-consul/audit"
 	"github.com/CiscoCloud/mesos-consul/config"
 	"github.com/CiscoCloud/mesos-consul/consul"
+	"github.com/CiscoCloud/mesos-consul/logging"
 	"github.com/CiscoCloud/mesos-consul/mesos"
 
 	flag "github.com/ogier/pflag"
@@ -24,27 +31,200 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if err := audit.Open(c.AuditLog); err != nil {
+		log.Fatal("Unable to open the audit log: ", err)
+	}
+
+	var leaders []*mesos.Mesos
+	for _, cc := range clusterConfigs(c) {
+		log.Info("Using zookeeper: ", cc.Zk)
+		leaders = append(leaders, mesos.New(cc))
+	}
+
 	if c.Healthcheck {
-		go StartHealthcheckService(c)
+		go StartHealthcheckService(c, leaders...)
 	}
 
-	log.Info("Using zookeeper: ", c.Zk)
-	leader := mesos.New(c)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
 	ticker := time.NewTicker(c.Refresh)
-	leader.Refresh()
-	for _ = range ticker.C {
+	refresh(leaders)
+	if c.EventStream {
+		for _, leader := range leaders {
+			go leader.WatchEvents()
+		}
+	}
+	for {
+		select {
+		case <-ticker.C:
+			refresh(leaders)
+		case <-hup:
+			nc, err := reload(leaders)
+			if err != nil {
+				log.Error("Unable to reload configuration: ", err)
+				continue
+			}
+			if nc.Refresh != c.Refresh {
+				ticker.Stop()
+				ticker = time.NewTicker(nc.Refresh)
+			}
+			c = nc
+		}
+	}
+}
+
+// clusterConfigs returns the configuration of each Mesos cluster: the one
+// on --zk, or one per --mesos-cluster with its name and Zookeeper path.
+func clusterConfigs(c *config.Config) []*config.Config {
+	if len(c.MesosClusters) == 0 {
+		return []*config.Config{c}
+	}
+
+	var configs []*config.Config
+	for _, mc := range c.MesosClusters {
+		split := strings.SplitN(mc, ":", 2)
+
+		cc := *c
+		cc.Cluster = split[0]
+		cc.Zk = split[1]
+		configs = append(configs, &cc)
+	}
+
+	return configs
+}
+
+// refresh refreshes the Mesos clusters one after the other.
+func refresh(leaders []*mesos.Mesos) {
+	for _, leader := range leaders {
 		leader.Refresh()
 	}
 }
 
-func StartHealthcheckService(c *config.Config) {
-	http.HandleFunc("/health", HealthHandler)
+// reload parses the command line and configuration file again and applies
+// the reloadable settings to every Mesos cluster, once every cluster
+// accepted them so that none runs a configuration the others refused.
+func reload(leaders []*mesos.Mesos) (*config.Config, error) {
+	log.Info("Reloading configuration")
+
+	c, err := parseFlags(os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, leader := range leaders {
+		if err := leader.CheckReload(c); err != nil {
+			return nil, err
+		}
+	}
+	for _, leader := range leaders {
+		if err := leader.Reload(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func StartHealthcheckService(c *config.Config, leaders ...*mesos.Mesos) {
+	http.HandleFunc("/health", HealthHandler(leaders...))
+	http.HandleFunc("/ready", ReadyHandler(leaders...))
+	http.HandleFunc("/framework/", FrameworkHandler(c.AdminToken, leaders...))
+	http.HandleFunc("/services", ServicesHandler(c.AdminToken, leaders...))
 	log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%s", c.HealthcheckIp, c.HealthcheckPort), nil))
 }
 
-func HealthHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "OK")
+// FrameworkHandler deregisters the services of the framework named by the
+// DELETE /framework/<name> path right away. It requires the admin token as
+// a bearer token and is disabled when no token is set.
+func FrameworkHandler(token string, leaders ...*mesos.Mesos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminRequest(w, r, token, "DELETE") {
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, "/framework/")
+		if name == "" || strings.Contains(name, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		n := 0
+		for _, leader := range leaders {
+			n += leader.DeregisterFramework(name)
+		}
+		fmt.Fprintf(w, "Deregistered %d services of framework %s\n", n, name)
+	}
+}
+
+// ServicesHandler lists the services cached by every cluster as JSON on
+// GET /services, with whether the last refresh marked them. It requires
+// the admin token like FrameworkHandler.
+func ServicesHandler(token string, leaders ...*mesos.Mesos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminRequest(w, r, token, "GET") {
+			return
+		}
+
+		services := []mesos.ManagedService{}
+		for _, leader := range leaders {
+			services = append(services, leader.ManagedServices()...)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(services); err != nil {
+			log.Warnf("Unable to write the services: %s", err)
+		}
+	}
+}
+
+// adminRequest checks the token and method of a request to an admin
+// endpoint, and answers it when they don't match. Admin endpoints are not
+// found when no token is set.
+func adminRequest(w http.ResponseWriter, r *http.Request, token, method string) bool {
+	if token == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	return true
+}
+
+// HealthHandler reports OK unless the last Mesos state fetch of one of the
+// clusters failed after all its retries.
+func HealthHandler(leaders ...*mesos.Mesos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, leader := range leaders {
+			if err := leader.Healthy(); err != nil {
+				http.Error(w, "Unable to load Mesos state: "+err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "OK")
+	}
+}
+
+// ReadyHandler reports OK once every cluster completed a refresh since
+// startup, and as long as their last one is not stale.
+func ReadyHandler(leaders ...*mesos.Mesos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, leader := range leaders {
+			if err := leader.Ready(); err != nil {
+				http.Error(w, "Not ready: "+err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "OK")
+	}
 }
 
 func parseFlags(args []string) (*config.Config, error) {
@@ -59,14 +239,69 @@ func parseFlags(args []string) (*config.Config, error) {
 
 	flags.BoolVar(&doHelp, "help", false, "")
 	flags.BoolVar(&doVersion, "version", false, "")
+	flags.StringVar(&c.ConfigFile, "config-file", "", "")
 	flags.StringVar(&c.LogLevel, "log-level", "WARN", "")
+	flags.StringVar(&c.LogLevels, "log-levels", "", "")
 	flags.DurationVar(&c.Refresh, "refresh", time.Minute, "")
+	flags.DurationVar(&c.MinAge, "min-age", 0, "")
+	flags.DurationVar(&c.DeregisterGrace, "deregister-grace", 0, "")
+	flags.DurationVar(&c.ReconcileInterval, "reconcile-interval", 0, "")
+	flags.IntVar(&c.StateFetchAttempts, "state-fetch-attempts", 3, "")
+	flags.DurationVar(&c.StateFetchDelay, "state-fetch-delay", time.Second, "")
 	flags.StringVar(&c.Zk, "zk", "zk://127.0.0.1:2181/mesos", "")
+	flags.Var((funcVar)(func(s string) error {
+		split := strings.SplitN(s, ":", 2)
+		if len(split) != 2 || split[0] == "" || split[1] == "" {
+			return fmt.Errorf("invalid mesos cluster '%s', must be name:zk", s)
+		}
+		c.MesosClusters = append(c.MesosClusters, s)
+		return nil
+	}), "mesos-cluster", "")
+	flags.BoolVar(&c.RequireConsul, "require-consul", false, "")
+	flags.BoolVar(&c.EventStream, "event-stream", false, "")
+	flags.StringVar(&c.OtlpEndpoint, "otlp-endpoint", "", "")
+	flags.StringVar(&c.AuditLog, "audit-log", "", "")
 	flags.StringVar(&c.Separator, "group-separator", "", "")
+	flags.StringVar(&c.NameSanitizer, "name-sanitizer", "default", "")
+	flags.StringVar(&c.NameSanitizerRegex, "name-sanitizer-regex", `[^\w-]`, "")
+	flags.StringVar(&c.NameCase, "name-case", "lower", "")
+	flags.BoolVar(&c.SrvSafeNames, "srv-safe-names", false, "")
+	flags.BoolVar(&c.EmptyNameFallback, "empty-name-fallback", false, "")
 	flags.StringVar(&c.MesosIpOrder, "mesos-ip-order", "netinfo,mesos,host", "")
+	flags.Var((funcVar)(func(s string) error {
+		c.FrameworkIpOrder = append(c.FrameworkIpOrder, s)
+		return nil
+	}), "framework-ip-order", "")
+	flags.StringVar(&c.AddressFamily, "address-family", "any", "")
+	flags.BoolVar(&c.AddressFallback, "address-family-fallback", false, "")
+	flags.StringVar(&c.IpStatusStates, "ip-status-states", "TASK_RUNNING", "")
+	flags.BoolVar(&c.SkipNoIp, "skip-no-ip", true, "")
+	flags.BoolVar(&c.SkipNonRoutable, "skip-nonroutable", true, "")
+	flags.BoolVar(&c.RegisterPrimaryPort, "register-primary-port", true, "")
+	flags.StringVar(&c.RegistrationPolicy, "registration-policy", "all", "")
+	flags.StringVar(&c.RegistrationLabel, "registration-label", "consul_register", "")
+	flags.StringVar(&c.RegisterFilter, "register-filter", "", "")
+	flags.StringVar(&c.LegacyConsulLabel, "legacy-consul-label", "ignore", "")
+	flags.StringVar(&c.DuplicatePortNames, "duplicate-port-names", "index", "")
+	flags.StringVar(&c.NamedPortCheck, "named-port-default-check", "inherit", "")
+	flags.BoolVar(&c.DockerChecks, "docker-checks", false, "")
+	flags.BoolVar(&c.BodyCheck, "body-check", false, "")
+	flags.BoolVar(&c.ProbeBeforeRegister, "probe-before-register", false, "")
+	flags.DurationVar(&c.ProbeTimeout, "probe-timeout", 2*time.Second, "")
+	flags.IntVar(&c.RegisterWorkers, "register-workers", 1, "")
+	flags.IntVar(&c.RegisterWorkersMax, "register-workers-max", 0, "")
+	flags.IntVar(&c.RegisterBacklog, "register-scale-backlog", 50, "")
+	flags.BoolVar(&c.CheckSchemeDetect, "check-scheme-autodetect", false, "")
+	flags.IntVar(&c.CheckOutputMaxSize, "check-output-max-size", 0, "")
+	flags.BoolVar(&c.CheckOwnerNotes, "check-owner-notes", false, "")
+	flags.Float64Var(&c.CheckTimeoutRatio, "check-timeout-ratio", 0, "")
+	flags.DurationVar(&c.CheckIntervalMin, "check-interval-min", 0, "")
+	flags.DurationVar(&c.CheckIntervalMax, "check-interval-max", 0, "")
+	flags.StringVar(&c.DefaultCheck, "default-check", "", "")
 	flags.BoolVar(&c.Healthcheck, "healthcheck", false, "")
 	flags.StringVar(&c.HealthcheckIp, "healthcheck-ip", "127.0.0.1", "")
 	flags.StringVar(&c.HealthcheckPort, "healthcheck-port", "24476", "")
+	flags.StringVar(&c.AdminToken, "admin-token", "", "")
 	flags.Var((funcVar)(func(s string) error {
 		c.TaskWhiteList = append(c.TaskWhiteList, s)
 		return nil
@@ -83,13 +318,49 @@ func parseFlags(args []string) (*config.Config, error) {
 		c.FwBlackList = append(c.FwBlackList, s)
 		return nil
 	}), "fw-blacklist", "")
+	flags.Var((funcVar)(func(s string) error {
+		c.AgentExclude = append(c.AgentExclude, s)
+		return nil
+	}), "agent-exclude", "")
+	flags.Var((funcVar)(func(s string) error {
+		c.MasterExclude = append(c.MasterExclude, s)
+		return nil
+	}), "master-exclude", "")
+	flags.BoolVar(&c.RegisterLeaderOnly, "register-leader-only", false, "")
 	flags.Var((funcVar)(func(s string) error {
 		c.TaskTag = append(c.TaskTag, s)
 		return nil
 	}), "task-tag", "")
 	flags.StringVar(&c.ServiceName, "service-name", "mesos", "")
+	flags.StringVar(&c.AgentServiceName, "agent-service-name", "", "")
+	flags.StringVar(&c.MasterServiceName, "master-service-name", "", "")
 	flags.StringVar(&c.ServiceTags, "service-tags", "", "")
+	flags.StringVar(&c.AgentAttributeTags, "agent-attribute-tags", "", "")
+	flags.StringVar(&c.DefaultTags, "default-tags", "", "")
 	flags.StringVar(&c.ServiceIdPrefix, "service-id-prefix", "mesos-consul", "")
+	flags.StringVar(&c.AdoptPrefixes, "adopt-prefixes", "", "")
+	flags.StringVar(&c.ServiceIdSeparator, "service-id-separator", ":", "")
+	flags.BoolVar(&c.StableIds, "stable-ids", false, "")
+	flags.BoolVar(&c.AgentNodeCheck, "agent-node-check", false, "")
+	flags.BoolVar(&c.AgentResourcesMeta, "agent-resources-meta", false, "")
+	flags.StringVar(&c.TagPrefix, "tag-prefix", "", "")
+	flags.StringVar(&c.LabelTagPrefix, "label-tag-prefix", "", "")
+	flags.StringVar(&c.LabelTagFormat, "label-tag-format", "key=value", "")
+	flags.Var((funcVar)(func(s string) error {
+		c.TagTemplates = append(c.TagTemplates, s)
+		return nil
+	}), "tag-template", "")
+	flags.StringVar(&c.TagTemplateMissing, "tag-template-missing", "drop", "")
+	flags.BoolVar(&c.TagNode, "tag-node", false, "")
+	flags.BoolVar(&c.TagRole, "tag-role", false, "")
+	flags.BoolVar(&c.TagSandboxURL, "tag-sandbox-url", false, "")
+	flags.BoolVar(&c.TagImage, "tag-image", false, "")
+	flags.BoolVar(&c.SortTags, "sort-tags", false, "")
+	flags.StringVar(&c.CanarySuffix, "canary-suffix", "-canary", "")
+	flags.IntVar(&c.MaxNameLength, "max-name-length", 256, "")
+	flags.StringVar(&c.KVPrefix, "kv-prefix", "", "")
+	flags.BoolVar(&c.KVClusterInfo, "kv-cluster-info", false, "")
+	flags.StringVar(&c.PauseKVKey, "pause-kv-key", "", "")
 
 	consul.AddCmdFlags(flags)
 
@@ -102,6 +373,20 @@ func parseFlags(args []string) (*config.Config, error) {
 		return nil, fmt.Errorf("extra argument(s): %q", args)
 	}
 
+	if c.ConfigFile != "" {
+		fileArgs, err := readConfigFile(c.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := flags.Parse(fileArgs); err != nil {
+			return nil, fmt.Errorf("%s: %s", c.ConfigFile, err)
+		}
+		if len(flags.Args()) > 0 {
+			return nil, fmt.Errorf("%s: extra argument(s): %q", c.ConfigFile, flags.Args())
+		}
+	}
+
 	if doVersion {
 		fmt.Printf("%s v%s\n", Name, Version)
 		os.Exit(0)
@@ -111,17 +396,45 @@ func parseFlags(args []string) (*config.Config, error) {
 		os.Exit(0)
 	}
 
+	levels, err := logging.ParseLevels(c.LogLevels)
+	if err != nil {
+		return nil, err
+	}
+
 	l, err := log.ParseLevel(strings.ToLower(c.LogLevel))
 	if err != nil {
-		log.SetLevel(log.WarnLevel)
+		l = log.WarnLevel
 		log.Warnf("Invalid log level '%v'. Setting to WARN", c.LogLevel)
-	} else {
-		log.SetLevel(l)
 	}
+	logging.SetLevels(l, levels)
 
 	return c, nil
 }
 
+// readConfigFile reads the options of a configuration file, one per line.
+// Empty lines and lines starting with # are ignored.
+func readConfigFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var args []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		args = append(args, line)
+	}
+
+	return args, scanner.Err()
+}
+
 func Help() string {
 	helpText := `
 Usage: mesos-consul [options]
@@ -129,19 +442,150 @@ Usage: mesos-consul [options]
 Options:
 
   --version 			Print mesos-consul version
+  --config-file=<path>		File of additional options, one per line such as
+				--whitelist=^web. Re-read along with the command line
+				on SIGHUP (default not set)
   --log-level=<log_level>	Set the Logging level to one of [ "DEBUG", "INFO", "WARN", "ERROR" ]
 				(default "WARN")
+  --log-levels=<subsystem=level>,...
+				Set the Logging level of subsystems, mesos for the Mesos
+				state and task registration, registry for the Consul
+				calls, tracing for the trace exports, e.g.
+				mesos=info,registry=debug. Other subsystems
+				log at --log-level (default not set)
   --refresh=<time>		Set the Mesos refresh rate (default 1m)
+  --min-age=<time>		Only register tasks that have been running for at least
+				this long. Can be overridden per task with the
+				'consul_min_age' label (default 0)
+  --deregister-grace=<time>	Delay the deregistration of tasks in a terminal state.
+				It is cancelled if the task is running again before
+				the delay expires (default 0)
+  --reconcile-interval=<time>	Compare the cache with the services in Consul at this
+				interval and repair the differences (default 0, never)
+  --state-fetch-attempts=<n>	Number of attempts to fetch the Mesos state on each refresh
+				(default 3)
+  --state-fetch-delay=<time>	Delay before retrying to fetch the Mesos state, doubled
+				after each attempt (default 1s)
   --zk=<address>		Zookeeper path to Mesos (default zk://127.0.0.1:2181/mesos)
+  --mesos-cluster=<name:zk>	A Mesos cluster to register, in the name:address form where
+				address is its Zookeeper path. Services are tagged
+				cluster:<name> and their IDs include the name. Can be
+				specified multiple times (default a single cluster on --zk)
+  --require-consul		Exit at startup if the Consul agent on the Mesos leader
+				can't be reached (default not enabled)
+  --event-stream		Update the services from the event stream of the Mesos
+				leader between refreshes (default not enabled)
+  --otlp-endpoint=<url>		Export traces of the sync cycles to this OTLP/HTTP endpoint,
+				e.g. http://collector:4318 (default not enabled)
+  --audit-log=<path>		Append every register, deregister and skip decision, with
+				its reason, to this file as JSON lines, or write them to
+				the standard output with '-' (default not enabled)
   --group-separator=<separator> Choose the group separator. Will replace _ in task names (default is empty)
+  --name-sanitizer=<name>	How task names become service names, one of:
+				default: replace characters other than letters, digits,
+				  '_' and '-' with '-', and lowercase
+				dns: keep a valid DNS label
+				lower: only lowercase
+				custom-regex: like default, with --name-sanitizer-regex
+				(default: default)
+  --name-sanitizer-regex=<regex> Characters replaced with '-' by the custom-regex
+				sanitizer (default: [^\w-])
+  --name-case=<case>		Case of the service names after the name sanitizer: 'lower',
+				'upper' or 'preserve' (default lower)
+  --srv-safe-names		Make service names valid DNS labels for SRV queries,
+				truncated to 63 characters with a stable hash suffix
+				(default not enabled)
+  --empty-name-fallback		Register tasks whose cleaned name is empty under their cleaned
+				task ID instead of skipping them (default not enabled)
   --healthcheck 		Enables a http endpoint for health checks. When this
 				flag is enabled, serves a service health status on 127.0.0.1:24476 (default not enabled)
+				The status is an error when the Mesos state can't be fetched
+				on /health, and /ready is an error until a first refresh
+				completed or when the last one is stale
   --healthcheck-ip=<ip> 	Health check interface ip (default 127.0.0.1)
   --healthcheck-port=<port>	Health check service port (default 24476)
+  --admin-token=<token>		Bearer token of the admin endpoints served with --healthcheck,
+				e.g. DELETE /framework/<name> and GET /services (default not
+				set, disabled)
   --mesos-ip-order		Comma separated list to control the order in
 				which github.com/CiscoCloud/mesos-consul searches for the task IP
 				address. Valid options are 'netinfo', 'mesos', 'docker' and 'host'
 				(default netinfo,mesos,host)
+  --framework-ip-order=<fw:order> The --mesos-ip-order of the tasks of a framework, e.g.
+				marathon:host,netinfo. Can be specified multiple times
+				(default not set)
+  --address-family=<family>	Only use the task IP addresses of that family, 'ipv4',
+				'ipv6' or 'any' (default any)
+  --address-family-fallback	Use an address of the other family when the task has
+				none of --address-family (default not enabled)
+  --ip-status-states=<state>,...	Comma separated list of task states whose statuses
+				are used to resolve the task IP. The most recent matching
+				status wins. (default TASK_RUNNING)
+  --skip-no-ip			Do not register tasks whose IP address can't be resolved
+				using --mesos-ip-order (default true)
+  --skip-nonroutable		Ignore loopback, link-local and unspecified task IP
+				addresses, and do not register tasks with only such
+				addresses (default true)
+  --register-primary-port	Register the task service on each of its ports in addition
+				to the services of its named DiscoveryInfo ports. When false,
+				only tasks without named ports are registered on their
+				ports (default true)
+  --registration-policy=<policy>	Which tasks are registered. Valid options are 'all' and
+				'opt-in', to only register tasks whose --registration-label
+				is true (default all)
+  --registration-label=<label>	Label enabling the registration of a task in opt-in mode
+				(default consul_register)
+  --register-filter=<expr>	Only register the tasks matching the expression, e.g.
+				'labels.env == "prod" && labels.tier != "batch"'. See the
+				README for its syntax (default all tasks)
+  --legacy-consul-label=<mode>	What to do with tasks labelled with the service name in the
+				old 'consul' label. Valid options are 'ignore' to register
+				them normally, 'honor' to use the label value as the
+				service name and 'error' to not register them (default ignore)
+  --duplicate-port-names=<mode>	What to do with the DiscoveryInfo ports of a task sharing a
+				name: 'index' suffixes the later ones with their index,
+				e.g. http-1, 'skip' ignores them and 'error' doesn't
+				register the task (default index)
+  --named-port-default-check=<mode>	Check of the named DiscoveryInfo ports without a
+				'check' label: 'inherit' checks them like the task, 'none'
+				registers them without check (default inherit)
+  --docker-checks		Register Docker exec checks from the 'check_docker' task label.
+				Script checks must be enabled on the Consul agents
+				(default not enabled)
+  --body-check			Probe the 'check_http' URL of tasks with a 'check_body_regex'
+				or 'check_ok_status' label on each refresh and report the
+				result to a Consul TTL check. The check fails unless the
+				response is a 2xx, or one of the 'check_ok_status' codes,
+				whose body matches the regex (default not enabled)
+  --probe-before-register	Probe the HTTP and TCP checks of new task services once
+				before registering them, and skip the services failing it
+				until a later refresh (default not enabled)
+  --probe-timeout=<time>	Timeout of the probes of --probe-before-register and
+				--check-scheme-autodetect (default 2s)
+  --register-workers=<n>	Number of task service registrations run at once at the
+				end of each registration pass (default 1)
+  --register-workers-max=<n>	Scale the registrations run at once up to this number
+				with the new services of the pass, by one per
+				--register-scale-backlog services (default 0, fixed)
+  --register-scale-backlog=<n>	Number of new services per registration run at once
+				with --register-workers-max (default 50)
+  --check-scheme-autodetect	Detect whether the HTTP checks of the task services
+				answer on https or http when they are registered, for
+				tasks without a 'check_scheme' label (default not enabled)
+  --check-output-max-size=<n>	Maximum size in bytes of the task check outputs stored
+				by Consul. Can be overridden per task with the
+				'check_output_max_size' label (default: Consul default)
+  --check-owner-notes		Set the notes of the task checks to 'managed by
+				mesos-consul for task <id>' (default not enabled)
+  --check-timeout-ratio=<r>	Timeout of the task checks with an interval and no
+				timeout, as a ratio of the interval, e.g. 0.5. The
+				'check_timeout' label wins (default: Consul default)
+  --check-interval-min=<time>	Clamp the task check intervals below this to it,
+				with a warning (default no minimum)
+  --check-interval-max=<time>	Clamp the task check intervals above this to it,
+				with a warning (default no maximum)
+  --default-check=<spec>	Check of the tasks without check labels, in the
+				'consul_check' form, e.g. tcp:{port} (default not set)
   --heartbeats-before-remove	Number of times that registration needs to fail before removing
 				task from Consul. (default: 1)
   --whitelist=<regex>		Only register services matching the provided regex. 
@@ -154,12 +598,76 @@ Options:
   --fw-blacklist=<regex>	Do not register services from frameworks matching the provided
 				regex.
 				Can be specified multiple times
+  --agent-exclude=<regex>	Do not register Mesos agents whose IP or hostname matches the
+				provided regex. Can be specified multiple times
+  --master-exclude=<regex>	Do not register Mesos masters whose IP or hostname matches the
+				provided regex. Can be specified multiple times
+  --register-leader-only	Only register the leading Mesos master, standby masters
+				are deregistered (default not enabled)
   --task-tag=<pattern:tag>	Tag tasks whose name contains 'pattern' substring (case-insensitive) with given tag.
 				Can be specified multiple times
   --service-name=<name>		Service name of the Mesos hosts. (default: mesos)
+  --agent-service-name=<name>	Service name of the Mesos agents (default: --service-name)
+  --master-service-name=<name>	Service name of the Mesos masters (default: --service-name)
   --service-tags=<tag>,...	Comma delimited list of tags to add to the mesos hosts
 				Hosts are registered as
 				(leader|master|follower).<tag>.mesos.service.conul
+  --agent-attribute-tags=<key>,...
+				Comma delimited list of Mesos agent attributes to tag the
+				agents with as key:value (default not set)
+  --default-tags=<tag>,...	Comma delimited list of tags added to every task and
+				Mesos host service (default not set)
+  --service-id-separator=<sep>	Separator used between the parts of the consul service ids
+				registered by mesos-consul. (default: :)
+  --stable-ids			Build the service IDs of the tasks with a consul_instance
+				label from their name and instance index instead of their
+				agent and address, so that they survive rescheduling
+				(default not enabled)
+  --adopt-prefixes=<prefix>,...
+				Comma delimited list of other service ID prefixes, with their
+				separator, whose services are deregistered by the sweep,
+				as <cluster>=<prefix> with --mesos-cluster (default not set)
+  --agent-node-check		Check the health of Mesos agents with a single node check
+				instead of a check on the agent service (default not enabled)
+  --agent-resources-meta	Set the total, used and available cpus, mem, disk and gpus
+				of Mesos agents in the Meta of their service, e.g.
+				mesos_agent_cpus_total (default not enabled)
+  --tag-prefix=<prefix>		Prefix added to every tag registered by mesos-consul, e.g. 'mc/'
+				(default is empty)
+  --label-tag-prefix=<prefix>	Tag task services with the task labels starting with the
+				prefix, e.g. 'tag.', without it (default not set)
+  --label-tag-format=<format>	Format of the tags of --label-tag-prefix: key, key=value
+				or key:value (default key=value)
+  --tag-template=<template>	Tag task services with the template, where ${label:<key>}
+				is replaced with a task label and ${task:<field>} with
+				the task id, name, framework, agent or hostname, e.g.
+				version-${label:VERSION}. Can be specified multiple times
+  --tag-template-missing=<mode>	With drop, templates with an unresolved reference give
+				no tag, with empty the reference is removed (default drop)
+  --tag-node			Tag task services with node:<agent>, the address of the
+				Consul agent they are registered on (default not enabled)
+  --tag-role			Tag task services with role:<role> for each Mesos role
+				of the task, except * (default not enabled)
+  --tag-sandbox-url		Add the URL of the Mesos sandbox of tasks to their service
+				meta as mesos_sandbox_url (default not enabled)
+  --tag-image			Add the image of the task container to their service
+				meta as mesos_image (default not enabled)
+  --sort-tags			Sort the tags of the registered services, so that a change
+				of their order doesn't re-register the Mesos hosts
+				(default not enabled)
+  --canary-suffix=<suffix>	Suffix added to the service name of tasks with a
+				consul_canary=true label (default -canary)
+  --max-name-length=<n>		Truncate task service names longer than n characters,
+				with a hash of the full name to keep them unique
+				(default 256, the Consul maximum)
+  --kv-prefix=<prefix>		Write the Mesos frameworks to Consul KV under
+				<prefix>/frameworks/<name> on each refresh (default not enabled)
+  --kv-cluster-info		Also write the Mesos version and cluster name to
+				<prefix>/cluster/version and <prefix>/cluster/name
+				(default not enabled)
+  --pause-kv-key=<key>		Skip the registrations and deregistrations, but not
+				the heartbeats, while this Consul KV key is set, to
+				anything but false, 0, no or off (default not enabled)
 ` + consul.Help()
 
 	return strings.TrimSpace(helpText)
@@ -0,0 +1,47 @@
+package mesos
+
+import (
+	"github.com/CiscoCloud/mesos-consul/audit"
+)
+
+// audit()
+//   Record a registration decision of the Mesos cluster
+//
+func (m *Mesos) audit(d audit.Decision) {
+	d.MesosCluster = m.Cluster
+	audit.Record(d)
+}
+
+// auditSkip()
+//   Record the decision not to register a task or host, once until its
+//   reason changes. Skips not decided again during a registration pass
+//   are forgotten, and recorded again if they come back.
+//
+func (m *Mesos) auditSkip(d audit.Decision) {
+	if !audit.Enabled() {
+		return
+	}
+
+	key := d.Task + "\x00" + d.Framework + "\x00" + d.Host + "\x00" + d.Service
+	last, ok := m.auditSeen[key]
+	if !ok {
+		last, ok = m.auditSkips[key]
+	}
+
+	if m.auditSeen == nil {
+		m.auditSeen = make(map[string]string)
+	}
+	m.auditSeen[key] = d.Reason
+
+	if !ok || last != d.Reason {
+		d.Action = audit.Skip
+		m.audit(d)
+	}
+}
+
+// rotateAuditSkips()
+//   Start a registration pass, keeping the skips of the last one
+//
+func (m *Mesos) rotateAuditSkips() {
+	m.auditSkips, m.auditSeen = m.auditSeen, nil
+}
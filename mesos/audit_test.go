@@ -0,0 +1,114 @@
+package mesos
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/audit"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+func TestRegisterTaskAudit(t *testing.T) {
+	var buf bytes.Buffer
+	audit.SetOutput(&buf)
+	defer audit.SetOutput(nil)
+
+	decisions := func() []audit.Decision {
+		var ds []audit.Decision
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var d audit.Decision
+			if err := dec.Decode(&d); err != nil {
+				t.Fatal(err)
+			}
+			ds = append(ds, d)
+		}
+		return ds
+	}
+
+	m, _ := newTestMesos()
+	m.SkipNoIp = true
+	m.AddressFamily = "ipv4"
+	task := &state.Task{
+		ID:      "web.1",
+		Name:    "web",
+		State:   "TASK_RUNNING",
+		SlaveIP: "",
+	}
+
+	// The skip is recorded once while its reason stays the same
+	for i := 0; i < 2; i++ {
+		m.rotateAuditSkips()
+		m.registerTask(task, "10.0.0.1")
+	}
+	if ds := decisions(); len(ds) != 1 || ds[0].Action != audit.Skip || ds[0].Task != "web.1" || ds[0].Reason != "no ipv4 IP address" {
+		t.Fatalf("registerTask() without IP twice => %+v, want one skip", ds)
+	}
+
+	task.SlaveIP = "10.0.0.1"
+	m.rotateAuditSkips()
+	ids := m.registerTask(task, "10.0.0.1")
+	m.rotateAuditSkips()
+	m.registerTask(task, "10.0.0.1")
+	if ds := decisions(); len(ds) != 1 || ds[0].Action != audit.Register || ds[0].Service != ids[0] {
+		t.Fatalf("registerTask() twice => %+v, want one registration of %v", ds, ids)
+	}
+
+	// A registered service is recorded again when its tags change, or
+	// when it moves with a stable ID
+	task.Labels = []state.Label{{Key: "tags", Value: "v2"}}
+	m.registerTask(task, "10.0.0.1")
+	if ds := decisions(); len(ds) != 1 || ds[0].Reason != "tags or meta changed" {
+		t.Fatalf("registerTask() with new tags => %+v, want one registration", ds)
+	}
+
+	m.StableIds = true
+	task.Labels = []state.Label{{Key: "consul_instance", Value: "0"}}
+	m.registerTask(task, "10.0.0.1")
+	task.SlaveIP = "10.0.0.2"
+	m.registerTask(task, "10.0.0.2")
+	if ds := decisions(); len(ds) != 2 || ds[0].Reason != "new service" || ds[1].Reason != "address or port changed" {
+		t.Fatalf("registerTask() of a moved stable ID => %+v, want a new and a moved registration", ds)
+	}
+	m.StableIds = false
+	task.Labels = nil
+	task.SlaveIP = "10.0.0.1"
+
+	// A skip coming back after a registration is recorded again
+	task.SlaveIP = ""
+	m.rotateAuditSkips()
+	m.registerTask(task, "10.0.0.1")
+	if ds := decisions(); len(ds) != 1 || ds[0].Action != audit.Skip {
+		t.Errorf("registerTask() without IP again => %+v, want one skip", ds)
+	}
+}
+
+func TestRegisterTaskAuditNoServices(t *testing.T) {
+	var buf bytes.Buffer
+	audit.SetOutput(&buf)
+	defer audit.SetOutput(nil)
+
+	for _, tt := range []struct {
+		name      string
+		fallback  bool
+		blacklist []string
+		reason    string
+	}{
+		{"...", false, nil, "empty name once cleaned"},
+		{"...", true, []string{"web"}, "name not allowed by --whitelist and --blacklist"},
+		{"web", false, []string{"web"}, "name not allowed by --whitelist and --blacklist"},
+	} {
+		m, _ := newTestMesos()
+		m.EmptyNameFallback = tt.fallback
+		m.TaskPrivilege = NewPrivilege(nil, tt.blacklist)
+		m.rotateAuditSkips()
+		m.registerTask(&state.Task{ID: "web.1", Name: tt.name, State: "TASK_RUNNING", SlaveIP: "10.0.0.1"}, "10.0.0.1")
+
+		var d audit.Decision
+		if err := json.NewDecoder(&buf).Decode(&d); err != nil || d.Reason != tt.reason {
+			t.Errorf("registerTask() of task %q with fallback %t and blacklist %v => %+v, want reason %q", tt.name, tt.fallback, tt.blacklist, d, tt.reason)
+		}
+		buf.Reset()
+	}
+}
@@ -0,0 +1,183 @@
+package mesos
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+var bodyCheckClient = &http.Client{Timeout: 5 * time.Second}
+
+// statusCheckClient doesn't follow redirects so that 3xx codes can be
+// listed in check_ok_status
+var statusCheckClient = &http.Client{
+	Timeout: 5 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// bodyProbeSlots bounds the body probes run at once
+var bodyProbeSlots = make(chan struct{}, 16)
+
+// bodyProbing is the set of services whose body probe is running
+var bodyProbing = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+// bodyProbe is an HTTP check performed by mesos-consul that can match
+// the response body and accept other status codes than 2xx. Its result
+// is pushed to a Consul TTL check.
+type bodyProbe struct {
+	url      string
+	re       *regexp.Regexp
+	okStatus map[int]bool
+}
+
+// newBodyProbe()
+//   Turn the HTTP check of a task with a check_body_regex or
+//   check_ok_status label into a TTL check and return the probe
+//   updating it, or nil when the check is left alone
+//
+func (m *Mesos) newBodyProbe(t *state.Task, c *registry.Check) *bodyProbe {
+	if !m.BodyCheck || c.HTTP == "" {
+		return nil
+	}
+
+	l := t.Label("check_body_regex")
+	s := t.Label("check_ok_status")
+	if l == "" && s == "" {
+		return nil
+	}
+
+	p := &bodyProbe{url: c.HTTP}
+
+	if l != "" {
+		re, err := regexp.Compile(l)
+		if err != nil {
+			log.WithField("check_body_regex", l).Warnf("Invalid body regex for task %s: %s", t.ID, err.Error())
+			return nil
+		}
+		p.re = re
+	}
+
+	if s != "" {
+		okStatus, err := parseOkStatus(s)
+		if err != nil {
+			log.WithField("check_ok_status", s).Warnf("Invalid status codes for task %s: %s", t.ID, err.Error())
+			return nil
+		}
+		p.okStatus = okStatus
+	}
+
+	c.HTTP = ""
+	c.Interval = ""
+	c.Timeout = ""
+	if c.TTL == "" {
+		c.TTL = m.BodyCheckTTL
+	}
+
+	return p
+}
+
+// runBodyProbe()
+//   Probe a service in the background and push the result to its TTL
+//   check, so that slow endpoints don't hold the refresh. A service is
+//   not probed again until its running probe is done.
+//
+func (m *Mesos) runBodyProbe(id string, p *bodyProbe) {
+	bodyProbing.Lock()
+	defer bodyProbing.Unlock()
+
+	if bodyProbing.ids[id] {
+		log.Debugf("Body probe of %s still running. Not probing", id)
+		return
+	}
+	bodyProbing.ids[id] = true
+
+	go func() {
+		bodyProbeSlots <- struct{}{}
+		pass, output := p.run()
+		<-bodyProbeSlots
+
+		m.Registry.UpdateTTL(id, pass, output)
+
+		bodyProbing.Lock()
+		delete(bodyProbing.ids, id)
+		bodyProbing.Unlock()
+	}()
+}
+
+// parseOkStatus()
+//   Parse a comma separated list of HTTP status codes
+//
+func parseOkStatus(s string) (map[int]bool, error) {
+	okStatus := make(map[int]bool)
+
+	for _, code := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(code))
+		if err != nil || n < 100 || n > 599 {
+			return nil, fmt.Errorf("invalid status code '%s'", code)
+		}
+		okStatus[n] = true
+	}
+
+	return okStatus, nil
+}
+
+// statusOk()
+//   Whether the response status passes the check: one of the listed
+//   codes when check_ok_status is set, otherwise a 2xx
+//
+func (p *bodyProbe) statusOk(code int) bool {
+	if p.okStatus != nil {
+		return p.okStatus[code]
+	}
+
+	return code >= 200 && code <= 299
+}
+
+// run()
+//   Probe the endpoint. The check passes on an accepted status whose
+//   body matches the regex, if any.
+//
+func (p *bodyProbe) run() (bool, string) {
+	client := bodyCheckClient
+	if p.okStatus != nil {
+		client = statusCheckClient
+	}
+
+	resp, err := client.Get(p.url)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	if !p.statusOk(resp.StatusCode) {
+		return false, fmt.Sprintf("GET %s: %s", p.url, resp.Status)
+	}
+
+	if p.re == nil {
+		return true, fmt.Sprintf("GET %s: %s", p.url, resp.Status)
+	}
+
+	if !p.re.Match(body) {
+		return false, fmt.Sprintf("GET %s: body does not match %s", p.url, p.re.String())
+	}
+
+	return true, fmt.Sprintf("GET %s: %s, body matches %s", p.url, resp.Status, p.re.String())
+}
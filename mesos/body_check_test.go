@@ -0,0 +1,173 @@
+package mesos
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+func TestBodyProbe(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprint(w, `{"status": "ok"}`)
+	}))
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		path  string
+		regex string
+		pass  bool
+	}{
+		{"/health", `"status": "ok"`, true},
+		{"/health", `"status": "error"`, false},
+		{"/down", `"status": "ok"`, false},
+	} {
+		m, _ := newTestMesos()
+		m.BodyCheck = true
+		m.BodyCheckTTL = "3m0s"
+
+		c := registry.DefaultCheck()
+		c.HTTP = ts.URL + tt.path
+		c.Interval = "10s"
+
+		p := m.newBodyProbe(&state.Task{
+			Labels: []state.Label{{Key: "check_body_regex", Value: tt.regex}},
+		}, c)
+		if p == nil {
+			t.Fatalf("newBodyProbe(%s) => nil", tt.regex)
+		}
+		if c.HTTP != "" || c.TTL != "3m0s" {
+			t.Errorf("newBodyProbe(%s) check => (%s, %s), want TTL check", tt.regex, c.HTTP, c.TTL)
+		}
+
+		if pass, output := p.run(); pass != tt.pass {
+			t.Errorf("run() on %s matching %s => (%t, %s), want %t", tt.path, tt.regex, pass, output, tt.pass)
+		}
+	}
+}
+
+func TestNewBodyProbeDisabled(t *testing.T) {
+	task := &state.Task{
+		Labels: []state.Label{{Key: "check_body_regex", Value: "ok"}},
+	}
+
+	m, _ := newTestMesos()
+	c := registry.DefaultCheck()
+	c.HTTP = "http://10.0.0.1/health"
+
+	if p := m.newBodyProbe(task, c); p != nil || c.HTTP == "" {
+		t.Errorf("newBodyProbe() without --body-check changed the check")
+	}
+}
+
+func TestBodyProbeOkStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		case "/moved":
+			http.Redirect(w, r, "/empty", http.StatusMovedPermanently)
+		}
+	}))
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		path     string
+		okStatus string
+		pass     bool
+	}{
+		{"/empty", "204,301", true},
+		{"/moved", "204,301", true},
+		{"/moved", "204", false},
+		{"/health", "204,301", false},
+	} {
+		m, _ := newTestMesos()
+		m.BodyCheck = true
+
+		c := registry.DefaultCheck()
+		c.HTTP = ts.URL + tt.path
+
+		p := m.newBodyProbe(&state.Task{
+			Labels: []state.Label{{Key: "check_ok_status", Value: tt.okStatus}},
+		}, c)
+		if p == nil {
+			t.Fatalf("newBodyProbe(%s) => nil", tt.okStatus)
+		}
+
+		if pass, output := p.run(); pass != tt.pass {
+			t.Errorf("run() on %s accepting %s => (%t, %s), want %t", tt.path, tt.okStatus, pass, output, tt.pass)
+		}
+	}
+}
+
+func TestParseOkStatus(t *testing.T) {
+	for _, tt := range []struct {
+		s   string
+		r   int
+		err bool
+	}{
+		{"204", 1, false},
+		{"204, 301", 2, false},
+		{"ok", 0, true},
+		{"204,1000", 0, true},
+	} {
+		r, err := parseOkStatus(tt.s)
+		if (err != nil) != tt.err || len(r) != tt.r {
+			t.Errorf("parseOkStatus(%s) => (%v, %v), want %d codes, error %t", tt.s, r, err, tt.r, tt.err)
+		}
+	}
+}
+
+// ttlRegistry sends the TTL updates to a channel
+type ttlRegistry struct {
+	*fakeRegistry
+	ttls chan bool
+}
+
+func (r ttlRegistry) UpdateTTL(_ string, pass bool, _ string) { r.ttls <- pass }
+
+func TestRunBodyProbe(t *testing.T) {
+	release := make(chan struct{})
+	requests := make(chan struct{}, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		<-release
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	m, _ := newTestMesos()
+	r := ttlRegistry{newFakeRegistry(), make(chan bool, 2)}
+	m.Registry = r
+
+	p := &bodyProbe{url: ts.URL, re: regexp.MustCompile("ok")}
+	m.runBodyProbe("web", p)
+	<-requests
+	m.runBodyProbe("web", p)
+	close(release)
+
+	select {
+	case pass := <-r.ttls:
+		if !pass {
+			t.Errorf("runBodyProbe() => fail, want pass")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runBodyProbe() did not update the TTL")
+	}
+
+	select {
+	case <-requests:
+		t.Error("runBodyProbe() of a service being probed probed it again")
+	case <-r.ttls:
+		t.Error("runBodyProbe() of a service being probed updated the TTL again")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
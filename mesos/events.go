@@ -0,0 +1,558 @@
+package mesos
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+// Mesos operator API v1 types, with only the fields needed to build
+// a state.State
+type v1Value struct {
+	Value string `json:"value"`
+}
+
+type v1Labels struct {
+	Labels []state.Label `json:"labels"`
+}
+
+type v1Ranges struct {
+	Range []struct {
+		Begin uint64 `json:"begin"`
+		End   uint64 `json:"end"`
+	} `json:"range"`
+}
+
+// String()
+//   Render the ranges like the /state.json endpoint, e.g. [1-2, 4-4]
+//
+func (r v1Ranges) String() string {
+	s := make([]string, len(r.Range))
+	for i, rg := range r.Range {
+		s[i] = fmt.Sprintf("%d-%d", rg.Begin, rg.End)
+	}
+
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+type v1Resource struct {
+	Name   string   `json:"name"`
+	Ranges v1Ranges `json:"ranges"`
+
+	// Role the resource is allocated to, and the stack of its
+	// reservations, the last one being the most refined
+	AllocationInfo struct {
+		Role string `json:"role"`
+	} `json:"allocation_info"`
+	Reservations []struct {
+		Role string `json:"role"`
+	} `json:"reservations"`
+}
+
+type v1Attribute struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Scalar struct {
+		Value float64 `json:"value"`
+	} `json:"scalar"`
+	Text struct {
+		Value string `json:"value"`
+	} `json:"text"`
+	Set struct {
+		Item []string `json:"item"`
+	} `json:"set"`
+	Ranges v1Ranges `json:"ranges"`
+}
+
+type v1Status struct {
+	TaskID          v1Value               `json:"task_id"`
+	State           string                `json:"state"`
+	Timestamp       float64               `json:"timestamp"`
+	Labels          v1Labels              `json:"labels"`
+	ContainerStatus state.ContainerStatus `json:"container_status"`
+}
+
+type v1Task struct {
+	Name        string              `json:"name"`
+	TaskID      v1Value             `json:"task_id"`
+	FrameworkID v1Value             `json:"framework_id"`
+	AgentID     v1Value             `json:"agent_id"`
+	ExecutorID  v1Value             `json:"executor_id"`
+	State       string              `json:"state"`
+	Resources   []v1Resource        `json:"resources"`
+	Statuses    []v1Status          `json:"statuses"`
+	Labels      v1Labels            `json:"labels"`
+	Discovery   state.DiscoveryInfo `json:"discovery"`
+	HealthCheck *state.HealthCheck  `json:"health_check"`
+	Container   *state.Container    `json:"container"`
+}
+
+type v1Agent struct {
+	AgentInfo struct {
+		ID         v1Value       `json:"id"`
+		Hostname   string        `json:"hostname"`
+		Attributes []v1Attribute `json:"attributes"`
+	} `json:"agent_info"`
+	PID string `json:"pid"`
+}
+
+type v1FrameworkInfo struct {
+	ID       v1Value `json:"id"`
+	Name     string  `json:"name"`
+	Hostname string  `json:"hostname"`
+	WebuiURL string  `json:"webui_url"`
+}
+
+type v1Framework struct {
+	FrameworkInfo v1FrameworkInfo `json:"framework_info"`
+	Active        bool            `json:"active"`
+}
+
+type v1State struct {
+	GetTasks struct {
+		Tasks          []v1Task `json:"tasks"`
+		CompletedTasks []v1Task `json:"completed_tasks"`
+	} `json:"get_tasks"`
+	GetAgents struct {
+		Agents []v1Agent `json:"agents"`
+	} `json:"get_agents"`
+	GetFrameworks struct {
+		Frameworks []v1Framework `json:"frameworks"`
+	} `json:"get_frameworks"`
+}
+
+type v1Event struct {
+	Type string `json:"type"`
+
+	Subscribed struct {
+		GetState                 v1State `json:"get_state"`
+		HeartbeatIntervalSeconds float64 `json:"heartbeat_interval_seconds"`
+	} `json:"subscribed"`
+	TaskAdded struct {
+		Task v1Task `json:"task"`
+	} `json:"task_added"`
+	TaskUpdated struct {
+		FrameworkID v1Value  `json:"framework_id"`
+		Status      v1Status `json:"status"`
+		State       string   `json:"state"`
+	} `json:"task_updated"`
+	AgentAdded struct {
+		Agent v1Agent `json:"agent"`
+	} `json:"agent_added"`
+	AgentRemoved struct {
+		AgentID v1Value `json:"agent_id"`
+	} `json:"agent_removed"`
+	FrameworkAdded struct {
+		Framework v1Framework `json:"framework"`
+	} `json:"framework_added"`
+	FrameworkUpdated struct {
+		Framework v1Framework `json:"framework"`
+	} `json:"framework_updated"`
+	FrameworkRemoved struct {
+		FrameworkInfo v1FrameworkInfo `json:"framework_info"`
+	} `json:"framework_removed"`
+}
+
+func (s v1Status) toState() state.Status {
+	return state.Status{
+		Timestamp:       s.Timestamp,
+		State:           s.State,
+		Labels:          s.Labels.Labels,
+		ContainerStatus: s.ContainerStatus,
+	}
+}
+
+func (t v1Task) toState() state.Task {
+	task := state.Task{
+		FrameworkID:   t.FrameworkID.Value,
+		ID:            t.TaskID.Value,
+		Name:          t.Name,
+		SlaveID:       t.AgentID.Value,
+		ExecutorID:    t.ExecutorID.Value,
+		State:         t.State,
+		Labels:        t.Labels.Labels,
+		DiscoveryInfo: t.Discovery,
+		HealthCheck:   t.HealthCheck,
+		Container:     t.Container,
+	}
+
+	for _, r := range t.Resources {
+		if r.Name == "ports" {
+			task.PortRanges = r.Ranges.String()
+		}
+		if task.Role == "" {
+			task.Role = r.AllocationInfo.Role
+		}
+		for _, rv := range r.Reservations {
+			task.ReservationRoles = append(task.ReservationRoles, rv.Role)
+		}
+	}
+	for _, s := range t.Statuses {
+		task.Statuses = append(task.Statuses, s.toState())
+	}
+
+	return task
+}
+
+func (a v1Agent) toState() state.Slave {
+	slave := state.Slave{
+		ID:         a.AgentInfo.ID.Value,
+		Hostname:   a.AgentInfo.Hostname,
+		Attributes: make(map[string]interface{}),
+	}
+
+	if a.PID != "" {
+		if err := slave.PID.UnmarshalJSON([]byte(a.PID)); err != nil {
+			log.Warnf("Invalid PID %s of agent %s: %s", a.PID, slave.ID, err.Error())
+		}
+	}
+
+	for _, attr := range a.AgentInfo.Attributes {
+		switch attr.Type {
+		case "SCALAR":
+			slave.Attributes[attr.Name] = attr.Scalar.Value
+		case "TEXT":
+			slave.Attributes[attr.Name] = attr.Text.Value
+		case "SET":
+			slave.Attributes[attr.Name] = "{" + strings.Join(attr.Set.Item, ",") + "}"
+		case "RANGES":
+			slave.Attributes[attr.Name] = attr.Ranges.String()
+		}
+	}
+
+	return slave
+}
+
+func (f v1Framework) toState() state.Framework {
+	return state.Framework{
+		ID:       f.FrameworkInfo.ID.Value,
+		Name:     f.FrameworkInfo.Name,
+		Hostname: f.FrameworkInfo.Hostname,
+		WebuiURL: f.FrameworkInfo.WebuiURL,
+		Active:   f.Active,
+	}
+}
+
+// eventState is the Mesos state maintained from the event stream
+type eventState struct {
+	frameworks map[string]state.Framework
+	agents     map[string]state.Slave
+	tasks      map[string]state.Task
+
+	// Leader and maintenance status of the last full sync
+	base state.State
+
+	// Whether events were applied since the last sync, and the IDs of
+	// the tasks they affected
+	dirty   bool
+	changed map[string]bool
+}
+
+func newEventState() *eventState {
+	return &eventState{
+		frameworks: make(map[string]state.Framework),
+		agents:     make(map[string]state.Slave),
+		tasks:      make(map[string]state.Task),
+		changed:    make(map[string]bool),
+	}
+}
+
+// reset()
+//   Replace the state with the one of a full sync
+//
+func (es *eventState) reset(sj state.State) {
+	*es = *newEventState()
+	es.base = state.State{Leader: sj.Leader, Maintenance: sj.Maintenance}
+
+	for _, f := range sj.Slaves {
+		es.agents[f.ID] = f
+	}
+	for _, fw := range sj.Frameworks {
+		for _, tasks := range [][]state.Task{fw.Tasks, fw.CompletedTasks} {
+			for _, t := range tasks {
+				if t.FrameworkID == "" {
+					t.FrameworkID = fw.ID
+				}
+				es.tasks[t.ID] = t
+			}
+		}
+		fw.Tasks, fw.CompletedTasks = nil, nil
+		es.frameworks[fw.ID] = fw
+	}
+}
+
+// apply()
+//   Update the state with an event. Returns whether the event
+//   changed the state.
+//
+func (es *eventState) apply(e *v1Event) bool {
+	switch e.Type {
+	case "SUBSCRIBED":
+		base := es.base
+		*es = *newEventState()
+		es.base = base
+
+		gs := e.Subscribed.GetState
+		for _, a := range gs.GetAgents.Agents {
+			es.addAgent(a)
+		}
+		for _, f := range gs.GetFrameworks.Frameworks {
+			es.frameworks[f.FrameworkInfo.ID.Value] = f.toState()
+		}
+		for _, tasks := range [][]v1Task{gs.GetTasks.Tasks, gs.GetTasks.CompletedTasks} {
+			for _, t := range tasks {
+				es.tasks[t.TaskID.Value] = t.toState()
+			}
+		}
+		es.touch(func(state.Task) bool { return true })
+	case "TASK_ADDED":
+		t := e.TaskAdded.Task.toState()
+		es.tasks[t.ID] = t
+		es.changed[t.ID] = true
+	case "TASK_UPDATED":
+		u := e.TaskUpdated
+		t, ok := es.tasks[u.Status.TaskID.Value]
+		if !ok {
+			log.Debugf("Update of unknown task %s", u.Status.TaskID.Value)
+			return false
+		}
+		t.State = u.State
+		t.Statuses = append(t.Statuses, u.Status.toState())
+		es.tasks[t.ID] = t
+		es.changed[t.ID] = true
+	case "AGENT_ADDED":
+		f := es.addAgent(e.AgentAdded.Agent)
+		es.touch(func(t state.Task) bool { return t.SlaveID == f.ID })
+	case "AGENT_REMOVED":
+		id := e.AgentRemoved.AgentID.Value
+		delete(es.agents, id)
+		es.touch(func(t state.Task) bool { return t.SlaveID == id })
+	case "FRAMEWORK_ADDED":
+		f := e.FrameworkAdded.Framework.toState()
+		es.frameworks[f.ID] = f
+		es.touch(func(t state.Task) bool { return t.FrameworkID == f.ID })
+	case "FRAMEWORK_UPDATED":
+		f := e.FrameworkUpdated.Framework.toState()
+		es.frameworks[f.ID] = f
+		es.touch(func(t state.Task) bool { return t.FrameworkID == f.ID })
+	case "FRAMEWORK_REMOVED":
+		id := e.FrameworkRemoved.FrameworkInfo.ID.Value
+		delete(es.frameworks, id)
+		es.touch(func(t state.Task) bool { return t.FrameworkID == id })
+	default:
+		return false
+	}
+
+	es.dirty = true
+	return true
+}
+
+func (es *eventState) addAgent(a v1Agent) state.Slave {
+	f := a.toState()
+	es.agents[f.ID] = f
+
+	return f
+}
+
+// touch()
+//   Mark the tasks matching fn as changed
+//
+func (es *eventState) touch(fn func(state.Task) bool) {
+	for id, t := range es.tasks {
+		if fn(t) {
+			es.changed[id] = true
+		}
+	}
+}
+
+// take()
+//   Return the state to register from and the IDs of the tasks changed
+//   since the last call, and clear them
+//
+func (es *eventState) take() (state.State, map[string]bool) {
+	changed := es.changed
+	es.dirty = false
+	es.changed = make(map[string]bool)
+
+	return es.snapshot(), changed
+}
+
+// snapshot()
+//   Build the state.State to register from. Tasks in a terminal state
+//   are listed as completed tasks of their framework.
+//
+func (es *eventState) snapshot() state.State {
+	sj := es.base
+
+	var agents []string
+	for id := range es.agents {
+		agents = append(agents, id)
+	}
+	sort.Strings(agents)
+	for _, id := range agents {
+		sj.Slaves = append(sj.Slaves, es.agents[id])
+	}
+
+	fws := make(map[string]*state.Framework)
+	var ids []string
+	for id, fw := range es.frameworks {
+		fw := fw
+		fws[id] = &fw
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var tasks []string
+	for id := range es.tasks {
+		tasks = append(tasks, id)
+	}
+	sort.Strings(tasks)
+
+	for _, id := range tasks {
+		t := es.tasks[id]
+		fw, ok := fws[t.FrameworkID]
+		if !ok {
+			// Tasks of removed frameworks are not registered
+			continue
+		}
+		if isTerminal(&t) {
+			fw.CompletedTasks = append(fw.CompletedTasks, t)
+		} else {
+			fw.Tasks = append(fw.Tasks, t)
+		}
+	}
+
+	for _, id := range ids {
+		sj.Frameworks = append(sj.Frameworks, *fws[id])
+	}
+
+	return sj
+}
+
+// readRecord()
+//   Read a RecordIO record, its length in decimal and a newline
+//   followed by the record itself
+//
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid RecordIO length '%s'", strings.TrimSpace(line))
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// WatchEvents()
+//   Keep the services up to date from the event stream of the Mesos
+//   leader, reconnecting when the stream ends. The periodic refresh
+//   still runs a full sync to reconcile missed events, and is the only
+//   one sweeping the cache.
+//
+func (m *Mesos) WatchEvents() {
+	go m.syncEvents()
+
+	for {
+		mh := m.getLeader()
+		if mh.Ip == "" {
+			log.Warn("No master in zookeeper to subscribe to")
+		} else {
+			url := "http://" + mh.Ip + ":" + mh.PortString + "/api/v1"
+			log.Info("Subscribing to the event stream of ", url)
+			if err := m.subscribe(url); err != nil {
+				log.Warn("Event stream failed: ", err.Error())
+			}
+		}
+
+		time.Sleep(m.StateFetchDelay)
+	}
+}
+
+// syncEvents()
+//   Register and deregister the tasks changed by the events once per
+//   second at most, so that bursts of events are batched
+//
+func (m *Mesos) syncEvents() {
+	for range time.Tick(time.Second) {
+		m.configLock.Lock()
+		// A paused refresh resets the events, so they are registered
+		// by the first refresh after the pause
+		if m.events.dirty && !m.paused {
+			m.span = m.Tracer.Start("event sync")
+			m.syncTasks(m.events.take())
+			m.span.End()
+		}
+		m.configLock.Unlock()
+	}
+}
+
+// subscribe()
+//   Apply the events of the operator API at url until the stream
+//   ends or stops sending heartbeats
+//
+func (m *Mesos) subscribe(url string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader([]byte(`{"type": "SUBSCRIBE"}`)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("subscribe to %s: %s", url, resp.Status)
+	}
+
+	// Close the stream when heartbeats are missed
+	timeout := 45 * time.Second
+	watchdog := time.AfterFunc(timeout, func() { resp.Body.Close() })
+	defer watchdog.Stop()
+
+	r := bufio.NewReader(resp.Body)
+	for {
+		b, err := readRecord(r)
+		if err != nil {
+			return err
+		}
+		watchdog.Reset(timeout)
+
+		var e v1Event
+		if err := json.Unmarshal(b, &e); err != nil {
+			log.Warn("Invalid event: ", err.Error())
+			continue
+		}
+		log.Debugf("Received %s event", e.Type)
+
+		if e.Type == "SUBSCRIBED" && e.Subscribed.HeartbeatIntervalSeconds > 0 {
+			timeout = 3 * time.Duration(e.Subscribed.HeartbeatIntervalSeconds*float64(time.Second))
+			watchdog.Reset(timeout)
+		}
+
+		m.configLock.Lock()
+		m.events.apply(&e)
+		m.configLock.Unlock()
+	}
+}
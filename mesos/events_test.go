@@ -0,0 +1,160 @@
+package mesos
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/state"
+	"github.com/mesos/mesos-go/upid"
+)
+
+var testEvents = []string{
+	`{"type": "SUBSCRIBED", "subscribed": {"heartbeat_interval_seconds": 15, "get_state": {
+		"get_agents": {"agents": [{"agent_info": {"id": {"value": "S1"}, "hostname": "agent1",
+			"attributes": [{"name": "zones", "type": "SET", "set": {"item": ["a", "b"]}}]},
+			"pid": "slave(1)@10.0.0.1:5051"}]},
+		"get_frameworks": {"frameworks": [{"framework_info": {"id": {"value": "F1"}, "name": "marathon"}, "active": true}]},
+		"get_tasks": {"tasks": [{"name": "web", "task_id": {"value": "web.1"}, "framework_id": {"value": "F1"},
+			"agent_id": {"value": "S1"}, "state": "TASK_RUNNING",
+			"resources": [{"name": "ports", "type": "RANGES", "ranges": {"range": [{"begin": 31000, "end": 31001}]},
+				"allocation_info": {"role": "eng/web"}, "reservations": [{"role": "eng"}, {"role": "eng/web"}]}],
+			"labels": {"labels": [{"key": "tag", "value": "v1"}]}}]}}}}`,
+	`{"type": "HEARTBEAT"}`,
+	`{"type": "TASK_ADDED", "task_added": {"task": {"name": "db", "task_id": {"value": "db.1"},
+		"framework_id": {"value": "F1"}, "agent_id": {"value": "S1"}, "state": "TASK_STAGING"}}}`,
+	`{"type": "TASK_UPDATED", "task_updated": {"framework_id": {"value": "F1"}, "state": "TASK_KILLED",
+		"status": {"task_id": {"value": "web.1"}, "state": "TASK_KILLED", "timestamp": 2}}}`,
+}
+
+func TestSubscribe(t *testing.T) {
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/v1" {
+			http.NotFound(w, r)
+			return
+		}
+		for _, e := range testEvents {
+			fmt.Fprintf(w, "%d\n%s", len(e), e)
+		}
+	}))
+	defer master.Close()
+
+	m, _ := newTestMesos()
+	m.events = newEventState()
+
+	if err := m.subscribe(master.URL + "/api/v1"); err == nil {
+		t.Error("subscribe() after the end of the stream => nil, want error")
+	}
+	if !m.events.dirty {
+		t.Error("subscribe() did not mark the events as dirty")
+	}
+
+	sj := m.events.snapshot()
+	if len(sj.Slaves) != 1 || sj.Slaves[0].PID.Host != "10.0.0.1" {
+		t.Fatalf("snapshot() agents => %+v, want agent1 on 10.0.0.1", sj.Slaves)
+	}
+	if zones := sj.Slaves[0].Attribute("zones"); len(zones) != 2 {
+		t.Errorf("snapshot() agent zones => %v, want [a b]", zones)
+	}
+	if len(sj.Frameworks) != 1 || sj.Frameworks[0].Name != "marathon" {
+		t.Fatalf("snapshot() frameworks => %+v, want marathon", sj.Frameworks)
+	}
+
+	fw := sj.Frameworks[0]
+	if len(fw.Tasks) != 1 || fw.Tasks[0].ID != "db.1" {
+		t.Errorf("snapshot() tasks => %+v, want db.1", fw.Tasks)
+	}
+	if len(fw.CompletedTasks) != 1 || fw.CompletedTasks[0].ID != "web.1" {
+		t.Fatalf("snapshot() completed tasks => %+v, want web.1", fw.CompletedTasks)
+	}
+
+	web := fw.CompletedTasks[0]
+	if ports := web.Ports(); len(ports) != 2 || ports[0] != "31000" {
+		t.Errorf("snapshot() web.1 ports => %v, want [31000 31001]", ports)
+	}
+	if web.Label("tag") != "v1" || len(web.Statuses) != 1 {
+		t.Errorf("snapshot() web.1 => %+v, want tag label and one status", web)
+	}
+	if roles := web.Roles(); len(roles) != 2 || roles[0] != "eng" || roles[1] != "eng/web" {
+		t.Errorf("snapshot() web.1 roles => %v, want [eng eng/web]", roles)
+	}
+}
+
+func TestReadRecordInvalid(t *testing.T) {
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "x\n{}")
+	}))
+	defer master.Close()
+
+	m, _ := newTestMesos()
+	m.events = newEventState()
+
+	if err := m.subscribe(master.URL); err == nil || m.events.dirty {
+		t.Errorf("subscribe() of an invalid stream => %v, dirty %t, want error", err, m.events.dirty)
+	}
+}
+
+func TestSyncTasks(t *testing.T) {
+	m, r := newTestMesos()
+	m.events = newEventState()
+
+	sj := state.State{
+		Slaves: []state.Slave{{
+			ID:       "S1",
+			Hostname: "agent1",
+			PID:      state.PID{UPID: &upid.UPID{ID: "slave(1)", Host: "10.0.0.1", Port: "5051"}},
+		}},
+		Frameworks: []state.Framework{{
+			ID: "F1",
+			Tasks: []state.Task{
+				{ID: "web.1", Name: "web", State: "TASK_RUNNING", SlaveID: "S1"},
+				{ID: "db.1", Name: "db", State: "TASK_RUNNING", SlaveID: "S1"},
+			},
+		}},
+	}
+	m.parseState(sj)
+	m.events.reset(sj)
+
+	registered := func(name string) bool {
+		for _, s := range r.services {
+			if s.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+	if !registered("web") || !registered("db") || r.sweeps != 1 {
+		t.Fatalf("parseState() => %v, %d sweeps, want web and db registered", r.services, r.sweeps)
+	}
+
+	// Services unchanged by the events are left alone
+	for id, s := range r.services {
+		if s.Name == "web" {
+			delete(r.services, id)
+		}
+	}
+
+	var e v1Event
+	json.Unmarshal([]byte(`{"type": "TASK_UPDATED", "task_updated": {"framework_id": {"value": "F1"}, "state": "TASK_KILLED",
+		"status": {"task_id": {"value": "db.1"}, "state": "TASK_KILLED", "timestamp": 2}}}`), &e)
+	if !m.events.apply(&e) {
+		t.Fatal("apply() of the db.1 update => false, want true")
+	}
+
+	m.syncTasks(m.events.take())
+
+	if registered("web") {
+		t.Error("syncTasks() registered web.1, unchanged by the events")
+	}
+	if registered("db") {
+		t.Error("syncTasks() kept the service of the killed db.1")
+	}
+	if r.sweeps != 1 {
+		t.Errorf("syncTasks() swept the cache, want it left to the refresh")
+	}
+	if m.events.dirty || len(m.events.changed) != 0 {
+		t.Error("take() did not clear the changed tasks")
+	}
+}
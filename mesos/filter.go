@@ -0,0 +1,348 @@
+package mesos
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+// RegisterFilter is a compiled --register-filter expression, e.g.
+// labels.env == "prod" && labels["tier"] != "batch". It compares the
+// task labels and the tag template task fields to strings with ==, !=
+// and the =~, !~ regex matches, combined with &&, || and !. A reference
+// alone is true when its value is not empty.
+type RegisterFilter struct {
+	expr string
+	root filterNode
+}
+
+// filterNode is a boolean node of a filter expression, evaluated with
+// the task references resolved by get
+type filterNode interface {
+	eval(get func(source, key string) string) bool
+}
+
+// filterOperand is a task reference, or a string literal if source is
+// empty
+type filterOperand struct {
+	source string
+	key    string
+}
+
+func (o filterOperand) value(get func(source, key string) string) string {
+	if o.source == "" {
+		return o.key
+	}
+
+	return get(o.source, o.key)
+}
+
+type filterNot struct{ x filterNode }
+
+type filterAnd struct{ x, y filterNode }
+
+type filterOr struct{ x, y filterNode }
+
+type filterSet struct{ x filterOperand }
+
+type filterCompare struct {
+	x, y filterOperand
+	neq  bool
+}
+
+type filterMatch struct {
+	x   filterOperand
+	re  *regexp.Regexp
+	neg bool
+}
+
+func (n filterNot) eval(get func(string, string) string) bool { return !n.x.eval(get) }
+func (n filterAnd) eval(get func(string, string) string) bool { return n.x.eval(get) && n.y.eval(get) }
+func (n filterOr) eval(get func(string, string) string) bool  { return n.x.eval(get) || n.y.eval(get) }
+func (n filterSet) eval(get func(string, string) string) bool { return n.x.value(get) != "" }
+
+func (n filterCompare) eval(get func(string, string) string) bool {
+	return (n.x.value(get) == n.y.value(get)) != n.neq
+}
+
+func (n filterMatch) eval(get func(string, string) string) bool {
+	return n.re.MatchString(n.x.value(get)) != n.neg
+}
+
+// NewRegisterFilter()
+//   Compile a filter expression, nil if it is empty
+//
+func NewRegisterFilter(expr string) (*RegisterFilter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+
+	toks, err := filterTokens(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{toks: toks}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected '%s'", p.toks[p.pos])
+	}
+
+	return &RegisterFilter{expr: expr, root: root}, nil
+}
+
+// String()
+//   The source expression of the filter
+//
+func (f *RegisterFilter) String() string {
+	return f.expr
+}
+
+// match()
+//   Whether the task matches the filter
+//
+func (f *RegisterFilter) match(m *Mesos, t *state.Task) bool {
+	return f.root.eval(func(source, key string) string {
+		v, _ := m.templateField(t, source, key)
+		return v
+	})
+}
+
+// filterTokens()
+//   Split a filter expression into identifiers, quoted strings and
+//   operators
+//
+func filterTokens(expr string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '`':
+			end := i + 1
+			for end < len(expr) && rune(expr[end]) != c {
+				if c == '"' && expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			toks = append(toks, expr[i:end+1])
+			i = end + 1
+		case c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			end := i
+			for end < len(expr) && (expr[end] == '_' || unicode.IsLetter(rune(expr[end])) || unicode.IsDigit(rune(expr[end]))) {
+				end++
+			}
+			toks = append(toks, expr[i:end])
+			i = end
+		default:
+			op := ""
+			for _, o := range []string{"&&", "||", "==", "!=", "=~", "!~", "!", "(", ")", "[", "]", "."} {
+				if strings.HasPrefix(expr[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected '%c' at offset %d", c, i)
+			}
+			toks = append(toks, op)
+			i += len(op)
+		}
+	}
+
+	return toks, nil
+}
+
+// filterParser is a recursive descent parser of the filter tokens
+type filterParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+
+	return ""
+}
+
+func (p *filterParser) next() (string, error) {
+	if p.pos >= len(p.toks) {
+		return "", fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+
+	return p.toks[p.pos-1], nil
+}
+
+func (p *filterParser) expect(tok string) error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	if t != tok {
+		return fmt.Errorf("expected '%s', got '%s'", tok, t)
+	}
+
+	return nil
+}
+
+func (p *filterParser) or() (filterNode, error) {
+	x, err := p.and()
+	for err == nil && p.peek() == "||" {
+		p.pos++
+		var y filterNode
+		if y, err = p.and(); err == nil {
+			x = filterOr{x, y}
+		}
+	}
+
+	return x, err
+}
+
+func (p *filterParser) and() (filterNode, error) {
+	x, err := p.unary()
+	for err == nil && p.peek() == "&&" {
+		p.pos++
+		var y filterNode
+		if y, err = p.unary(); err == nil {
+			x = filterAnd{x, y}
+		}
+	}
+
+	return x, err
+}
+
+func (p *filterParser) unary() (filterNode, error) {
+	switch p.peek() {
+	case "!":
+		p.pos++
+		x, err := p.unary()
+		return filterNot{x}, err
+	case "(":
+		p.pos++
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	}
+
+	return p.comparison()
+}
+
+func (p *filterParser) comparison() (filterNode, error) {
+	x, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.peek()
+	switch op {
+	case "==", "!=":
+		p.pos++
+		y, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return filterCompare{x: x, y: y, neq: op == "!="}, nil
+	case "=~", "!~":
+		p.pos++
+		y, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		if y.source != "" {
+			return nil, fmt.Errorf("the right side of %s must be a string", op)
+		}
+		re, err := regexp.Compile(y.key)
+		if err != nil {
+			return nil, err
+		}
+		return filterMatch{x: x, re: re, neg: op == "!~"}, nil
+	}
+
+	if x.source == "" {
+		return nil, fmt.Errorf("string %q is not a condition", x.key)
+	}
+
+	return filterSet{x}, nil
+}
+
+// operand()
+//   Parse a string literal, labels.<key>, labels["<key>"] or
+//   task.<field>
+//
+func (p *filterParser) operand() (filterOperand, error) {
+	tok, err := p.next()
+	if err != nil {
+		return filterOperand{}, err
+	}
+
+	switch tok {
+	case "labels":
+		if p.peek() == "[" {
+			p.pos++
+			key, err := p.next()
+			if err != nil {
+				return filterOperand{}, err
+			}
+			s, err := strconv.Unquote(key)
+			if err != nil {
+				return filterOperand{}, fmt.Errorf("expected a quoted label key, got '%s'", key)
+			}
+			return filterOperand{source: "label", key: s}, p.expect("]")
+		}
+		if err := p.expect("."); err != nil {
+			return filterOperand{}, err
+		}
+		key, err := p.next()
+		if err != nil {
+			return filterOperand{}, err
+		}
+		if !isFilterIdent(key) {
+			return filterOperand{}, fmt.Errorf("expected a label key, got '%s'", key)
+		}
+		return filterOperand{source: "label", key: key}, nil
+	case "task":
+		if err := p.expect("."); err != nil {
+			return filterOperand{}, err
+		}
+		field, err := p.next()
+		if err != nil {
+			return filterOperand{}, err
+		}
+		if !sliceContainsString(tagTemplateFields, field) {
+			return filterOperand{}, fmt.Errorf("unknown task field '%s', must be one of %s", field, strings.Join(tagTemplateFields, ", "))
+		}
+		return filterOperand{source: "task", key: field}, nil
+	}
+
+	if tok[0] == '"' || tok[0] == '`' {
+		s, err := strconv.Unquote(tok)
+		if err != nil {
+			return filterOperand{}, fmt.Errorf("invalid string %s", tok)
+		}
+		return filterOperand{key: s}, nil
+	}
+
+	return filterOperand{}, fmt.Errorf("unexpected '%s', must be a string, labels.<key> or task.<field>", tok)
+}
+
+func isFilterIdent(tok string) bool {
+	c := rune(tok[0])
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
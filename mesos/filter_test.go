@@ -0,0 +1,90 @@
+package mesos
+
+import (
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+func TestRegisterFilter(t *testing.T) {
+	m, _ := newTestMesos()
+	m.Frameworks = map[string]string{"F1": "marathon-prod"}
+
+	task := &state.Task{
+		ID:          "web.1",
+		Name:        "web",
+		FrameworkID: "F1",
+		Labels: []state.Label{
+			{Key: "env", Value: "prod"},
+			{Key: "tier", Value: "front"},
+			{Key: "com.example.team", Value: "search"},
+		},
+	}
+
+	for _, tt := range []struct {
+		expr  string
+		match bool
+	}{
+		{`labels.env == "prod" && labels.tier != "batch"`, true},
+		{`labels.env == "prod" && labels.tier == "batch"`, false},
+		{`labels.env == "dev" || labels.tier == "front"`, true},
+		{`!(labels.env == "prod")`, false},
+		{`labels["com.example.team"] == "search"`, true},
+		{`task.framework =~ "^marathon" && task.name !~ "^db"`, true},
+		{"task.id =~ `\\.1$`", true},
+		{`labels.public`, false},
+		{`!labels.public && labels.env`, true},
+		{`labels.env == "dev" || labels.tier == "front" && labels.env == "dev"`, false},
+		{`task.name == labels.tier`, false},
+	} {
+		f, err := NewRegisterFilter(tt.expr)
+		if err != nil {
+			t.Errorf("NewRegisterFilter(%s) => %v", tt.expr, err)
+			continue
+		}
+		if match := f.match(m, task); match != tt.match {
+			t.Errorf("NewRegisterFilter(%s).match() => %t, want %t", tt.expr, match, tt.match)
+		}
+	}
+
+	for _, expr := range []string{
+		`labels.env ==`,
+		`labels.env == "prod`,
+		`(labels.env == "prod"`,
+		`labels.env = "prod"`,
+		`task.owner == "me"`,
+		`labels.env =~ "("`,
+		`labels.env =~ labels.tier`,
+		`"prod"`,
+		`labels.env labels.tier`,
+	} {
+		if _, err := NewRegisterFilter(expr); err == nil {
+			t.Errorf("NewRegisterFilter(%s) => nil, want error", expr)
+		}
+	}
+
+	if f, err := NewRegisterFilter(" "); f != nil || err != nil {
+		t.Errorf("NewRegisterFilter() of an empty expression => %v, %v, want nil", f, err)
+	}
+}
+
+func TestRegisterTaskFilter(t *testing.T) {
+	m, r := newTestMesos()
+	m.RegisterFilter, _ = NewRegisterFilter(`labels.env == "prod"`)
+
+	task := &state.Task{
+		ID:      "web.1",
+		Name:    "web",
+		State:   "TASK_RUNNING",
+		SlaveIP: "10.0.0.1",
+		Labels:  []state.Label{{Key: "env", Value: "dev"}},
+	}
+	if ids := m.registerTask(task, "10.0.0.1"); len(ids) != 0 || len(r.services) != 0 {
+		t.Errorf("registerTask() of a task not matching the filter => %v, want none", ids)
+	}
+
+	task.Labels[0].Value = "prod"
+	if ids := m.registerTask(task, "10.0.0.1"); len(ids) != 1 {
+		t.Errorf("registerTask() of a task matching the filter => %v, want 1 service", ids)
+	}
+}
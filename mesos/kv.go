@@ -0,0 +1,167 @@
+package mesos
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+// frameworkKV is the value written to Consul KV for each framework.
+type frameworkKV struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Active    bool   `json:"active"`
+	Hostname  string `json:"hostname"`
+	LeaderURL string `json:"leader_url"`
+	Tasks     int    `json:"tasks"`
+}
+
+// frameworksKV()
+//   Build the <prefix>/frameworks/<name> keys describing the frameworks
+//
+func frameworksKV(prefix string, frameworks []state.Framework) map[string][]byte {
+	kv := make(map[string][]byte)
+
+	for _, fw := range frameworks {
+		leader := fw.WebuiURL
+		if leader == "" {
+			if host, port := fw.HostPort(); port != "" {
+				leader = fmt.Sprintf("http://%s:%s", host, port)
+			}
+		}
+
+		v, err := json.Marshal(frameworkKV{
+			ID:        fw.ID,
+			Name:      fw.Name,
+			Active:    fw.Active,
+			Hostname:  fw.Hostname,
+			LeaderURL: leader,
+			Tasks:     len(fw.Tasks),
+		})
+		if err != nil {
+			log.WithField("framework", fw.Name).Warn("Unable to encode framework: ", err.Error())
+			continue
+		}
+
+		key := fmt.Sprintf("%s/frameworks/%s", strings.TrimSuffix(prefix, "/"), cleanName(fw.Name, "_"))
+		kv[key] = v
+	}
+
+	return kv
+}
+
+// clusterInfoKV()
+//   Build the <prefix>/cluster/version and <prefix>/cluster/name keys
+//   from the Mesos state, leaving out the empty ones
+//
+func clusterInfoKV(prefix string, sj state.State) map[string][]byte {
+	kv := make(map[string][]byte)
+
+	prefix = strings.TrimSuffix(prefix, "/") + "/cluster/"
+	if sj.Version != "" {
+		kv[prefix+"version"] = []byte(sj.Version)
+	}
+	if sj.Cluster != "" {
+		kv[prefix+"name"] = []byte(sj.Cluster)
+	}
+
+	return kv
+}
+
+// syncClusterInfoKV()
+//   Write the Mesos version and cluster name under kv-prefix. Errors
+//   are logged and don't fail the refresh.
+//
+func (m *Mesos) syncClusterInfoKV(sj state.State) {
+	kvPrefix := m.kvPrefix()
+
+	err := m.Registry.KVSync(m.getLeader().Ip, kvPrefix+"/cluster", clusterInfoKV(kvPrefix, sj))
+	if err != nil {
+		log.Warn("Unable to sync the cluster info to Consul KV: ", err.Error())
+	}
+}
+
+// checkPaused()
+//   Read the pause-kv-key and pause the registrations while it is set
+//   to anything but false, 0, no or off. The last state is kept when
+//   the key can't be read.
+//
+func (m *Mesos) checkPaused() {
+	mh, err := m.leader()
+	if err != nil {
+		log.Warnf("Unable to read the pause key %s, registrations stay %s: %s", m.PauseKVKey, pausedState(m.paused), err.Error())
+		return
+	}
+
+	v, ok, err := m.Registry.KVGet(mh.Ip, m.PauseKVKey)
+	if err != nil {
+		log.Warnf("Unable to read the pause key %s, registrations stay %s: %s", m.PauseKVKey, pausedState(m.paused), err.Error())
+		return
+	}
+
+	paused := ok && kvTruthy(v)
+	if paused != m.paused {
+		log.Warnf("Registrations %s by Consul KV key %s", pausedState(paused), m.PauseKVKey)
+	}
+	m.setPaused(paused)
+}
+
+// setPaused()
+//   Record whether the registrations are paused
+//
+func (m *Mesos) setPaused(paused bool) {
+	m.paused = paused
+	if paused {
+		registrationPaused.Set(1)
+	} else {
+		registrationPaused.Set(0)
+	}
+}
+
+func pausedState(paused bool) string {
+	if paused {
+		return "paused"
+	}
+	return "resumed"
+}
+
+// kvTruthy()
+//   Whether a KV value is set, i.e. not false, 0, no or off. An empty
+//   value is set, so that creating the key is enough.
+//
+func kvTruthy(v []byte) bool {
+	switch strings.ToLower(strings.TrimSpace(string(v))) {
+	case "false", "0", "no", "off":
+		return false
+	}
+
+	return true
+}
+
+// kvPrefix()
+//   The kv-prefix, followed by the Mesos cluster name if any
+//
+func (m *Mesos) kvPrefix() string {
+	kvPrefix := strings.TrimSuffix(m.KVPrefix, "/")
+	if m.Cluster != "" {
+		kvPrefix += "/" + m.Cluster
+	}
+
+	return kvPrefix
+}
+
+// syncFrameworksKV()
+//   Mirror the frameworks in Consul KV under kv-prefix, followed by the
+//   Mesos cluster name if any
+//
+func (m *Mesos) syncFrameworksKV(sj state.State) {
+	kvPrefix := m.kvPrefix()
+	prefix := kvPrefix + "/frameworks"
+
+	err := m.Registry.KVSync(m.getLeader().Ip, prefix, frameworksKV(kvPrefix, sj.Frameworks))
+	if err != nil {
+		log.Warn("Unable to sync frameworks to Consul KV: ", err.Error())
+	}
+}
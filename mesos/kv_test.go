@@ -0,0 +1,59 @@
+package mesos
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+func TestFrameworksKV(t *testing.T) {
+	fws := []state.Framework{
+		{ID: "fw-1", Name: "Marathon", Hostname: "master1", Active: true, WebuiURL: "http://master1:8080"},
+		{ID: "fw-2", Name: "chronos", Hostname: "master2"},
+	}
+
+	kv := frameworksKV("mesos/", fws)
+	if len(kv) != 2 {
+		t.Fatalf("frameworksKV() => %d keys, want 2", len(kv))
+	}
+
+	for _, tt := range []struct {
+		key  string
+		want string
+	}{
+		{"mesos/frameworks/marathon", `"leader_url":"http://master1:8080"`},
+		{"mesos/frameworks/chronos", `"leader_url":""`},
+	} {
+		v, ok := kv[tt.key]
+		if !ok {
+			t.Errorf("frameworksKV() missing key %s", tt.key)
+			continue
+		}
+		if !strings.Contains(string(v), tt.want) {
+			t.Errorf("frameworksKV()[%s] => %s, want %s", tt.key, v, tt.want)
+		}
+	}
+}
+
+func TestClusterInfoKV(t *testing.T) {
+	for _, tt := range []struct {
+		sj   state.State
+		want map[string]string
+	}{
+		{state.State{Version: "1.11.0", Cluster: "prod"}, map[string]string{"mesos/cluster/version": "1.11.0", "mesos/cluster/name": "prod"}},
+		{state.State{Version: "1.11.0"}, map[string]string{"mesos/cluster/version": "1.11.0"}},
+		{state.State{}, map[string]string{}},
+	} {
+		kv := clusterInfoKV("mesos/", tt.sj)
+		if len(kv) != len(tt.want) {
+			t.Errorf("clusterInfoKV(%+v) => %d keys, want %d", tt.sj, len(kv), len(tt.want))
+			continue
+		}
+		for k, v := range tt.want {
+			if string(kv[k]) != v {
+				t.Errorf("clusterInfoKV(%+v)[%s] => %q, want %q", tt.sj, k, kv[k], v)
+			}
+		}
+	}
+}
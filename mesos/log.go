@@ -0,0 +1,8 @@
+package mesos
+
+import (
+	"github.com/CiscoCloud/mesos-consul/logging"
+)
+
+// Logger of the mesos subsystem, see --log-levels
+var log = logging.New("mesos")
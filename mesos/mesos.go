@@ -3,19 +3,23 @@ package mesos
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/CiscoCloud/mesos-consul/audit"
 	"github.com/CiscoCloud/mesos-consul/config"
 	"github.com/CiscoCloud/mesos-consul/consul"
 	"github.com/CiscoCloud/mesos-consul/registry"
 	"github.com/CiscoCloud/mesos-consul/state"
+	"github.com/CiscoCloud/mesos-consul/tracing"
 
 	consulapi "github.com/hashicorp/consul/api"
 	proto "github.com/mesos/mesos-go/mesosproto"
-	log "github.com/sirupsen/logrus"
 )
 
 type CacheEntry struct {
@@ -26,25 +30,200 @@ type CacheEntry struct {
 type Mesos struct {
 	Registry registry.Registry
 	Agents   map[string]string
-	Lock     sync.Mutex
+
+	// Agent HTTP ports and hostnames by agent ID
+	agentPorts     map[string]int
+	agentHostnames map[string]string
+	Lock           sync.Mutex
+
+	// Framework names by framework ID
+	Frameworks map[string]string
+
+	// Held while refreshing and while reloading the configuration
+	configLock sync.Mutex
+
+	// Error of the last Mesos state fetch, reported by the health check
+	healthLock sync.Mutex
+	stateErr   error
+
+	// Whether a refresh completed since startup and when the last one
+	// did, reported by the readiness check. It is stale after staleAfter.
+	firstSyncDone bool
+	lastSync      time.Time
+	staleAfter    time.Duration
 
 	Leader    *proto.MasterInfo
 	Masters   []*proto.MasterInfo
 	started   sync.Once
 	startChan chan struct{}
 
-	IpOrder []string
-	taskTag map[string][]string
+	IpOrder             []string
+	IpStates            []string
+	frameworkIpOrder    map[string][]string
+	AddressFamily       string
+	AddressFallback     bool
+	SkipNoIp            bool
+	SkipNonRoutable     bool
+	RegisterPrimaryPort bool
+	taskTag             map[string][]string
+
+	// Opt-in registration of tasks through a label
+	OptIn             bool
+	RegistrationLabel string
+
+	// Only register the tasks matching the filter, all if nil
+	RegisterFilter *RegisterFilter
+
+	// Handling of the service name in the legacy consul label: ignore,
+	// honor or error
+	LegacyConsulLabel string
+
+	// Handling of the DiscoveryInfo ports sharing a name: index, skip
+	// or error
+	DuplicatePortNames string
+
+	// Check of the named DiscoveryInfo ports without a check label:
+	// inherit the task check or none
+	NamedPortCheck string
+
+	// Docker exec checks from the check_docker label
+	DockerChecks bool
+
+	// HTTP checks matching the body from the check_body_regex label
+	BodyCheck    bool
+	BodyCheckTTL string
+
+	// Probe the checks of new services once before registering them,
+	// the probes running by service ID and the services of the pass
+	// waiting for theirs
+	ProbeBeforeRegister bool
+	ProbeTimeout        time.Duration
+	probes              map[string]*serviceProbe
+	probeQueue          []probedService
+
+	// Registrations run at once, scaled up to the max with the new
+	// services of the pass, and the registrations queued by the pass
+	// when run by several workers
+	RegisterWorkers      int
+	RegisterWorkersMax   int
+	RegisterScaleBacklog int
+	registerQueue        []queuedRegistration
+
+	// Detect the scheme of the HTTP checks, the detections keyed by
+	// service ID and check URL, and the services to register again
+	// with the schemes detected since their registration
+	CheckSchemeDetect bool
+	checkSchemes      map[string]map[string]*schemeDetection
+	schemeChanged     map[string]bool
 
 	// Whitelist/Blacklist privileges
 	TaskPrivilege *Privilege
 	FwPrivilege   *Privilege
 
+	// Mesos hosts not to register, by IP or hostname
+	AgentExclude  *RegexList
+	MasterExclude *RegexList
+
+	// Only register the leading Mesos master
+	RegisterLeaderOnly bool
+
 	Separator string
 
-	ServiceName     string
-	ServiceTags     []string
-	ServiceIdPrefix string
+	// Turns task names into service names, the default one if nil
+	Sanitizer NameSanitizer
+
+	// Register tasks whose cleaned name is empty under their task ID
+	EmptyNameFallback bool
+
+	ServiceName        string
+	AgentServiceName   string
+	MasterServiceName  string
+	ServiceTags        []string
+	AgentAttributeTags []string
+	DefaultTags        []string
+	AgentNodeCheck     bool
+	AgentResourcesMeta bool
+	ServiceIdPrefix    string
+	Cluster            string
+	AdoptPrefixes      []string
+	ServiceIdSeparator string
+	StableIds          bool
+	TagPrefix          string
+	LabelTagPrefix     string
+	LabelTagFormat     string
+	TagTemplates       []string
+	TagTemplateMissing string
+	TagNode            bool
+	TagRole            bool
+	TagSandboxURL      bool
+	TagImage           bool
+	SortTags           bool
+	CanarySuffix       string
+
+	// Maximum length of the task service names, longer ones are truncated
+	MaxNameLength int
+
+	// Minimum time a task must have been running before registration
+	MinAge time.Duration
+
+	// Default maximum size of the task check outputs, 0 if unset
+	CheckOutputMaxSize int
+
+	// Set the notes of the task checks to the task owning them
+	CheckOwnerNotes bool
+
+	// Ratio of the check intervals used as the timeout of the task
+	// checks without one, 0 to keep the Consul default
+	CheckTimeoutRatio float64
+
+	// Bounds the task check intervals are clamped to, none if 0
+	CheckIntervalMin time.Duration
+	CheckIntervalMax time.Duration
+
+	// Check of the tasks without check labels, in the consul_check
+	// form, none if empty
+	DefaultCheck string
+
+	// Skips recorded in the audit log by the last and the current
+	// registration passes, keyed by what was skipped
+	auditSkips map[string]string
+	auditSeen  map[string]string
+
+	// Interval of the reconciliations of the cache with Consul, none if
+	// 0, and the time of the last one or of the cache load
+	ReconcileInterval time.Duration
+	reconciled        time.Time
+
+	// Delay before deregistering the services of terminal tasks, and the
+	// deadline of the pending deregistrations keyed by service ID
+	DeregisterGrace   time.Duration
+	pendingDeregister map[string]time.Time
+
+	// Running instances of each service name in the current state
+	instances map[string]int
+
+	// State maintained from the Mesos event stream, nil when polling
+	events *eventState
+
+	// Attempts to fetch the Mesos state and delay before the first retry
+	StateFetchAttempts int
+	StateFetchDelay    time.Duration
+
+	// Consul KV prefix to mirror frameworks under, disabled if empty
+	KVPrefix string
+
+	// Write the Mesos version and cluster name under KVPrefix too
+	KVClusterInfo bool
+
+	// Consul KV key pausing the registrations while set, and whether
+	// they were paused by the last check of the key
+	PauseKVKey string
+	paused     bool
+
+	// Tracer of the sync cycles, nil when disabled, and the span of the
+	// current cycle
+	Tracer *tracing.Tracer
+	span   *tracing.Span
 }
 
 func New(c *config.Config) *Mesos {
@@ -55,44 +234,386 @@ func New(c *config.Config) *Mesos {
 	}
 	m.Separator = c.Separator
 
-	m.TaskPrivilege = NewPrivilege(c.TaskWhiteList, c.TaskBlackList)
-	m.FwPrivilege = NewPrivilege(c.FwWhiteList, c.FwBlackList)
-
-	var err error
-	m.taskTag, err = buildTaskTag(c.TaskTag)
+	sanitizer, err := NewNameSanitizer(c.NameSanitizer, c.NameSanitizerRegex, c.NameCase)
 	if err != nil {
-		log.WithField("task-tag", c.TaskTag).Fatal(err.Error())
+		log.Fatal(err.Error())
 	}
+	m.Sanitizer = sanitizer
 
 	m.ServiceName = cleanName(c.ServiceName, c.Separator)
+	if c.AgentServiceName != "" {
+		m.AgentServiceName = cleanName(c.AgentServiceName, c.Separator)
+	}
+	if c.MasterServiceName != "" {
+		m.MasterServiceName = cleanName(c.MasterServiceName, c.Separator)
+	}
+	if c.SrvSafeNames {
+		m.Sanitizer = srvSafeSanitizer{next: sanitizer}
+		m.ServiceName = srvSafeName(m.ServiceName)
+		if m.AgentServiceName != "" {
+			m.AgentServiceName = srvSafeName(m.AgentServiceName)
+		}
+		if m.MasterServiceName != "" {
+			m.MasterServiceName = srvSafeName(m.MasterServiceName)
+		}
+	}
 
-	m.Registry = consul.New()
+	m.Registry = consul.NewRegistry()
 
 	if m.Registry == nil {
 		log.Fatal("No registry specified")
 	}
 
+	if err := m.loadConfig(c); err != nil {
+		log.Fatal(err.Error())
+	}
+
 	m.zkDetector(c.Zk)
 
-	m.IpOrder = strings.Split(c.MesosIpOrder, ",")
-	for _, src := range m.IpOrder {
-		switch src {
-		case "netinfo", "host", "docker", "mesos":
-		default:
-			log.Fatalf("Invalid IP Search Order: '%v'", src)
+	if err := m.Registry.Ping(m.getLeader().Ip); err != nil {
+		if c.RequireConsul {
+			log.Fatal("Unable to connect to Consul: ", err.Error())
 		}
+		log.Warn("Unable to connect to Consul: ", err.Error())
 	}
-	log.Debugf("m.IpOrder = '%v'", m.IpOrder)
 
-	if c.ServiceTags != "" {
-		m.ServiceTags = strings.Split(c.ServiceTags, ",")
+	m.ServiceIdPrefix = c.ServiceIdPrefix
+	m.Cluster = c.Cluster
+	adoptPrefixes, err := parseAdoptPrefixes(c.AdoptPrefixes, c.Cluster)
+	if err != nil {
+		log.Fatal(err.Error())
 	}
+	m.AdoptPrefixes = adoptPrefixes
+	m.ServiceIdSeparator = c.ServiceIdSeparator
+	m.StableIds = c.StableIds
 
-	m.ServiceIdPrefix = c.ServiceIdPrefix
+	if c.EventStream {
+		m.events = newEventState()
+	}
+
+	m.Tracer = tracing.New(c.OtlpEndpoint, "mesos-consul")
 
 	return m
 }
 
+// parseAdoptPrefixes()
+//   Parse the --adopt-prefixes of a Mesos cluster, skipping the empty
+//   ones that would adopt every service. With several Mesos clusters,
+//   each prefix is scoped to one as <cluster>=<prefix>, so that the
+//   clusters don't sweep each other's services.
+//
+func parseAdoptPrefixes(s string, cluster string) ([]string, error) {
+	var prefixes []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+
+		if i := strings.Index(p, "="); i >= 0 {
+			if strings.TrimSpace(p[:i]) != cluster {
+				continue
+			}
+			p = strings.TrimSpace(p[i+1:])
+		} else if p != "" && cluster != "" {
+			return nil, fmt.Errorf("Invalid adopt prefix '%v', must be <cluster>=<prefix> with several Mesos clusters", p)
+		}
+
+		if p != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+
+	return prefixes, nil
+}
+
+// CheckReload()
+//   Validate the reloadable part of the configuration without applying
+//   it, so that a reload can be checked against every Mesos cluster
+//   before any of them runs it
+//
+func (m *Mesos) CheckReload(c *config.Config) error {
+	m.configLock.Lock()
+	defer m.configLock.Unlock()
+
+	_, err := m.parseConfig(c)
+	return err
+}
+
+// Reload()
+//   Apply the reloadable part of the configuration. Settings that
+//   change service IDs or Consul connections require a restart.
+//
+func (m *Mesos) Reload(c *config.Config) error {
+	m.configLock.Lock()
+	defer m.configLock.Unlock()
+
+	return m.loadConfig(c)
+}
+
+// loadConfig()
+//   Validate and apply the reloadable settings. Nothing is changed if
+//   the configuration is invalid.
+//
+func (m *Mesos) loadConfig(c *config.Config) error {
+	p, err := m.parseConfig(c)
+	if err != nil {
+		return err
+	}
+
+	m.applyConfig(c, p)
+	return nil
+}
+
+// parsedConfig holds the reloadable settings parsed by parseConfig()
+type parsedConfig struct {
+	taskTag          map[string][]string
+	ipOrder          []string
+	frameworkIpOrder map[string][]string
+	optIn            bool
+	registerFilter   *RegisterFilter
+	serviceTags      []string
+	attributeTags    []string
+	defaultTags      []string
+}
+
+// parseConfig()
+//   Validate the reloadable settings and parse the ones applied from
+//   another form, without changing anything
+//
+func (m *Mesos) parseConfig(c *config.Config) (*parsedConfig, error) {
+	taskTag, err := buildTaskTag(c.TaskTag)
+	if err != nil {
+		return nil, fmt.Errorf("task-tag %v: %s", c.TaskTag, err.Error())
+	}
+
+	ipOrder, err := parseIpOrder(c.MesosIpOrder)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("m.IpOrder = '%v'", ipOrder)
+
+	frameworkIpOrder := make(map[string][]string)
+	for _, fo := range c.FrameworkIpOrder {
+		i := strings.LastIndex(fo, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid framework IP order '%v', must be framework:order", fo)
+		}
+		order, err := parseIpOrder(fo[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		frameworkIpOrder[fo[:i]] = order
+	}
+
+	if ttl := registryHeartbeatTTL(m.Registry); ttl > 0 && ttl < 3*c.Refresh {
+		return nil, fmt.Errorf("Invalid consul heartbeat ttl: %s, must be at least 3 times the refresh %s", ttl, c.Refresh)
+	}
+
+	switch c.AddressFamily {
+	case "ipv4", "ipv6", "any":
+	default:
+		return nil, fmt.Errorf("Invalid address family: '%v'", c.AddressFamily)
+	}
+
+	var optIn bool
+	switch c.RegistrationPolicy {
+	case "all":
+	case "opt-in":
+		optIn = true
+	default:
+		return nil, fmt.Errorf("Invalid registration policy: '%v'", c.RegistrationPolicy)
+	}
+
+	switch c.DuplicatePortNames {
+	case "index", "skip", "error":
+	default:
+		return nil, fmt.Errorf("Invalid duplicate port names mode: '%v'", c.DuplicatePortNames)
+	}
+
+	switch c.NamedPortCheck {
+	case "inherit", "none":
+	default:
+		return nil, fmt.Errorf("Invalid named port default check: '%v'", c.NamedPortCheck)
+	}
+
+	switch c.LegacyConsulLabel {
+	case "ignore", "honor", "error":
+	default:
+		return nil, fmt.Errorf("Invalid legacy consul label mode: '%v'", c.LegacyConsulLabel)
+	}
+
+	if c.ReconcileInterval < 0 {
+		return nil, fmt.Errorf("Invalid reconcile interval: %s", c.ReconcileInterval)
+	}
+
+	if c.ProbeTimeout <= 0 {
+		return nil, fmt.Errorf("Invalid probe timeout: %s", c.ProbeTimeout)
+	}
+
+	if c.RegisterWorkers < 1 {
+		return nil, fmt.Errorf("Invalid register workers: %d", c.RegisterWorkers)
+	}
+	if c.RegisterWorkersMax != 0 && c.RegisterWorkersMax < c.RegisterWorkers {
+		return nil, fmt.Errorf("Invalid register workers max: %d, must be at least the register workers %d", c.RegisterWorkersMax, c.RegisterWorkers)
+	}
+	if c.RegisterBacklog < 1 {
+		return nil, fmt.Errorf("Invalid register scale backlog: %d", c.RegisterBacklog)
+	}
+
+	if c.CheckOutputMaxSize < 0 {
+		return nil, fmt.Errorf("Invalid check output max size: %d", c.CheckOutputMaxSize)
+	}
+
+	if c.CheckTimeoutRatio < 0 {
+		return nil, fmt.Errorf("Invalid check timeout ratio: %v", c.CheckTimeoutRatio)
+	}
+
+	if c.CheckIntervalMin < 0 || c.CheckIntervalMax < 0 || (c.CheckIntervalMax > 0 && c.CheckIntervalMin > c.CheckIntervalMax) {
+		return nil, fmt.Errorf("Invalid check interval bounds: %s to %s", c.CheckIntervalMin, c.CheckIntervalMax)
+	}
+
+	if c.DefaultCheck != "" {
+		if err := parseCheckDSL(registry.DefaultCheck(), &CheckVar{Host: "127.0.0.1", Port: "1"}, c.DefaultCheck); err != nil {
+			return nil, fmt.Errorf("Invalid default check '%v': %s", c.DefaultCheck, err.Error())
+		}
+	}
+
+	if emptyName(m.taskName(c.CanarySuffix)) {
+		return nil, fmt.Errorf("Invalid canary suffix: '%v'", c.CanarySuffix)
+	}
+
+	if c.MaxNameLength < 16 {
+		return nil, fmt.Errorf("Invalid max name length: %d, must be at least 16", c.MaxNameLength)
+	}
+
+	switch c.LabelTagFormat {
+	case "key", "key=value", "key:value":
+	default:
+		return nil, fmt.Errorf("Invalid label tag format: '%v'", c.LabelTagFormat)
+	}
+
+	registerFilter, err := NewRegisterFilter(c.RegisterFilter)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid register filter '%v': %s", c.RegisterFilter, err.Error())
+	}
+
+	for _, tpl := range c.TagTemplates {
+		if err := checkTagTemplate(tpl); err != nil {
+			return nil, fmt.Errorf("Invalid tag template '%v': %s", tpl, err.Error())
+		}
+	}
+
+	switch c.TagTemplateMissing {
+	case "drop", "empty":
+	default:
+		return nil, fmt.Errorf("Invalid tag template missing mode: '%v'", c.TagTemplateMissing)
+	}
+
+	if c.StateFetchAttempts < 1 {
+		return nil, fmt.Errorf("Invalid state fetch attempts: %d", c.StateFetchAttempts)
+	}
+
+	var serviceTags []string
+	if c.ServiceTags != "" {
+		serviceTags = strings.Split(c.ServiceTags, ",")
+	}
+
+	var attributeTags []string
+	if c.AgentAttributeTags != "" {
+		attributeTags = strings.Split(c.AgentAttributeTags, ",")
+	}
+
+	var defaultTags []string
+	if c.DefaultTags != "" {
+		defaultTags = strings.Split(c.DefaultTags, ",")
+	}
+
+	return &parsedConfig{
+		taskTag:          taskTag,
+		ipOrder:          ipOrder,
+		frameworkIpOrder: frameworkIpOrder,
+		optIn:            optIn,
+		registerFilter:   registerFilter,
+		serviceTags:      serviceTags,
+		attributeTags:    attributeTags,
+		defaultTags:      defaultTags,
+	}, nil
+}
+
+// applyConfig()
+//   Apply the reloadable settings validated by parseConfig()
+//
+func (m *Mesos) applyConfig(c *config.Config, p *parsedConfig) {
+	m.TaskPrivilege = NewPrivilege(c.TaskWhiteList, c.TaskBlackList)
+	m.FwPrivilege = NewPrivilege(c.FwWhiteList, c.FwBlackList)
+	m.AgentExclude = NewRegexList(c.AgentExclude)
+	m.MasterExclude = NewRegexList(c.MasterExclude)
+	m.RegisterLeaderOnly = c.RegisterLeaderOnly
+	m.taskTag = p.taskTag
+
+	m.IpOrder = p.ipOrder
+	m.frameworkIpOrder = p.frameworkIpOrder
+	m.AddressFamily = c.AddressFamily
+	m.AddressFallback = c.AddressFallback
+	m.SkipNoIp = c.SkipNoIp
+	m.SkipNonRoutable = c.SkipNonRoutable
+	m.RegisterPrimaryPort = c.RegisterPrimaryPort
+
+	m.OptIn = p.optIn
+	m.RegistrationLabel = c.RegistrationLabel
+	m.RegisterFilter = p.registerFilter
+	m.LegacyConsulLabel = c.LegacyConsulLabel
+	m.DuplicatePortNames = c.DuplicatePortNames
+	m.NamedPortCheck = c.NamedPortCheck
+	m.DockerChecks = c.DockerChecks
+	m.BodyCheck = c.BodyCheck
+	m.BodyCheckTTL = (3 * c.Refresh).String()
+	m.setStaleAfter(3 * c.Refresh)
+	m.ProbeBeforeRegister = c.ProbeBeforeRegister
+	m.ProbeTimeout = c.ProbeTimeout
+	m.RegisterWorkers = c.RegisterWorkers
+	m.RegisterWorkersMax = c.RegisterWorkersMax
+	m.RegisterScaleBacklog = c.RegisterBacklog
+	m.CheckSchemeDetect = c.CheckSchemeDetect
+
+	m.IpStates = strings.Split(strings.ToUpper(c.IpStatusStates), ",")
+	log.Debugf("m.IpStates = '%v'", m.IpStates)
+
+	m.ServiceTags = p.serviceTags
+	m.AgentAttributeTags = p.attributeTags
+	m.DefaultTags = p.defaultTags
+	m.AgentNodeCheck = c.AgentNodeCheck
+	m.AgentResourcesMeta = c.AgentResourcesMeta
+	m.TagPrefix = c.TagPrefix
+	m.LabelTagPrefix = c.LabelTagPrefix
+	m.LabelTagFormat = c.LabelTagFormat
+	m.TagTemplates = c.TagTemplates
+	m.TagTemplateMissing = c.TagTemplateMissing
+	m.TagNode = c.TagNode
+	m.TagRole = c.TagRole
+	m.TagSandboxURL = c.TagSandboxURL
+	m.TagImage = c.TagImage
+	m.SortTags = c.SortTags
+	m.CanarySuffix = c.CanarySuffix
+	m.MaxNameLength = c.MaxNameLength
+	m.MinAge = c.MinAge
+	m.CheckOutputMaxSize = c.CheckOutputMaxSize
+	m.CheckOwnerNotes = c.CheckOwnerNotes
+	m.CheckTimeoutRatio = c.CheckTimeoutRatio
+	m.CheckIntervalMin = c.CheckIntervalMin
+	m.CheckIntervalMax = c.CheckIntervalMax
+	m.DefaultCheck = c.DefaultCheck
+	m.DeregisterGrace = c.DeregisterGrace
+	m.ReconcileInterval = c.ReconcileInterval
+	m.StateFetchAttempts = c.StateFetchAttempts
+	m.StateFetchDelay = c.StateFetchDelay
+	m.KVPrefix = c.KVPrefix
+	m.KVClusterInfo = c.KVClusterInfo
+	m.PauseKVKey = c.PauseKVKey
+	if m.PauseKVKey == "" {
+		m.setPaused(false)
+	}
+	m.EmptyNameFallback = c.EmptyNameFallback
+}
+
 // buildTaskTag takes a slice of task-tag arguments from the command line
 // and returns a map of tasks name patterns to slice of tags that should be applied.
 func buildTaskTag(taskTag []string) (map[string][]string, error) {
@@ -118,30 +639,179 @@ func buildTaskTag(taskTag []string) (map[string][]string, error) {
 	return result, nil
 }
 
+// parseIpOrder()
+//   Parse a comma separated list of task IP sources
+//
+func parseIpOrder(s string) ([]string, error) {
+	ipOrder := strings.Split(s, ",")
+	for _, src := range ipOrder {
+		switch src {
+		case "netinfo", "host", "docker", "mesos":
+		default:
+			return nil, fmt.Errorf("Invalid IP Search Order: '%v'", src)
+		}
+	}
+
+	return ipOrder, nil
+}
+
 func (m *Mesos) Refresh() error {
-	sj, err := m.loadState()
+	m.configLock.Lock()
+	defer m.configLock.Unlock()
+
+	m.span = m.Tracer.Start("refresh")
+	defer m.span.End()
+
+	if m.PauseKVKey != "" {
+		m.checkPaused()
+	}
+
+	fetch := m.span.Child("state fetch")
+	sj, err := m.loadStateRetry()
+	fetch.SetError(err)
+	fetch.End()
+	m.setStateErr(err)
 	if err != nil {
+		m.span.SetError(err)
 		log.Warn("loadState failed: ", err.Error())
 		return err
 	}
+	m.span.SetAttribute("mesos.leader", sj.Leader)
+	if m.Cluster != "" {
+		m.span.SetAttribute("mesos.cluster", m.Cluster)
+	}
 
-	if sj.Leader == "" {
-		return errors.New("Empty master")
+	// The Consul agent of the leader is queried below, skip the cycle if
+	// the leader was lost since the state fetch
+	if _, err := m.leader(); err != nil {
+		m.setStateErr(err)
+		m.span.SetError(err)
+		log.Warn("Skipping refresh: ", err.Error())
+		return err
 	}
 
 	if m.Registry.CacheCreate() {
-		m.LoadCache()
+		load := m.span.Child("cache load")
+		load.SetError(m.LoadCache())
+		load.End()
+		m.reconciled = time.Now()
+	} else if m.ReconcileInterval > 0 && time.Since(m.reconciled) >= m.ReconcileInterval {
+		reconcile := m.span.Child("cache reconciliation")
+		err := m.ReconcileCache()
+		reconcile.SetError(err)
+		reconcile.End()
+		if err != nil {
+			log.Warn("Unable to reconcile the cache with Consul: ", err.Error())
+		} else {
+			m.reconciled = time.Now()
+		}
 	}
 
-	m.parseState(sj)
+	if m.paused {
+		log.Infof("Registrations paused by Consul KV key %s, skipping the registration pass", m.PauseKVKey)
+		m.span.SetAttribute("paused", "true")
+	} else {
+		m.parseState(sj)
+	}
+	if m.events != nil {
+		m.events.reset(sj)
+	}
+
+	if m.KVPrefix != "" {
+		m.syncFrameworksKV(sj)
+		if m.KVClusterInfo {
+			m.syncClusterInfoKV(sj)
+		}
+	}
+
+	m.setSynced()
 
 	return nil
 }
 
-func (m *Mesos) loadState() (state.State, error) {
-	var err error
-	var sj state.State
+// loadStateRetry()
+//   Fetch the Mesos state, retrying with an exponential backoff. The
+//   leader is looked up again on each attempt in case it changed.
+//
+func (m *Mesos) loadStateRetry() (state.State, error) {
+	delay := m.StateFetchDelay
+
+	for attempt := 1; ; attempt++ {
+		sj, err := m.loadState()
+		if err == nil && sj.Leader == "" {
+			err = errNoElectedLeader
+		}
+
+		if err == nil || attempt >= m.StateFetchAttempts {
+			return sj, err
+		}
+
+		log.Warnf("loadState failed (attempt %d/%d), retrying in %s: %s", attempt, m.StateFetchAttempts, delay, err.Error())
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// setStateErr()
+//   Record the result of the last Mesos state fetch
+//
+func (m *Mesos) setStateErr(err error) {
+	m.healthLock.Lock()
+	defer m.healthLock.Unlock()
+
+	m.stateErr = err
+}
+
+// Healthy()
+//   Return the error of the last Mesos state fetch, if it failed
+//
+func (m *Mesos) Healthy() error {
+	m.healthLock.Lock()
+	defer m.healthLock.Unlock()
 
+	return m.stateErr
+}
+
+// setSynced()
+//   Record the completion of a refresh
+//
+func (m *Mesos) setSynced() {
+	m.healthLock.Lock()
+	defer m.healthLock.Unlock()
+
+	m.firstSyncDone = true
+	m.lastSync = time.Now()
+}
+
+// setStaleAfter()
+//   Set the time after which the last refresh is stale
+//
+func (m *Mesos) setStaleAfter(d time.Duration) {
+	m.healthLock.Lock()
+	defer m.healthLock.Unlock()
+
+	m.staleAfter = d
+}
+
+// Ready()
+//   Return an error until a refresh completed since startup, or when
+//   the last completed refresh is stale
+//
+func (m *Mesos) Ready() error {
+	m.healthLock.Lock()
+	defer m.healthLock.Unlock()
+
+	if !m.firstSyncDone {
+		return errors.New("first sync not done")
+	}
+	if age := time.Since(m.lastSync); m.staleAfter > 0 && age > m.staleAfter {
+		return fmt.Errorf("last sync %s ago", age.Round(time.Second))
+	}
+
+	return nil
+}
+
+func (m *Mesos) loadState() (sj state.State, err error) {
 	log.Debug("loadState() called")
 
 	defer func() {
@@ -150,16 +820,22 @@ func (m *Mesos) loadState() (state.State, error) {
 		}
 	}()
 
-	mh := m.getLeader()
-	if mh.Ip == "" {
-		log.Warn("No master in zookeeper")
-		return sj, errors.New("No master in zookeeper")
+	mh, err := m.leader()
+	if err != nil {
+		log.Warn(err.Error())
+		return sj, err
 	}
 
 	log.Infof("Zookeeper leader: %s:%s", mh.Ip, mh.PortString)
 
 	log.Info("reloading from master ", mh.Ip)
 	sj, err = m.loadFromMaster(mh.Ip, mh.PortString)
+	if err != nil {
+		return sj, err
+	}
+	if sj.Leader == "" {
+		return sj, errNoElectedLeader
+	}
 
 	if rip := leaderIP(sj.Leader); rip != mh.Ip {
 		log.Warn("master changed to ", rip)
@@ -172,47 +848,183 @@ func (m *Mesos) loadState() (state.State, error) {
 func (m *Mesos) loadFromMaster(ip string, port string) (sj state.State, err error) {
 	url := "http://" + ip + ":" + port + "/master/state.json"
 
+	err = getJSON(url, &sj)
+	if err != nil {
+		return
+	}
+
+	murl := "http://" + ip + ":" + port + "/master/maintenance/status"
+	if merr := getJSON(murl, &sj.Maintenance); merr != nil {
+		log.Warn("Unable to load maintenance status: ", merr.Error())
+	}
+
+	return sj, nil
+}
+
+// getJSON()
+//   Decode the JSON document at url into v
+//
+func getJSON(url string, v interface{}) error {
 	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
 	req.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return
+		return err
 	}
 
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return
-	}
-
-	err = json.Unmarshal(body, &sj)
-	if err != nil {
-		return
+		return err
 	}
 
-	return sj, nil
+	return json.Unmarshal(body, v)
 }
 
 func (m *Mesos) parseState(sj state.State) {
 	log.Info("Running parseState")
 
+	pass := m.span.Child("registration pass")
+	m.rotateAuditSkips()
+	resetCheckHosts()
+	m.registerState(sj, nil, pass)
+	pass.End()
+
+	sweep := m.span.Child("sweep")
+	m.Registry.Deregister()
+	sweep.End()
+}
+
+// syncTasks()
+//   Register and deregister the services of the tasks changed by
+//   events. The services no task registers are left to the sweep of
+//   the next refresh, so that --heartbeats-before-remove still counts
+//   refreshes.
+//
+func (m *Mesos) syncTasks(sj state.State, changed map[string]bool) {
+	log.Debugf("Syncing %d tasks changed by events", len(changed))
+
+	pass := m.span.Child("registration pass")
+	m.registerState(sj, changed, pass)
+	pass.End()
+}
+
+// registerState()
+//   Register the hosts and the running tasks of the state, and
+//   deregister the services of its terminal tasks. Only the tasks in
+//   changed are registered or deregistered, unless it is nil.
+//
+func (m *Mesos) registerState(sj state.State, changed map[string]bool, pass *tracing.Span) {
 	m.RegisterHosts(sj)
 	log.Debug("Done running RegisterHosts")
 
+	m.Frameworks = make(map[string]string)
+	for _, fw := range sj.Frameworks {
+		m.Frameworks[fw.ID] = fw.Name
+	}
+
+	// Running instances of each service, for consul_min_instances
+	m.instances = make(map[string]int)
 	for _, fw := range sj.Frameworks {
 		if !m.FwPrivilege.Allowed(fw.Name) {
 			continue
 		}
+		for i := range fw.Tasks {
+			if _, ok := m.Agents[fw.Tasks[i].SlaveID]; ok && fw.Tasks[i].State == "TASK_RUNNING" {
+				m.instances[m.serviceName(&fw.Tasks[i])]++
+			}
+		}
+	}
+
+	registered := make(map[string]bool)
+	var terminal []state.Task
+
+	if m.RegisterWorkers > 1 || m.RegisterWorkersMax > 1 {
+		m.registerQueue = []queuedRegistration{}
+	}
+
+	for _, fw := range sj.Frameworks {
+		if !m.FwPrivilege.Allowed(fw.Name) {
+			m.auditSkip(audit.Decision{Framework: fw.Name, Reason: "framework not allowed by --fw-whitelist and --fw-blacklist"})
+			continue
+		}
 		for _, task := range fw.Tasks {
 			agent, ok := m.Agents[task.SlaveID]
-			if ok && task.State == "TASK_RUNNING" {
+			if !ok {
+				continue
+			}
+			task.SlaveIP = agent
+
+			if changed != nil && !changed[task.ID] {
+				if task.State == "TASK_RUNNING" {
+					// Keep the services of the task from being deregistered
+					// with a terminal task sharing their stable ID
+					services, _ := m.taskServices(&task, agent)
+					for _, s := range services {
+						registered[s.ID] = true
+					}
+				}
+				continue
+			}
+
+			if task.State == "TASK_RUNNING" {
+				ids := m.safeRegisterTask(&task, agent)
+				for _, id := range ids {
+					registered[id] = true
+				}
+				pass.Event("registerTask", "task.id", task.ID, "services", strconv.Itoa(len(ids)))
+			} else if isTerminal(&task) {
+				terminal = append(terminal, task)
+			}
+		}
+		for _, task := range fw.CompletedTasks {
+			agent, ok := m.Agents[task.SlaveID]
+			if ok && isTerminal(&task) && (changed == nil || changed[task.ID]) {
 				task.SlaveIP = agent
-				m.registerTask(&task, agent)
+				terminal = append(terminal, task)
 			}
 		}
 	}
 
-	m.Registry.Deregister()
+	for _, id := range m.registerProbed() {
+		registered[id] = true
+	}
+	m.flushRegistrations()
+
+	// Deregister terminal tasks once all running tasks have been seen so that
+	// a task restarted with the same service ID is not removed.
+	pending := make(map[string]time.Time)
+	for i := range terminal {
+		m.deregisterTask(&terminal[i], terminal[i].SlaveIP, registered, pending)
+	}
+	for id := range m.pendingDeregister {
+		if registered[id] {
+			log.Infof("%s is running again. Cancelling its deregistration", id)
+			delete(m.pendingDeregister, id)
+		}
+	}
+
+	if changed != nil {
+		// The other pending deregistrations are still pending
+		if m.pendingDeregister == nil {
+			m.pendingDeregister = make(map[string]time.Time)
+		}
+		for id, deadline := range pending {
+			m.pendingDeregister[id] = deadline
+		}
+		return
+	}
+
+	m.pendingDeregister = pending
+	for id := range m.checkSchemes {
+		if !registered[id] {
+			delete(m.checkSchemes, id)
+			delete(m.schemeChanged, id)
+		}
+	}
 }
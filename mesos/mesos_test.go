@@ -1,6 +1,21 @@
 package mesos
 
-import "testing"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/config"
+	"github.com/CiscoCloud/mesos-consul/registry"
+
+	proto "github.com/mesos/mesos-go/mesosproto"
+)
 
 func TestBuildTaskTag(t *testing.T) {
 	for _, tt := range []struct {
@@ -43,32 +58,156 @@ func TestBuildRegisterTaskTags(t *testing.T) {
 		taskName     string
 		startingTags []string
 		taskTag      map[string][]string
+		prefix       string
 		tags         []string
 	}{
-		{"mytask", []string{}, map[string][]string{}, []string{}},
-		{"mytask", []string{"one"}, map[string][]string{}, []string{"one"}},
+		{"mytask", []string{}, map[string][]string{}, "", []string{}},
+		{"mytask", []string{"one"}, map[string][]string{}, "", []string{"one"}},
 		{"mytask", []string{}, map[string][]string{
 			"mytask": []string{"one"},
-		}, []string{"one"}},
+		}, "", []string{"one"}},
 		{"mytask", []string{"one"}, map[string][]string{
 			"mytask": []string{"one"},
-		}, []string{"one"}},
+		}, "", []string{"one"}},
 		{"mytask", []string{"one"}, map[string][]string{
 			"mytask": []string{"one", "two"},
-		}, []string{"one", "two"}},
+		}, "", []string{"one", "two"}},
 		{"mytask", []string{"one"}, map[string][]string{
 			"mytask": []string{"two", "three"},
-		}, []string{"one", "two", "three"}},
+		}, "", []string{"one", "two", "three"}},
 		{"myTask-5", []string{}, map[string][]string{
 			"mytask": []string{"one"},
-		}, []string{"one"}},
+		}, "", []string{"one"}},
 		{"other", []string{"first"}, map[string][]string{
 			"mytask": []string{"two", "three"},
-		}, []string{"first"}},
+		}, "", []string{"first"}},
+		{"mytask", []string{"one"}, map[string][]string{
+			"mytask": []string{"two"},
+		}, "mc/", []string{"mc/one", "mc/two"}},
+		{"mytask", []string{"mc/one"}, map[string][]string{
+			"mytask": []string{"one"},
+		}, "mc/", []string{"mc/one"}},
 	} {
-		tags := buildRegisterTaskTags(tt.taskName, tt.startingTags, tt.taskTag)
+		tags := buildRegisterTaskTags(tt.taskName, tt.startingTags, tt.taskTag, tt.prefix)
 		if !sliceEq(tags, tt.tags) {
-			t.Errorf("buildRegisterTaskTags(%s, %v, %v) => %v want %v", tt.taskName, tt.startingTags, tt.taskTag, tags, tt.tags)
+			t.Errorf("buildRegisterTaskTags(%s, %v, %v, %s) => %v want %v", tt.taskName, tt.startingTags, tt.taskTag, tt.prefix, tags, tt.tags)
+		}
+	}
+}
+
+func TestParseAdoptPrefixes(t *testing.T) {
+	for _, tt := range []struct {
+		s       string
+		cluster string
+		r       []string
+		err     bool
+	}{
+		{"", "", nil, false},
+		{"old:", "", []string{"old:"}, false},
+		{"old:,", "", []string{"old:"}, false},
+		{"a:,,b:", "", []string{"a:", "b:"}, false},
+		{" a: , ,", "", []string{"a:"}, false},
+		{"prod=old:prod:,dev=old:dev:", "prod", []string{"old:prod:"}, false},
+		{"prod=old:,dev=", "dev", nil, false},
+		{"old:", "prod", nil, true},
+	} {
+		r, err := parseAdoptPrefixes(tt.s, tt.cluster)
+		if (err != nil) != tt.err || !reflect.DeepEqual(r, tt.r) {
+			t.Errorf("parseAdoptPrefixes(%q, %q) => (%q, %v), want %q", tt.s, tt.cluster, r, err, tt.r)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	m := new(Mesos)
+
+	c := config.DefaultConfig()
+	c.TaskTag = []string{"mytask:one"}
+	c.ServiceTags = "dc1"
+	if err := m.loadConfig(c); err != nil {
+		t.Fatalf("loadConfig() => %v, want nil", err)
+	}
+
+	for _, invalid := range []func(*config.Config){
+		func(c *config.Config) { c.TaskTag = []string{"invalid"} },
+		func(c *config.Config) { c.MesosIpOrder = "netinfo,invalid" },
+		func(c *config.Config) { c.FrameworkIpOrder = []string{"marathon:host,invalid"} },
+		func(c *config.Config) { c.FrameworkIpOrder = []string{"host"} },
+		func(c *config.Config) { c.RegistrationPolicy = "invalid" },
+		func(c *config.Config) { c.RegisterFilter = `labels.env == "prod` },
+		func(c *config.Config) { c.NamedPortCheck = "invalid" },
+		func(c *config.Config) { c.ReconcileInterval = -time.Second },
+		func(c *config.Config) { c.CanarySuffix = "" },
+		func(c *config.Config) { c.CanarySuffix = " ." },
+		func(c *config.Config) { c.LegacyConsulLabel = "invalid" },
+		func(c *config.Config) { c.DuplicatePortNames = "invalid" },
+		func(c *config.Config) { c.LabelTagFormat = "key-value" },
+		func(c *config.Config) { c.TagTemplates = []string{"${env:HOME}"} },
+		func(c *config.Config) { c.TagTemplateMissing = "invalid" },
+		func(c *config.Config) { c.StateFetchAttempts = 0 },
+		func(c *config.Config) { c.ProbeTimeout = 0 },
+		func(c *config.Config) { c.RegisterWorkers = 0 },
+		func(c *config.Config) { c.RegisterWorkers = 4; c.RegisterWorkersMax = 2 },
+		func(c *config.Config) { c.RegisterBacklog = 0 },
+		func(c *config.Config) { c.CheckTimeoutRatio = -1 },
+		func(c *config.Config) { c.CheckIntervalMin = -time.Second },
+		func(c *config.Config) { c.CheckIntervalMin = time.Minute; c.CheckIntervalMax = time.Second },
+		func(c *config.Config) { c.DefaultCheck = "udp:{port}" },
+		func(c *config.Config) { c.MaxNameLength = 8 },
+	} {
+		nc := config.DefaultConfig()
+		nc.ServiceTags = "dc2"
+		invalid(nc)
+
+		if err := m.loadConfig(nc); err == nil {
+			t.Errorf("loadConfig(%+v) => nil, want error", nc)
+		}
+		if !sliceEq(m.ServiceTags, []string{"dc1"}) || !taskMapEq(m.taskTag, map[string][]string{"mytask": []string{"one"}}) {
+			t.Errorf("loadConfig(%+v) changed the configuration", nc)
+		}
+	}
+
+	// A valid configuration is only checked, not applied
+	nc := config.DefaultConfig()
+	nc.ServiceTags = "dc2"
+	if err := m.CheckReload(nc); err != nil || !sliceEq(m.ServiceTags, []string{"dc1"}) {
+		t.Errorf("CheckReload(%+v) => %v, tags %v, want nil and the configuration unchanged", nc, err, m.ServiceTags)
+	}
+	if err := m.Reload(nc); err != nil || !sliceEq(m.ServiceTags, []string{"dc2"}) {
+		t.Errorf("Reload(%+v) => %v, tags %v, want nil and [dc2]", nc, err, m.ServiceTags)
+	}
+}
+
+type heartbeatRegistry struct {
+	*fakeRegistry
+	ttl time.Duration
+}
+
+func (r heartbeatRegistry) HeartbeatTTL() time.Duration { return r.ttl }
+
+func TestLoadConfigHeartbeatTTL(t *testing.T) {
+	for _, tt := range []struct {
+		ttls    []time.Duration
+		refresh time.Duration
+		valid   bool
+	}{
+		{nil, time.Minute, true},
+		{[]time.Duration{0}, time.Minute, true},
+		{[]time.Duration{3 * time.Minute}, time.Minute, true},
+		{[]time.Duration{2 * time.Minute}, time.Minute, false},
+		{[]time.Duration{3 * time.Minute, 2 * time.Minute}, time.Minute, false},
+		{[]time.Duration{0, 5 * time.Minute}, time.Minute, true},
+	} {
+		var rs registry.Multi
+		for _, ttl := range tt.ttls {
+			rs = append(rs, heartbeatRegistry{&fakeRegistry{}, ttl})
+		}
+		m := &Mesos{Registry: rs}
+
+		c := config.DefaultConfig()
+		c.Refresh = tt.refresh
+		if err := m.loadConfig(c); (err == nil) != tt.valid {
+			t.Errorf("loadConfig() with ttls %v and refresh %s => %v, want valid %t", tt.ttls, tt.refresh, err, tt.valid)
 		}
 	}
 }
@@ -100,3 +239,233 @@ func taskMapEq(a, b map[string][]string) bool {
 
 	return true
 }
+
+func masterInfo(t *testing.T, url string) *proto.MasterInfo {
+	host, port, err := net.SplitHostPort(url[len("http://"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	p32 := int32(p)
+
+	return &proto.MasterInfo{
+		Id:      &url,
+		Address: &proto.Address{Hostname: &host, Ip: &host, Port: &p32},
+	}
+}
+
+func TestRefreshLeaderChange(t *testing.T) {
+	m, _ := newTestMesos()
+	m.StateFetchAttempts = 3
+	m.StateFetchDelay = time.Millisecond
+
+	newLeader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"leader": "master@%s"}`, r.Host)
+	}))
+	defer newLeader.Close()
+
+	hits := 0
+	oldLeader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Leadership moves while the old leader is unavailable
+		hits++
+		m.Lock.Lock()
+		m.Leader = masterInfo(t, newLeader.URL)
+		m.Lock.Unlock()
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer oldLeader.Close()
+
+	m.Leader = masterInfo(t, oldLeader.URL)
+
+	if err := m.Refresh(); err != nil {
+		t.Errorf("Refresh() => %v, want nil", err)
+	}
+	if hits != 1 {
+		t.Errorf("Refresh() fetched the old leader %d times, want 1", hits)
+	}
+	if err := m.Healthy(); err != nil {
+		t.Errorf("Healthy() => %v, want nil", err)
+	}
+}
+
+func TestRefreshRetriesExhausted(t *testing.T) {
+	m, _ := newTestMesos()
+	m.StateFetchAttempts = 3
+	m.StateFetchDelay = time.Millisecond
+
+	hits := 0
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer master.Close()
+
+	m.Leader = masterInfo(t, master.URL)
+
+	if err := m.Refresh(); err == nil {
+		t.Errorf("Refresh() => nil, want error")
+	}
+	if hits != 3 {
+		t.Errorf("Refresh() fetched the state %d times, want 3", hits)
+	}
+	if err := m.Healthy(); err == nil {
+		t.Errorf("Healthy() => nil, want error")
+	}
+}
+
+func TestReady(t *testing.T) {
+	m, _ := newTestMesos()
+	m.StateFetchAttempts = 1
+	m.setStaleAfter(time.Minute)
+
+	up := true
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"leader": "master@%s"}`, r.Host)
+	}))
+	defer master.Close()
+
+	m.Leader = masterInfo(t, master.URL)
+
+	if err := m.Ready(); err == nil {
+		t.Error("Ready() before the first refresh => nil, want error")
+	}
+
+	up = false
+	m.Refresh()
+	if err := m.Ready(); err == nil {
+		t.Error("Ready() after a failed first refresh => nil, want error")
+	}
+
+	up = true
+	m.Refresh()
+	if err := m.Ready(); err != nil {
+		t.Errorf("Ready() after a refresh => %v, want nil", err)
+	}
+
+	// A failed refresh keeps the instance ready until the last sync is stale
+	up = false
+	m.Refresh()
+	if err := m.Ready(); err != nil {
+		t.Errorf("Ready() after a failed refresh => %v, want nil", err)
+	}
+
+	m.lastSync = time.Now().Add(-2 * time.Minute)
+	if err := m.Ready(); err == nil {
+		t.Error("Ready() with a stale last sync => nil, want error")
+	}
+}
+
+func TestRefreshPaused(t *testing.T) {
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"leader": "master@%s", "slaves": [{"id": "S1", "hostname": "agent1", "pid": "slave(1)@10.0.0.1:5051"}]}`, r.Host)
+	}))
+	defer master.Close()
+
+	m, r := newTestMesos()
+	m.StateFetchAttempts = 1
+	m.PauseKVKey = "mesos-consul/pause"
+	m.Leader = masterInfo(t, master.URL)
+
+	for _, tt := range []struct {
+		value    string
+		set      bool
+		err      error
+		services int
+		paused   bool
+	}{
+		{"", true, nil, 0, true},
+		{"maintenance", true, nil, 0, true},
+		// The last state is kept when the key can't be read
+		{"false", true, errors.New("down"), 0, true},
+		{"false", true, nil, 1, false},
+		{"yes", true, errors.New("down"), 1, false},
+		{"", false, nil, 1, false},
+	} {
+		r.services = make(map[string]*registry.Service)
+		delete(r.kv, m.PauseKVKey)
+		if tt.set {
+			r.kv[m.PauseKVKey] = []byte(tt.value)
+		}
+		r.kvErr = tt.err
+
+		if err := m.Refresh(); err != nil {
+			t.Fatalf("Refresh() => %v, want nil", err)
+		}
+		if len(r.services) != tt.services || m.paused != tt.paused {
+			t.Errorf("Refresh() with key %q (set %t, err %v) => %d services, paused %t, want %d, %t", tt.value, tt.set, tt.err, len(r.services), m.paused, tt.services, tt.paused)
+		}
+	}
+}
+
+func TestRefreshReconcile(t *testing.T) {
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"leader": "master@%s"}`, r.Host)
+	}))
+	defer master.Close()
+
+	m, r := newTestMesos()
+	m.StateFetchAttempts = 1
+	m.ReconcileInterval = time.Hour
+	m.Leader = masterInfo(t, master.URL)
+
+	for i, want := range []int{1, 1} {
+		if err := m.Refresh(); err != nil {
+			t.Fatalf("Refresh() => %v, want nil", err)
+		}
+		if r.reconciles != want {
+			t.Errorf("Refresh() %d => %d reconciliations, want %d", i, r.reconciles, want)
+		}
+	}
+
+	m.reconciled = time.Now().Add(-2 * time.Hour)
+	m.Refresh()
+	if r.reconciles != 2 {
+		t.Errorf("Refresh() after the interval => %d reconciliations, want 2", r.reconciles)
+	}
+
+	m.ReconcileInterval = 0
+	m.reconciled = time.Time{}
+	m.Refresh()
+	if r.reconciles != 2 {
+		t.Errorf("Refresh() without interval => %d reconciliations, want 2", r.reconciles)
+	}
+}
+
+func TestRefreshNoLeader(t *testing.T) {
+	// A master without quorum serves its state without a leader
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"slaves": [{"id": "S1", "hostname": "agent1", "pid": "slave(1)@10.0.0.1:5051"}]}`)
+	}))
+	defer master.Close()
+
+	for _, tt := range []struct {
+		leader string
+		err    error
+	}{
+		{"", errNoLeader},
+		{master.URL, errNoElectedLeader},
+	} {
+		m, r := newTestMesos()
+		m.StateFetchAttempts = 1
+		if tt.leader != "" {
+			m.Leader = masterInfo(t, tt.leader)
+		}
+
+		if err := m.Refresh(); err != tt.err {
+			t.Errorf("Refresh() with leader %q => %v, want %v", tt.leader, err, tt.err)
+		}
+		if err := m.Healthy(); err != tt.err {
+			t.Errorf("Healthy() after a refresh with leader %q => %v, want %v", tt.leader, err, tt.err)
+		}
+		if err := m.Ready(); err == nil {
+			t.Errorf("Ready() after a refresh with leader %q => nil, want error", tt.leader)
+		}
+		if len(r.services) != 0 {
+			t.Errorf("Refresh() with leader %q registered %d services, want none", tt.leader, len(r.services))
+		}
+	}
+}
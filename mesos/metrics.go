@@ -0,0 +1,18 @@
+package mesos
+
+import (
+	"expvar"
+)
+
+// Metrics are published with expvar and served on /debug/vars by the
+// healthcheck endpoint, for all Mesos clusters.
+var (
+	// Number of task registrations that panicked and were skipped
+	registerPanics = expvar.NewInt("register_panics_total")
+
+	// 1 while the registrations are paused by --pause-kv-key
+	registrationPaused = expvar.NewInt("registration_paused")
+
+	// Registrations run at once by the last registration pass
+	registerWorkersUsed = expvar.NewInt("register_workers")
+)
@@ -1,9 +1,5 @@
 package mesos
 
-import (
-	log "github.com/sirupsen/logrus"
-)
-
 type Privilege struct {
 	WhiteList *RegexList
 	BlackList *RegexList
@@ -0,0 +1,370 @@
+package mesos
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/audit"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+// serviceProbeSlots bounds the probes of new services run at once
+var serviceProbeSlots = make(chan struct{}, 16)
+
+// serviceProbe is a probe of a new service running in the background,
+// its error set once done is closed
+type serviceProbe struct {
+	done chan struct{}
+	err  error
+}
+
+// probedService is a service of a task waiting for its probe
+type probedService struct {
+	task    state.Task
+	service *registry.Service
+	probe   *serviceProbe
+}
+
+// queueProbe()
+//   Probe a new service in the background, unless its probe is already
+//   running, and queue it for registerProbed()
+//
+func (m *Mesos) queueProbe(t *state.Task, s *registry.Service) {
+	p, ok := m.probes[s.ID]
+	if !ok {
+		p = &serviceProbe{done: make(chan struct{})}
+		if m.probes == nil {
+			m.probes = make(map[string]*serviceProbe)
+		}
+		m.probes[s.ID] = p
+
+		go func(s *registry.Service) {
+			serviceProbeSlots <- struct{}{}
+			p.err = m.probeService(s)
+			<-serviceProbeSlots
+			close(p.done)
+		}(s)
+	}
+
+	m.probeQueue = append(m.probeQueue, probedService{task: *t, service: s, probe: p})
+}
+
+// registerProbed()
+//   Wait for the probes queued by the registration pass, up to
+//   --probe-timeout in all, register the services passing them and
+//   return their IDs. Services still probed are registered by a later
+//   pass, failing ones are probed again.
+//
+func (m *Mesos) registerProbed() []string {
+	var ids []string
+
+	deadline := time.NewTimer(m.ProbeTimeout)
+	defer deadline.Stop()
+
+	queued := make(map[string]bool)
+	expired := false
+	for _, q := range m.probeQueue {
+		queued[q.service.ID] = true
+
+		if !expired {
+			select {
+			case <-q.probe.done:
+			case <-deadline.C:
+				expired = true
+			}
+		}
+
+		select {
+		case <-q.probe.done:
+		default:
+			log.Debugf("Probe of %s still running. Not registering yet", q.service.ID)
+			continue
+		}
+
+		delete(m.probes, q.service.ID)
+		if q.probe.err != nil {
+			log.Warnf("Probe of %s failed: %s. Not registering until it passes", q.service.ID, q.probe.err.Error())
+			m.auditSkip(audit.Decision{Task: q.task.ID, Service: q.service.ID, Reason: "probe failed"})
+			continue
+		}
+
+		m.registerService(&q.task, q.service)
+		ids = append(ids, q.service.ID)
+	}
+	m.probeQueue = nil
+
+	// Drop the finished probes of services gone since
+	for id, p := range m.probes {
+		select {
+		case <-p.done:
+			if !queued[id] {
+				delete(m.probes, id)
+			}
+		default:
+		}
+	}
+
+	return ids
+}
+
+// probeService()
+//   Probe the HTTP and TCP checks of a service once, and return the
+//   first failure
+//
+func (m *Mesos) probeService(s *registry.Service) error {
+	checks := s.Checks
+	if s.Check != nil {
+		checks = append([]*registry.Check{s.Check}, checks...)
+	}
+
+	for _, c := range checks {
+		if err := probeCheck(c, m.ProbeTimeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// probeCheck()
+//   Probe an HTTP check, passing on a 2xx status, or a TCP check,
+//   passing when the connection is accepted. Other checks pass.
+//
+func probeCheck(c *registry.Check, timeout time.Duration) error {
+	switch {
+	case c.HTTP != "":
+		method := c.Method
+		if method == "" {
+			method = "GET"
+		}
+		req, err := http.NewRequest(method, c.HTTP, nil)
+		if err != nil {
+			return err
+		}
+
+		client := &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: c.TLSSkipVerify},
+				DisableKeepAlives: true,
+			},
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s %s: %s", method, c.HTTP, resp.Status)
+		}
+	case c.TCP != "":
+		conn, err := net.DialTimeout("tcp", c.TCP, timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+
+	return nil
+}
+
+// detectScheme()
+//   Request the HTTP check URL over https, then http, and return the
+//   first scheme answering with any HTTP response, empty if none does
+//
+func detectScheme(c *registry.Check, timeout time.Duration) string {
+	method := c.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	// Only the scheme matters here, the certificates are left to the
+	// tls_skip_verify setting of the Consul check
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// https first: plain HTTP servers don't answer a TLS handshake,
+	// while HTTPS servers often answer plain requests with a 400
+	for _, scheme := range []string{"https", "http"} {
+		req, err := http.NewRequest(method, setScheme(c.HTTP, scheme), nil)
+		if err != nil {
+			return ""
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		return scheme
+	}
+
+	return ""
+}
+
+// Delay before detecting again the scheme of a check answering on
+// neither, doubled on each failure up to schemeRetryMax
+var (
+	schemeRetryMin = 30 * time.Second
+	schemeRetryMax = 30 * time.Minute
+)
+
+// schemeDetection is the detection of the scheme of a check URL running
+// in the background, its scheme set once done is closed, empty when the
+// URL answered on neither scheme until retry
+type schemeDetection struct {
+	done    chan struct{}
+	scheme  string
+	retry   time.Time
+	attempt int
+	applied bool
+}
+
+// retryDue()
+//   Whether the detection failed and its backoff is over
+//
+func (d *schemeDetection) retryDue() bool {
+	select {
+	case <-d.done:
+		return d.scheme == "" && !time.Now().Before(d.retry)
+	default:
+		return false
+	}
+}
+
+// schemeRetry()
+//   Backoff after the given number of failed detections
+//
+func schemeRetry(attempt int) time.Duration {
+	delay := schemeRetryMin
+	for i := 1; i < attempt && delay < schemeRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > schemeRetryMax {
+		delay = schemeRetryMax
+	}
+
+	return delay
+}
+
+// queueSchemeDetection()
+//   Detect the scheme of a check in the background, in the slots of
+//   the probes, following the failed detection prev if any
+//
+func (m *Mesos) queueSchemeDetection(c *registry.Check, id string, prev *schemeDetection) *schemeDetection {
+	d := &schemeDetection{done: make(chan struct{}), attempt: 1}
+	if prev != nil {
+		d.attempt = prev.attempt + 1
+	}
+	delay := schemeRetry(d.attempt)
+
+	go func(c registry.Check, timeout time.Duration) {
+		serviceProbeSlots <- struct{}{}
+		d.scheme = detectScheme(&c, timeout)
+		<-serviceProbeSlots
+
+		if d.scheme == "" {
+			log.Warnf("Unable to detect the scheme of check %s of %s. Retrying in %s", c.HTTP, id, delay)
+			d.retry = time.Now().Add(delay)
+		} else {
+			log.Infof("Check %s of %s answers on %s", c.HTTP, id, d.scheme)
+		}
+		close(d.done)
+	}(*c, m.ProbeTimeout)
+
+	return d
+}
+
+// detectSchemes()
+//   Set the scheme of the HTTP checks of a service to the one their
+//   target answers on. The scheme is detected in the background once
+//   per check URL of the service ID and reused until the check
+//   changes, the check being registered as is until then. A failed
+//   detection is retried with a backoff, so that a broken endpoint
+//   isn't probed again on every pass. The services registered before
+//   the detection changed their checks are marked for registering
+//   again.
+//
+func (m *Mesos) detectSchemes(t *state.Task, s *registry.Service) {
+	if hasSchemeLabel(t) {
+		return
+	}
+
+	checks := s.Checks
+	if s.Check != nil {
+		checks = append([]*registry.Check{s.Check}, checks...)
+	}
+
+	known := m.checkSchemes[s.ID]
+	schemes := make(map[string]*schemeDetection)
+	for _, c := range checks {
+		if c.HTTP == "" {
+			continue
+		}
+
+		d, ok := known[c.HTTP]
+		if !ok || d.retryDue() {
+			d = m.queueSchemeDetection(c, s.ID, d)
+		}
+		schemes[c.HTTP] = d
+
+		select {
+		case <-d.done:
+		default:
+			continue
+		}
+		if d.scheme == "" {
+			continue
+		}
+
+		u := setScheme(c.HTTP, d.scheme)
+		if !d.applied && u != c.HTTP {
+			if m.schemeChanged == nil {
+				m.schemeChanged = make(map[string]bool)
+			}
+			m.schemeChanged[s.ID] = true
+		}
+		d.applied = true
+		c.HTTP = u
+	}
+
+	if len(schemes) == 0 {
+		delete(m.checkSchemes, s.ID)
+		return
+	}
+	if m.checkSchemes == nil {
+		m.checkSchemes = make(map[string]map[string]*schemeDetection)
+	}
+	m.checkSchemes[s.ID] = schemes
+}
+
+// hasSchemeLabel()
+//   Whether a check_scheme label is set on the task or one of its
+//   DiscoveryInfo ports
+//
+func hasSchemeLabel(t *state.Task) bool {
+	if t.Label("check_scheme") != "" {
+		return true
+	}
+	for _, p := range t.DiscoveryInfo.Ports.DiscoveryPorts {
+		if p.Label("check_scheme") != "" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,287 @@
+package mesos
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+func TestProbeCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	// A port nothing listens on anymore
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := l.Addr().String()
+	l.Close()
+
+	tcp := strings.TrimPrefix(srv.URL, "http://")
+	for _, tt := range []struct {
+		check *registry.Check
+		pass  bool
+	}{
+		{&registry.Check{HTTP: srv.URL + "/health"}, true},
+		{&registry.Check{HTTP: srv.URL + "/ready"}, false},
+		{&registry.Check{HTTP: "http://" + closed + "/health"}, false},
+		{&registry.Check{TCP: tcp}, true},
+		{&registry.Check{TCP: closed}, false},
+		{&registry.Check{TTL: "30s"}, true},
+	} {
+		if err := probeCheck(tt.check, time.Second); (err == nil) != tt.pass {
+			t.Errorf("probeCheck(%+v) => %v, want pass %t", tt.check, err, tt.pass)
+		}
+	}
+}
+
+func TestRegisterTaskProbe(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	defer l.Close()
+
+	m, r := newTestMesos()
+	m.ProbeBeforeRegister = true
+	m.ProbeTimeout = time.Second
+	m.SkipNonRoutable = false
+
+	task := &state.Task{
+		ID:        "api.1",
+		Name:      "api",
+		State:     "TASK_RUNNING",
+		SlaveIP:   "127.0.0.1",
+		Resources: state.Resources{PortRanges: "[" + port + "-" + port + "]"},
+		Labels:    []state.Label{{Key: "consul_check", Value: "tcp:{port}"}},
+	}
+
+	if ids := m.registerTask(task, "127.0.0.1"); len(ids) != 0 || len(m.probeQueue) != 1 {
+		t.Fatalf("registerTask() of a new service => %v, %d probes queued, want the service queued", ids, len(m.probeQueue))
+	}
+	if ids := m.registerProbed(); len(ids) != 1 || len(r.services) != 1 {
+		t.Fatalf("registerProbed() with a passing probe => %v, want 1 service", ids)
+	}
+
+	l.Close()
+	r.services = make(map[string]*registry.Service)
+	m.registerTask(task, "127.0.0.1")
+	if ids := m.registerProbed(); len(ids) != 0 || len(r.services) != 0 || len(m.probes) != 0 {
+		t.Errorf("registerProbed() with a failing probe => %v, want none", ids)
+	}
+}
+
+func TestRegisterProbedTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	m, r := newTestMesos()
+	m.ProbeBeforeRegister = true
+	m.ProbeTimeout = 50 * time.Millisecond
+
+	task := &state.Task{ID: "api.1", Name: "api", State: "TASK_RUNNING", SlaveIP: "10.0.0.1"}
+	for i := 0; i < 3; i++ {
+		m.queueProbe(task, &registry.Service{
+			ID:    fmt.Sprintf("api:%d", i),
+			Check: &registry.Check{HTTP: ts.URL},
+		})
+	}
+
+	// The probes run together, so the pass waits for one timeout only
+	start := time.Now()
+	if ids := m.registerProbed(); len(ids) != 0 || len(r.services) != 0 {
+		t.Errorf("registerProbed() of hanging probes => %v, want none", ids)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("registerProbed() of 3 hanging probes took %s, want about the probe timeout", d)
+	}
+}
+
+func TestDetectScheme(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+	}))
+	defer secure.Close()
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := l.Addr().String()
+	l.Close()
+
+	for _, tt := range []struct {
+		check  *registry.Check
+		scheme string
+	}{
+		{&registry.Check{HTTP: plain.URL + "/health"}, "http"},
+		{&registry.Check{HTTP: strings.Replace(secure.URL, "https:", "http:", 1) + "/health"}, "https"},
+		{&registry.Check{HTTP: "http://" + closed + "/health"}, ""},
+	} {
+		if scheme := detectScheme(tt.check, time.Second); scheme != tt.scheme {
+			t.Errorf("detectScheme(%+v) => %q, want %q", tt.check, scheme, tt.scheme)
+		}
+	}
+}
+
+func TestRegisterTaskSchemeDetect(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+
+	m, r := newTestMesos()
+	m.CheckSchemeDetect = true
+	m.ProbeTimeout = time.Second
+	m.SkipNonRoutable = false
+
+	task := &state.Task{
+		ID:        "api.1",
+		Name:      "api",
+		State:     "TASK_RUNNING",
+		SlaveIP:   "127.0.0.1",
+		Resources: state.Resources{PortRanges: "[" + port + "-" + port + "]"},
+		Labels:    []state.Label{{Key: "check_http", Value: "http://{host}:{port}/health"}},
+	}
+
+	// Registered as is until the detection is done
+	ids := m.registerTask(task, "127.0.0.1")
+	if len(ids) != 1 || r.services[ids[0]].Check.HTTP != "http://127.0.0.1:"+port+"/health" {
+		t.Fatalf("registerTask() of an https endpoint => %v, want the check as is", ids)
+	}
+	waitSchemes(m, ids[0])
+
+	want := "https://127.0.0.1:" + port + "/health"
+	m.Registry = &deletingRegistry{fakeRegistry: r}
+	ids = m.registerTask(task, "127.0.0.1")
+	if len(ids) != 1 || r.services[ids[0]].Check.HTTP != want {
+		t.Fatalf("registerTask() once detected => %v, want check %s", ids, want)
+	}
+	if d := m.Registry.(*deletingRegistry).deletes; d != 1 {
+		t.Errorf("registerTask() once detected => %d re-registrations, want 1", d)
+	}
+
+	// The detected scheme is reused once the endpoint is gone
+	srv.Close()
+	ids = m.registerTask(task, "127.0.0.1")
+	if len(ids) != 1 || r.services[ids[0]].Check.HTTP != want {
+		t.Errorf("registerTask() again => %s, want the cached %s", r.services[ids[0]].Check.HTTP, want)
+	}
+	if d := m.Registry.(*deletingRegistry).deletes; d != 1 {
+		t.Errorf("registerTask() again => %d re-registrations, want 1", d)
+	}
+
+	task.Labels = append(task.Labels, state.Label{Key: "check_scheme", Value: "http"})
+	ids = m.registerTask(task, "127.0.0.1")
+	if got := r.services[ids[0]].Check.HTTP; got != "http://127.0.0.1:"+port+"/health" {
+		t.Errorf("registerTask() with a check_scheme label => %s, want http", got)
+	}
+}
+
+func TestRegisterTaskSchemeDetectFailed(t *testing.T) {
+	// An endpoint closing every connection answers on neither scheme
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepts := make(chan struct{}, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			accepts <- struct{}{}
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	m, r := newTestMesos()
+	m.CheckSchemeDetect = true
+	m.ProbeTimeout = time.Second
+	m.SkipNonRoutable = false
+
+	task := &state.Task{
+		ID:        "api.1",
+		Name:      "api",
+		State:     "TASK_RUNNING",
+		SlaveIP:   "127.0.0.1",
+		Resources: state.Resources{PortRanges: "[" + port + "-" + port + "]"},
+		Labels:    []state.Label{{Key: "check_http", Value: "http://{host}:{port}/health"}},
+	}
+
+	want := "http://127.0.0.1:" + port + "/health"
+	var id string
+	for i := 0; i < 2; i++ {
+		ids := m.registerTask(task, "127.0.0.1")
+		if len(ids) != 1 || r.services[ids[0]].Check.HTTP != want {
+			t.Fatalf("registerTask() of an endpoint answering on no scheme => %v, want check %s", ids, want)
+		}
+		id = ids[0]
+		waitSchemes(m, id)
+	}
+
+	// Only the first registration tried both schemes, the next
+	// detection waits for the backoff
+	time.Sleep(50 * time.Millisecond)
+	if n := len(accepts); n != 2 {
+		t.Errorf("registerTask() twice of an endpoint answering on no scheme => %d connections, want 2", n)
+	}
+
+	m.checkSchemes[id][want].retry = time.Now()
+	m.registerTask(task, "127.0.0.1")
+	waitSchemes(m, id)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(accepts); n != 4 {
+		t.Errorf("registerTask() after the backoff => %d connections, want 4", n)
+	}
+	if d := m.checkSchemes[id][want]; d.attempt != 2 {
+		t.Errorf("registerTask() after the backoff => attempt %d, want 2", d.attempt)
+	}
+}
+
+func TestSchemeRetry(t *testing.T) {
+	for _, tt := range []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 30 * time.Minute},
+		{100, 30 * time.Minute},
+	} {
+		if got := schemeRetry(tt.attempt); got != tt.want {
+			t.Errorf("schemeRetry(%d) => %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+// deletingRegistry counts the cache deletions of re-registrations
+type deletingRegistry struct {
+	*fakeRegistry
+	deletes int
+}
+
+func (r *deletingRegistry) CacheDelete(id string) {
+	r.deletes++
+	r.fakeRegistry.CacheDelete(id)
+}
+
+// waitSchemes waits for the scheme detections of a service
+func waitSchemes(m *Mesos, id string) {
+	for _, d := range m.checkSchemes[id] {
+		<-d.done
+	}
+}
@@ -3,8 +3,6 @@ package mesos
 import (
 	"regexp"
 	"strings"
-
-	log "github.com/sirupsen/logrus"
 )
 
 type RegexList struct {
@@ -2,33 +2,110 @@ package mesos
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/CiscoCloud/mesos-consul/audit"
 	"github.com/CiscoCloud/mesos-consul/registry"
 	"github.com/CiscoCloud/mesos-consul/state"
-
-	log "github.com/sirupsen/logrus"
 )
 
 // Query the consul agent on the Mesos Master
 // to initialize the cache.
 //
 // All services created by mesos-consul are prefixed
-// with service-id-prefix flag, followed by a colon.
+// with service-id-prefix flag, followed by service-id-separator.
 //
 func (m *Mesos) LoadCache() error {
 	log.Debug("Populating cache from Consul")
 
-	mh := m.getLeader()
+	mh, err := m.leader()
+	if err != nil {
+		return err
+	}
+
+	prefixes := append([]string{m.serviceID("")}, m.AdoptPrefixes...)
+
+	return m.Registry.CacheLoad(mh.Ip, prefixes...)
+}
+
+// ReconcileCache()
+//   Compare the cache with the services in Consul and repair the
+//   drift before the registration pass
+//
+func (m *Mesos) ReconcileCache() error {
+	mh, err := m.leader()
+	if err != nil {
+		return err
+	}
+
+	return m.Registry.CacheReconcile(mh.Ip)
+}
+
+// serviceID()
+//   Build a service ID from the service-id-prefix, the Mesos cluster
+//   name if any, and the given parts, joined with service-id-separator
+//
+func (m *Mesos) serviceID(parts ...string) string {
+	prefix := []string{m.ServiceIdPrefix}
+	if m.Cluster != "" {
+		prefix = append(prefix, m.Cluster)
+	}
+
+	return strings.Join(append(prefix, parts...), m.ServiceIdSeparator)
+}
+
+// taskServiceID()
+//   Build the ID of a task service from its agent, name, address and
+//   port, or from its name, instance index and port key with
+//   --stable-ids so that it survives the rescheduling of the task. The
+//   port key is the port name, or the port index for unnamed ports, as
+//   the host port changes with the agent.
+//
+func (m *Mesos) taskServiceID(t *state.Task, agent, tname, address, port, portKey string) string {
+	if m.StableIds {
+		if index, ok := taskInstanceIndex(t); ok {
+			if portKey == "" {
+				return m.serviceID(tname, index)
+			}
+			return m.serviceID(tname, index, portKey)
+		}
+		log.Debugf("Task %s has no consul_instance label. Not using a stable ID", t.ID)
+	}
 
-	return m.Registry.CacheLoad(mh.Ip, m.ServiceIdPrefix)
+	if port == "" {
+		return m.serviceID(agent+"-"+tname, address)
+	}
+	return m.serviceID(agent, tname, address, port)
+}
+
+// hostServiceName()
+//   Service name of a kind of Mesos host, the service-name when name
+//   is empty
+//
+func (m *Mesos) hostServiceName(name string) string {
+	if name == "" {
+		return m.ServiceName
+	}
+
+	return name
 }
 
 func (m *Mesos) RegisterHosts(s state.State) {
 	log.Debug("Running RegisterHosts")
 
+	agentName := m.hostServiceName(m.AgentServiceName)
+	masterName := m.hostServiceName(m.MasterServiceName)
+
 	m.Agents = make(map[string]string)
+	m.agentPorts = make(map[string]int)
+	m.agentHostnames = make(map[string]string)
 
 	// Register slaves
 	for _, f := range s.Slaves {
@@ -36,19 +113,59 @@ func (m *Mesos) RegisterHosts(s state.State) {
 		port := toPort(f.PID.Port)
 
 		m.Agents[f.ID] = agent
+		m.agentPorts[f.ID] = port
+		m.agentHostnames[f.ID] = f.Hostname
+
+		if excluded(m.AgentExclude, agent, f.Hostname) {
+			log.Debugf("Agent %s excluded. Not registering", f.Hostname)
+			m.auditSkip(audit.Decision{Host: f.Hostname, Reason: "excluded by --agent-exclude"})
+			continue
+		}
+
+		check := &registry.Check{
+			HTTP:     fmt.Sprintf("http://%s:%d/slave(1)/health", agent, port),
+			Interval: "10s",
+		}
 
-		m.registerHost(&registry.Service{
-			ID:      fmt.Sprintf("%s:%s:%s:%s", m.ServiceIdPrefix, m.ServiceName, f.ID, f.Hostname),
-			Name:    m.ServiceName,
+		svc := &registry.Service{
+			ID:      m.serviceID(agentName, f.ID, f.Hostname),
+			Name:    agentName,
 			Port:    port,
 			Address: agent,
 			Agent:   agent,
 			Tags:    m.agentTags("agent", "follower"),
-			Check: &registry.Check{
-				HTTP:     fmt.Sprintf("http://%s:%d/slave(1)/health", agent, port),
-				Interval: "10s",
-			},
-		})
+			Check:   check,
+		}
+
+		if m.AgentResourcesMeta {
+			svc.Meta = agentResourcesMeta(f)
+		}
+
+		if s.InMaintenance(f) {
+			svc.Tags = append(svc.Tags, prefixTag("maintenance", m.TagPrefix))
+		}
+
+		for _, key := range m.AgentAttributeTags {
+			for _, v := range f.Attribute(key) {
+				if tag := prefixTag(key+":"+v, m.TagPrefix); !sliceContainsString(svc.Tags, tag) {
+					svc.Tags = append(svc.Tags, tag)
+				}
+			}
+		}
+
+		if m.AgentNodeCheck {
+			// The agent health is checked once for the whole node
+			svc.Check = registry.DefaultCheck()
+
+			m.Registry.RegisterCheck(&registry.NodeCheck{
+				ID:    m.serviceID(agentName, f.ID, "node-health"),
+				Name:  fmt.Sprintf("Mesos agent %s", f.Hostname),
+				Agent: agent,
+				Check: check,
+			})
+		}
+
+		m.registerHost(svc)
 	}
 
 	// Register masters
@@ -56,14 +173,26 @@ func (m *Mesos) RegisterHosts(s state.State) {
 	for _, ma := range mas {
 		var tags []string
 
+		if excluded(m.MasterExclude, ma.Ip, ma.Host) {
+			log.Debugf("Master %s excluded. Not registering", ma.Host)
+			m.auditSkip(audit.Decision{Host: ma.Host, Reason: "excluded by --master-exclude"})
+			continue
+		}
+
+		if m.RegisterLeaderOnly && !ma.IsLeader {
+			log.Debugf("Master %s is not the leader. Not registering", ma.Host)
+			m.auditSkip(audit.Decision{Host: ma.Host, Reason: "not the leader, with --register-leader-only"})
+			continue
+		}
+
 		if ma.IsLeader {
 			tags = m.agentTags("leader", "master")
 		} else {
 			tags = m.agentTags("master")
 		}
 		s := &registry.Service{
-			ID:      fmt.Sprintf("%s:%s:%s:%s", m.ServiceIdPrefix, m.ServiceName, ma.Ip, ma.PortString),
-			Name:    m.ServiceName,
+			ID:      m.serviceID(masterName, ma.Ip, ma.PortString),
+			Name:    masterName,
 			Port:    ma.Port,
 			Address: ma.Ip,
 			Agent:   ma.Ip,
@@ -78,58 +207,685 @@ func (m *Mesos) RegisterHosts(s state.State) {
 	}
 }
 
+// excluded()
+//   Whether the IP or hostname of a Mesos host matches the exclude list.
+//   Excluded hosts are not marked and get deregistered by the sweep.
+//
+func excluded(rl *RegexList, ip string, hostname string) bool {
+	if rl == nil {
+		return false
+	}
+
+	return rl.MatchString(ip, false) || rl.MatchString(hostname, false)
+}
+
 func (m *Mesos) registerHost(s *registry.Service) {
+	s.Tags = m.sortTags(s.Tags)
+
+	reason := "new service"
 	h := m.Registry.CacheLookup(s.ID)
 	if h != nil {
 		log.Infof("Host found. Comparing tags: (%v, %v)", h.Tags, s.Tags)
 
-		if sliceEq(s.Tags, h.Tags) {
+		if sliceEq(s.Tags, m.sortTags(h.Tags)) && mapEq(s.Meta, h.Meta) {
 			m.Registry.CacheMark(s.ID)
 
-			// Tags are the same. Return
+			// Tags and meta are the same. Return
 			return
 		}
 
-		log.Info("Tags changed. Re-registering")
+		log.Info("Tags or meta changed. Re-registering")
+		reason = "tags or meta changed"
 
 		// Delete cache entry. It will be re-created below
 		m.Registry.CacheDelete(s.ID)
 	}
 
+	m.audit(audit.Decision{Action: audit.Register, Reason: reason, Host: s.Address, Service: s.ID})
 	m.Registry.Register(s)
 }
 
-func (m *Mesos) registerTask(t *state.Task, agent string) {
-	var tags []string
+// agentResourcesMeta()
+//   Build the mesos_agent_<resource>_{total,used,available} meta of an
+//   agent, skipping the resources missing from the state
+//
+func agentResourcesMeta(f state.Slave) map[string]string {
+	meta := make(map[string]string)
+
+	for _, r := range []struct {
+		name        string
+		total, used *float64
+	}{
+		{"cpus", f.Resources.CPUs, f.UsedResources.CPUs},
+		{"mem", f.Resources.Mem, f.UsedResources.Mem},
+		{"disk", f.Resources.Disk, f.UsedResources.Disk},
+		{"gpus", f.Resources.GPUs, f.UsedResources.GPUs},
+	} {
+		key := "mesos_agent_" + r.name
+		if r.total != nil {
+			meta[key+"_total"] = formatResource(*r.total)
+		}
+		if r.used != nil {
+			meta[key+"_used"] = formatResource(*r.used)
+		}
+		if r.total != nil && r.used != nil {
+			meta[key+"_available"] = formatResource(*r.total - *r.used)
+		}
+	}
+
+	return meta
+}
+
+// formatResource()
+//   Format a resource amount with at most 3 decimals and no trailing
+//   zeros, e.g. 0.5 or 2048
+//
+func formatResource(v float64) string {
+	s := strings.TrimRight(strconv.FormatFloat(v, 'f', 3, 64), "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		return "0"
+	}
+
+	return s
+}
+
+func (m *Mesos) registerTask(t *state.Task, agent string) []string {
+	var ids []string
+
+	if m.OptIn && !labelEnabled(t, m.RegistrationLabel) {
+		log.Debugf("Task %s not opted in with label %s. Not registering", t.ID, m.RegistrationLabel)
+		m.auditSkip(audit.Decision{Task: t.ID, Reason: fmt.Sprintf("not opted in with label %s", m.RegistrationLabel)})
+		return nil
+	}
+
+	if m.RegisterFilter != nil && !m.RegisterFilter.match(m, t) {
+		log.Debugf("Task %s doesn't match the register filter %s. Not registering", t.ID, m.RegisterFilter)
+		m.auditSkip(audit.Decision{Task: t.ID, Reason: "does not match --register-filter"})
+		return nil
+	}
+
+	if l := t.Label("consul_checks_json"); l != "" {
+		if _, err := parseChecksJSON(l); err != nil {
+			log.WithField("consul_checks_json", l).Errorf("Invalid checks of task %s: %s. Not registering", t.ID, err.Error())
+			m.auditSkip(audit.Decision{Task: t.ID, Reason: "invalid consul_checks_json label"})
+			return nil
+		}
+	}
+
+	if name := duplicatePortName(t); m.DuplicatePortNames == "error" && name != "" {
+		log.Errorf("Task %s has several ports named %s. Not registering", t.ID, name)
+		m.auditSkip(audit.Decision{Task: t.ID, Reason: fmt.Sprintf("several ports named %s", name)})
+		return nil
+	}
+
+	if m.LegacyConsulLabel == "error" && t.Label("consul") != "" {
+		log.Errorf("Task %s has a legacy consul label, use overrideTaskName instead. Not registering", t.ID)
+		m.auditSkip(audit.Decision{Task: t.ID, Reason: "legacy consul label"})
+		return nil
+	}
+
+	if n, min := m.instances[m.serviceName(t)], taskMinInstances(t); n < min {
+		log.Infof("Task %s has %d running instances, less than %d. Not registering", t.ID, n, min)
+		m.auditSkip(audit.Decision{Task: t.ID, Reason: fmt.Sprintf("%d running instances, less than %d", n, min)})
+		return nil
+	}
+
+	if age, min := time.Since(t.RunningSince()), taskMinAge(t, m.MinAge); age < min {
+		log.Debugf("Task %s running for %s, less than %s. Not registering", t.ID, age, min)
+		m.auditSkip(audit.Decision{Task: t.ID, Reason: fmt.Sprintf("running for less than %s", min)})
+		return nil
+	}
+
+	if m.SkipNonRoutable && m.taskIP(t) == "" && t.IP(m.IpStates, m.ipOrder(t)...) != "" {
+		log.Warnf("Only non-routable IP addresses found for task %s using %v. Not registering", t.ID, m.ipOrder(t))
+		m.auditSkip(audit.Decision{Task: t.ID, Reason: "only non-routable IP addresses"})
+		return nil
+	}
+
+	if m.SkipNoIp && m.taskIP(t) == "" {
+		log.Warnf("No %s IP address found for task %s using %v. Not registering", m.AddressFamily, t.ID, m.ipOrder(t))
+		m.auditSkip(audit.Decision{Task: t.ID, Reason: fmt.Sprintf("no %s IP address", m.AddressFamily)})
+		return nil
+	}
+
+	services, reason := m.taskServices(t, agent)
+	if len(services) == 0 {
+		m.auditSkip(audit.Decision{Task: t.ID, Reason: reason})
+	}
+
+	for _, s := range services {
+		if m.TagNode {
+			if tag := prefixTag("node:"+s.Agent, m.TagPrefix); !sliceContainsString(s.Tags, tag) {
+				// Copy the tags, they can be shared with other services
+				s.Tags = append(append([]string{}, s.Tags...), tag)
+			}
+		}
+		if m.TagRole {
+			s.Tags = m.roleTags(t, s.Tags)
+		}
+		if m.CheckOwnerNotes {
+			setOwnerNotes(t, s)
+		}
+
+		s.Tags = m.sortTags(s.Tags)
+
+		if m.CheckSchemeDetect {
+			m.detectSchemes(t, s)
+		}
+
+		if m.ProbeBeforeRegister && m.Registry.CacheLookup(s.ID) == nil {
+			// Registered by registerProbed() once the probe passes
+			m.queueProbe(t, s)
+			continue
+		}
+
+		m.registerService(t, s)
+		ids = append(ids, s.ID)
+	}
+
+	return ids
+}
+
+// registerService()
+//   Register a service of a task, with the body probe of its check.
+//   Like the hosts, a cached service is registered again when its tags
+//   or meta changed, and moved when its address or port changed.
+//
+func (m *Mesos) registerService(t *state.Task, s *registry.Service) {
+	probe := m.newBodyProbe(t, s.Check)
+
+	rescheme := m.schemeChanged[s.ID]
+	delete(m.schemeChanged, s.ID)
+
+	c := m.Registry.CacheLookup(s.ID)
+	switch {
+	case c == nil:
+		m.audit(audit.Decision{Action: audit.Register, Reason: "new service", Task: t.ID, Service: s.ID})
+	case c.Address != s.Address || c.Port != s.Port:
+		// The registry moves it from its previous agent
+		m.audit(audit.Decision{Action: audit.Register, Reason: "address or port changed", Task: t.ID, Service: s.ID})
+	case !sliceEq(s.Tags, m.sortTags(c.Tags)) || !mapEq(s.Meta, c.Meta):
+		log.Infof("Tags or meta of %s changed. Re-registering", s.ID)
+		m.audit(audit.Decision{Action: audit.Register, Reason: "tags or meta changed", Task: t.ID, Service: s.ID})
+		m.Registry.CacheDelete(s.ID)
+	case rescheme:
+		log.Infof("Check scheme of %s detected. Re-registering", s.ID)
+		m.audit(audit.Decision{Action: audit.Register, Reason: "check scheme detected", Task: t.ID, Service: s.ID})
+		m.Registry.CacheDelete(s.ID)
+	}
+	if m.registerQueue != nil {
+		m.registerQueue = append(m.registerQueue, queuedRegistration{service: s, probe: probe})
+		return
+	}
+	m.Registry.Register(s)
+
+	if probe != nil {
+		m.runBodyProbe(s.ID, probe)
+	}
+}
+
+// queuedRegistration is a task service registered at the end of the
+// pass, with the body probe of its check
+type queuedRegistration struct {
+	service *registry.Service
+	probe   *bodyProbe
+}
+
+// registerWorkers()
+//   Number of registrations run at once for a backlog of new services:
+//   --register-workers, scaled up to --register-workers-max by one per
+//   --register-scale-backlog services when set
+//
+func (m *Mesos) registerWorkers(backlog int) int {
+	workers := m.RegisterWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	if m.RegisterWorkersMax > workers && m.RegisterScaleBacklog > 0 {
+		scaled := (backlog + m.RegisterScaleBacklog - 1) / m.RegisterScaleBacklog
+		if scaled > m.RegisterWorkersMax {
+			scaled = m.RegisterWorkersMax
+		}
+		if scaled > workers {
+			workers = scaled
+		}
+	}
+
+	return workers
+}
+
+// flushRegistrations()
+//   Register the services queued by the pass, as many at once as
+//   registerWorkers() gives for the new ones, then start their body
+//   probes
+//
+func (m *Mesos) flushRegistrations() {
+	queue := m.registerQueue
+	m.registerQueue = nil
+	if queue == nil {
+		registerWorkersUsed.Set(1)
+		return
+	}
+
+	backlog := 0
+	for _, q := range queue {
+		if m.Registry.CacheLookup(q.service.ID) == nil {
+			backlog++
+		}
+	}
+
+	workers := m.registerWorkers(backlog)
+	registerWorkersUsed.Set(int64(workers))
+	if workers > m.RegisterWorkers {
+		log.Infof("Scaling the registrations to %d at once for %d new services", workers, backlog)
+	}
+
+	jobs := make(chan *registry.Service)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(queue); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range jobs {
+				m.safeRegister(s)
+			}
+		}()
+	}
+	for _, q := range queue {
+		jobs <- q.service
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, q := range queue {
+		if q.probe != nil {
+			m.runBodyProbe(q.service.ID, q.probe)
+		}
+	}
+}
+
+// safeRegister()
+//   Register a queued service, recovering from a panic of its
+//   registration like safeRegisterTask()
+//
+func (m *Mesos) safeRegister(s *registry.Service) {
+	defer func() {
+		if r := recover(); r != nil {
+			registerPanics.Add(1)
+			log.Errorf("Registration of %s panicked: %v. Skipping it", s.ID, r)
+			log.Debugf("Stack of the registration of %s:\n%s", s.ID, debug.Stack())
+		}
+	}()
+
+	m.Registry.Register(s)
+}
+
+// safeRegisterTask()
+//   Register a task, recovering from a panic of its registration so
+//   that one bad task doesn't stop the registration of the others
+//
+func (m *Mesos) safeRegisterTask(t *state.Task, agent string) (ids []string) {
+	defer func() {
+		if r := recover(); r != nil {
+			registerPanics.Add(1)
+			log.Errorf("Registration of task %s panicked: %v. Skipping it", t.ID, r)
+			log.Debugf("Stack of the registration of task %s:\n%s", t.ID, debug.Stack())
+			ids = nil
+		}
+	}()
+
+	return m.registerTask(t, agent)
+}
+
+// deregisterTask()
+//   Remove the services of a task in a terminal state right away
+//   instead of waiting for the cache sweep. IDs in skip were registered
+//   by a running task during this refresh and are left alone.
+//   With a deregistration grace, services are kept until their deadline
+//   and added to pending.
+//
+func (m *Mesos) deregisterTask(t *state.Task, agent string, skip map[string]bool, pending map[string]time.Time) {
+	services, _ := m.taskServices(t, agent)
+	for _, s := range services {
+		if skip[s.ID] || m.Registry.CacheLookup(s.ID) == nil {
+			continue
+		}
+
+		if m.DeregisterGrace > 0 {
+			deadline, ok := m.pendingDeregister[s.ID]
+			if !ok {
+				deadline = time.Now().Add(m.DeregisterGrace)
+				log.Infof("Task %s is %s. Deregistering %s in %s", t.ID, t.State, s.ID, m.DeregisterGrace)
+			}
+			if time.Now().Before(deadline) {
+				// Keep the service from being swept meanwhile
+				m.Registry.CacheMark(s.ID)
+				pending[s.ID] = deadline
+				continue
+			}
+		}
+
+		log.Infof("Task %s is %s. Deregistering %s", t.ID, t.State, s.ID)
+		m.audit(audit.Decision{Action: audit.Deregister, Reason: "task " + t.State, Task: t.ID, Service: s.ID})
+		m.Registry.DeregisterService(s.ID)
+	}
+}
+
+// DeregisterFramework()
+//   Deregister the cached services of a framework immediately, found by
+//   their mesos_framework meta or framework tag in the cache of each
+//   Consul cluster, and return how many were deregistered. Tasks still
+//   in the Mesos state are registered again by the next refresh.
+//
+func (m *Mesos) DeregisterFramework(name string) int {
+	m.configLock.Lock()
+	defer m.configLock.Unlock()
+
+	tag := prefixTag("framework:"+name, m.TagPrefix)
+
+	deregistered := make(map[string]bool)
+	for _, r := range registry.Registries(m.Registry) {
+		consul := registryName(r)
+		for _, id := range r.CacheIDs() {
+			s := r.CacheLookup(id)
+			if s == nil || (s.Meta["mesos_framework"] != name && !sliceContainsString(s.Tags, tag)) {
+				continue
+			}
+
+			log.WithField("consul", consul).Infof("Framework %s removed. Deregistering %s", name, id)
+			m.audit(audit.Decision{Action: audit.Deregister, Reason: "framework removed", Framework: name, Service: id})
+			r.DeregisterService(id)
+			delete(m.pendingDeregister, id)
+			deregistered[id] = true
+		}
+	}
+
+	return len(deregistered)
+}
+
+// ManagedServices()
+//   List the cached services of each Consul cluster, sorted by ID, with
+//   whether the last refresh marked them
+//
+func (m *Mesos) ManagedServices() []ManagedService {
+	m.configLock.Lock()
+	defer m.configLock.Unlock()
+
+	rs := registry.Registries(m.Registry)
+
+	services := []ManagedService{}
+	for _, r := range rs {
+		consul := ""
+		if len(rs) > 1 {
+			consul = registryName(r)
+		}
 
-	registered := false
+		for _, id := range r.CacheIDs() {
+			s := r.CacheLookup(id)
+			if s == nil {
+				continue
+			}
+
+			services = append(services, ManagedService{
+				ID:      id,
+				Name:    s.Name,
+				Tags:    s.Tags,
+				Cluster: m.Cluster,
+				Consul:  consul,
+				Marked:  r.CacheMarked(id),
+			})
+		}
+	}
+	sort.SliceStable(services, func(i, j int) bool {
+		return services[i].ID < services[j].ID
+	})
+
+	return services
+}
+
+// registryName()
+//   Name of the Consul cluster of a registry, empty if not named
+//
+func registryName(r registry.Registry) string {
+	if n, ok := r.(registry.Named); ok {
+		return n.Name()
+	}
+
+	return ""
+}
 
-	tname := cleanName(t.Name, m.Separator)
+// registryHeartbeatTTL()
+//   Heartbeat TTL the registry is running with, 0 without heartbeats
+//
+func registryHeartbeatTTL(r registry.Registry) time.Duration {
+	if h, ok := r.(registry.Heartbeater); ok {
+		return h.HeartbeatTTL()
+	}
+
+	return 0
+}
+
+// ipOrder()
+//   The --framework-ip-order of the framework of the task, or the
+//   --mesos-ip-order
+//
+func (m *Mesos) ipOrder(t *state.Task) []string {
+	if order, ok := m.frameworkIpOrder[m.Frameworks[t.FrameworkID]]; ok {
+		return order
+	}
+
+	return m.IpOrder
+}
+
+// taskIP()
+//   First IP address of the task of the configured address family,
+//   or of the other family with the fallback. Loopback, link-local and
+//   unspecified addresses are skipped with --skip-nonroutable.
+//
+func (m *Mesos) taskIP(t *state.Task) string {
+	var ips []net.IP
+	for _, ip := range t.IPs(m.IpStates, m.ipOrder(t)...) {
+		if m.SkipNonRoutable && !routable(ip) {
+			log.Debugf("Skipping non-routable IP address %s of task %s", ip, t.ID)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	if m.AddressFamily == "" || m.AddressFamily == "any" {
+		if len(ips) > 0 {
+			return ips[0].String()
+		}
+		return ""
+	}
+
+	var other string
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (m.AddressFamily == "ipv4") {
+			return ip.String()
+		}
+		if other == "" {
+			other = ip.String()
+		}
+	}
+
+	if m.AddressFallback {
+		return other
+	}
+
+	return ""
+}
+
+// routable()
+//   Whether clients can reach a service on the IP address
+//
+func routable(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsUnspecified()
+}
+
+// sandboxURL()
+//   URL browsing the sandbox of the task on its agent, empty if the
+//   agent or framework is unknown. Tasks of the command executor run
+//   in an executor named after the task.
+//
+func (m *Mesos) sandboxURL(t *state.Task) string {
+	agent, port := m.Agents[t.SlaveID], m.agentPorts[t.SlaveID]
+	if agent == "" || port == 0 || t.FrameworkID == "" {
+		log.Debugf("No sandbox URL for task %s, its agent or framework is unknown", t.ID)
+		return ""
+	}
+
+	executor := t.ExecutorID
+	if executor == "" {
+		executor = t.ID
+	}
+
+	return fmt.Sprintf("http://%s/files/browse?path=/frameworks/%s/executors/%s/runs/latest",
+		net.JoinHostPort(agent, strconv.Itoa(port)), url.QueryEscape(t.FrameworkID), url.QueryEscape(executor))
+}
+
+// serviceName()
+//   Clean name of the services of a task, before the empty name
+//   fallback
+//
+func (m *Mesos) serviceName(t *state.Task) string {
+	name := t.Name
+	tname := m.taskName(name)
 	log.Debugf("original TaskName : (%v)", tname)
+	if m.LegacyConsulLabel == "honor" && t.Label("consul") != "" {
+		name = t.Label("consul")
+		tname = m.taskName(name)
+		log.Debugf("legacy consul label TaskName : (%v)", tname)
+	}
 	if t.Label("overrideTaskName") != "" {
-		tname = cleanName(t.Label("overrideTaskName"), m.Separator)
+		name = t.Label("overrideTaskName")
+		tname = m.taskName(name)
 		log.Debugf("overrideTaskName to : (%v)", tname)
 	}
+
+	// Canary instances get a service of their own. The suffix is cleaned
+	// along with the name so that it stays a valid name.
+	if tname != "" && labelEnabled(t, "consul_canary") {
+		tname = m.taskName(name + m.CanarySuffix)
+	}
+
+	return m.maxLengthName(t, tname)
+}
+
+// maxLengthName()
+//   Truncate a service name of a task to --max-name-length
+//
+func (m *Mesos) maxLengthName(t *state.Task, tname string) string {
+	if m.MaxNameLength > 0 && len(tname) > m.MaxNameLength {
+		short := truncateName(tname, m.MaxNameLength)
+		log.Infof("Service name of task %s over %d characters. Truncating it to %s", t.ID, m.MaxNameLength, short)
+		tname = short
+	}
+
+	return tname
+}
+
+// Consul service kinds of the consul_kind label. connect-proxy is left
+// out, Consul rejects a proxy without its destination service.
+var consulKinds = []string{"mesh-gateway", "terminating-gateway", "ingress-gateway", "api-gateway"}
+
+// taskServices()
+//   Build the services that a task is registered as, or the reason why
+//   it has none
+//
+func (m *Mesos) taskServices(t *state.Task, agent string) ([]*registry.Service, string) {
+	var tags []string
+	var services []*registry.Service
+
+	tname := m.serviceName(t)
+	if emptyName(tname) {
+		if !m.EmptyNameFallback {
+			log.Warnf("Task %s has an empty name once cleaned. Not registering", t.ID)
+			return nil, "empty name once cleaned"
+		}
+		tname = m.maxLengthName(t, m.taskName(t.ID))
+		if emptyName(tname) {
+			log.Warnf("Task %s has an empty ID once cleaned. Not registering", t.ID)
+			return nil, "empty name and ID once cleaned"
+		}
+		log.Warnf("Task %s has an empty name once cleaned. Registering as %s", t.ID, tname)
+	}
 	if !m.TaskPrivilege.Allowed(tname) {
 		// Task not allowed to be registered
-		return
+		return nil, "name not allowed by --whitelist and --blacklist"
+	}
+
+	address := m.taskIP(t)
+
+	tags = taskLabelTags(t)
+	tags = append(tags, m.labelTags(t, tags)...)
+	tags = append(tags, m.templateTags(t, tags)...)
+	tags = buildRegisterTaskTags(tname, tags, m.taskTag, m.TagPrefix)
+	tags = m.withDefaultTags(tags)
+
+	meta := make(map[string]string)
+	if fw, ok := m.Frameworks[t.FrameworkID]; ok {
+		if tag := prefixTag("framework:"+fw, m.TagPrefix); !sliceContainsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+		meta["mesos_framework"] = fw
+	}
+	if started := t.StartedAt(); !started.IsZero() {
+		meta["mesos_started_at"] = started.UTC().Format(time.RFC3339)
+	}
+	if m.TagSandboxURL {
+		if u := m.sandboxURL(t); u != "" {
+			meta["mesos_sandbox_url"] = u
+		}
+	}
+	if m.TagImage {
+		if img := t.Image(); img != "" {
+			meta["mesos_image"] = img
+		}
 	}
 
-	address := t.IP(m.IpOrder...)
+	// First unlabelled DiscoveryInfo port, used as the primary port
+	// when the task ports aren't registered
+	var primary *state.DiscoveryPort
 
-	l := t.Label("tags")
-	if l != "" {
-		tags = strings.Split(t.Label("tags"), ",")
-	} else {
-		tags = []string{}
+	// Occurrences of each port name, for --duplicate-port-names, and
+	// the names taken by the ports or their renamed duplicates
+	portNames := make(map[string]int)
+	takenNames := make(map[string]bool)
+	for _, p := range t.DiscoveryInfo.Ports.DiscoveryPorts {
+		takenNames[p.Name] = true
 	}
 
-	tags = buildRegisterTaskTags(tname, tags, m.taskTag)
+	// Services of the named ports registered without checks
+	unchecked := make(map[*registry.Service]bool)
 
 	for key := range t.DiscoveryInfo.Ports.DiscoveryPorts {
 		var porttags []string
 		discoveryPort := state.DiscoveryPort(t.DiscoveryInfo.Ports.DiscoveryPorts[key])
+		if discoveryPort.Number <= 0 || discoveryPort.Number > 65535 {
+			log.Warnf("Task %s has invalid number %d for port %s. Skipping port",
+				t.Name,
+				discoveryPort.Number,
+				discoveryPort.Name)
+			continue
+		}
 		serviceName := discoveryPort.Name
+		if n := portNames[serviceName]; serviceName != "" && n > 0 {
+			if m.DuplicatePortNames == "skip" {
+				log.Warnf("Task %s has several ports named %s. Skipping port %d", t.ID, serviceName, discoveryPort.Number)
+				continue
+			}
+			renamed := fmt.Sprintf("%s-%d", serviceName, n)
+			for takenNames[renamed] {
+				n++
+				renamed = fmt.Sprintf("%s-%d", serviceName, n)
+			}
+			takenNames[renamed] = true
+			log.Warnf("Task %s has several ports named %s. Registering port %d as %s", t.ID, serviceName, discoveryPort.Number, renamed)
+			serviceName = renamed
+		}
+		portNames[discoveryPort.Name]++
 		servicePort := strconv.Itoa(discoveryPort.Number)
 		log.Debugf("%+v framework has %+v as a name for %+v port",
 			t.Name,
@@ -142,62 +898,281 @@ func (m *Mesos) registerTask(t *state.Task, agent string) {
 			porttags = []string{}
 		}
 		if discoveryPort.Name != "" {
-			m.Registry.Register(&registry.Service{
-				ID:      fmt.Sprintf("%s:%s:%s:%s:%d", m.ServiceIdPrefix, agent, tname, address, discoveryPort.Number),
+			// Copy the task tags so ports don't share a backing array
+			ptags := append([]string{}, tags...)
+			ptags = append(ptags, prefixTag(serviceName, m.TagPrefix))
+			ptags = append(ptags, prefixTags(porttags, m.TagPrefix)...)
+
+			s := &registry.Service{
+				ID:      m.taskServiceID(t, agent, tname, address, servicePort, serviceName),
 				Name:    tname,
 				Port:    toPort(servicePort),
 				Address: address,
-				Tags:    append(append(tags, serviceName), porttags...),
-				Check: GetCheck(t, &CheckVar{
-					Host: toIP(address),
-					Port: servicePort,
-				}),
-				Agent: toIP(agent),
-			})
-			registered = true
+				Tags:    ptags,
+				Meta:    meta,
+				Check:   registry.DefaultCheck(),
+				Agent:   toIP(agent),
+			}
+			if m.portCheck(t, &discoveryPort) {
+				s.Check = m.taskCheck(t, &CheckVar{
+					Host:   toIP(address),
+					Port:   servicePort,
+					Scheme: discoveryPort.Label("check_scheme"),
+				})
+			} else {
+				unchecked[s] = true
+			}
+			services = append(services, s)
+		} else if primary == nil {
+			primary = &discoveryPort
 		}
 	}
 
-	if t.Resources.PortRanges != "" {
-		for _, port := range t.Resources.Ports() {
-			m.Registry.Register(&registry.Service{
-				ID:      fmt.Sprintf("%s:%s:%s:%s:%s", m.ServiceIdPrefix, agent, tname, address, port),
+	// The primary service is registered on every task port unless
+	// --register-primary-port=false and named ports were registered
+	if t.Resources.PortRanges != "" && (m.RegisterPrimaryPort || len(services) == 0) {
+		for i, port := range t.Resources.Ports() {
+			services = append(services, &registry.Service{
+				ID:      m.taskServiceID(t, agent, tname, address, port, strconv.Itoa(i)),
 				Name:    tname,
 				Port:    toPort(port),
 				Address: address,
 				Tags:    tags,
-				Check: GetCheck(t, &CheckVar{
+				Meta:    meta,
+				Check: m.taskCheck(t, &CheckVar{
 					Host: toIP(address),
 					Port: port,
 				}),
 				Agent: toIP(agent),
 			})
-			registered = true
 		}
+	} else if primary != nil {
+		servicePort := strconv.Itoa(primary.Number)
+		services = append(services, &registry.Service{
+			ID:      m.taskServiceID(t, agent, tname, address, servicePort, "0"),
+			Name:    tname,
+			Port:    primary.Number,
+			Address: address,
+			Tags:    tags,
+			Meta:    meta,
+			Check: m.taskCheck(t, &CheckVar{
+				Host:   toIP(address),
+				Port:   servicePort,
+				Scheme: primary.Label("check_scheme"),
+			}),
+			Agent: toIP(agent),
+		})
 	}
 
-	if !registered {
-		m.Registry.Register(&registry.Service{
-			ID:      fmt.Sprintf("%s:%s-%s:%s", m.ServiceIdPrefix, agent, tname, address),
+	if len(services) == 0 {
+		services = append(services, &registry.Service{
+			ID:      m.taskServiceID(t, agent, tname, address, "", ""),
 			Name:    tname,
 			Address: address,
 			Tags:    tags,
-			Check: GetCheck(t, &CheckVar{
+			Meta:    meta,
+			Check: m.taskCheck(t, &CheckVar{
 				Host: toIP(address),
 			}),
 			Agent: toIP(agent),
 		})
 	}
+
+	// The consul_checks_json checks replace the other check labels. They
+	// target the task port, before consul_port changes it.
+	if t.Label("consul_checks_json") != "" {
+		for _, s := range services {
+			if unchecked[s] {
+				continue
+			}
+			var port string
+			if s.Port > 0 {
+				port = strconv.Itoa(s.Port)
+			}
+			s.Check = registry.DefaultCheck()
+			s.Checks = m.taskChecks(t, &CheckVar{Host: toIP(address), Port: port})
+		}
+	}
+
+	if p := t.Label("consul_partition"); p != "" {
+		for _, s := range services {
+			s.Partition = p
+		}
+	}
+
+	if k := t.Label("consul_kind"); k != "" {
+		if !sliceContainsString(consulKinds, k) {
+			log.WithField("consul_kind", k).Warnf("Invalid service kind of task %s, must be one of %s. Registering a typical service", t.ID, strings.Join(consulKinds, ", "))
+		} else {
+			for _, s := range services {
+				s.Kind = k
+			}
+		}
+	}
+
+	// Advertise a fixed port, checks still target the task port
+	if l := t.Label("consul_port"); l != "" {
+		if p, err := strconv.Atoi(l); err != nil || p <= 0 || p > 65535 {
+			log.Warnf("Task %s has invalid consul_port %s. Ignoring it", t.ID, l)
+		} else {
+			for _, s := range services {
+				s.Port = p
+			}
+		}
+	}
+
+	if sp := t.Label("consul_socket_path"); sp != "" {
+		for _, s := range services {
+			for _, c := range append([]*registry.Check{s.Check}, s.Checks...) {
+				if c.HTTP != "" || c.TCP != "" {
+					log.Warnf("Task %s is registered with socket path %s. Its HTTP or TCP check needs a TCP address", t.ID, sp)
+				}
+			}
+			s.SocketPath = sp
+			s.Port = 0
+			s.Address = ""
+		}
+	}
+
+	return services, ""
+}
+
+// taskName()
+//   Sanitize a task name with the configured sanitizer
+//
+func (m *Mesos) taskName(name string) string {
+	if m.Sanitizer == nil {
+		return cleanName(name, m.Separator)
+	}
+
+	return m.Sanitizer.Sanitize(name, m.Separator)
+}
+
+// taskCheck()
+//   Build the check of a task service
+//
+func (m *Mesos) taskCheck(t *state.Task, cv *CheckVar) *registry.Check {
+	cv.Default = m.DefaultCheck
+	cv.TimeoutRatio = m.CheckTimeoutRatio
+	cv.IntervalMin = m.CheckIntervalMin
+	cv.IntervalMax = m.CheckIntervalMax
+	c := GetCheck(t, cv)
+
+	if m.DockerChecks {
+		setDockerCheck(t, c, cv)
+	}
+
+	// Consul rejects a check with an output size but no type
+	if !hasCheckType(c) {
+		c.OutputMaxSize = 0
+	} else if c.OutputMaxSize == 0 {
+		c.OutputMaxSize = m.CheckOutputMaxSize
+	}
+
+	return c
+}
+
+// taskChecks()
+//   Build the consul_checks_json checks of a task with the defaults of
+//   the task checks
+//
+func (m *Mesos) taskChecks(t *state.Task, cv *CheckVar) []*registry.Check {
+	cv.TimeoutRatio = m.CheckTimeoutRatio
+	cv.IntervalMin = m.CheckIntervalMin
+	cv.IntervalMax = m.CheckIntervalMax
+	checks := GetChecks(t, cv)
+
+	for _, c := range checks {
+		if c.OutputMaxSize == 0 {
+			c.OutputMaxSize = m.CheckOutputMaxSize
+		}
+	}
+
+	return checks
+}
+
+// hasCheckType()
+//   Whether a check has a type. Consul ignores the empty check of a
+//   task without check labels.
+//
+func hasCheckType(c *registry.Check) bool {
+	return c != nil && (c.HTTP != "" || c.TCP != "" || c.Script != "" || c.TTL != "" || len(c.Args) > 0 || c.AliasService != "")
 }
 
-// buildRegisterTaskTags takes a cleaned task name, a slice of starting tags, and the processed
-// taskTag map and returns a slice of tags that should be applied to this task.
-func buildRegisterTaskTags(taskName string, startingTags []string, taskTag map[string][]string) []string {
-	result := startingTags
+// portCheck()
+//   Whether a named DiscoveryInfo port is checked like the task, from
+//   its check label, inherit or none, or --named-port-default-check
+//
+func (m *Mesos) portCheck(t *state.Task, p *state.DiscoveryPort) bool {
+	mode := p.Label("check")
+	switch mode {
+	case "inherit", "none":
+	case "":
+		mode = m.NamedPortCheck
+	default:
+		log.WithField("check", mode).Warnf("Invalid check of port %s of task %s, must be inherit or none. Using %s", p.Name, t.ID, m.NamedPortCheck)
+		mode = m.NamedPortCheck
+	}
+
+	return mode != "none"
+}
+
+// setOwnerNotes()
+//   Set the notes of the checks of a task service to the task owning
+//   them. Empty checks are left empty, Consul would reject them.
+//
+func setOwnerNotes(t *state.Task, s *registry.Service) {
+	for _, c := range append([]*registry.Check{s.Check}, s.Checks...) {
+		if !hasCheckType(c) {
+			continue
+		}
+
+		c.Notes = "managed by mesos-consul for task " + t.ID
+	}
+}
+
+// labelTags()
+//   Tags of the task labels starting with --label-tag-prefix, without
+//   the prefix, in the --label-tag-format, skipping the ones already
+//   in tags
+//
+func (m *Mesos) labelTags(t *state.Task, tags []string) []string {
+	if m.LabelTagPrefix == "" {
+		return nil
+	}
+
+	var result []string
+	for _, l := range t.Labels {
+		key := strings.TrimPrefix(l.Key, m.LabelTagPrefix)
+		if key == l.Key || key == "" {
+			continue
+		}
+
+		tag := key
+		switch m.LabelTagFormat {
+		case "key=value":
+			tag = key + "=" + l.Value
+		case "key:value":
+			tag = key + ":" + l.Value
+		}
+
+		if !sliceContainsString(tags, tag) && !sliceContainsString(result, tag) {
+			result = append(result, tag)
+		}
+	}
+
+	return result
+}
+
+// buildRegisterTaskTags takes a cleaned task name, a slice of starting tags, the processed
+// taskTag map and the tag prefix and returns a slice of tags that should be applied to this task.
+func buildRegisterTaskTags(taskName string, startingTags []string, taskTag map[string][]string, prefix string) []string {
+	result := prefixTags(startingTags, prefix)
 	tnameLower := strings.ToLower(taskName)
 
 	for pattern, taskTags := range taskTag {
 		for _, tag := range taskTags {
+			tag = prefixTag(tag, prefix)
 			if strings.Contains(tnameLower, pattern) {
 				if !sliceContainsString(result, tag) {
 					log.WithField("task-tag", tnameLower).Debug("Task matches pattern for tag")
@@ -212,7 +1187,7 @@ func buildRegisterTaskTags(taskName string, startingTags []string, taskTag map[s
 
 func (m *Mesos) agentTags(ts ...string) []string {
 	if len(m.ServiceTags) == 0 {
-		return ts
+		return m.withDefaultTags(prefixTags(ts, m.TagPrefix))
 	}
 
 	rval := []string{}
@@ -223,5 +1198,60 @@ func (m *Mesos) agentTags(ts ...string) []string {
 		}
 	}
 
-	return rval
+	return m.withDefaultTags(prefixTags(rval, m.TagPrefix))
+}
+
+// withDefaultTags()
+//   Add the --default-tags missing from tags, and the cluster tag
+//   with --mesos-cluster
+//
+func (m *Mesos) withDefaultTags(tags []string) []string {
+	defaults := m.DefaultTags
+	if m.Cluster != "" {
+		defaults = append([]string{"cluster:" + m.Cluster}, defaults...)
+	}
+
+	for _, tag := range defaults {
+		if tag = prefixTag(tag, m.TagPrefix); !sliceContainsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+// roleTags()
+//   Add a role:<role> tag for each role the task resources are
+//   allocated to or reserved for, except the default * role
+//
+func (m *Mesos) roleTags(t *state.Task, tags []string) []string {
+	roles := t.Roles()
+	if len(roles) == 0 {
+		return tags
+	}
+
+	// Copy the tags, they can be shared with other services
+	tags = append([]string{}, tags...)
+	for _, r := range roles {
+		if tag := prefixTag("role:"+r, m.TagPrefix); !sliceContainsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+// sortTags()
+//   Sort the tags in a new slice with --sort-tags, so that their order
+//   doesn't change between refreshes
+//
+func (m *Mesos) sortTags(tags []string) []string {
+	if !m.SortTags {
+		return tags
+	}
+
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+
+	return sorted
 }
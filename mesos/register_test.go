@@ -0,0 +1,1829 @@
+package mesos
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+
+	proto "github.com/mesos/mesos-go/mesosproto"
+	"github.com/mesos/mesos-go/upid"
+)
+
+// fakeRegistry records the services registered through it.
+type fakeRegistry struct {
+	services map[string]*registry.Service
+	checks   map[string]*registry.NodeCheck
+	kv       map[string][]byte
+	kvErr    error
+
+	// Number of cache reconciliations and sweeps
+	reconciles int
+	sweeps     int
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		services: make(map[string]*registry.Service),
+		checks:   make(map[string]*registry.NodeCheck),
+		kv:       make(map[string][]byte),
+	}
+}
+
+func (f *fakeRegistry) CacheCreate() bool                 { return false }
+func (f *fakeRegistry) CacheDelete(id string)             { delete(f.services, id) }
+func (f *fakeRegistry) CacheLoad(string, ...string) error { return nil }
+func (f *fakeRegistry) CacheReconcile(string) error       { f.reconciles++; return nil }
+func (f *fakeRegistry) CacheLookup(id string) *registry.Service {
+	return f.services[id]
+}
+func (f *fakeRegistry) CacheIDs() []string {
+	var ids []string
+	for id := range f.services {
+		ids = append(ids, id)
+	}
+	return ids
+}
+func (f *fakeRegistry) CacheMark(string)                               {}
+func (f *fakeRegistry) CacheMarked(id string) bool                     { return f.services[id] != nil }
+func (f *fakeRegistry) Register(s *registry.Service)                   { f.services[s.ID] = s }
+func (f *fakeRegistry) Deregister()                                    { f.sweeps++ }
+func (f *fakeRegistry) DeregisterService(id string)                    { delete(f.services, id) }
+func (f *fakeRegistry) RegisterCheck(c *registry.NodeCheck)            { f.checks[c.ID] = c }
+func (f *fakeRegistry) UpdateTTL(string, bool, string)                 {}
+func (f *fakeRegistry) KVSync(string, string, map[string][]byte) error { return nil }
+func (f *fakeRegistry) Ping(string) error                              { return nil }
+func (f *fakeRegistry) KVGet(_, key string) ([]byte, bool, error) {
+	v, ok := f.kv[key]
+	return v, ok, f.kvErr
+}
+
+// namedRegistry is a fakeRegistry of a named Consul cluster
+type namedRegistry struct {
+	*fakeRegistry
+	name string
+}
+
+func (n namedRegistry) Name() string { return n.name }
+
+func newTestMesos() (*Mesos, *fakeRegistry) {
+	r := newFakeRegistry()
+
+	return &Mesos{
+		Registry:            r,
+		IpOrder:             []string{"netinfo", "host"},
+		TaskPrivilege:       NewPrivilege(nil, nil),
+		FwPrivilege:         NewPrivilege(nil, nil),
+		ServiceIdPrefix:     "mesos-consul",
+		ServiceIdSeparator:  ":",
+		RegisterPrimaryPort: true,
+	}, r
+}
+
+func TestRegisterTaskNoIP(t *testing.T) {
+	for _, tt := range []struct {
+		skipNoIp bool
+		slaveIP  string
+		r        int
+	}{
+		{true, "", 0},
+		{false, "", 1},
+		{true, "10.0.0.1", 1},
+	} {
+		m, r := newTestMesos()
+		m.SkipNoIp = tt.skipNoIp
+
+		m.registerTask(&state.Task{
+			ID:      "mytask.1",
+			Name:    "mytask",
+			State:   "TASK_RUNNING",
+			SlaveIP: tt.slaveIP,
+		}, "agent")
+
+		if len(r.services) != tt.r {
+			t.Errorf("registerTask() with skipNoIp=%t registered %d services, want %d", tt.skipNoIp, len(r.services), tt.r)
+		}
+	}
+}
+
+func TestServiceID(t *testing.T) {
+	for _, tt := range []struct {
+		separator string
+		parts     []string
+		r         string
+	}{
+		{":", []string{"agent", "mytask", "10.0.0.1", "31000"}, "mesos-consul:agent:mytask:10.0.0.1:31000"},
+		{"/", []string{"agent", "mytask", "10.0.0.1", "31000"}, "mesos-consul/agent/mytask/10.0.0.1/31000"},
+		{"/", []string{"agent-mytask", "10.0.0.1"}, "mesos-consul/agent-mytask/10.0.0.1"},
+	} {
+		m, _ := newTestMesos()
+		m.ServiceIdSeparator = tt.separator
+
+		r := m.serviceID(tt.parts...)
+		if r != tt.r {
+			t.Errorf("serviceID(%v) with separator %s => %s, want %s", tt.parts, tt.separator, r, tt.r)
+		}
+	}
+}
+
+func TestRegisterHostsAgentNodeCheck(t *testing.T) {
+	for _, tt := range []struct {
+		agentNodeCheck bool
+		checks         int
+		serviceHTTP    string
+	}{
+		{false, 0, "http://10.0.0.1:5051/slave(1)/health"},
+		{true, 1, ""},
+	} {
+		m, r := newTestMesos()
+		m.ServiceName = "mesos"
+		m.AgentNodeCheck = tt.agentNodeCheck
+
+		m.RegisterHosts(state.State{
+			Slaves: []state.Slave{{
+				ID:       "S1",
+				Hostname: "agent1",
+				PID:      state.PID{UPID: &upid.UPID{ID: "slave(1)", Host: "10.0.0.1", Port: "5051"}},
+			}},
+		})
+
+		if len(r.checks) != tt.checks {
+			t.Errorf("RegisterHosts() with agentNodeCheck=%t registered %d node checks, want %d", tt.agentNodeCheck, len(r.checks), tt.checks)
+		}
+
+		s := r.services["mesos-consul:mesos:S1:agent1"]
+		if s == nil {
+			t.Errorf("RegisterHosts() with agentNodeCheck=%t did not register the agent", tt.agentNodeCheck)
+		} else if s.Check.HTTP != tt.serviceHTTP {
+			t.Errorf("RegisterHosts() with agentNodeCheck=%t service check => %s, want %s", tt.agentNodeCheck, s.Check.HTTP, tt.serviceHTTP)
+		}
+	}
+}
+
+func TestRegisterHostsAgentAttributeTags(t *testing.T) {
+	m, r := newTestMesos()
+	m.ServiceName = "mesos"
+	m.AgentAttributeTags = []string{"rack", "zones", "missing"}
+
+	m.RegisterHosts(state.State{
+		Slaves: []state.Slave{{
+			ID:         "S1",
+			Hostname:   "agent1",
+			PID:        state.PID{UPID: &upid.UPID{ID: "slave(1)", Host: "10.0.0.1", Port: "5051"}},
+			Attributes: map[string]interface{}{"rack": "r1", "zones": "{a,b}"},
+		}},
+	})
+
+	s := r.services["mesos-consul:mesos:S1:agent1"]
+	if s == nil {
+		t.Fatal("RegisterHosts() did not register the agent")
+	}
+	for _, tag := range []string{"rack:r1", "zones:a", "zones:b"} {
+		if !sliceContainsString(s.Tags, tag) {
+			t.Errorf("RegisterHosts() agent tags => %v, want %s", s.Tags, tag)
+		}
+	}
+}
+
+func TestRegisterHostsAgentExclude(t *testing.T) {
+	for _, tt := range []struct {
+		exclude []string
+		r       int
+	}{
+		{nil, 2},
+		{[]string{"^10\\.1\\."}, 1},
+		{[]string{"^agent2$"}, 1},
+		{[]string{"^agent"}, 0},
+	} {
+		m, r := newTestMesos()
+		m.ServiceName = "mesos"
+		m.AgentExclude = NewRegexList(tt.exclude)
+
+		m.RegisterHosts(state.State{
+			Slaves: []state.Slave{{
+				ID:       "S1",
+				Hostname: "agent1",
+				PID:      state.PID{UPID: &upid.UPID{ID: "slave(1)", Host: "10.0.0.1", Port: "5051"}},
+			}, {
+				ID:       "S2",
+				Hostname: "agent2",
+				PID:      state.PID{UPID: &upid.UPID{ID: "slave(1)", Host: "10.1.0.1", Port: "5051"}},
+			}},
+		})
+
+		if len(r.services) != tt.r {
+			t.Errorf("RegisterHosts() with exclude %v registered %d agents, want %d", tt.exclude, len(r.services), tt.r)
+		}
+		if len(m.Agents) != 2 {
+			t.Errorf("RegisterHosts() with exclude %v => %d known agents, want 2", tt.exclude, len(m.Agents))
+		}
+	}
+}
+
+func TestRegisterTaskPrimaryPort(t *testing.T) {
+	for _, tt := range []struct {
+		registerPrimaryPort bool
+		named               bool
+		unnamed             bool
+		r                   int
+	}{
+		{true, true, false, 2},
+		{false, true, false, 1},
+		{false, false, false, 2},
+		{true, true, true, 2},
+		{false, true, true, 2},
+	} {
+		m, r := newTestMesos()
+		m.RegisterPrimaryPort = tt.registerPrimaryPort
+
+		task := &state.Task{
+			ID:        "mytask.1",
+			Name:      "mytask",
+			State:     "TASK_RUNNING",
+			SlaveIP:   "10.0.0.1",
+			Resources: state.Resources{PortRanges: "[31000-31001]"},
+		}
+		if tt.named {
+			task.DiscoveryInfo.Ports.DiscoveryPorts = []state.DiscoveryPort{{Name: "metrics", Number: 31000}}
+		}
+		if tt.unnamed {
+			task.DiscoveryInfo.Ports.DiscoveryPorts = append(task.DiscoveryInfo.Ports.DiscoveryPorts, state.DiscoveryPort{Number: 31001})
+		}
+
+		m.registerTask(task, "agent")
+
+		if len(r.services) != tt.r {
+			t.Errorf("registerTask() with registerPrimaryPort=%t, named=%t, unnamed=%t registered %d services, want %d", tt.registerPrimaryPort, tt.named, tt.unnamed, len(r.services), tt.r)
+		}
+		if tt.unnamed && !tt.registerPrimaryPort {
+			s := r.services["mesos-consul:agent:mytask:10.0.0.1:31001"]
+			if s == nil || s.Port != 31001 || len(s.Tags) != 0 {
+				t.Errorf("registerTask() primary service => %+v, want untagged service on port 31001", s)
+			}
+		}
+	}
+}
+
+func TestRegisterTaskOptIn(t *testing.T) {
+	for _, tt := range []struct {
+		optIn  bool
+		labels []state.Label
+		r      int
+	}{
+		{false, nil, 1},
+		{true, nil, 0},
+		{true, []state.Label{{Key: "consul_register", Value: "false"}}, 0},
+		{true, []state.Label{{Key: "consul_register", Value: "true"}}, 1},
+		{true, []state.Label{{Key: "consul_register", Value: "yes"}}, 0},
+	} {
+		m, r := newTestMesos()
+		m.OptIn = tt.optIn
+		m.RegistrationLabel = "consul_register"
+
+		m.registerTask(&state.Task{
+			ID:      "mytask.1",
+			Name:    "mytask",
+			State:   "TASK_RUNNING",
+			SlaveIP: "10.0.0.1",
+			Labels:  tt.labels,
+		}, "agent")
+
+		if len(r.services) != tt.r {
+			t.Errorf("registerTask() with optIn=%t, labels=%v registered %d services, want %d", tt.optIn, tt.labels, len(r.services), tt.r)
+		}
+	}
+}
+
+func TestRegisterTaskInvalidDiscoveryPort(t *testing.T) {
+	m, r := newTestMesos()
+
+	task := &state.Task{
+		ID:      "mytask.1",
+		Name:    "mytask",
+		State:   "TASK_RUNNING",
+		SlaveIP: "10.0.0.1",
+	}
+	task.DiscoveryInfo.Ports.DiscoveryPorts = []state.DiscoveryPort{
+		{Name: "http", Number: 31000},
+		{Name: "admin", Number: 0},
+		{Name: "debug", Number: -1},
+	}
+
+	m.registerTask(task, "agent")
+
+	if len(r.services) != 1 {
+		t.Fatalf("registerTask() registered %d services, want 1", len(r.services))
+	}
+	if s := r.services["mesos-consul:agent:mytask:10.0.0.1:31000"]; s == nil || s.Port != 31000 {
+		t.Errorf("registerTask() did not register the valid port: %v", r.services)
+	}
+}
+
+func TestRegisterTaskPortCheckScheme(t *testing.T) {
+	m, r := newTestMesos()
+	m.RegisterPrimaryPort = false
+
+	task := &state.Task{
+		ID:      "mytask.1",
+		Name:    "mytask",
+		State:   "TASK_RUNNING",
+		SlaveIP: "10.0.0.1",
+		Labels:  []state.Label{{Key: "check_http", Value: "http://{host}:{port}/health"}},
+	}
+
+	api := state.DiscoveryPort{Name: "api", Number: 31000}
+	api.Labels.Labels = []state.Label{{Key: "check_scheme", Value: "https"}}
+	metrics := state.DiscoveryPort{Name: "metrics", Number: 31001}
+	metrics.Labels.Labels = []state.Label{{Key: "check_scheme", Value: "http"}}
+	task.DiscoveryInfo.Ports.DiscoveryPorts = []state.DiscoveryPort{api, metrics}
+
+	m.registerTask(task, "agent")
+
+	for id, want := range map[string]string{
+		"mesos-consul:agent:mytask:10.0.0.1:31000": "https://10.0.0.1:31000/health",
+		"mesos-consul:agent:mytask:10.0.0.1:31001": "http://10.0.0.1:31001/health",
+	} {
+		s := r.services[id]
+		if s == nil {
+			t.Errorf("registerTask() did not register %s", id)
+		} else if s.Check.HTTP != want {
+			t.Errorf("registerTask() %s check => %s, want %s", id, s.Check.HTTP, want)
+		}
+	}
+}
+
+func TestRegisterTaskPortCheck(t *testing.T) {
+	api := state.DiscoveryPort{Name: "api", Number: 31000}
+	data := state.DiscoveryPort{Name: "data", Number: 31001}
+	data.Labels.Labels = []state.Label{{Key: "check", Value: "none"}}
+	admin := state.DiscoveryPort{Name: "admin", Number: 31002}
+	admin.Labels.Labels = []state.Label{{Key: "check", Value: "inherit"}}
+
+	for _, tt := range []struct {
+		mode    string
+		checked map[int]bool
+	}{
+		{"inherit", map[int]bool{31000: true, 31001: false, 31002: true}},
+		{"none", map[int]bool{31000: false, 31001: false, 31002: true}},
+	} {
+		m, r := newTestMesos()
+		m.RegisterPrimaryPort = false
+		m.NamedPortCheck = tt.mode
+
+		task := &state.Task{
+			ID:      "mytask.1",
+			Name:    "mytask",
+			State:   "TASK_RUNNING",
+			SlaveIP: "10.0.0.1",
+			Labels:  []state.Label{{Key: "check_http", Value: "http://{host}:{port}/health"}},
+		}
+		task.DiscoveryInfo.Ports.DiscoveryPorts = []state.DiscoveryPort{api, data, admin}
+
+		m.registerTask(task, "agent")
+
+		for port, checked := range tt.checked {
+			s := r.services[fmt.Sprintf("mesos-consul:agent:mytask:10.0.0.1:%d", port)]
+			if s == nil {
+				t.Errorf("registerTask() with %s did not register port %d", tt.mode, port)
+			} else if (s.Check.HTTP != "") != checked {
+				t.Errorf("registerTask() with %s port %d check => %q, want checked %t", tt.mode, port, s.Check.HTTP, checked)
+			}
+		}
+	}
+}
+
+func TestRegisterTaskEmptyName(t *testing.T) {
+	for _, tt := range []struct {
+		fallback bool
+		name     string
+		id       string
+	}{
+		{false, "", ""},
+		{true, "", "mesos-consul:agent-marathon-abc-123:10.0.0.1"},
+		{false, "mytask", "mesos-consul:agent-mytask:10.0.0.1"},
+	} {
+		m, r := newTestMesos()
+		m.EmptyNameFallback = tt.fallback
+
+		m.registerTask(&state.Task{
+			ID:      "marathon.abc-123",
+			Name:    tt.name,
+			State:   "TASK_RUNNING",
+			SlaveIP: "10.0.0.1",
+		}, "agent")
+
+		if tt.id == "" {
+			if len(r.services) != 0 {
+				t.Errorf("registerTask(%q) with fallback=%t registered %d services, want 0", tt.name, tt.fallback, len(r.services))
+			}
+			continue
+		}
+		if _, ok := r.services[tt.id]; !ok || len(r.services) != 1 {
+			t.Errorf("registerTask(%q) with fallback=%t => %v, want %s", tt.name, tt.fallback, r.services, tt.id)
+		}
+	}
+}
+
+func TestRegisterTaskFramework(t *testing.T) {
+	m, r := newTestMesos()
+	m.Frameworks = map[string]string{"fw-1": "marathon"}
+
+	m.registerTask(&state.Task{
+		FrameworkID: "fw-1",
+		ID:          "mytask.1",
+		Name:        "mytask",
+		State:       "TASK_RUNNING",
+		SlaveIP:     "10.0.0.1",
+		Labels:      []state.Label{{Key: "tags", Value: "framework:marathon,web"}},
+		Statuses:    []state.Status{{State: "TASK_RUNNING", Timestamp: 1500000000.5}},
+	}, "agent")
+
+	s := r.services["mesos-consul:agent-mytask:10.0.0.1"]
+	if s == nil {
+		t.Fatalf("registerTask() registered %v, want mesos-consul:agent-mytask:10.0.0.1", r.services)
+	}
+	if want := []string{"framework:marathon", "web"}; !sliceEq(s.Tags, want) {
+		t.Errorf("registerTask() tags => %v, want %v", s.Tags, want)
+	}
+	if s.Meta["mesos_framework"] != "marathon" {
+		t.Errorf("registerTask() meta => %v, want mesos_framework=marathon", s.Meta)
+	}
+	if s.Meta["mesos_started_at"] != "2017-07-14T02:40:00Z" {
+		t.Errorf("registerTask() meta => %v, want mesos_started_at=2017-07-14T02:40:00Z", s.Meta)
+	}
+}
+
+func TestRegisterTaskTagNode(t *testing.T) {
+	for _, tt := range []struct {
+		tagNode bool
+		tags    []string
+	}{
+		{false, []string{"web"}},
+		{true, []string{"web", "node:10.0.0.2"}},
+	} {
+		m, r := newTestMesos()
+		m.TagNode = tt.tagNode
+
+		m.registerTask(&state.Task{
+			ID:        "mytask.1",
+			Name:      "mytask",
+			State:     "TASK_RUNNING",
+			SlaveIP:   "10.0.0.1",
+			Labels:    []state.Label{{Key: "tags", Value: "web"}},
+			Resources: state.Resources{PortRanges: "[31000-31001]"},
+		}, "10.0.0.2")
+
+		if len(r.services) != 2 {
+			t.Fatalf("registerTask() registered %d services, want 2", len(r.services))
+		}
+		for id, s := range r.services {
+			if !sliceEq(s.Tags, tt.tags) {
+				t.Errorf("registerTask() with tagNode=%t tags of %s => %v, want %v", tt.tagNode, id, s.Tags, tt.tags)
+			}
+		}
+	}
+}
+
+func TestRegisterTaskTagRole(t *testing.T) {
+	for _, tt := range []struct {
+		tagRole      bool
+		role         string
+		reservations []string
+		tags         []string
+	}{
+		{false, "team-a", nil, []string{"web"}},
+		{true, "team-a", nil, []string{"web", "role:team-a"}},
+		{true, "*", nil, []string{"web"}},
+		{true, "", nil, []string{"web"}},
+		{true, "eng/web", []string{"eng", "eng/web"}, []string{"web", "role:eng", "role:eng/web"}},
+	} {
+		m, r := newTestMesos()
+		m.TagRole = tt.tagRole
+
+		m.registerTask(&state.Task{
+			ID:               "mytask.1",
+			Name:             "mytask",
+			State:            "TASK_RUNNING",
+			SlaveIP:          "10.0.0.1",
+			Labels:           []state.Label{{Key: "tags", Value: "web"}},
+			Resources:        state.Resources{PortRanges: "[31000-31001]"},
+			Role:             tt.role,
+			ReservationRoles: tt.reservations,
+		}, "10.0.0.2")
+
+		if len(r.services) != 2 {
+			t.Fatalf("registerTask() registered %d services, want 2", len(r.services))
+		}
+		for id, s := range r.services {
+			if !sliceEq(s.Tags, tt.tags) {
+				t.Errorf("registerTask() with tagRole=%t role %q tags of %s => %v, want %v", tt.tagRole, tt.role, id, s.Tags, tt.tags)
+			}
+		}
+	}
+}
+
+func TestRegisterTaskCheckOwnerNotes(t *testing.T) {
+	for _, tt := range []struct {
+		ownerNotes bool
+		labels     []state.Label
+		notes      []string
+	}{
+		{false, []state.Label{{Key: "check_http", Value: "/health"}}, []string{""}},
+		{true, []state.Label{{Key: "check_http", Value: "/health"}}, []string{"managed by mesos-consul for task mytask.1"}},
+		{true, nil, []string{""}},
+		{true, []state.Label{{Key: "consul_checks_json", Value: `[{"type": "tcp"}, {"type": "ttl", "ttl": "30s"}]`}}, []string{"", "managed by mesos-consul for task mytask.1", "managed by mesos-consul for task mytask.1"}},
+	} {
+		m, r := newTestMesos()
+		m.CheckOwnerNotes = tt.ownerNotes
+
+		m.registerTask(&state.Task{
+			ID:        "mytask.1",
+			Name:      "mytask",
+			State:     "TASK_RUNNING",
+			SlaveIP:   "10.0.0.1",
+			Labels:    tt.labels,
+			Resources: state.Resources{PortRanges: "[31000-31000]"},
+		}, "10.0.0.1")
+
+		if len(r.services) != 1 {
+			t.Fatalf("registerTask() registered %d services, want 1", len(r.services))
+		}
+		for _, s := range r.services {
+			var notes []string
+			for _, c := range append([]*registry.Check{s.Check}, s.Checks...) {
+				notes = append(notes, c.Notes)
+			}
+			if !sliceEq(notes, tt.notes) {
+				t.Errorf("registerTask() with check-owner-notes %t and %v => notes %q, want %q", tt.ownerNotes, tt.labels, notes, tt.notes)
+			}
+		}
+	}
+}
+
+func TestRegisterTaskSameHost(t *testing.T) {
+	for _, tt := range []struct {
+		portRanges []string
+		discovery  []int
+	}{
+		{[]string{"[31000-31000]", "[31001-31001]"}, nil},
+		{nil, []int{31000, 31001}},
+	} {
+		m, r := newTestMesos()
+
+		for i := 0; i < 2; i++ {
+			task := &state.Task{
+				ID:      fmt.Sprintf("mytask.%d", i),
+				Name:    "mytask",
+				State:   "TASK_RUNNING",
+				SlaveIP: "10.0.0.1",
+			}
+			if tt.portRanges != nil {
+				task.Resources.PortRanges = tt.portRanges[i]
+			}
+			if tt.discovery != nil {
+				task.DiscoveryInfo.Ports.DiscoveryPorts = []state.DiscoveryPort{{Number: tt.discovery[i]}}
+			}
+
+			m.registerTask(task, "agent")
+		}
+
+		if len(r.services) != 2 {
+			t.Errorf("registerTask() of same-name tasks on ports %v%v of one host registered %v, want 2 services", tt.portRanges, tt.discovery, r.services)
+		}
+	}
+}
+
+func TestRegisterTaskPartition(t *testing.T) {
+	for _, tt := range []struct {
+		labels    []state.Label
+		partition string
+	}{
+		{nil, ""},
+		{[]state.Label{{Key: "consul_partition", Value: "tenant1"}}, "tenant1"},
+	} {
+		m, r := newTestMesos()
+
+		m.registerTask(&state.Task{
+			ID:        "mytask.1",
+			Name:      "mytask",
+			State:     "TASK_RUNNING",
+			SlaveIP:   "10.0.0.1",
+			Labels:    tt.labels,
+			Resources: state.Resources{PortRanges: "[31000-31001]"},
+		}, "agent")
+
+		for id, s := range r.services {
+			if s.Partition != tt.partition {
+				t.Errorf("registerTask() with labels %v partition of %s => %q, want %q", tt.labels, id, s.Partition, tt.partition)
+			}
+		}
+	}
+}
+
+func TestRegisterTaskKind(t *testing.T) {
+	for _, tt := range []struct {
+		kind string
+		want string
+	}{
+		{"", ""},
+		{"mesh-gateway", "mesh-gateway"},
+		{"connect-proxy", ""},
+		{"invalid", ""},
+	} {
+		m, r := newTestMesos()
+
+		task := &state.Task{
+			ID:        "gateway.1",
+			Name:      "gateway",
+			State:     "TASK_RUNNING",
+			SlaveIP:   "10.0.0.1",
+			Resources: state.Resources{PortRanges: "[8443-8443]"},
+		}
+		if tt.kind != "" {
+			task.Labels = []state.Label{{Key: "consul_kind", Value: tt.kind}}
+		}
+
+		if ids := m.registerTask(task, "agent"); len(ids) != 1 || r.services[ids[0]].Kind != tt.want {
+			t.Errorf("registerTask() with consul_kind %q => %v, want kind %q", tt.kind, r.services, tt.want)
+		}
+	}
+}
+
+func TestRegisterTaskConsulPort(t *testing.T) {
+	for _, tt := range []struct {
+		consulPort string
+		named      bool
+		port       int
+	}{
+		{"", false, 31000},
+		{"8080", false, 8080},
+		{"8080", true, 8080},
+		{"99999", false, 31000},
+		{"http", true, 31000},
+	} {
+		m, r := newTestMesos()
+		m.RegisterPrimaryPort = false
+
+		task := &state.Task{
+			ID:      "mytask.1",
+			Name:    "mytask",
+			State:   "TASK_RUNNING",
+			SlaveIP: "10.0.0.1",
+			Labels: []state.Label{
+				{Key: "check_http", Value: "http://{host}:{port}/health"},
+				{Key: "consul_port", Value: tt.consulPort},
+			},
+			Resources: state.Resources{PortRanges: "[31000-31000]"},
+		}
+		if tt.named {
+			task.DiscoveryInfo.Ports.DiscoveryPorts = []state.DiscoveryPort{{Name: "http", Number: 31000}}
+		}
+
+		m.registerTask(task, "agent")
+
+		if len(r.services) != 1 {
+			t.Fatalf("registerTask() registered %d services, want 1", len(r.services))
+		}
+		for _, s := range r.services {
+			if s.Port != tt.port {
+				t.Errorf("registerTask() with consul_port %q, named=%t port => %d, want %d", tt.consulPort, tt.named, s.Port, tt.port)
+			}
+			if s.Check.HTTP != "http://10.0.0.1:31000/health" {
+				t.Errorf("registerTask() with consul_port %q check => %s, want the task port", tt.consulPort, s.Check.HTTP)
+			}
+		}
+	}
+}
+
+func TestRegisterTaskSocketPath(t *testing.T) {
+	m, r := newTestMesos()
+
+	m.registerTask(&state.Task{
+		ID:      "mytask.1",
+		Name:    "mytask",
+		State:   "TASK_RUNNING",
+		SlaveIP: "10.0.0.1",
+		Labels: []state.Label{
+			{Key: "consul_socket_path", Value: "/var/run/mytask.sock"},
+			{Key: "check_ttl", Value: "30s"},
+		},
+		Resources: state.Resources{PortRanges: "[31000-31000]"},
+	}, "agent")
+
+	s := r.services["mesos-consul:agent:mytask:10.0.0.1:31000"]
+	if s == nil {
+		t.Fatalf("registerTask() registered %v, want mesos-consul:agent:mytask:10.0.0.1:31000", r.services)
+	}
+	if s.SocketPath != "/var/run/mytask.sock" || s.Port != 0 || s.Address != "" {
+		t.Errorf("registerTask() => (%s, %d, %s), want socket path without port nor address", s.SocketPath, s.Port, s.Address)
+	}
+}
+
+func TestParseStateDeregisterGrace(t *testing.T) {
+	m, r := newTestMesos()
+	m.DeregisterGrace = time.Minute
+
+	sj := func(taskState string) state.State {
+		return state.State{
+			Slaves: []state.Slave{{
+				ID:       "S1",
+				Hostname: "agent1",
+				PID:      state.PID{UPID: &upid.UPID{ID: "slave(1)", Host: "10.0.0.1", Port: "5051"}},
+			}},
+			Frameworks: []state.Framework{{
+				Tasks: []state.Task{{ID: "mytask.1", Name: "mytask", State: taskState, SlaveID: "S1"}},
+			}},
+		}
+	}
+	tasks := func() int {
+		n := 0
+		for _, s := range r.services {
+			if s.Name == "mytask" {
+				n++
+			}
+		}
+		return n
+	}
+
+	m.parseState(sj("TASK_RUNNING"))
+	m.parseState(sj("TASK_KILLED"))
+	if tasks() != 1 || len(m.pendingDeregister) != 1 {
+		t.Fatalf("parseState() of a killed task within the grace => %d services, %d pending, want 1, 1", tasks(), len(m.pendingDeregister))
+	}
+
+	// Back to running before the deadline
+	m.parseState(sj("TASK_RUNNING"))
+	if tasks() != 1 || len(m.pendingDeregister) != 0 {
+		t.Errorf("parseState() of a running task => %d services, %d pending, want 1, 0", tasks(), len(m.pendingDeregister))
+	}
+
+	m.parseState(sj("TASK_KILLED"))
+	for id := range m.pendingDeregister {
+		m.pendingDeregister[id] = time.Now().Add(-time.Second)
+	}
+	m.parseState(sj("TASK_KILLED"))
+	if tasks() != 0 || len(m.pendingDeregister) != 0 {
+		t.Errorf("parseState() of a killed task after the grace => %d services, %d pending, want 0, 0", tasks(), len(m.pendingDeregister))
+	}
+}
+
+func TestParseStateMinInstances(t *testing.T) {
+	for _, tt := range []struct {
+		instances  int
+		registered bool
+	}{
+		{2, false},
+		{3, true},
+	} {
+		m, r := newTestMesos()
+
+		var tasks []state.Task
+		for i := 0; i < tt.instances; i++ {
+			tasks = append(tasks, state.Task{
+				ID:      fmt.Sprintf("zk.%d", i),
+				Name:    "zk",
+				State:   "TASK_RUNNING",
+				SlaveID: "S1",
+				Labels:  []state.Label{{Key: "consul_min_instances", Value: "3"}},
+			})
+		}
+
+		m.parseState(state.State{
+			Slaves: []state.Slave{{
+				ID:       "S1",
+				Hostname: "agent1",
+				PID:      state.PID{UPID: &upid.UPID{ID: "slave(1)", Host: "10.0.0.1", Port: "5051"}},
+			}},
+			Frameworks: []state.Framework{{Tasks: tasks}},
+		})
+
+		registered := false
+		for _, s := range r.services {
+			registered = registered || s.Name == "zk"
+		}
+		if registered != tt.registered {
+			t.Errorf("parseState() with %d instances and consul_min_instances=3 => registered %t, want %t", tt.instances, registered, tt.registered)
+		}
+	}
+}
+
+func TestTaskIPAddressFamily(t *testing.T) {
+	task := func(ips ...string) *state.Task {
+		var addrs []state.IPAddress
+		for _, ip := range ips {
+			addrs = append(addrs, state.IPAddress{IPAddress: ip})
+		}
+		return &state.Task{
+			State: "TASK_RUNNING",
+			Statuses: []state.Status{{
+				State:           "TASK_RUNNING",
+				ContainerStatus: state.ContainerStatus{NetworkInfos: []state.NetworkInfo{{IPAddresses: addrs}}},
+			}},
+		}
+	}
+
+	for _, tt := range []struct {
+		family   string
+		fallback bool
+		ips      []string
+		r        string
+	}{
+		{"any", false, []string{"fd00::1", "10.0.0.1"}, "fd00::1"},
+		{"ipv4", false, []string{"fd00::1", "10.0.0.1"}, "10.0.0.1"},
+		{"ipv6", false, []string{"10.0.0.1", "fd00::1"}, "fd00::1"},
+		{"ipv4", false, []string{"fd00::1"}, ""},
+		{"ipv4", true, []string{"fd00::1"}, "fd00::1"},
+		{"ipv6", false, []string{"10.0.0.1"}, ""},
+		{"ipv6", true, []string{"10.0.0.1"}, "10.0.0.1"},
+	} {
+		m, _ := newTestMesos()
+		m.IpOrder = []string{"netinfo"}
+		m.AddressFamily = tt.family
+		m.AddressFallback = tt.fallback
+
+		if ip := m.taskIP(task(tt.ips...)); ip != tt.r {
+			t.Errorf("taskIP(%v) with %s, fallback=%t => %s, want %s", tt.ips, tt.family, tt.fallback, ip, tt.r)
+		}
+	}
+}
+
+func TestTaskIPStates(t *testing.T) {
+	task := &state.Task{
+		State: "TASK_RUNNING",
+		Statuses: []state.Status{
+			{State: "TASK_RUNNING", Timestamp: 1, ContainerStatus: state.ContainerStatus{NetworkInfos: []state.NetworkInfo{{IPAddress: "10.0.0.1"}}}},
+			{State: "TASK_STAGING", Timestamp: 2, ContainerStatus: state.ContainerStatus{NetworkInfos: []state.NetworkInfo{{IPAddress: "10.0.0.2"}}}},
+		},
+	}
+
+	// Each Mesos cluster resolves the IPs with its own states
+	running, _ := newTestMesos()
+	running.IpOrder = []string{"netinfo"}
+	running.IpStates = []string{"TASK_RUNNING"}
+	staging, _ := newTestMesos()
+	staging.IpOrder = []string{"netinfo"}
+	staging.IpStates = []string{"TASK_STAGING"}
+
+	if ip := running.taskIP(task); ip != "10.0.0.1" {
+		t.Errorf("taskIP() with %v => %s, want 10.0.0.1", running.IpStates, ip)
+	}
+	if ip := staging.taskIP(task); ip != "10.0.0.2" {
+		t.Errorf("taskIP() with %v => %s, want 10.0.0.2", staging.IpStates, ip)
+	}
+}
+
+func TestDefaultTags(t *testing.T) {
+	m, r := newTestMesos()
+	m.ServiceName = "mesos"
+	m.DefaultTags = []string{"cluster:prod", "dc1"}
+
+	m.RegisterHosts(state.State{
+		Slaves: []state.Slave{{
+			ID:       "S1",
+			Hostname: "agent1",
+			PID:      state.PID{UPID: &upid.UPID{ID: "slave(1)", Host: "10.0.0.1", Port: "5051"}},
+		}},
+	})
+	m.registerTask(&state.Task{
+		ID:      "mytask.1",
+		Name:    "mytask",
+		State:   "TASK_RUNNING",
+		SlaveIP: "10.0.0.1",
+		Labels:  []state.Label{{Key: "tags", Value: "dc1,web"}},
+	}, "10.0.0.1")
+
+	if len(r.services) != 2 {
+		t.Fatalf("registered %d services, want 2", len(r.services))
+	}
+	for id, s := range r.services {
+		n := 0
+		for _, tag := range s.Tags {
+			if tag == "dc1" {
+				n++
+			}
+		}
+		if !sliceContainsString(s.Tags, "cluster:prod") || n != 1 {
+			t.Errorf("%s tags => %v, want cluster:prod and dc1 once", id, s.Tags)
+		}
+	}
+}
+
+func TestSkipNonRoutable(t *testing.T) {
+	for _, tt := range []struct {
+		ip   string
+		skip bool
+		r    int
+	}{
+		{"10.0.0.1", true, 1},
+		{"127.0.0.1", true, 0},
+		{"::1", true, 0},
+		{"169.254.1.1", true, 0},
+		{"fe80::1", true, 0},
+		{"0.0.0.0", true, 0},
+		{"::", true, 0},
+		{"127.0.0.1", false, 1},
+	} {
+		m, r := newTestMesos()
+		m.IpOrder = []string{"host"}
+		m.SkipNoIp = true
+		m.SkipNonRoutable = tt.skip
+
+		m.registerTask(&state.Task{
+			ID:      "mytask.1",
+			Name:    "mytask",
+			State:   "TASK_RUNNING",
+			SlaveIP: tt.ip,
+		}, "agent")
+
+		if len(r.services) != tt.r {
+			t.Errorf("registerTask() on %s with skipNonRoutable=%t registered %d services, want %d", tt.ip, tt.skip, len(r.services), tt.r)
+		}
+	}
+
+	// The next address is used
+	m, _ := newTestMesos()
+	m.IpOrder = []string{"mesos", "host"}
+	m.SkipNonRoutable = true
+	task := &state.Task{
+		SlaveIP: "10.0.0.1",
+		Statuses: []state.Status{{
+			State:  "TASK_RUNNING",
+			Labels: []state.Label{{Key: state.MesosIPLabel, Value: "169.254.0.5"}},
+		}},
+	}
+	if ip := m.taskIP(task); ip != "10.0.0.1" {
+		t.Errorf("taskIP() with a link-local mesos IP => %s, want 10.0.0.1", ip)
+	}
+}
+
+func TestSandboxURL(t *testing.T) {
+	for _, tt := range []struct {
+		task state.Task
+		r    string
+	}{
+		{state.Task{ID: "web.1", FrameworkID: "F1", SlaveID: "S1"}, "http://10.0.0.1:5051/files/browse?path=/frameworks/F1/executors/web.1/runs/latest"},
+		{state.Task{ID: "web.1", FrameworkID: "F1", SlaveID: "S1", ExecutorID: "exec 1"}, "http://10.0.0.1:5051/files/browse?path=/frameworks/F1/executors/exec+1/runs/latest"},
+		{state.Task{ID: "web.1", SlaveID: "S1"}, ""},
+		{state.Task{ID: "web.1", FrameworkID: "F1", SlaveID: "S2"}, ""},
+	} {
+		m, r := newTestMesos()
+		m.ServiceName = "mesos"
+		m.TagSandboxURL = true
+		m.RegisterHosts(state.State{
+			Slaves: []state.Slave{{
+				ID:       "S1",
+				Hostname: "agent1",
+				PID:      state.PID{UPID: &upid.UPID{ID: "slave(1)", Host: "10.0.0.1", Port: "5051"}},
+			}},
+		})
+
+		task := tt.task
+		task.Name = "web"
+		task.State = "TASK_RUNNING"
+		task.SlaveIP = "10.0.0.1"
+		m.registerTask(&task, "10.0.0.1")
+
+		var got string
+		for _, s := range r.services {
+			if s.Name == "web" {
+				got = s.Meta["mesos_sandbox_url"]
+			}
+		}
+		if got != tt.r {
+			t.Errorf("registerTask(%+v) mesos_sandbox_url => %s, want %s", tt.task, got, tt.r)
+		}
+	}
+}
+
+func TestRegisterTaskImage(t *testing.T) {
+	for _, tt := range []struct {
+		tagImage  bool
+		container string
+		image     string
+	}{
+		{false, `{"type": "DOCKER", "docker": {"image": "nginx:1.25"}}`, ""},
+		{true, `{"type": "DOCKER", "docker": {"image": "nginx:1.25"}}`, "nginx:1.25"},
+		{true, `{"type": "MESOS", "mesos": {"image": {"type": "DOCKER", "docker": {"name": "web:2"}}}}`, "web:2"},
+		{true, "", ""},
+	} {
+		m, r := newTestMesos()
+		m.TagImage = tt.tagImage
+
+		task := state.Task{ID: "web.1", Name: "web", State: "TASK_RUNNING", SlaveIP: "10.0.0.1"}
+		if tt.container != "" {
+			if err := json.Unmarshal([]byte(tt.container), &task.Container); err != nil {
+				t.Fatal(err)
+			}
+		}
+		m.registerTask(&task, "10.0.0.1")
+
+		if len(r.services) != 1 {
+			t.Fatalf("registerTask() registered %d services, want 1", len(r.services))
+		}
+		for _, s := range r.services {
+			if got, ok := s.Meta["mesos_image"]; got != tt.image || ok != (tt.image != "") {
+				t.Errorf("registerTask() with tag-image %t and container %s => mesos_image %q, want %q", tt.tagImage, tt.container, got, tt.image)
+			}
+		}
+	}
+}
+
+func TestRegisterTaskCanary(t *testing.T) {
+	long := strings.Repeat("a", 60)
+	for _, tt := range []struct {
+		labels []state.Label
+		suffix string
+		srv    bool
+		name   string
+	}{
+		{nil, "-canary", false, "api"},
+		{[]state.Label{{Key: "consul_canary", Value: "true"}}, "-canary", false, "api-canary"},
+		{[]state.Label{{Key: "consul_canary", Value: "false"}}, "-canary", false, "api"},
+		{[]state.Label{{Key: "consul_canary", Value: "1"}, {Key: "overrideTaskName", Value: "web"}}, "-canary", false, "web-canary"},
+		{[]state.Label{{Key: "consul_canary", Value: "true"}}, " Canary.v2", false, "api-canary-v2"},
+		{[]state.Label{{Key: "consul_canary", Value: "true"}, {Key: "overrideTaskName", Value: long}}, "-canary", true, truncateName(long+"-canary", 63)},
+	} {
+		m, r := newTestMesos()
+		m.CanarySuffix = tt.suffix
+		if tt.srv {
+			m.Sanitizer = srvSafeSanitizer{next: lowerSanitizer{}}
+		}
+
+		m.registerTask(&state.Task{
+			ID:      "api.1",
+			Name:    "api",
+			State:   "TASK_RUNNING",
+			SlaveIP: "10.0.0.1",
+			Labels:  tt.labels,
+		}, "10.0.0.1")
+
+		if len(r.services) != 1 {
+			t.Fatalf("registerTask(%v) registered %d services, want 1", tt.labels, len(r.services))
+		}
+		for _, s := range r.services {
+			if s.Name != tt.name {
+				t.Errorf("registerTask(%v) => service %s, want %s", tt.labels, s.Name, tt.name)
+			}
+		}
+	}
+}
+
+func TestServiceNameMaxLength(t *testing.T) {
+	m, r := newTestMesos()
+	m.MaxNameLength = 256
+
+	long := strings.Repeat("team/", 60) + "api"
+	for _, name := range []string{long, long + "2", "api"} {
+		m.registerTask(&state.Task{
+			ID:      name + ".1",
+			Name:    name,
+			State:   "TASK_RUNNING",
+			SlaveIP: "10.0.0.1",
+		}, "10.0.0.1")
+	}
+
+	names := make(map[string]bool)
+	for _, s := range r.services {
+		if len(s.Name) > 256 {
+			t.Errorf("registerTask() of a long name => %s, want at most 256 characters", s.Name)
+		}
+		names[s.Name] = true
+	}
+	if len(names) != 3 || !names["api"] {
+		t.Errorf("registerTask() => names %v, want 3 distinct names including api", names)
+	}
+
+	task := &state.Task{Name: long}
+	if a, b := m.serviceName(task), m.serviceName(task); a != b || !strings.HasPrefix(a, "team-team-") {
+		t.Errorf("serviceName(%s) => %s then %s, want a stable truncated name", long, a, b)
+	}
+
+	// Task IDs used as names are truncated too
+	m.EmptyNameFallback = true
+	r.services = make(map[string]*registry.Service)
+	m.registerTask(&state.Task{ID: strings.Repeat("team.", 60) + "1", Name: "//", State: "TASK_RUNNING", SlaveIP: "10.0.0.1"}, "10.0.0.1")
+	if len(r.services) != 1 {
+		t.Fatalf("registerTask() of an empty name with a long ID => %d services, want 1", len(r.services))
+	}
+	for _, s := range r.services {
+		if len(s.Name) > 256 {
+			t.Errorf("registerTask() of an empty name with a long ID => %s, want at most 256 characters", s.Name)
+		}
+	}
+}
+
+func TestRegisterHostsLeaderOnly(t *testing.T) {
+	for _, tt := range []struct {
+		leaderOnly bool
+		r          []string
+	}{
+		{false, []string{"10.0.0.1", "10.0.0.2"}},
+		{true, []string{"10.0.0.1"}},
+	} {
+		m, r := newTestMesos()
+		m.ServiceName = "mesos"
+		m.MasterExclude = NewRegexList(nil)
+		m.RegisterLeaderOnly = tt.leaderOnly
+
+		for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+			id, host := "master@"+ip, ip
+			port := int32(5050)
+			m.Masters = append(m.Masters, &proto.MasterInfo{
+				Id:      &id,
+				Address: &proto.Address{Hostname: &host, Ip: &host, Port: &port},
+			})
+		}
+		m.Leader = m.Masters[0]
+
+		m.RegisterHosts(state.State{})
+
+		var ips []string
+		for _, s := range r.services {
+			ips = append(ips, s.Address)
+		}
+		sort.Strings(ips)
+		if !sliceEq(ips, tt.r) {
+			t.Errorf("RegisterHosts() with register-leader-only %t => %v, want %v", tt.leaderOnly, ips, tt.r)
+		}
+	}
+}
+
+func TestRegisterHostEmptyTags(t *testing.T) {
+	for _, tt := range []struct {
+		cached, tags []string
+		sortTags     bool
+	}{
+		{nil, []string{}, false},
+		{[]string{}, nil, false},
+		{[]string{}, []string{}, false},
+		{nil, []string{}, true},
+		{[]string{}, nil, true},
+	} {
+		m, r := newTestMesos()
+		m.SortTags = tt.sortTags
+
+		cached := &registry.Service{ID: "mesos-consul:mesos:S1", Tags: tt.cached}
+		r.services[cached.ID] = cached
+
+		m.registerHost(&registry.Service{ID: cached.ID, Tags: tt.tags})
+		if r.services[cached.ID] != cached {
+			t.Errorf("registerHost(%#v) with cached tags %#v and sort-tags %t re-registered the service", tt.tags, tt.cached, tt.sortTags)
+		}
+	}
+}
+
+func TestRegisterHostSortTags(t *testing.T) {
+	for _, tt := range []struct {
+		sortTags     bool
+		reregistered bool
+	}{
+		{false, true},
+		{true, false},
+	} {
+		m, r := newTestMesos()
+		m.SortTags = tt.sortTags
+
+		cached := &registry.Service{ID: "mesos-consul:mesos:S1", Tags: []string{"master", "leader"}}
+		r.services[cached.ID] = cached
+
+		m.registerHost(&registry.Service{ID: cached.ID, Tags: []string{"leader", "master"}})
+		if got := r.services[cached.ID] != cached; got != tt.reregistered {
+			t.Errorf("registerHost() with reordered tags and sort-tags %t => re-registered %t, want %t", tt.sortTags, got, tt.reregistered)
+		}
+	}
+
+	m, r := newTestMesos()
+	m.SortTags = true
+	m.registerHost(&registry.Service{ID: "new", Tags: []string{"master", "leader"}})
+	if tags := r.services["new"].Tags; !sliceEq(tags, []string{"leader", "master"}) {
+		t.Errorf("registerHost() with sort-tags => tags %v, want [leader master]", tags)
+	}
+}
+
+func TestRegisterTaskCluster(t *testing.T) {
+	for _, tt := range []struct {
+		cluster string
+		id      string
+		tags    []string
+	}{
+		{"", "mesos-consul:", nil},
+		{"prod", "mesos-consul:prod:", []string{"cluster:prod"}},
+	} {
+		m, r := newTestMesos()
+		m.Cluster = tt.cluster
+
+		if prefix := m.serviceID(""); prefix != tt.id {
+			t.Errorf("serviceID(\"\") with cluster %q => %s, want %s", tt.cluster, prefix, tt.id)
+		}
+
+		m.registerTask(&state.Task{
+			ID:      "api.1",
+			Name:    "api",
+			State:   "TASK_RUNNING",
+			SlaveIP: "10.0.0.1",
+		}, "10.0.0.1")
+
+		for id, s := range r.services {
+			if !strings.HasPrefix(id, tt.id) {
+				t.Errorf("registerTask() with cluster %q => ID %s, want prefix %s", tt.cluster, id, tt.id)
+			}
+			if !sliceEq(s.Tags, tt.tags) {
+				t.Errorf("registerTask() with cluster %q => tags %v, want %v", tt.cluster, s.Tags, tt.tags)
+			}
+		}
+	}
+}
+
+func TestAgentResourcesMeta(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+
+	for _, tt := range []struct {
+		total, used state.ScalarResources
+		meta        map[string]string
+	}{
+		{state.ScalarResources{}, state.ScalarResources{}, map[string]string{}},
+		{
+			state.ScalarResources{CPUs: f(8), Mem: f(15360)},
+			state.ScalarResources{CPUs: f(2.3), Mem: f(2048.5)},
+			map[string]string{
+				"mesos_agent_cpus_total":     "8",
+				"mesos_agent_cpus_used":      "2.3",
+				"mesos_agent_cpus_available": "5.7",
+				"mesos_agent_mem_total":      "15360",
+				"mesos_agent_mem_used":       "2048.5",
+				"mesos_agent_mem_available":  "13311.5",
+			},
+		},
+		{
+			state.ScalarResources{Disk: f(100)},
+			state.ScalarResources{GPUs: f(0)},
+			map[string]string{"mesos_agent_disk_total": "100", "mesos_agent_gpus_used": "0"},
+		},
+	} {
+		meta := agentResourcesMeta(state.Slave{Resources: tt.total, UsedResources: tt.used})
+		if !mapEq(meta, tt.meta) {
+			t.Errorf("agentResourcesMeta(%+v, %+v) => %v, want %v", tt.total, tt.used, meta, tt.meta)
+		}
+	}
+
+	m, r := newTestMesos()
+	m.AgentResourcesMeta = true
+	m.registerHost(&registry.Service{ID: "agent", Meta: map[string]string{"mesos_agent_cpus_used": "1"}})
+	cached := r.services["agent"]
+
+	m.registerHost(&registry.Service{ID: "agent", Meta: map[string]string{"mesos_agent_cpus_used": "1"}})
+	if r.services["agent"] != cached {
+		t.Error("registerHost() with the same meta re-registered the service")
+	}
+	m.registerHost(&registry.Service{ID: "agent", Meta: map[string]string{"mesos_agent_cpus_used": "2"}})
+	if r.services["agent"].Meta["mesos_agent_cpus_used"] != "2" {
+		t.Errorf("registerHost() with new meta => %v, want mesos_agent_cpus_used 2", r.services["agent"].Meta)
+	}
+}
+
+func TestDeregisterFramework(t *testing.T) {
+	m, r := newTestMesos()
+	m.TagPrefix = "mc/"
+	m.pendingDeregister = map[string]time.Time{"mesos-consul:a:web.1": time.Now()}
+
+	for _, s := range []*registry.Service{
+		{ID: "mesos-consul:a:web.1", Meta: map[string]string{"mesos_framework": "marathon"}},
+		{ID: "mesos-consul:a:api.1", Tags: []string{"mc/framework:marathon"}},
+		{ID: "mesos-consul:a:job.1", Meta: map[string]string{"mesos_framework": "chronos"}},
+		{ID: "mesos-consul:mesos:S1", Tags: []string{"mc/agent"}},
+	} {
+		r.Register(s)
+	}
+
+	if n := m.DeregisterFramework("marathon"); n != 2 {
+		t.Errorf("DeregisterFramework(marathon) => %d, want 2", n)
+	}
+
+	var ids []string
+	for id := range r.services {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if want := []string{"mesos-consul:a:job.1", "mesos-consul:mesos:S1"}; !sliceEq(ids, want) {
+		t.Errorf("DeregisterFramework(marathon) left %v, want %v", ids, want)
+	}
+	if len(m.pendingDeregister) != 0 {
+		t.Errorf("DeregisterFramework(marathon) left pending deregistrations %v", m.pendingDeregister)
+	}
+
+	// A service cached by only one Consul cluster, or with other tags in
+	// each, is still deregistered from the clusters matching
+	a := namedRegistry{newFakeRegistry(), "a"}
+	b := namedRegistry{newFakeRegistry(), "b"}
+	a.Register(&registry.Service{ID: "mesos-consul:a:web.1", Tags: []string{"mc/framework:marathon"}})
+	b.Register(&registry.Service{ID: "mesos-consul:a:web.1", Tags: []string{"mc/framework:marathon", "v2"}})
+	b.Register(&registry.Service{ID: "mesos-consul:a:api.1", Tags: []string{"mc/framework:marathon"}})
+	m.Registry = registry.Multi{a, b}
+
+	if n := m.DeregisterFramework("marathon"); n != 2 || len(a.services) != 0 || len(b.services) != 0 {
+		t.Errorf("DeregisterFramework(marathon) of two clusters => %d, left %v and %v, want 2 and none", n, a.services, b.services)
+	}
+}
+
+func TestLegacyConsulLabel(t *testing.T) {
+	for _, tt := range []struct {
+		mode   string
+		labels []state.Label
+		names  []string
+	}{
+		{"ignore", []state.Label{{Key: "consul", Value: "web"}}, []string{"api"}},
+		{"honor", []state.Label{{Key: "consul", Value: "web"}}, []string{"web"}},
+		{"honor", []state.Label{{Key: "consul", Value: "web"}, {Key: "overrideTaskName", Value: "front"}}, []string{"front"}},
+		{"honor", nil, []string{"api"}},
+		{"error", []state.Label{{Key: "consul", Value: "web"}}, nil},
+		{"error", nil, []string{"api"}},
+	} {
+		m, r := newTestMesos()
+		m.LegacyConsulLabel = tt.mode
+
+		m.registerTask(&state.Task{
+			ID:      "api.1",
+			Name:    "api",
+			State:   "TASK_RUNNING",
+			SlaveIP: "10.0.0.1",
+			Labels:  tt.labels,
+		}, "10.0.0.1")
+
+		var names []string
+		for _, s := range r.services {
+			names = append(names, s.Name)
+		}
+		if !sliceEq(names, tt.names) {
+			t.Errorf("registerTask(%v) with legacy-consul-label %s => %v, want %v", tt.labels, tt.mode, names, tt.names)
+		}
+	}
+}
+
+func TestRegisterTaskChecksJSON(t *testing.T) {
+	for _, tt := range []struct {
+		label  string
+		checks int
+	}{
+		{`[{"type": "http", "target": "/health"}, {"type": "tcp"}]`, 2},
+		{`[{"type": "http", "target": "/health"`, -1},
+	} {
+		m, r := newTestMesos()
+
+		m.registerTask(&state.Task{
+			ID:        "api.1",
+			Name:      "api",
+			State:     "TASK_RUNNING",
+			SlaveIP:   "10.0.0.1",
+			Resources: state.Resources{PortRanges: "[31000-31000]"},
+			Labels: []state.Label{
+				{Key: "check_http", Value: "http://{host}:{port}/"},
+				{Key: "consul_checks_json", Value: tt.label},
+			},
+		}, "10.0.0.1")
+
+		if tt.checks < 0 {
+			if len(r.services) != 0 {
+				t.Errorf("registerTask(%s) registered %d services, want none", tt.label, len(r.services))
+			}
+			continue
+		}
+		if len(r.services) != 1 {
+			t.Fatalf("registerTask(%s) registered %d services, want 1", tt.label, len(r.services))
+		}
+		for _, s := range r.services {
+			if len(s.Checks) != tt.checks || s.Check.HTTP != "" {
+				t.Errorf("registerTask(%s) => check %+v and %d checks, want %d checks only", tt.label, s.Check, len(s.Checks), tt.checks)
+			}
+		}
+	}
+}
+
+func TestRegisterTaskNameCase(t *testing.T) {
+	for _, tt := range []struct {
+		nameCase string
+		name     string
+	}{
+		{"lower", "my-app"},
+		{"upper", "MY-APP"},
+		{"preserve", "My-App"},
+	} {
+		m, r := newTestMesos()
+		m.Sanitizer, _ = NewNameSanitizer("default", "", tt.nameCase)
+
+		task := &state.Task{
+			ID:        "My_App.1",
+			Name:      "My_App",
+			State:     "TASK_RUNNING",
+			SlaveIP:   "10.0.0.1",
+			Resources: state.Resources{PortRanges: "[31000-31000]"},
+		}
+		m.Separator = "-"
+		first := m.registerTask(task, "10.0.0.1")
+		second := m.registerTask(task, "10.0.0.1")
+
+		if len(r.services) != 1 || !sliceEq(first, second) {
+			t.Fatalf("registerTask() twice with name-case %s => %v then %v, want the same service", tt.nameCase, first, second)
+		}
+		for _, s := range r.services {
+			if s.Name != tt.name || !strings.Contains(s.ID, tt.name) {
+				t.Errorf("registerTask() with name-case %s => %s (%s), want %s", tt.nameCase, s.Name, s.ID, tt.name)
+			}
+		}
+	}
+}
+
+func TestFrameworkIpOrder(t *testing.T) {
+	m, r := newTestMesos()
+	m.Frameworks = map[string]string{"F1": "marathon", "F2": "aurora"}
+	m.frameworkIpOrder = map[string][]string{"marathon": {"host"}}
+
+	for _, fw := range []string{"F1", "F2"} {
+		m.registerTask(&state.Task{
+			FrameworkID: fw,
+			ID:          "api-" + fw,
+			Name:        "api-" + fw,
+			State:       "TASK_RUNNING",
+			SlaveIP:     "10.0.0.1",
+			Statuses: []state.Status{{
+				State: "TASK_RUNNING",
+				ContainerStatus: state.ContainerStatus{NetworkInfos: []state.NetworkInfo{{
+					IPAddresses: []state.IPAddress{{IPAddress: "172.17.0.2"}},
+				}}},
+			}},
+		}, "10.0.0.1")
+	}
+
+	for _, tt := range []struct {
+		name    string
+		address string
+	}{
+		{"api-f1", "10.0.0.1"},
+		{"api-f2", "172.17.0.2"},
+	} {
+		var addresses []string
+		for _, s := range r.services {
+			if s.Name == tt.name {
+				addresses = append(addresses, s.Address)
+			}
+		}
+		if !sliceEq(addresses, []string{tt.address}) {
+			t.Errorf("registerTask(%s) => addresses %v, want [%s]", tt.name, addresses, tt.address)
+		}
+	}
+}
+
+func TestRegisterTaskStableIds(t *testing.T) {
+	for _, tt := range []struct {
+		stable bool
+		labels []state.Label
+		ids    []string
+	}{
+		{false, []state.Label{{Key: "consul_instance", Value: "1"}}, []string{"mesos-consul:10.0.0.1:web:10.0.0.1:31000", "mesos-consul:10.0.0.2:web:10.0.0.2:31005"}},
+		{true, []state.Label{{Key: "consul_instance", Value: "1"}}, []string{"mesos-consul:web:1:0", "mesos-consul:web:1:0"}},
+		{true, []state.Label{{Key: "consul_instance", Value: "01"}}, []string{"mesos-consul:web:1:0", "mesos-consul:web:1:0"}},
+		{true, []state.Label{{Key: "consul_instance", Value: "-1"}}, []string{"mesos-consul:10.0.0.1:web:10.0.0.1:31000", "mesos-consul:10.0.0.2:web:10.0.0.2:31005"}},
+		{true, nil, []string{"mesos-consul:10.0.0.1:web:10.0.0.1:31000", "mesos-consul:10.0.0.2:web:10.0.0.2:31005"}},
+	} {
+		m, _ := newTestMesos()
+		m.StableIds = tt.stable
+
+		// The task is rescheduled from 10.0.0.1 to 10.0.0.2, on another
+		// host port
+		var ids []string
+		for i, agent := range []string{"10.0.0.1", "10.0.0.2"} {
+			port := 31000 + 5*i
+			ids = append(ids, m.registerTask(&state.Task{
+				ID:        fmt.Sprintf("web.%d", i),
+				Name:      "web",
+				State:     "TASK_RUNNING",
+				SlaveIP:   agent,
+				Labels:    tt.labels,
+				Resources: state.Resources{PortRanges: fmt.Sprintf("[%d-%d]", port, port)},
+			}, agent)...)
+		}
+
+		if !sliceEq(ids, tt.ids) {
+			t.Errorf("registerTask() with stable IDs %t and labels %v => %v, want %v", tt.stable, tt.labels, ids, tt.ids)
+		}
+	}
+
+	m, _ := newTestMesos()
+	m.StableIds = true
+	task := &state.Task{ID: "web.0", Name: "web", State: "TASK_RUNNING", SlaveIP: "10.0.0.1", Labels: []state.Label{{Key: "consul_instance", Value: "2"}}}
+	if ids := m.registerTask(task, "10.0.0.1"); !sliceEq(ids, []string{"mesos-consul:web:2"}) {
+		t.Errorf("registerTask() of a task without ports with stable IDs => %v, want [mesos-consul:web:2]", ids)
+	}
+
+	task.DiscoveryInfo.Ports.DiscoveryPorts = []state.DiscoveryPort{{Name: "http", Number: 31002}}
+	if ids := m.registerTask(task, "10.0.0.1"); !sliceEq(ids, []string{"mesos-consul:web:2:http"}) {
+		t.Errorf("registerTask() of a named port with stable IDs => %v, want [mesos-consul:web:2:http]", ids)
+	}
+}
+
+func TestManagedServices(t *testing.T) {
+	m, r := newTestMesos()
+	m.Cluster = "prod"
+
+	for _, s := range []*registry.Service{
+		{ID: "mesos-consul:prod:b", Name: "web", Tags: []string{"framework:marathon"}},
+		{ID: "mesos-consul:prod:a", Name: "api"},
+	} {
+		r.Register(s)
+	}
+
+	want := []ManagedService{
+		{ID: "mesos-consul:prod:a", Name: "api", Cluster: "prod", Marked: true},
+		{ID: "mesos-consul:prod:b", Name: "web", Tags: []string{"framework:marathon"}, Cluster: "prod", Marked: true},
+	}
+	if services := m.ManagedServices(); !reflect.DeepEqual(services, want) {
+		t.Errorf("ManagedServices() => %+v, want %+v", services, want)
+	}
+
+	m, _ = newTestMesos()
+	if services := m.ManagedServices(); services == nil || len(services) != 0 {
+		t.Errorf("ManagedServices() of an empty cache => %#v, want an empty list", services)
+	}
+
+	// Each Consul cluster reports its own services
+	a := namedRegistry{newFakeRegistry(), "a"}
+	b := namedRegistry{newFakeRegistry(), "b"}
+	a.Register(&registry.Service{ID: "mesos-consul:web", Name: "web", Tags: []string{"v1"}})
+	b.Register(&registry.Service{ID: "mesos-consul:web", Name: "web", Tags: []string{"v2"}})
+	b.Register(&registry.Service{ID: "mesos-consul:api", Name: "api"})
+	m.Registry = registry.Multi{a, b}
+
+	want = []ManagedService{
+		{ID: "mesos-consul:api", Name: "api", Consul: "b", Marked: true},
+		{ID: "mesos-consul:web", Name: "web", Tags: []string{"v1"}, Consul: "a", Marked: true},
+		{ID: "mesos-consul:web", Name: "web", Tags: []string{"v2"}, Consul: "b", Marked: true},
+	}
+	if services := m.ManagedServices(); !reflect.DeepEqual(services, want) {
+		t.Errorf("ManagedServices() of two Consul clusters => %+v, want %+v", services, want)
+	}
+}
+
+func TestRegisterTaskLabelTags(t *testing.T) {
+	labels := []state.Label{
+		{Key: "tags", Value: "web,env=prod"},
+		{Key: "tag.env", Value: "prod"},
+		{Key: "tag.zone", Value: "eu"},
+		{Key: "tag.", Value: "empty"},
+		{Key: "other", Value: "x"},
+	}
+
+	for _, tt := range []struct {
+		prefix string
+		format string
+		tags   []string
+	}{
+		{"", "key=value", []string{"web", "env=prod"}},
+		{"tag.", "key=value", []string{"web", "env=prod", "zone=eu"}},
+		{"tag.", "key:value", []string{"web", "env=prod", "env:prod", "zone:eu"}},
+		{"tag.", "key", []string{"web", "env=prod", "env", "zone"}},
+	} {
+		m, r := newTestMesos()
+		m.LabelTagPrefix = tt.prefix
+		m.LabelTagFormat = tt.format
+
+		m.registerTask(&state.Task{
+			ID:      "web.1",
+			Name:    "web",
+			State:   "TASK_RUNNING",
+			SlaveIP: "10.0.0.1",
+			Labels:  labels,
+		}, "10.0.0.1")
+
+		if len(r.services) != 1 {
+			t.Fatalf("registerTask() => %d services, want 1", len(r.services))
+		}
+		for _, s := range r.services {
+			if !sliceEq(s.Tags, tt.tags) {
+				t.Errorf("registerTask() with label tag prefix %q and format %s => tags %v, want %v", tt.prefix, tt.format, s.Tags, tt.tags)
+			}
+		}
+	}
+}
+
+// panicRegistry panics when registering the services named name
+type panicRegistry struct {
+	*fakeRegistry
+	name string
+}
+
+func (p panicRegistry) Register(s *registry.Service) {
+	if s.Name == p.name {
+		panic("bad task")
+	}
+	p.fakeRegistry.Register(s)
+}
+
+func TestParseStateRegisterPanic(t *testing.T) {
+	m, r := newTestMesos()
+	m.Registry = panicRegistry{fakeRegistry: r, name: "bad"}
+	before := registerPanics.Value()
+
+	var tasks []state.Task
+	for _, name := range []string{"web", "bad", "api"} {
+		tasks = append(tasks, state.Task{ID: name + ".1", Name: name, State: "TASK_RUNNING", SlaveID: "S1"})
+	}
+
+	m.parseState(state.State{
+		Slaves: []state.Slave{{
+			ID:       "S1",
+			Hostname: "agent1",
+			PID:      state.PID{UPID: &upid.UPID{ID: "slave(1)", Host: "10.0.0.1", Port: "5051"}},
+		}},
+		Frameworks: []state.Framework{{Tasks: tasks}},
+	})
+
+	var names []string
+	for _, s := range r.services {
+		if s.Name == "web" || s.Name == "bad" || s.Name == "api" {
+			names = append(names, s.Name)
+		}
+	}
+	sort.Strings(names)
+	if !sliceEq(names, []string{"api", "web"}) {
+		t.Errorf("parseState() with a panicking task => registered %v, want [api web]", names)
+	}
+	if n := registerPanics.Value() - before; n != 1 {
+		t.Errorf("parseState() with a panicking task => %d register panics, want 1", n)
+	}
+}
+
+// lockedRegistry serializes the registrations into a registry, for the
+// registrations run at once
+type lockedRegistry struct {
+	registry.Registry
+	sync.Mutex
+}
+
+func (l *lockedRegistry) Register(s *registry.Service) {
+	l.Lock()
+	defer l.Unlock()
+	l.Registry.Register(s)
+}
+
+func TestRegisterWorkers(t *testing.T) {
+	for _, tt := range []struct {
+		workers, max, backlog int
+		services              int
+		want                  int
+	}{
+		{1, 0, 50, 500, 1},
+		{4, 0, 50, 500, 4},
+		{1, 8, 50, 0, 1},
+		{1, 8, 50, 120, 3},
+		{2, 8, 50, 60, 2},
+		{1, 8, 50, 5000, 8},
+	} {
+		m, _ := newTestMesos()
+		m.RegisterWorkers = tt.workers
+		m.RegisterWorkersMax = tt.max
+		m.RegisterScaleBacklog = tt.backlog
+
+		if n := m.registerWorkers(tt.services); n != tt.want {
+			t.Errorf("registerWorkers(%d) with %d workers, max %d and backlog %d => %d, want %d", tt.services, tt.workers, tt.max, tt.backlog, n, tt.want)
+		}
+	}
+}
+
+func TestParseStateRegisterWorkers(t *testing.T) {
+	m, r := newTestMesos()
+	m.Registry = &lockedRegistry{Registry: panicRegistry{fakeRegistry: r, name: "bad"}}
+	m.RegisterWorkersMax = 4
+	m.RegisterScaleBacklog = 2
+	before := registerPanics.Value()
+
+	var tasks []state.Task
+	for _, name := range []string{"a", "b", "c", "d", "e", "bad"} {
+		tasks = append(tasks, state.Task{ID: name + ".1", Name: name, State: "TASK_RUNNING", SlaveID: "S1"})
+	}
+
+	m.parseState(state.State{
+		Slaves: []state.Slave{{
+			ID:       "S1",
+			Hostname: "agent1",
+			PID:      state.PID{UPID: &upid.UPID{ID: "slave(1)", Host: "10.0.0.1", Port: "5051"}},
+		}},
+		Frameworks: []state.Framework{{Tasks: tasks}},
+	})
+
+	var names []string
+	for _, s := range r.services {
+		if s.Name != "" {
+			names = append(names, s.Name)
+		}
+	}
+	sort.Strings(names)
+	if !sliceEq(names, []string{"a", "b", "c", "d", "e"}) {
+		t.Errorf("parseState() with register workers => registered %v, want [a b c d e]", names)
+	}
+	if n := registerWorkersUsed.Value(); n != 3 {
+		t.Errorf("parseState() of 6 new services by 2 per worker => %d workers, want 3", n)
+	}
+	if n := registerPanics.Value() - before; n != 1 {
+		t.Errorf("parseState() with register workers and a panicking task => %d register panics, want 1", n)
+	}
+	if m.registerQueue != nil {
+		t.Errorf("parseState() left %d queued registrations", len(m.registerQueue))
+	}
+}
+
+func TestRegisterHostsServiceNames(t *testing.T) {
+	for _, tt := range []struct {
+		agent, master string
+		ids           []string
+	}{
+		{"", "", []string{"mesos-consul:mesos:10.0.0.1:5050", "mesos-consul:mesos:S1:agent1"}},
+		{"mesos-agent", "mesos-master", []string{"mesos-consul:mesos-agent:S1:agent1", "mesos-consul:mesos-master:10.0.0.1:5050"}},
+		{"mesos-agent", "", []string{"mesos-consul:mesos-agent:S1:agent1", "mesos-consul:mesos:10.0.0.1:5050"}},
+	} {
+		m, r := newTestMesos()
+		m.ServiceName = "mesos"
+		m.AgentServiceName = tt.agent
+		m.MasterServiceName = tt.master
+
+		id, host := "master@10.0.0.1", "10.0.0.1"
+		port := int32(5050)
+		m.Masters = []*proto.MasterInfo{{Id: &id, Address: &proto.Address{Hostname: &host, Ip: &host, Port: &port}}}
+		m.Leader = m.Masters[0]
+
+		m.RegisterHosts(state.State{Slaves: []state.Slave{{
+			ID:       "S1",
+			Hostname: "agent1",
+			PID:      state.PID{UPID: &upid.UPID{ID: "slave(1)", Host: "10.0.0.2", Port: "5051"}},
+		}}})
+
+		var ids []string
+		for id, s := range r.services {
+			ids = append(ids, id)
+			if want := strings.Split(id, ":")[1]; s.Name != want {
+				t.Errorf("RegisterHosts() registered %s as %s, want %s", id, s.Name, want)
+			}
+		}
+		sort.Strings(ids)
+		if !sliceEq(ids, tt.ids) {
+			t.Errorf("RegisterHosts() with agent and master service names %q, %q => %v, want %v", tt.agent, tt.master, ids, tt.ids)
+		}
+	}
+}
+
+func TestRegisterTaskDuplicatePortNames(t *testing.T) {
+	for _, tt := range []struct {
+		mode string
+		tags map[string]string
+	}{
+		{"index", map[string]string{"31000": "http", "31001": "http-1", "31002": "admin", "31003": "http-2"}},
+		{"skip", map[string]string{"31000": "http", "31002": "admin"}},
+		{"error", map[string]string{}},
+	} {
+		m, r := newTestMesos()
+		m.DuplicatePortNames = tt.mode
+
+		task := &state.Task{ID: "web.1", Name: "web", State: "TASK_RUNNING", SlaveIP: "10.0.0.1"}
+		task.DiscoveryInfo.Ports.DiscoveryPorts = []state.DiscoveryPort{
+			{Name: "http", Number: 31000},
+			{Name: "http", Number: 31001},
+			{Name: "admin", Number: 31002},
+			{Name: "http", Number: 31003},
+		}
+		m.registerTask(task, "10.0.0.1")
+
+		tags := make(map[string]string)
+		for _, s := range r.services {
+			tags[strconv.Itoa(s.Port)] = strings.Join(s.Tags, ",")
+		}
+		if !reflect.DeepEqual(tags, tt.tags) {
+			t.Errorf("registerTask() with duplicate port names in %s mode => port tags %v, want %v", tt.mode, tags, tt.tags)
+		}
+	}
+
+	// A renamed port skips the names of the other ports
+	m, r := newTestMesos()
+	m.DuplicatePortNames = "index"
+	task := &state.Task{ID: "web.1", Name: "web", State: "TASK_RUNNING", SlaveIP: "10.0.0.1"}
+	task.DiscoveryInfo.Ports.DiscoveryPorts = []state.DiscoveryPort{
+		{Name: "http", Number: 31000},
+		{Name: "http", Number: 31001},
+		{Name: "http-1", Number: 31002},
+		{Name: "http", Number: 31003},
+	}
+	m.registerTask(task, "10.0.0.1")
+
+	tags := make(map[string]string)
+	for _, s := range r.services {
+		tags[strconv.Itoa(s.Port)] = strings.Join(s.Tags, ",")
+	}
+	if want := map[string]string{"31000": "http", "31001": "http-2", "31002": "http-1", "31003": "http-3"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("registerTask() with a port named like a renamed duplicate => port tags %v, want %v", tags, want)
+	}
+}
@@ -0,0 +1,140 @@
+package mesos
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+)
+
+// NameSanitizer turns task names into Consul service names. Underscores
+// are replaced with the group separator.
+type NameSanitizer interface {
+	Sanitize(name string, separator string) string
+}
+
+// DefaultNameRegex matches the characters replaced by the default sanitizer
+const DefaultNameRegex = `[^\w-]`
+
+// NewNameSanitizer()
+//   Return the sanitizer named kind: default, dns, lower or
+//   custom-regex. custom-regex replaces the characters matching re.
+//   The sanitized names are then lowercased, uppercased or left as is
+//   depending on nameCase: lower, upper or preserve.
+//
+func NewNameSanitizer(kind string, re string, nameCase string) (NameSanitizer, error) {
+	var s NameSanitizer
+	switch kind {
+	case "", "default":
+		s = &regexSanitizer{re: regexp.MustCompile(DefaultNameRegex)}
+	case "dns":
+		s = dnsSanitizer{}
+	case "lower":
+		s = lowerSanitizer{}
+	case "custom-regex":
+		r, err := regexp.Compile(re)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid name sanitizer regex '%s': %s", re, err.Error())
+		}
+		s = &regexSanitizer{re: r}
+	default:
+		return nil, fmt.Errorf("Invalid name sanitizer: '%s'", kind)
+	}
+
+	switch nameCase {
+	case "", "lower":
+		return caseSanitizer{next: s, transform: strings.ToLower}, nil
+	case "upper":
+		return caseSanitizer{next: s, transform: strings.ToUpper}, nil
+	case "preserve":
+		return s, nil
+	}
+
+	return nil, fmt.Errorf("Invalid name case: '%s'", nameCase)
+}
+
+// caseSanitizer changes the case of the names of another sanitizer,
+// see --name-case
+type caseSanitizer struct {
+	next      NameSanitizer
+	transform func(string) string
+}
+
+func (s caseSanitizer) Sanitize(name string, separator string) string {
+	return s.transform(s.next.Sanitize(name, separator))
+}
+
+// regexSanitizer replaces the characters matching re with a dash
+type regexSanitizer struct {
+	re *regexp.Regexp
+}
+
+func (s *regexSanitizer) Sanitize(name string, separator string) string {
+	n := s.re.ReplaceAllString(name, "-")
+
+	return strings.Replace(n, "_", separator, -1)
+}
+
+// dnsSanitizer returns a valid DNS label: letters, digits and dashes, at
+// most 63 characters, not starting nor ending with a dash
+type dnsSanitizer struct{}
+
+var dnsInvalid = regexp.MustCompile(`[^a-z0-9-]+`)
+
+var dnsInvalidCase = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+func (dnsSanitizer) Sanitize(name string, separator string) string {
+	n := strings.Replace(name, "_", separator, -1)
+	n = strings.Trim(dnsInvalidCase.ReplaceAllString(n, "-"), "-")
+
+	if len(n) > 63 {
+		n = strings.TrimRight(n[:63], "-")
+	}
+
+	return n
+}
+
+// lowerSanitizer only lowercases the name
+type lowerSanitizer struct{}
+
+func (lowerSanitizer) Sanitize(name string, separator string) string {
+	return strings.ToLower(strings.Replace(name, "_", separator, -1))
+}
+
+// srvSafeSanitizer makes the names of another sanitizer valid DNS labels
+// for SRV queries. Names over 63 characters are truncated and suffixed
+// with a hash of the full name so that they stay unique and stable.
+type srvSafeSanitizer struct {
+	next NameSanitizer
+}
+
+func (s srvSafeSanitizer) Sanitize(name string, separator string) string {
+	return srvSafeName(s.next.Sanitize(name, separator))
+}
+
+var dnsDashes = regexp.MustCompile(`-{2,}`)
+
+// srvSafeName()
+//   Return the name as a valid DNS label
+//
+func srvSafeName(name string) string {
+	n := dnsInvalid.ReplaceAllString(strings.ToLower(name), "-")
+	n = strings.Trim(dnsDashes.ReplaceAllString(n, "-"), "-")
+
+	return truncateName(n, 63)
+}
+
+// truncateName()
+//   Truncate names over max characters, suffixed with a hash of the
+//   full name so that they stay unique and stable
+//
+func truncateName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(name))
+
+	return fmt.Sprintf("%s-%08x", strings.TrimRight(name[:max-9], "-"), h.Sum32())
+}
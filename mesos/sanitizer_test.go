@@ -0,0 +1,113 @@
+package mesos
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNameSanitizer(t *testing.T) {
+	for _, tt := range []struct {
+		kind string
+		re   string
+		name string
+		r    string
+	}{
+		{"default", "", "My_App.v2", "my-app-v2"},
+		{"dns", "", "My_App.v2", "my-app-v2"},
+		{"dns", "", "-_web.", "web"},
+		{"dns", "", strings.Repeat("a", 70), strings.Repeat("a", 63)},
+		{"lower", "", "My_App.v2", "my-app.v2"},
+		{"custom-regex", `[^a-zA-Z0-9.]`, "My_App.v2", "my-app.v2"},
+	} {
+		s, err := NewNameSanitizer(tt.kind, tt.re, "lower")
+		if err != nil {
+			t.Fatalf("NewNameSanitizer(%s, %s) => %v", tt.kind, tt.re, err)
+		}
+
+		if r := s.Sanitize(tt.name, "-"); r != tt.r {
+			t.Errorf("%s Sanitize(%s) => %s, want %s", tt.kind, tt.name, r, tt.r)
+		}
+	}
+}
+
+func TestNewNameSanitizerInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		kind string
+		re   string
+	}{
+		{"upper", ""},
+		{"custom-regex", "[invalid"},
+	} {
+		if _, err := NewNameSanitizer(tt.kind, tt.re, "lower"); err == nil {
+			t.Errorf("NewNameSanitizer(%s, %s) => nil, want error", tt.kind, tt.re)
+		}
+	}
+}
+
+func TestSrvSafeSanitizer(t *testing.T) {
+	long := strings.Repeat("a", 70)
+
+	for _, tt := range []struct {
+		kind string
+		name string
+		r    string
+	}{
+		{"default", "My_App.v2", "my-app-v2"},
+		{"lower", "My_App.v2", "my-app-v2"},
+		{"lower", "web--api__", "web-api"},
+		{"lower", "µ-service", "service"},
+		{"default", strings.Repeat("b", 63), strings.Repeat("b", 63)},
+	} {
+		next, _ := NewNameSanitizer(tt.kind, "", "lower")
+		s := srvSafeSanitizer{next: next}
+
+		if r := s.Sanitize(tt.name, "-"); r != tt.r {
+			t.Errorf("srv-safe %s Sanitize(%s) => %s, want %s", tt.kind, tt.name, r, tt.r)
+		}
+	}
+
+	s := srvSafeSanitizer{next: lowerSanitizer{}}
+	a := s.Sanitize(long, "-")
+	b := s.Sanitize(long+"b", "-")
+	if len(a) > 63 || len(b) > 63 {
+		t.Errorf("srv-safe Sanitize() of long names => %s, %s, want at most 63 characters", a, b)
+	}
+	if !strings.HasPrefix(a, strings.Repeat("a", 54)+"-") {
+		t.Errorf("srv-safe Sanitize(%s) => %s, want truncated name with a hash suffix", long, a)
+	}
+	if a == b {
+		t.Errorf("srv-safe Sanitize() of different long names => %s for both", a)
+	}
+	if s.Sanitize(long, "-") != a {
+		t.Errorf("srv-safe Sanitize(%s) is not stable", long)
+	}
+}
+
+func TestNameCase(t *testing.T) {
+	for _, tt := range []struct {
+		kind     string
+		nameCase string
+		name     string
+		r        string
+	}{
+		{"default", "lower", "My_App.v2", "my-app-v2"},
+		{"default", "upper", "My_App.v2", "MY-APP-V2"},
+		{"default", "preserve", "My_App.v2", "My-App-v2"},
+		{"dns", "preserve", "-My_App.v2", "My-App-v2"},
+		{"dns", "upper", "My_App.v2", "MY-APP-V2"},
+		{"lower", "preserve", "My_App.v2", "my-app.v2"},
+	} {
+		s, err := NewNameSanitizer(tt.kind, "", tt.nameCase)
+		if err != nil {
+			t.Fatalf("NewNameSanitizer(%s, %s) => %v", tt.kind, tt.nameCase, err)
+		}
+
+		if r := s.Sanitize(tt.name, "-"); r != tt.r {
+			t.Errorf("%s %s Sanitize(%s) => %s, want %s", tt.kind, tt.nameCase, tt.name, r, tt.r)
+		}
+	}
+
+	if _, err := NewNameSanitizer("default", "", "title"); err == nil {
+		t.Error("NewNameSanitizer(default, title) => nil, want error")
+	}
+}
@@ -1,8 +1,15 @@
 package mesos
 
 import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/CiscoCloud/mesos-consul/registry"
 	"github.com/CiscoCloud/mesos-consul/state"
@@ -11,17 +18,169 @@ import (
 type CheckVar struct {
 	Host string
 	Port string
-}
 
-var globalCV *CheckVar
+	// Scheme of the HTTP check URL, from the check_scheme label of
+	// a DiscoveryInfo port
+	Scheme string
+
+	// Check spec used when the task has no check labels, in the
+	// consul_check form
+	Default string
+
+	// Ratio of the interval used as the timeout of the checks without
+	// one, the Consul default timeout if 0
+	TimeoutRatio float64
+
+	// Bounds the check intervals are clamped to, none if 0
+	IntervalMin time.Duration
+	IntervalMax time.Duration
+}
 
 // Task Methods
 
+// isTerminal()
+//   Whether the task has reached a state it will never leave
+//
+func isTerminal(t *state.Task) bool {
+	switch t.State {
+	case "TASK_FINISHED", "TASK_FAILED", "TASK_KILLED", "TASK_LOST":
+		return true
+	}
+
+	return false
+}
+
+// labelEnabled()
+//   Whether the label of the task is set to a true value
+//
+func labelEnabled(t *state.Task, name string) bool {
+	b, err := strconv.ParseBool(t.Label(name))
+	return err == nil && b
+}
+
+// taskLabelTags()
+//   Return the tags of the task from the consul_tags_json label, a JSON
+//   array of strings, or from the comma separated tags label
+//
+func taskLabelTags(t *state.Task) []string {
+	if l := t.Label("consul_tags_json"); l != "" {
+		var tags []string
+		err := json.Unmarshal([]byte(l), &tags)
+		if err == nil {
+			return tags
+		}
+
+		log.WithField("consul_tags_json", l).Warnf("Invalid JSON tags for task %s: %s", t.ID, err.Error())
+	}
+
+	if l := t.Label("tags"); l != "" {
+		return strings.Split(l, ",")
+	}
+
+	return []string{}
+}
+
+// duplicatePortName()
+//   First name given to several DiscoveryInfo ports of the task, empty
+//   if none
+//
+func duplicatePortName(t *state.Task) string {
+	seen := make(map[string]bool)
+	for _, p := range t.DiscoveryInfo.Ports.DiscoveryPorts {
+		if p.Name == "" {
+			continue
+		}
+		if seen[p.Name] {
+			return p.Name
+		}
+		seen[p.Name] = true
+	}
+
+	return ""
+}
+
+// taskMinAge()
+//   Return the minimum running time of the task from the consul_min_age
+//   label, either a duration or a number of seconds, or def if not set
+//
+func taskMinAge(t *state.Task, def time.Duration) time.Duration {
+	l := t.Label("consul_min_age")
+	if l == "" {
+		return def
+	}
+
+	if d, err := time.ParseDuration(l); err == nil {
+		return d
+	}
+
+	if s, err := strconv.Atoi(l); err == nil {
+		return time.Duration(s) * time.Second
+	}
+
+	log.WithField("consul_min_age", l).Warnf("Invalid minimum age for task %s", t.ID)
+	return def
+}
+
+// taskMinInstances()
+//   Number of running instances of the service the task needs before
+//   being registered, from the consul_min_instances label
+//
+func taskMinInstances(t *state.Task) int {
+	l := t.Label("consul_min_instances")
+	if l == "" {
+		return 0
+	}
+
+	n, err := strconv.Atoi(l)
+	if err != nil || n < 0 {
+		log.WithField("consul_min_instances", l).Warnf("Invalid minimum number of instances for task %s", t.ID)
+		return 0
+	}
+
+	return n
+}
+
+// taskInstanceIndex()
+//   Instance index of the task in its service, from the consul_instance
+//   label
+//
+func taskInstanceIndex(t *state.Task) (string, bool) {
+	l := t.Label("consul_instance")
+	if l == "" {
+		return "", false
+	}
+
+	n, err := strconv.Atoi(l)
+	if err != nil || n < 0 {
+		log.WithField("consul_instance", l).Warnf("Invalid instance index for task %s", t.ID)
+		return "", false
+	}
+
+	return strconv.Itoa(n), true
+}
+
 // GetCheck()
 //   Build a Check structure from the Task labels
 //
 func GetCheck(t *state.Task, cv *CheckVar) *registry.Check {
 	c := registry.DefaultCheck()
+	cv = withCheckHost(t, cv)
+
+	// The native health check of the task is applied first, unless the
+	// labels set a check, so that the granular labels override it
+	native := t.HealthCheck != nil && !hasCheckLabel(t) && setNativeCheck(c, cv, t.HealthCheck)
+
+	// The compact check label is applied next so that the granular labels
+	// override it
+	if dsl := t.Label("consul_check"); dsl != "" {
+		if err := parseCheckDSL(c, cv, dsl); err != nil {
+			log.WithField("consul_check", dsl).Warnf("Invalid check of task %s: %s", t.ID, err.Error())
+		}
+	} else if cv.Default != "" && !native && !hasCheckLabel(t) {
+		if err := parseCheckDSL(c, cv, cv.Default); err != nil {
+			log.WithField("default-check", cv.Default).Debugf("Default check not applicable to task %s: %s", t.ID, err.Error())
+		}
+	}
 
 	for _, l := range t.Labels {
 		k := strings.ToLower(l.Key)
@@ -35,32 +194,552 @@ func GetCheck(t *state.Task, cv *CheckVar) *registry.Check {
 			c.TTL = interpolate(cv, l.Value)
 		case "check_interval":
 			c.Interval = l.Value
+		case "check_timeout":
+			c.Timeout = l.Value
+		case "check_alias":
+			c.AliasService = l.Value
+		case "check_failures_before_warning":
+			c.FailuresBeforeWarning = checkThreshold(k, l.Value)
+		case "check_failures_before_critical":
+			c.FailuresBeforeCritical = checkThreshold(k, l.Value)
+		case "check_output_max_size":
+			c.OutputMaxSize = outputMaxSize(l.Value)
 		}
 	}
 
+	if c.FailuresBeforeWarning > 0 && c.FailuresBeforeCritical > 0 && c.FailuresBeforeWarning >= c.FailuresBeforeCritical {
+		log.WithField("check_failures_before_warning", c.FailuresBeforeWarning).Warnf("Warning threshold of task %s must be lower than its critical threshold %d. Ignoring it", t.ID, c.FailuresBeforeCritical)
+		c.FailuresBeforeWarning = 0
+	}
+
+	clampInterval(t, c, cv)
+	setDerivedTimeout(c, cv.TimeoutRatio)
+
+	scheme := cv.Scheme
+	if scheme == "" {
+		scheme = t.Label("check_scheme")
+	}
+	if scheme != "" && c.HTTP != "" {
+		c.HTTP = setScheme(c.HTTP, scheme)
+	}
+
+	if q := t.Label("check_query"); q != "" && c.HTTP != "" {
+		c.HTTP = addQuery(c.HTTP, q)
+	}
+
 	return c
 }
 
-// Replace {variables} with values
+// withCheckHost()
+//   Return the check variables with the host of the check_host label
+//   of the task, if set and resolvable
 //
-func interpolate(cv *CheckVar, s string) string {
-	r := regexp.MustCompile("{[^}]*}")
+func withCheckHost(t *state.Task, cv *CheckVar) *CheckVar {
+	h := t.Label("check_host")
+	if h == "" {
+		return cv
+	}
 
-	globalCV = cv
-	rval := r.ReplaceAllStringFunc(s, varReplace)
+	ip := checkHost(h)
+	if ip == "" {
+		log.WithField("check_host", h).Warnf("Unable to resolve check host of task %s. Using %s", t.ID, cv.Host)
+		return cv
+	}
 
-	return string(rval)
+	hcv := *cv
+	hcv.Host = ip
+
+	return &hcv
 }
 
-// Replacement function
+// jsonCheck is a check of the consul_checks_json label
+type jsonCheck struct {
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Target   string `json:"target"`
+	TTL      string `json:"ttl"`
+	Interval string `json:"interval"`
+	Timeout  string `json:"timeout"`
+
+	Method        string `json:"method"`
+	TLSSkipVerify bool   `json:"tls_skip_verify"`
+
+	FailuresBeforeWarning  int `json:"failures_before_warning"`
+	FailuresBeforeCritical int `json:"failures_before_critical"`
+}
+
+// parseChecksJSON()
+//   Parse and validate the JSON array of checks of a consul_checks_json
+//   label
 //
-func varReplace(s string) string {
-	switch s {
-	case "{port}":
-		return globalCV.Port
-	case "{host}":
-		return globalCV.Host
+func parseChecksJSON(s string) ([]jsonCheck, error) {
+	var checks []jsonCheck
+
+	d := json.NewDecoder(strings.NewReader(s))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&checks); err != nil {
+		return nil, err
+	}
+	if len(checks) == 0 {
+		return nil, fmt.Errorf("no checks")
+	}
+
+	for i, jc := range checks {
+		switch strings.ToLower(jc.Type) {
+		case "http", "https":
+			if !strings.HasPrefix(jc.Target, "/") && !strings.Contains(jc.Target, "://") {
+				return nil, fmt.Errorf("check %d: invalid target '%s', must be a path or a URL", i, jc.Target)
+			}
+		case "tcp":
+		case "script":
+			if jc.Target == "" {
+				return nil, fmt.Errorf("check %d: script check without target", i)
+			}
+		case "ttl":
+			if d, err := time.ParseDuration(jc.TTL); err != nil || d <= 0 {
+				return nil, fmt.Errorf("check %d: invalid ttl '%s'", i, jc.TTL)
+			}
+		default:
+			return nil, fmt.Errorf("check %d: unknown type '%s', must be http, https, tcp, script or ttl", i, jc.Type)
+		}
+
+		for _, v := range []string{jc.Interval, jc.Timeout} {
+			if d, err := time.ParseDuration(v); v != "" && (err != nil || d <= 0) {
+				return nil, fmt.Errorf("check %d: invalid duration '%s'", i, v)
+			}
+		}
+		if jc.FailuresBeforeWarning < 0 || jc.FailuresBeforeCritical < 0 {
+			return nil, fmt.Errorf("check %d: negative failure threshold", i)
+		}
+	}
+
+	return checks, nil
+}
+
+// GetChecks()
+//   Build the checks of the consul_checks_json label of the task, nil
+//   if the label is not set or invalid. Targets are interpolated, and
+//   paths and empty tcp targets are relative to the task address.
+//
+func GetChecks(t *state.Task, cv *CheckVar) []*registry.Check {
+	l := t.Label("consul_checks_json")
+	if l == "" {
+		return nil
+	}
+
+	jcs, err := parseChecksJSON(l)
+	if err != nil {
+		log.WithField("consul_checks_json", l).Warnf("Invalid checks of task %s: %s", t.ID, err.Error())
+		return nil
+	}
+
+	cv = withCheckHost(t, cv)
+	address := net.JoinHostPort(cv.Host, cv.Port)
+
+	var checks []*registry.Check
+	for i, jc := range jcs {
+		c := registry.DefaultCheck()
+		c.Name = jc.Name
+		c.Interval = jc.Interval
+		c.Timeout = jc.Timeout
+		c.Method = jc.Method
+		c.TLSSkipVerify = jc.TLSSkipVerify
+		c.FailuresBeforeWarning = jc.FailuresBeforeWarning
+		c.FailuresBeforeCritical = jc.FailuresBeforeCritical
+
+		kind := strings.ToLower(jc.Type)
+		if kind != "ttl" && c.Interval == "" {
+			c.Interval = "10s"
+		}
+
+		target := interpolate(cv, jc.Target)
+		relative := target == "" || strings.HasPrefix(target, "/")
+		if relative && (kind == "http" || kind == "https" || kind == "tcp") && cv.Port == "" {
+			log.WithField("consul_checks_json", l).Warnf("Check %d of task %s needs a task port. Skipping it", i, t.ID)
+			continue
+		}
+
+		switch kind {
+		case "http", "https":
+			if relative {
+				target = fmt.Sprintf("%s://%s%s", kind, address, target)
+			}
+			c.HTTP = target
+		case "tcp":
+			if relative {
+				target = address
+			}
+			c.TCP = target
+		case "script":
+			c.Script = target
+		case "ttl":
+			c.TTL = jc.TTL
+		}
+
+		clampInterval(t, c, cv)
+		setDerivedTimeout(c, cv.TimeoutRatio)
+		checks = append(checks, c)
+	}
+
+	return checks
+}
+
+// clampInterval()
+//   Clamp the interval of a check to the check-interval-min and
+//   check-interval-max bounds, with a warning
+//
+func clampInterval(t *state.Task, c *registry.Check, cv *CheckVar) {
+	if c.Interval == "" || (cv.IntervalMin == 0 && cv.IntervalMax == 0) {
+		return
+	}
+
+	interval, err := time.ParseDuration(c.Interval)
+	if err != nil {
+		return
+	}
+
+	clamped := interval
+	if cv.IntervalMin > 0 && clamped < cv.IntervalMin {
+		clamped = cv.IntervalMin
+	}
+	if cv.IntervalMax > 0 && clamped > cv.IntervalMax {
+		clamped = cv.IntervalMax
+	}
+	if clamped == interval {
+		return
+	}
+
+	log.WithField("check_interval", c.Interval).Warnf("Check interval of task %s out of bounds. Using %s", t.ID, clamped)
+	c.Interval = clamped.String()
+}
+
+// setDerivedTimeout()
+//   Set the timeout of a check with an interval and no timeout to its
+//   interval multiplied by ratio, when ratio is set
+//
+func setDerivedTimeout(c *registry.Check, ratio float64) {
+	if ratio <= 0 || c.Timeout != "" || c.Interval == "" || c.TTL != "" {
+		return
+	}
+
+	interval, err := time.ParseDuration(c.Interval)
+	if err != nil || interval <= 0 {
+		return
+	}
+
+	timeout := time.Duration(float64(interval) * ratio).Round(time.Millisecond)
+	if timeout < time.Millisecond {
+		timeout = time.Millisecond
+	}
+	c.Timeout = timeout.String()
+}
+
+// setNativeCheck()
+//   Set the check from the Mesos native HTTP or TCP health check of the
+//   task, e.g. defined in Marathon. Command health checks run inside
+//   the task container and are not translated. Return whether the
+//   check was set.
+//
+func setNativeCheck(c *registry.Check, cv *CheckVar, hc *state.HealthCheck) bool {
+	port := cv.Port
+	switch {
+	case hc.HTTP != nil && hc.HTTP.Port > 0:
+		port = strconv.Itoa(hc.HTTP.Port)
+	case hc.TCP != nil && hc.TCP.Port > 0:
+		port = strconv.Itoa(hc.TCP.Port)
+	}
+	if port == "" {
+		return false
+	}
+	address := net.JoinHostPort(cv.Host, port)
+
+	// Health checks of Mesos before 1.2 have no type
+	kind := strings.ToUpper(hc.Type)
+	if kind == "" && hc.HTTP != nil {
+		kind = "HTTP"
+	}
+
+	switch kind {
+	case "HTTP":
+		if hc.HTTP == nil {
+			return false
+		}
+		scheme := strings.ToLower(hc.HTTP.Scheme)
+		if scheme == "" {
+			scheme = "http"
+		}
+		path := hc.HTTP.Path
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		c.HTTP = fmt.Sprintf("%s://%s%s", scheme, address, path)
+	case "TCP":
+		c.TCP = address
 	default:
-		return s
+		return false
+	}
+
+	// Mesos defaults
+	c.Interval = "10s"
+	if hc.IntervalSeconds > 0 {
+		c.Interval = seconds(hc.IntervalSeconds)
+	}
+	c.Timeout = "20s"
+	if hc.TimeoutSeconds > 0 {
+		c.Timeout = seconds(hc.TimeoutSeconds)
+	}
+	if hc.ConsecutiveFailures > 0 {
+		c.FailuresBeforeCritical = hc.ConsecutiveFailures
+	}
+
+	return true
+}
+
+// seconds()
+//   Format a number of seconds as a duration
+//
+func seconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).String()
+}
+
+// hasCheckLabel()
+//   Whether the task sets its own check through labels
+//
+func hasCheckLabel(t *state.Task) bool {
+	for _, l := range t.Labels {
+		switch strings.ToLower(l.Key) {
+		case "consul_check", "check_http", "check_script", "check_ttl", "check_docker":
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseCheckDSL()
+//   Set the check from a consul_check label in the
+//   http|https:<port>:<path>[:<interval>] or tcp:<port>[:<interval>]
+//   form. An empty port is the task port and the interval defaults
+//   to 10s. The check is left unchanged if the label is invalid.
+//
+func parseCheckDSL(c *registry.Check, cv *CheckVar, s string) error {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 {
+		return fmt.Errorf("must be <type>:<port>...")
+	}
+
+	kind := strings.ToLower(parts[0])
+	port := interpolate(cv, parts[1])
+	if port == "" {
+		port = cv.Port
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("invalid port '%s'", port)
+	}
+
+	rest := parts[2:]
+	interval := "10s"
+	if len(rest) > 0 {
+		if d, err := time.ParseDuration(rest[len(rest)-1]); err == nil {
+			if d <= 0 {
+				return fmt.Errorf("invalid interval '%s'", rest[len(rest)-1])
+			}
+			interval = rest[len(rest)-1]
+			rest = rest[:len(rest)-1]
+		}
+	}
+
+	address := net.JoinHostPort(cv.Host, port)
+	switch kind {
+	case "http", "https":
+		// Paths may contain colons
+		path := strings.Join(rest, ":")
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("invalid path '%s', must start with /", path)
+		}
+		c.HTTP = fmt.Sprintf("%s://%s%s", kind, address, path)
+	case "tcp":
+		if len(rest) > 0 {
+			return fmt.Errorf("unexpected '%s' in tcp check", strings.Join(rest, ":"))
+		}
+		c.TCP = address
+	default:
+		return fmt.Errorf("unknown check type '%s', must be http, https or tcp", kind)
+	}
+
+	c.Interval = interval
+
+	return nil
+}
+
+// checkThreshold()
+//   Parse a check failure threshold label, 0 if invalid
+//
+func checkThreshold(label string, value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.WithField(label, value).Warn("Invalid check threshold, must be a positive integer")
+		return 0
+	}
+
+	return n
+}
+
+// outputMaxSize()
+//   Parse a check output size label, 0 if invalid
+//
+func outputMaxSize(value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.WithField("check_output_max_size", value).Warn("Invalid check output size, must be a positive integer")
+		return 0
+	}
+
+	return n
+}
+
+// setScheme()
+//   Replace the scheme of the check URL with http or https
+//
+func setScheme(check string, scheme string) string {
+	scheme = strings.ToLower(scheme)
+	if scheme != "http" && scheme != "https" {
+		log.WithField("check_scheme", scheme).Warn("Invalid check scheme, must be http or https")
+		return check
 	}
+
+	u, err := url.Parse(check)
+	if err != nil {
+		log.WithField("check_http", check).Warn("Invalid check URL: ", err.Error())
+		return check
+	}
+
+	u.Scheme = scheme
+	return u.String()
+}
+
+// addQuery()
+//   Append the query parameters to the check URL, after the ones it
+//   already has
+//
+func addQuery(check string, query string) string {
+	u, err := url.Parse(check)
+	if err != nil {
+		log.WithField("check_http", check).Warn("Invalid check URL: ", err.Error())
+		return check
+	}
+
+	q, err := url.ParseQuery(strings.TrimPrefix(query, "?"))
+	if err != nil {
+		log.WithField("check_query", query).Warn("Invalid check query: ", err.Error())
+		return check
+	}
+
+	if u.RawQuery != "" {
+		u.RawQuery += "&" + q.Encode()
+	} else {
+		u.RawQuery = q.Encode()
+	}
+
+	return u.String()
+}
+
+// dockerContainerName()
+//   Name of the Docker container the Mesos Docker containerizer
+//   started for the task
+//
+func dockerContainerName(t *state.Task) string {
+	id := t.ContainerID()
+	if id == "" {
+		return ""
+	}
+
+	return "mesos-" + id
+}
+
+// setDockerCheck()
+//   Turn the check into a Docker exec check when the task has a
+//   check_docker label. The label value is run with /bin/sh inside
+//   the task container.
+//
+func setDockerCheck(t *state.Task, c *registry.Check, cv *CheckVar) {
+	cmd := t.Label("check_docker")
+	if cmd == "" {
+		return
+	}
+
+	container := dockerContainerName(t)
+	if container == "" {
+		log.WithField("check_docker", cmd).Warnf("No container found for task %s. Not adding docker check", t.ID)
+		return
+	}
+
+	c.DockerContainerID = container
+	c.Shell = "/bin/sh"
+	c.Args = []string{c.Shell, "-c", interpolate(cv, cmd)}
+}
+
+// lookupIP resolves the check_host labels, replaced by the tests
+var lookupIP = net.LookupIP
+
+// checkHosts caches the check_host resolutions of a registration pass,
+// failed ones included
+var checkHosts = struct {
+	sync.Mutex
+	ips map[string]string
+}{ips: make(map[string]string)}
+
+// resetCheckHosts()
+//   Forget the check_host resolutions, so that each registration pass
+//   resolves each host once
+//
+func resetCheckHosts() {
+	checkHosts.Lock()
+	defer checkHosts.Unlock()
+
+	checkHosts.ips = make(map[string]string)
+}
+
+// checkHost()
+//   Return the IP address of host, or an empty string if host is
+//   neither an IP address nor a resolvable hostname
+//
+func checkHost(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return host
+	}
+
+	checkHosts.Lock()
+	defer checkHosts.Unlock()
+
+	if ip, ok := checkHosts.ips[host]; ok {
+		return ip
+	}
+
+	ip := ""
+	if ips, err := lookupIP(host); err == nil && len(ips) > 0 {
+		ip = ips[0].String()
+	}
+	checkHosts.ips[host] = ip
+
+	return ip
+}
+
+// Replace {variables} with values
+//
+func interpolate(cv *CheckVar, s string) string {
+	r := regexp.MustCompile("{[^}]*}")
+
+	rval := r.ReplaceAllStringFunc(s, func(v string) string {
+		switch v {
+		case "{port}":
+			return cv.Port
+		case "{host}":
+			return cv.Host
+		default:
+			return v
+		}
+	})
+
+	return string(rval)
 }
@@ -0,0 +1,481 @@
+package mesos
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/registry"
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+func TestIsTerminal(t *testing.T) {
+	for _, tt := range []struct {
+		state string
+		r     bool
+	}{
+		{"TASK_FINISHED", true},
+		{"TASK_FAILED", true},
+		{"TASK_KILLED", true},
+		{"TASK_LOST", true},
+		{"TASK_RUNNING", false},
+		{"TASK_STAGING", false},
+		{"TASK_STARTING", false},
+		{"TASK_KILLING", false},
+		{"", false},
+	} {
+		r := isTerminal(&state.Task{State: tt.state})
+		if r != tt.r {
+			t.Errorf("isTerminal(%s) => %t, want %t", tt.state, r, tt.r)
+		}
+	}
+}
+
+func TestTaskMinAge(t *testing.T) {
+	for _, tt := range []struct {
+		label string
+		def   time.Duration
+		r     time.Duration
+	}{
+		{"", 0, 0},
+		{"", time.Minute, time.Minute},
+		{"30s", time.Minute, 30 * time.Second},
+		{"45", 0, 45 * time.Second},
+		{"invalid", time.Minute, time.Minute},
+	} {
+		task := &state.Task{}
+		if tt.label != "" {
+			task.Labels = []state.Label{{Key: "consul_min_age", Value: tt.label}}
+		}
+
+		r := taskMinAge(task, tt.def)
+		if r != tt.r {
+			t.Errorf("taskMinAge(%s, %s) => %s, want %s", tt.label, tt.def, r, tt.r)
+		}
+	}
+}
+
+func TestSetDockerCheck(t *testing.T) {
+	running := state.Status{State: "TASK_RUNNING"}
+	running.ContainerStatus.ContainerID.Value = "abc"
+
+	for _, tt := range []struct {
+		label     string
+		statuses  []state.Status
+		container string
+		args      []string
+	}{
+		{"", []state.Status{running}, "", nil},
+		{"curl {host}:{port}", nil, "", nil},
+		{"curl {host}:{port}", []state.Status{running}, "mesos-abc", []string{"/bin/sh", "-c", "curl 10.0.0.1:8080"}},
+	} {
+		task := &state.Task{Statuses: tt.statuses}
+		if tt.label != "" {
+			task.Labels = []state.Label{{Key: "check_docker", Value: tt.label}}
+		}
+
+		c := registry.DefaultCheck()
+		setDockerCheck(task, c, &CheckVar{Host: "10.0.0.1", Port: "8080"})
+		if c.DockerContainerID != tt.container || !sliceEq(c.Args, tt.args) {
+			t.Errorf("setDockerCheck(%s) => (%s, %v), want (%s, %v)", tt.label, c.DockerContainerID, c.Args, tt.container, tt.args)
+		}
+	}
+}
+
+func TestTaskLabelTags(t *testing.T) {
+	for _, tt := range []struct {
+		labels []state.Label
+		r      []string
+	}{
+		{nil, []string{}},
+		{[]state.Label{{Key: "tags", Value: "one,two"}}, []string{"one", "two"}},
+		{[]state.Label{{Key: "consul_tags_json", Value: `["one,1", "two"]`}}, []string{"one,1", "two"}},
+		{[]state.Label{
+			{Key: "tags", Value: "one,two"},
+			{Key: "consul_tags_json", Value: `["three"]`},
+		}, []string{"three"}},
+		{[]state.Label{
+			{Key: "tags", Value: "one,two"},
+			{Key: "consul_tags_json", Value: `["three"`},
+		}, []string{"one", "two"}},
+		{[]state.Label{{Key: "consul_tags_json", Value: `{"three": 3}`}}, []string{}},
+	} {
+		r := taskLabelTags(&state.Task{Labels: tt.labels})
+		if !sliceEq(r, tt.r) {
+			t.Errorf("taskLabelTags(%v) => %v, want %v", tt.labels, r, tt.r)
+		}
+	}
+}
+
+func TestGetCheckHost(t *testing.T) {
+	lookups := make(map[string]int)
+	lookupIP = func(host string) ([]net.IP, error) {
+		lookups[host]++
+		if host == "health.example.com" {
+			return []net.IP{net.ParseIP("192.168.0.2")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	defer func() { lookupIP = net.LookupIP }()
+	resetCheckHosts()
+
+	for _, tt := range []struct {
+		checkHost string
+		http      string
+	}{
+		{"", "http://10.0.0.1:8080/health"},
+		{"192.168.0.1", "http://192.168.0.1:8080/health"},
+		{"health.example.com", "http://192.168.0.2:8080/health"},
+		{"health.example.com", "http://192.168.0.2:8080/health"},
+		{"no-such-host.invalid", "http://10.0.0.1:8080/health"},
+		{"no-such-host.invalid", "http://10.0.0.1:8080/health"},
+	} {
+		task := &state.Task{
+			Labels: []state.Label{{Key: "check_http", Value: "http://{host}:{port}/health"}},
+		}
+		if tt.checkHost != "" {
+			task.Labels = append(task.Labels, state.Label{Key: "check_host", Value: tt.checkHost})
+		}
+
+		c := GetCheck(task, &CheckVar{Host: "10.0.0.1", Port: "8080"})
+		if c.HTTP != tt.http {
+			t.Errorf("GetCheck() with check_host %s => %s, want %s", tt.checkHost, c.HTTP, tt.http)
+		}
+	}
+
+	if lookups["health.example.com"] != 1 || lookups["no-such-host.invalid"] != 1 || lookups["192.168.0.1"] != 0 {
+		t.Errorf("GetCheck() resolved %v, want each hostname once", lookups)
+	}
+
+	resetCheckHosts()
+	GetCheck(&state.Task{Labels: []state.Label{{Key: "check_http", Value: "http://{host}/"}, {Key: "check_host", Value: "health.example.com"}}}, &CheckVar{Host: "10.0.0.1"})
+	if lookups["health.example.com"] != 2 {
+		t.Errorf("GetCheck() after resetCheckHosts() resolved %v, want health.example.com again", lookups)
+	}
+}
+
+func TestGetCheckThresholds(t *testing.T) {
+	for _, tt := range []struct {
+		warning  string
+		critical string
+		w        int
+		c        int
+	}{
+		{"", "", 0, 0},
+		{"2", "", 2, 0},
+		{"2", "5", 2, 5},
+		{"5", "5", 0, 5},
+		{"bad", "3", 0, 3},
+	} {
+		task := &state.Task{}
+		if tt.warning != "" {
+			task.Labels = append(task.Labels, state.Label{Key: "check_failures_before_warning", Value: tt.warning})
+		}
+		if tt.critical != "" {
+			task.Labels = append(task.Labels, state.Label{Key: "check_failures_before_critical", Value: tt.critical})
+		}
+
+		c := GetCheck(task, &CheckVar{Host: "10.0.0.1", Port: "8080"})
+		if c.FailuresBeforeWarning != tt.w || c.FailuresBeforeCritical != tt.c {
+			t.Errorf("GetCheck(%s, %s) => %d, %d, want %d, %d", tt.warning, tt.critical, c.FailuresBeforeWarning, c.FailuresBeforeCritical, tt.w, tt.c)
+		}
+	}
+}
+
+func TestGetCheckQuery(t *testing.T) {
+	for _, tt := range []struct {
+		http  string
+		query string
+		r     string
+	}{
+		{"http://{host}:{port}/health", "verbose=false", "http://10.0.0.1:8080/health?verbose=false"},
+		{"http://{host}:{port}/health", "?verbose=false", "http://10.0.0.1:8080/health?verbose=false"},
+		{"http://{host}:{port}/health?full=1", "verbose=false", "http://10.0.0.1:8080/health?full=1&verbose=false"},
+		{"http://{host}:{port}/health", "msg=a b&x=1/2", "http://10.0.0.1:8080/health?msg=a+b&x=1%2F2"},
+		{"http://{host}:{port}/health", "bad=%zz", "http://10.0.0.1:8080/health"},
+	} {
+		task := &state.Task{
+			Labels: []state.Label{
+				{Key: "check_http", Value: tt.http},
+				{Key: "check_query", Value: tt.query},
+			},
+		}
+
+		c := GetCheck(task, &CheckVar{Host: "10.0.0.1", Port: "8080"})
+		if c.HTTP != tt.r {
+			t.Errorf("GetCheck(%s, %s) => %s, want %s", tt.http, tt.query, c.HTTP, tt.r)
+		}
+		if _, err := url.Parse(c.HTTP); err != nil {
+			t.Errorf("GetCheck(%s, %s) => %s: %v", tt.http, tt.query, c.HTTP, err)
+		}
+	}
+}
+
+func TestGetCheckDSL(t *testing.T) {
+	for _, tt := range []struct {
+		dsl      string
+		http     string
+		tcp      string
+		interval string
+	}{
+		{"http:8080:/healthz:5s", "http://10.0.0.1:8080/healthz", "", "5s"},
+		{"https::/healthz", "https://10.0.0.1:31000/healthz", "", "10s"},
+		{"http:{port}:/a:b", "http://10.0.0.1:31000/a:b", "", "10s"},
+		{"tcp:9000:10s", "", "10.0.0.1:9000", "10s"},
+		{"tcp:{port}", "", "10.0.0.1:31000", "10s"},
+		{"http:8080:healthz", "", "", ""},
+		{"tcp:9000:/x", "", "", ""},
+		{"udp:9000", "", "", ""},
+		{"http:99999:/", "", "", ""},
+		{"http:8080:/:-5s", "", "", ""},
+		{"tcp", "", "", ""},
+	} {
+		task := &state.Task{Labels: []state.Label{{Key: "consul_check", Value: tt.dsl}}}
+
+		c := GetCheck(task, &CheckVar{Host: "10.0.0.1", Port: "31000"})
+		if c.HTTP != tt.http || c.TCP != tt.tcp || c.Interval != tt.interval {
+			t.Errorf("GetCheck(%s) => %q, %q, %q, want %q, %q, %q", tt.dsl, c.HTTP, c.TCP, c.Interval, tt.http, tt.tcp, tt.interval)
+		}
+	}
+
+	// Granular labels take precedence
+	task := &state.Task{Labels: []state.Label{
+		{Key: "consul_check", Value: "http:8080:/healthz:5s"},
+		{Key: "check_interval", Value: "30s"},
+	}}
+	if c := GetCheck(task, &CheckVar{Host: "10.0.0.1", Port: "31000"}); c.Interval != "30s" {
+		t.Errorf("GetCheck() with check_interval => %s, want 30s", c.Interval)
+	}
+}
+
+func TestGetCheckDefault(t *testing.T) {
+	for _, tt := range []struct {
+		labels []state.Label
+		port   string
+		http   string
+		tcp    string
+	}{
+		{nil, "31000", "", "10.0.0.1:31000"},
+		{[]state.Label{{Key: "check_http", Value: "http://{host}:{port}/health"}}, "31000", "http://10.0.0.1:31000/health", ""},
+		{[]state.Label{{Key: "consul_check", Value: "http:{port}:/ping"}}, "31000", "http://10.0.0.1:31000/ping", ""},
+		{[]state.Label{{Key: "CHECK_TTL", Value: "30s"}}, "31000", "", ""},
+		{nil, "", "", ""},
+	} {
+		task := &state.Task{Labels: tt.labels}
+
+		c := GetCheck(task, &CheckVar{Host: "10.0.0.1", Port: tt.port, Default: "tcp:{port}"})
+		if c.HTTP != tt.http || c.TCP != tt.tcp {
+			t.Errorf("GetCheck(%v) with a default check => %q, %q, want %q, %q", tt.labels, c.HTTP, c.TCP, tt.http, tt.tcp)
+		}
+	}
+}
+
+func TestGetCheckNative(t *testing.T) {
+	for _, tt := range []struct {
+		hc       string
+		labels   []state.Label
+		http     string
+		tcp      string
+		interval string
+		timeout  string
+	}{
+		{`{"type": "HTTP", "interval_seconds": 5, "timeout_seconds": 2.5, "http": {"port": 8080, "path": "/health"}}`, nil, "http://10.0.0.1:8080/health", "", "5s", "2.5s"},
+		{`{"type": "HTTP", "http": {"scheme": "https"}}`, nil, "https://10.0.0.1:31000/", "", "10s", "20s"},
+		{`{"http": {"port": 8080, "path": "ping"}}`, nil, "http://10.0.0.1:8080/ping", "", "10s", "20s"},
+		{`{"type": "TCP", "interval_seconds": 30, "tcp": {"port": 9000}}`, nil, "", "10.0.0.1:9000", "30s", "20s"},
+		{`{"type": "COMMAND", "command": {"value": "true"}}`, nil, "", "10.0.0.1:31000", "1s", ""},
+		{`{"type": "TCP", "tcp": {"port": 9000}}`, []state.Label{{Key: "check_http", Value: "http://{host}:{port}/"}}, "http://10.0.0.1:31000/", "", "", ""},
+		{`{"type": "TCP", "tcp": {"port": 9000}}`, []state.Label{{Key: "check_interval", Value: "1m"}}, "", "10.0.0.1:9000", "1m", "20s"},
+	} {
+		task := &state.Task{Labels: tt.labels}
+		if err := json.Unmarshal([]byte(`{"health_check": `+tt.hc+`}`), task); err != nil {
+			t.Fatalf("Unmarshal(%s) => %v", tt.hc, err)
+		}
+
+		c := GetCheck(task, &CheckVar{Host: "10.0.0.1", Port: "31000", Default: "tcp:{port}:1s"})
+		if c.HTTP != tt.http || c.TCP != tt.tcp || c.Interval != tt.interval || c.Timeout != tt.timeout {
+			t.Errorf("GetCheck(%s, %v) => %q, %q, %q, %q, want %q, %q, %q, %q", tt.hc, tt.labels, c.HTTP, c.TCP, c.Interval, c.Timeout, tt.http, tt.tcp, tt.interval, tt.timeout)
+		}
+	}
+
+	task := &state.Task{HealthCheck: &state.HealthCheck{Type: "TCP", ConsecutiveFailures: 3, TCP: &state.TCPCheck{Port: 9000}}}
+	if c := GetCheck(task, &CheckVar{Host: "10.0.0.1", Port: "31000"}); c.FailuresBeforeCritical != 3 {
+		t.Errorf("GetCheck() with 3 consecutive failures => %d failures before critical, want 3", c.FailuresBeforeCritical)
+	}
+}
+
+func TestGetCheckOutputMaxSize(t *testing.T) {
+	for _, tt := range []struct {
+		check bool
+		label string
+		def   int
+		r     int
+	}{
+		{true, "", 0, 0},
+		{true, "", 2048, 2048},
+		{true, "512", 2048, 512},
+		{true, "0", 2048, 2048},
+		{true, "-1", 0, 0},
+		{true, "bad", 0, 0},
+		{false, "", 2048, 0},
+		{false, "512", 0, 0},
+	} {
+		m, _ := newTestMesos()
+		m.CheckOutputMaxSize = tt.def
+
+		task := &state.Task{}
+		if tt.check {
+			task.Labels = append(task.Labels, state.Label{Key: "check_ttl", Value: "30s"})
+		}
+		if tt.label != "" {
+			task.Labels = append(task.Labels, state.Label{Key: "check_output_max_size", Value: tt.label})
+		}
+
+		if c := m.taskCheck(task, &CheckVar{Host: "10.0.0.1", Port: "8080"}); c.OutputMaxSize != tt.r {
+			t.Errorf("taskCheck(%s) of a task with check %t and default %d => %d, want %d", tt.label, tt.check, tt.def, c.OutputMaxSize, tt.r)
+		}
+	}
+
+	m, _ := newTestMesos()
+	m.CheckOutputMaxSize = 2048
+	task := &state.Task{Labels: []state.Label{{Key: "consul_checks_json", Value: `[{"type": "tcp"}, {"type": "ttl", "ttl": "30s"}]`}}}
+	for _, c := range m.taskChecks(task, &CheckVar{Host: "10.0.0.1", Port: "8080"}) {
+		if c.OutputMaxSize != 2048 {
+			t.Errorf("taskChecks() with default 2048 => %+v, want output max size 2048", c)
+		}
+	}
+}
+
+func TestParseChecksJSON(t *testing.T) {
+	for _, tt := range []struct {
+		label string
+		valid bool
+	}{
+		{`[{"type": "http", "target": "/health"}, {"type": "tcp"}]`, true},
+		{`[{"type": "ttl", "ttl": "30s"}, {"type": "script", "target": "/bin/true", "interval": "1m"}]`, true},
+		{`[{"type": "https", "target": "https://{host}:8443/", "tls_skip_verify": true}]`, true},
+		{`[]`, false},
+		{`{"type": "tcp"}`, false},
+		{`[{"type": "tcp"`, false},
+		{`[{"type": "udp"}]`, false},
+		{`[{"type": "tcp", "port": 80}]`, false},
+		{`[{"type": "http", "target": "health"}]`, false},
+		{`[{"type": "script"}]`, false},
+		{`[{"type": "ttl"}]`, false},
+		{`[{"type": "tcp", "interval": "soon"}]`, false},
+		{`[{"type": "tcp", "failures_before_critical": -1}]`, false},
+	} {
+		if _, err := parseChecksJSON(tt.label); (err == nil) != tt.valid {
+			t.Errorf("parseChecksJSON(%s) => %v, want valid %t", tt.label, err, tt.valid)
+		}
+	}
+}
+
+func TestGetChecks(t *testing.T) {
+	task := &state.Task{Labels: []state.Label{{Key: "consul_checks_json", Value: `[
+		{"type": "http", "name": "ready", "target": "/ready", "interval": "5s", "method": "HEAD"},
+		{"type": "tcp", "failures_before_critical": 3},
+		{"type": "https", "target": "https://{host}:8443/health"},
+		{"type": "ttl", "ttl": "30s"}]`}}}
+
+	checks := GetChecks(task, &CheckVar{Host: "10.0.0.1", Port: "31000"})
+	if len(checks) != 4 {
+		t.Fatalf("GetChecks() => %d checks, want 4", len(checks))
+	}
+	if c := checks[0]; c.Name != "ready" || c.HTTP != "http://10.0.0.1:31000/ready" || c.Interval != "5s" || c.Method != "HEAD" {
+		t.Errorf("GetChecks() http check => %+v, want ready on http://10.0.0.1:31000/ready every 5s", c)
+	}
+	if c := checks[1]; c.TCP != "10.0.0.1:31000" || c.Interval != "10s" || c.FailuresBeforeCritical != 3 {
+		t.Errorf("GetChecks() tcp check => %+v, want 10.0.0.1:31000 every 10s", c)
+	}
+	if c := checks[2]; c.HTTP != "https://10.0.0.1:8443/health" {
+		t.Errorf("GetChecks() https check => %q, want https://10.0.0.1:8443/health", c.HTTP)
+	}
+	if c := checks[3]; c.TTL != "30s" || c.Interval != "" {
+		t.Errorf("GetChecks() ttl check => %+v, want a 30s TTL", c)
+	}
+
+	if checks := GetChecks(task, &CheckVar{Host: "10.0.0.1"}); len(checks) != 2 {
+		t.Errorf("GetChecks() without port => %d checks, want the https and ttl checks", len(checks))
+	}
+}
+
+func TestGetCheckTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		labels  []state.Label
+		ratio   float64
+		timeout string
+	}{
+		{[]state.Label{{Key: "check_http", Value: "/"}, {Key: "check_interval", Value: "30s"}}, 0, ""},
+		{[]state.Label{{Key: "check_http", Value: "/"}, {Key: "check_interval", Value: "30s"}}, 0.5, "15s"},
+		{[]state.Label{{Key: "check_http", Value: "/"}, {Key: "check_interval", Value: "10s"}}, 2, "20s"},
+		{[]state.Label{{Key: "check_http", Value: "/"}, {Key: "check_interval", Value: "1s"}}, 0.3333, "333ms"},
+		{[]state.Label{{Key: "check_http", Value: "/"}, {Key: "check_interval", Value: "30s"}, {Key: "check_timeout", Value: "3s"}}, 0.5, "3s"},
+		{[]state.Label{{Key: "check_http", Value: "/"}, {Key: "check_timeout", Value: "3s"}}, 0, "3s"},
+		{[]state.Label{{Key: "check_http", Value: "/"}}, 0.5, ""},
+		{[]state.Label{{Key: "check_http", Value: "/"}, {Key: "check_interval", Value: "soon"}}, 0.5, ""},
+		{[]state.Label{{Key: "check_ttl", Value: "30s"}, {Key: "check_interval", Value: "30s"}}, 0.5, ""},
+		{[]state.Label{{Key: "consul_check", Value: "tcp:{port}:20s"}}, 0.5, "10s"},
+	} {
+		task := &state.Task{Labels: tt.labels}
+
+		c := GetCheck(task, &CheckVar{Host: "10.0.0.1", Port: "31000", TimeoutRatio: tt.ratio})
+		if c.Timeout != tt.timeout {
+			t.Errorf("GetCheck(%v, ratio %v) => timeout %q, want %q", tt.labels, tt.ratio, c.Timeout, tt.timeout)
+		}
+	}
+
+	// The timeout of a native health check is kept
+	task := &state.Task{HealthCheck: &state.HealthCheck{
+		Type:            "HTTP",
+		HTTP:            &state.HTTPCheck{Port: 8080, Path: "/health"},
+		IntervalSeconds: 30,
+		TimeoutSeconds:  5,
+	}}
+	if c := GetCheck(task, &CheckVar{Host: "10.0.0.1", Port: "31000", TimeoutRatio: 0.5}); c.Timeout != "5s" {
+		t.Errorf("GetCheck() of a native health check with ratio 0.5 => timeout %q, want 5s", c.Timeout)
+	}
+
+	checks := GetChecks(&state.Task{Labels: []state.Label{{Key: "consul_checks_json", Value: `[{"type": "tcp", "interval": "4s"}, {"type": "tcp", "timeout": "1s"}]`}}}, &CheckVar{Host: "10.0.0.1", Port: "31000", TimeoutRatio: 0.5})
+	if len(checks) != 2 || checks[0].Timeout != "2s" || checks[1].Timeout != "1s" {
+		t.Errorf("GetChecks() with ratio 0.5 => %+v, want timeouts 2s and 1s", checks)
+	}
+}
+
+func TestGetCheckIntervalBounds(t *testing.T) {
+	for _, tt := range []struct {
+		interval string
+		min, max time.Duration
+		want     string
+	}{
+		{"1ms", 0, 0, "1ms"},
+		{"1ms", 5 * time.Second, time.Minute, "5s"},
+		{"10s", 5 * time.Second, time.Minute, "10s"},
+		{"5s", 5 * time.Second, time.Minute, "5s"},
+		{"1h", 5 * time.Second, time.Minute, "1m0s"},
+		{"1h", 5 * time.Second, 0, "1h"},
+		{"1ms", 0, time.Minute, "1ms"},
+		{"soon", 5 * time.Second, time.Minute, "soon"},
+	} {
+		task := &state.Task{ID: "web.1", Labels: []state.Label{{Key: "check_http", Value: "/"}, {Key: "check_interval", Value: tt.interval}}}
+
+		c := GetCheck(task, &CheckVar{Host: "10.0.0.1", Port: "31000", IntervalMin: tt.min, IntervalMax: tt.max})
+		if c.Interval != tt.want {
+			t.Errorf("GetCheck(interval %s, bounds %s-%s) => %q, want %q", tt.interval, tt.min, tt.max, c.Interval, tt.want)
+		}
+	}
+
+	// The clamped interval derives the timeout
+	task := &state.Task{ID: "web.1", Labels: []state.Label{{Key: "check_http", Value: "/"}, {Key: "check_interval", Value: "1ms"}}}
+	if c := GetCheck(task, &CheckVar{Host: "10.0.0.1", Port: "31000", TimeoutRatio: 0.5, IntervalMin: 4 * time.Second}); c.Timeout != "2s" {
+		t.Errorf("GetCheck() with ratio 0.5 and a clamped 4s interval => timeout %q, want 2s", c.Timeout)
+	}
+
+	checks := GetChecks(&state.Task{Labels: []state.Label{{Key: "consul_checks_json", Value: `[{"type": "tcp", "interval": "1ms"}]`}}}, &CheckVar{Host: "10.0.0.1", Port: "31000", IntervalMin: time.Second})
+	if len(checks) != 1 || checks[0].Interval != "1s" {
+		t.Errorf("GetChecks() with a 1s minimum => %+v, want interval 1s", checks)
+	}
+}
@@ -0,0 +1,99 @@
+package mesos
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+// References of the tag templates, e.g. ${label:VERSION} or ${task:name}
+var tagTemplateRef = regexp.MustCompile(`\$\{(\w+):([^}]*)\}`)
+
+// Task fields available to the tag templates as ${task:<field>}
+var tagTemplateFields = []string{"id", "name", "framework", "agent", "hostname"}
+
+// checkTagTemplate()
+//   Return an error when a tag template has an unterminated, unknown
+//   or empty reference
+//
+func checkTagTemplate(tpl string) error {
+	for _, ref := range tagTemplateRef.FindAllStringSubmatch(tpl, -1) {
+		switch ref[1] {
+		case "label":
+			if ref[2] == "" {
+				return fmt.Errorf("empty label in %s", ref[0])
+			}
+		case "task":
+			if !sliceContainsString(tagTemplateFields, ref[2]) {
+				return fmt.Errorf("unknown task field in %s, must be one of %s", ref[0], strings.Join(tagTemplateFields, ", "))
+			}
+		default:
+			return fmt.Errorf("unknown reference %s, must be ${label:<key>} or ${task:<field>}", ref[0])
+		}
+	}
+
+	if strings.Contains(tagTemplateRef.ReplaceAllString(tpl, ""), "${") {
+		return fmt.Errorf("unterminated reference")
+	}
+
+	return nil
+}
+
+// templateField()
+//   Value of a tag template reference for a task, and whether it is set
+//
+func (m *Mesos) templateField(t *state.Task, source, key string) (string, bool) {
+	var v string
+	switch source {
+	case "label":
+		v = t.Label(key)
+	case "task":
+		switch key {
+		case "id":
+			v = t.ID
+		case "name":
+			v = t.Name
+		case "framework":
+			v = m.Frameworks[t.FrameworkID]
+		case "agent":
+			v = m.Agents[t.SlaveID]
+		case "hostname":
+			v = m.agentHostnames[t.SlaveID]
+		}
+	}
+
+	return v, v != ""
+}
+
+// templateTags()
+//   Tags of the --tag-template templates for a task, skipping the ones
+//   already in tags. With --tag-template-missing=drop, the templates
+//   with an unresolved reference give no tag.
+//
+func (m *Mesos) templateTags(t *state.Task, tags []string) []string {
+	var result []string
+	for _, tpl := range m.TagTemplates {
+		missing := false
+		tag := tagTemplateRef.ReplaceAllStringFunc(tpl, func(ref string) string {
+			sub := tagTemplateRef.FindStringSubmatch(ref)
+			v, ok := m.templateField(t, sub[1], sub[2])
+			if !ok {
+				missing = true
+			}
+			return v
+		})
+
+		if missing && m.TagTemplateMissing == "drop" {
+			log.Debugf("Tag template %s has unresolved references for task %s. Dropping it", tpl, t.ID)
+			continue
+		}
+
+		if tag != "" && !sliceContainsString(tags, tag) && !sliceContainsString(result, tag) {
+			result = append(result, tag)
+		}
+	}
+
+	return result
+}
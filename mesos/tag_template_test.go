@@ -0,0 +1,63 @@
+package mesos
+
+import (
+	"testing"
+
+	"github.com/CiscoCloud/mesos-consul/state"
+)
+
+func TestCheckTagTemplate(t *testing.T) {
+	for _, tt := range []struct {
+		tpl   string
+		valid bool
+	}{
+		{"static", true},
+		{"version-${label:VERSION}", true},
+		{"${task:hostname}-${task:framework}", true},
+		{"${label:}", false},
+		{"${task:cpus}", false},
+		{"${env:HOME}", false},
+		{"version-${label:VERSION", false},
+		{"${label:a}${", false},
+	} {
+		if err := checkTagTemplate(tt.tpl); (err == nil) != tt.valid {
+			t.Errorf("checkTagTemplate(%s) => %v, want valid %t", tt.tpl, err, tt.valid)
+		}
+	}
+}
+
+func TestTemplateTags(t *testing.T) {
+	task := &state.Task{
+		ID:          "web.1",
+		Name:        "web",
+		FrameworkID: "F1",
+		SlaveID:     "S1",
+		Labels:      []state.Label{{Key: "VERSION", Value: "1.2"}},
+	}
+
+	for _, tt := range []struct {
+		templates []string
+		missing   string
+		tags      []string
+		r         []string
+	}{
+		{[]string{"version-${label:VERSION}", "host-${task:hostname}"}, "drop", nil, []string{"version-1.2", "host-agent1"}},
+		{[]string{"${task:framework}/${task:name}/${task:id}@${task:agent}"}, "drop", nil, []string{"marathon/web/web.1@10.0.0.1"}},
+		{[]string{"team-${label:TEAM}", "version-${label:VERSION}"}, "drop", nil, []string{"version-1.2"}},
+		{[]string{"team-${label:TEAM}", "version-${label:VERSION}"}, "empty", nil, []string{"team-", "version-1.2"}},
+		{[]string{"${label:TEAM}"}, "empty", nil, nil},
+		{[]string{"version-${label:VERSION}", "version-${label:VERSION}"}, "drop", []string{"web"}, []string{"version-1.2"}},
+		{[]string{"version-${label:VERSION}"}, "drop", []string{"version-1.2"}, nil},
+	} {
+		m, _ := newTestMesos()
+		m.TagTemplates = tt.templates
+		m.TagTemplateMissing = tt.missing
+		m.Frameworks = map[string]string{"F1": "marathon"}
+		m.Agents = map[string]string{"S1": "10.0.0.1"}
+		m.agentHostnames = map[string]string{"S1": "agent1"}
+
+		if r := m.templateTags(task, tt.tags); !sliceEq(r, tt.r) {
+			t.Errorf("templateTags(%v, %s) => %v, want %v", tt.templates, tt.missing, r, tt.r)
+		}
+	}
+}
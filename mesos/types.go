@@ -1,5 +1,15 @@
 package mesos
 
+// ManagedService is a service of the cache, as listed by GET /services
+type ManagedService struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Tags    []string `json:"tags"`
+	Cluster string   `json:"cluster,omitempty"`
+	Consul  string   `json:"consul,omitempty"`
+	Marked  bool     `json:"marked"`
+}
+
 type MesosHost struct {
 	Ip           string
 	Host         string
@@ -5,10 +5,11 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-
-	log "github.com/sirupsen/logrus"
 )
 
+// cleanName()
+//   The default name sanitizer
+//
 func cleanName(name string, separator string) string {
 	reg, err := regexp.Compile("[^\\w-]")
 	if err != nil {
@@ -21,7 +22,16 @@ func cleanName(name string, separator string) string {
 	return strings.ToLower(strings.Replace(s, "_", separator, -1))
 }
 
-// helper function to compare service tag slices
+// emptyName()
+//   A cleaned name without any valid character is not a usable
+//   service name
+//
+func emptyName(name string) bool {
+	return strings.Trim(name, "-") == ""
+}
+
+// helper function to compare service tag slices, nil and empty slices
+// are equal
 //
 func sliceEq(a, b []string) bool {
 	if len(a) != len(b) {
@@ -37,6 +47,23 @@ func sliceEq(a, b []string) bool {
 	return true
 }
 
+// helper function to compare service meta, nil and empty maps are
+// equal
+//
+func mapEq(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+
+	return true
+}
+
 func sliceContainsString(s []string, b string) bool {
 	for _, a := range s {
 		if a == b {
@@ -46,9 +73,36 @@ func sliceContainsString(s []string, b string) bool {
 	return false
 }
 
+// prefixTag prepends prefix to tag unless the tag already carries it,
+// so that tags read back from Consul are not prefixed twice.
+//
+func prefixTag(tag string, prefix string) string {
+	if prefix == "" || strings.HasPrefix(tag, prefix) {
+		return tag
+	}
+
+	return prefix + tag
+}
+
+func prefixTags(tags []string, prefix string) []string {
+	if prefix == "" {
+		return tags
+	}
+
+	rval := make([]string, len(tags))
+	for i, t := range tags {
+		rval[i] = prefixTag(t, prefix)
+	}
+
+	return rval
+}
+
 func leaderIP(leader string) string {
-	host := strings.Split(leader, "@")[1]
-	host = strings.Split(host, ":")[0]
+	i := strings.Index(leader, "@")
+	if i < 0 {
+		return ""
+	}
+	host := strings.Split(leader[i+1:], ":")[0]
 
 	return toIP(host)
 }
@@ -5,11 +5,18 @@ import (
 )
 
 func TestLeaderIP(t *testing.T) {
-	l := "master@124.123.123.121:5050"
-
-	ip := leaderIP(l)
-
-	t.Log("ip: ", ip)
+	for _, tt := range []struct {
+		leader string
+		ip     string
+	}{
+		{"master@124.123.123.121:5050", "124.123.123.121"},
+		{"", ""},
+		{"124.123.123.121:5050", ""},
+	} {
+		if ip := leaderIP(tt.leader); ip != tt.ip {
+			t.Errorf("leaderIP(%q) => %q, want %q", tt.leader, ip, tt.ip)
+		}
+	}
 }
 
 func TestSliceEq(t *testing.T) {
@@ -19,7 +26,11 @@ func TestSliceEq(t *testing.T) {
 		r bool
 	}{
 		{[]string{}, []string{}, true},
+		{nil, []string{}, true},
+		{[]string{}, nil, true},
+		{nil, nil, true},
 		{[]string{"one"}, []string{}, false},
+		{[]string{"one"}, nil, false},
 		{[]string{"one"}, []string{"one"}, true},
 		{[]string{"one"}, []string{"two"}, false},
 		{[]string{"one"}, []string{"one", "two"}, false},
@@ -51,3 +62,21 @@ func TestSliceContainsString(t *testing.T) {
 		}
 	}
 }
+
+func TestPrefixTag(t *testing.T) {
+	for _, tt := range []struct {
+		tag    string
+		prefix string
+		r      string
+	}{
+		{"one", "", "one"},
+		{"one", "mc/", "mc/one"},
+		{"mc/one", "mc/", "mc/one"},
+		{"", "mc/", "mc/"},
+	} {
+		r := prefixTag(tt.tag, tt.prefix)
+		if r != tt.r {
+			t.Errorf("prefixTag(%s, %s) => %s, want %s", tt.tag, tt.prefix, r, tt.r)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package mesos
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"time"
@@ -9,7 +10,13 @@ import (
 	"github.com/mesos/mesos-go/detector"
 	_ "github.com/mesos/mesos-go/detector/zoo"
 	proto "github.com/mesos/mesos-go/mesosproto"
-	log "github.com/sirupsen/logrus"
+)
+
+// Errors of a missing leader, in Zookeeper or in the Mesos state when
+// the masters lost their quorum
+var (
+	errNoLeader        = errors.New("No master in zookeeper")
+	errNoElectedLeader = errors.New("No elected leader in the Mesos state")
 )
 
 func (m *Mesos) OnMasterChanged(leader *proto.MasterInfo) {
@@ -59,6 +66,18 @@ func (m *Mesos) getLeader() *MesosHost {
 	return MasterInfoToMesosHost(m.Leader)
 }
 
+// Get the leader, or an error when Zookeeper has no leader with an
+// address
+//
+func (m *Mesos) leader() (*MesosHost, error) {
+	mh := m.getLeader()
+	if mh.Ip == "" {
+		return nil, errNoLeader
+	}
+
+	return mh, nil
+}
+
 func (m *Mesos) getMasters() []*MesosHost {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
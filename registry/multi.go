@@ -0,0 +1,270 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Multi is a Registry that fans every operation out to several registries.
+// A failure in one registry does not prevent the others from being updated.
+type Multi []Registry
+
+// Named is implemented by the registries of a named cluster.
+type Named interface {
+	Name() string
+}
+
+// Heartbeater is implemented by the registries that pass a heartbeat check
+// per service, expiring after HeartbeatTTL, 0 when disabled.
+type Heartbeater interface {
+	HeartbeatTTL() time.Duration
+}
+
+// HeartbeatTTL returns the shortest heartbeat TTL of the registries, the
+// one the refresh must keep up with.
+func (rs Multi) HeartbeatTTL() time.Duration {
+	var ttl time.Duration
+	for _, r := range rs {
+		if h, ok := r.(Heartbeater); ok {
+			if t := h.HeartbeatTTL(); t > 0 && (ttl == 0 || t < ttl) {
+				ttl = t
+			}
+		}
+	}
+
+	return ttl
+}
+
+// Registries returns the registries of a Multi, or the registry itself, so
+// that callers can read the cache of each cluster on its own.
+func Registries(r Registry) []Registry {
+	if rs, ok := r.(Multi); ok {
+		return rs
+	}
+
+	return []Registry{r}
+}
+
+func (rs Multi) CacheCreate() bool {
+	created := false
+	for _, r := range rs {
+		if r.CacheCreate() {
+			created = true
+		}
+	}
+
+	return created
+}
+
+func (rs Multi) CacheDelete(id string) {
+	for _, r := range rs {
+		r.CacheDelete(id)
+	}
+}
+
+func (rs Multi) CacheLoad(host string, idPrefixes ...string) error {
+	var errs []string
+	for _, r := range rs {
+		if err := r.CacheLoad(host, idPrefixes...); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("cache load failed: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// CacheReconcile reconciles the cache of each registry with its Consul,
+// and returns their errors joined.
+func (rs Multi) CacheReconcile(host string) error {
+	var errs []string
+	for _, r := range rs {
+		if err := r.CacheReconcile(host); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("cache reconciliation failed: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// CacheLookup returns the service only if every registry knows it. When
+// the registries disagree on the tags, meta, address or port, the
+// returned service has none of the differing ones, so that callers
+// comparing them re-register it everywhere.
+func (rs Multi) CacheLookup(id string) *Service {
+	var rval *Service
+	for _, r := range rs {
+		s := r.CacheLookup(id)
+		if s == nil {
+			return nil
+		}
+
+		if rval == nil {
+			copied := *s
+			rval = &copied
+			continue
+		}
+		if !tagsEq(rval.Tags, s.Tags) {
+			rval.Tags = nil
+		}
+		if !metaEq(rval.Meta, s.Meta) {
+			rval.Meta = nil
+		}
+		if rval.Address != s.Address || rval.Port != s.Port {
+			rval.Address = ""
+			rval.Port = 0
+		}
+	}
+
+	return rval
+}
+
+// CacheIDs returns the IDs of the services cached by any registry.
+func (rs Multi) CacheIDs() []string {
+	seen := make(map[string]bool)
+
+	var ids []string
+	for _, r := range rs {
+		for _, id := range r.CacheIDs() {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids
+}
+
+func (rs Multi) CacheMark(id string) {
+	for _, r := range rs {
+		r.CacheMark(id)
+	}
+}
+
+// CacheMarked returns whether any registry marked the service in its last
+// refresh.
+func (rs Multi) CacheMarked(id string) bool {
+	for _, r := range rs {
+		if r.CacheMarked(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rs Multi) Register(s *Service) {
+	for _, r := range rs {
+		r.Register(s)
+	}
+}
+
+func (rs Multi) Deregister() {
+	for _, r := range rs {
+		r.Deregister()
+	}
+}
+
+func (rs Multi) DeregisterService(id string) {
+	for _, r := range rs {
+		r.DeregisterService(id)
+	}
+}
+
+func (rs Multi) RegisterCheck(c *NodeCheck) {
+	for _, r := range rs {
+		r.RegisterCheck(c)
+	}
+}
+
+func (rs Multi) UpdateTTL(id string, pass bool, output string) {
+	for _, r := range rs {
+		r.UpdateTTL(id, pass, output)
+	}
+}
+
+func (rs Multi) KVSync(host, prefix string, kv map[string][]byte) error {
+	var errs []string
+	for _, r := range rs {
+		if err := r.KVSync(host, prefix, kv); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("kv sync failed: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// KVGet returns the value of the key in the first registry where it is
+// present, so that a key set in any Consul cluster is seen.
+func (rs Multi) KVGet(host, key string) ([]byte, bool, error) {
+	var errs []string
+	for _, r := range rs {
+		v, ok, err := r.KVGet(host, key)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if ok {
+			return v, true, nil
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, false, fmt.Errorf("kv get failed: %s", strings.Join(errs, "; "))
+	}
+
+	return nil, false, nil
+}
+
+func (rs Multi) Ping(host string) error {
+	for _, r := range rs {
+		if err := r.Ping(host); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// metaEq compares meta, nil and empty meta are equal
+func metaEq(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// tagsEq compares tags in order, nil and empty tags are equal
+func tagsEq(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,157 @@
+package registry
+
+import (
+	"sort"
+	"testing"
+)
+
+type fakeRegistry map[string]*Service
+
+func (f fakeRegistry) CacheCreate() bool                              { return false }
+func (f fakeRegistry) CacheDelete(id string)                          { delete(f, id) }
+func (f fakeRegistry) CacheLoad(string, ...string) error              { return nil }
+func (f fakeRegistry) CacheReconcile(string) error                    { return nil }
+func (f fakeRegistry) CacheMark(string)                               {}
+func (f fakeRegistry) CacheMarked(id string) bool                     { _, ok := f[id]; return ok }
+func (f fakeRegistry) Register(s *Service)                            { f[s.ID] = s }
+func (f fakeRegistry) Deregister()                                    {}
+func (f fakeRegistry) DeregisterService(id string)                    { delete(f, id) }
+func (f fakeRegistry) RegisterCheck(*NodeCheck)                       {}
+func (f fakeRegistry) UpdateTTL(string, bool, string)                 {}
+func (f fakeRegistry) KVSync(string, string, map[string][]byte) error { return nil }
+func (f fakeRegistry) KVGet(string, string) ([]byte, bool, error)     { return nil, false, nil }
+func (f fakeRegistry) Ping(string) error                              { return nil }
+func (f fakeRegistry) CacheIDs() []string {
+	var ids []string
+	for id := range f {
+		ids = append(ids, id)
+	}
+	return ids
+}
+func (f fakeRegistry) CacheLookup(id string) *Service {
+	if s, ok := f[id]; ok {
+		return &Service{ID: s.ID, Tags: s.Tags, Meta: s.Meta, Address: s.Address, Port: s.Port}
+	}
+	return nil
+}
+
+func TestMultiCacheLookup(t *testing.T) {
+	for _, tt := range []struct {
+		a, b  []string
+		found bool
+		tags  []string
+	}{
+		{[]string{"one"}, []string{"one"}, true, []string{"one"}},
+		{[]string{"one"}, []string{"two"}, true, nil},
+		{[]string{"one"}, nil, false, nil},
+	} {
+		a, b := fakeRegistry{}, fakeRegistry{}
+		a.Register(&Service{ID: "id", Tags: tt.a})
+		if tt.b != nil {
+			b.Register(&Service{ID: "id", Tags: tt.b})
+		}
+
+		s := Multi{a, b}.CacheLookup("id")
+		if (s != nil) != tt.found {
+			t.Errorf("CacheLookup(%v, %v) found => %t, want %t", tt.a, tt.b, s != nil, tt.found)
+			continue
+		}
+		if s != nil && !tagsEq(s.Tags, tt.tags) {
+			t.Errorf("CacheLookup(%v, %v) tags => %v, want %v", tt.a, tt.b, s.Tags, tt.tags)
+		}
+	}
+}
+
+func TestMultiCacheLookupDisagree(t *testing.T) {
+	for _, tt := range []struct {
+		a, b    *Service
+		meta    map[string]string
+		address string
+		port    int
+	}{
+		{
+			&Service{ID: "id", Meta: map[string]string{"k": "v"}, Address: "10.0.0.1", Port: 31000},
+			&Service{ID: "id", Meta: map[string]string{"k": "v"}, Address: "10.0.0.1", Port: 31000},
+			map[string]string{"k": "v"}, "10.0.0.1", 31000,
+		},
+		{
+			&Service{ID: "id", Meta: map[string]string{"k": "v"}, Address: "10.0.0.1", Port: 31000},
+			&Service{ID: "id", Meta: map[string]string{"k": "old"}, Address: "10.0.0.1", Port: 31000},
+			nil, "10.0.0.1", 31000,
+		},
+		{
+			&Service{ID: "id", Address: "10.0.0.1", Port: 31000},
+			&Service{ID: "id", Address: "10.0.0.2", Port: 31000},
+			nil, "", 0,
+		},
+		{
+			&Service{ID: "id", Address: "10.0.0.1", Port: 31000},
+			&Service{ID: "id", Address: "10.0.0.1", Port: 31001},
+			nil, "", 0,
+		},
+	} {
+		a, b := fakeRegistry{}, fakeRegistry{}
+		a.Register(tt.a)
+		b.Register(tt.b)
+
+		s := Multi{a, b}.CacheLookup("id")
+		if s == nil || !metaEq(s.Meta, tt.meta) || s.Address != tt.address || s.Port != tt.port {
+			t.Errorf("CacheLookup(%+v, %+v) => %+v, want meta %v and %s:%d", tt.a, tt.b, s, tt.meta, tt.address, tt.port)
+		}
+	}
+}
+
+func TestTagsEq(t *testing.T) {
+	for _, tt := range []struct {
+		a, b []string
+		want bool
+	}{
+		{nil, nil, true},
+		{nil, []string{}, true},
+		{[]string{}, nil, true},
+		{[]string{}, []string{}, true},
+		{[]string{"one"}, nil, false},
+		{[]string{"one", "two"}, []string{"two", "one"}, false},
+	} {
+		if got := tagsEq(tt.a, tt.b); got != tt.want {
+			t.Errorf("tagsEq(%#v, %#v) => %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMultiCacheIDs(t *testing.T) {
+	a, b := fakeRegistry{}, fakeRegistry{}
+	a.Register(&Service{ID: "one"})
+	a.Register(&Service{ID: "two"})
+	b.Register(&Service{ID: "two"})
+	b.Register(&Service{ID: "three"})
+
+	ids := Multi{a, b}.CacheIDs()
+	sort.Strings(ids)
+	if !tagsEq(ids, []string{"one", "three", "two"}) {
+		t.Errorf("CacheIDs() => %v, want [one three two]", ids)
+	}
+}
+
+func TestMultiRegister(t *testing.T) {
+	a, b := fakeRegistry{}, fakeRegistry{}
+	Multi{a, b}.Register(&Service{ID: "id"})
+
+	if _, ok := a["id"]; !ok {
+		t.Errorf("service not registered in first registry")
+	}
+	if _, ok := b["id"]; !ok {
+		t.Errorf("service not registered in second registry")
+	}
+}
+
+func TestRegistries(t *testing.T) {
+	a, b := fakeRegistry{}, fakeRegistry{}
+
+	if rs := Registries(Multi{a, b}); len(rs) != 2 {
+		t.Errorf("Registries(Multi) => %d registries, want 2", len(rs))
+	}
+	if rs := Registries(a); len(rs) != 1 {
+		t.Errorf("Registries(registry) => %d registries, want 1", len(rs))
+	}
+}
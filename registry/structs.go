@@ -1,10 +1,36 @@
 package registry
 
 type Check struct {
+	Name     string
 	Script   string
 	TTL      string
 	HTTP     string
+	TCP      string
 	Interval string
+	Timeout  string
+
+	// HTTP check method and TLS verification
+	Method        string
+	TLSSkipVerify bool
+
+	// Docker exec check
+	DockerContainerID string
+	Shell             string
+	Args              []string
+
+	// Alias check mirroring the health of another service
+	AliasService string
+
+	// Consecutive failures before the check turns warning or critical
+	FailuresBeforeWarning  int
+	FailuresBeforeCritical int
+
+	// Maximum size of the check output stored by Consul, 0 for the
+	// Consul default
+	OutputMaxSize int
+
+	// Free-form notes of the check, shown by Consul
+	Notes string
 }
 
 type Service struct {
@@ -13,26 +39,80 @@ type Service struct {
 	Port    int
 	Address string
 	Tags    []string
+	Meta    map[string]string
 	Check   *Check
 	Agent   string
+
+	// Checks registered along Check, from the consul_checks_json label
+	Checks []*Check
+
+	// Consul Enterprise admin partition, empty for the agent default
+	Partition string
+
+	// Unix socket of the service, registered without port nor address
+	SocketPath string
+
+	// Consul service kind, e.g. mesh-gateway, empty for a typical
+	// service
+	Kind string
+}
+
+// NodeCheck is a check attached to the node of an agent rather than
+// to one of its services.
+type NodeCheck struct {
+	ID    string
+	Name  string
+	Agent string
+	Check *Check
 }
 
 type Registry interface {
 	CacheCreate() bool
 	CacheDelete(string)
-	CacheLoad(string, string) error
+	CacheLoad(string, ...string) error
+	CacheReconcile(string) error
 	CacheLookup(string) *Service
+	CacheIDs() []string
 	CacheMark(string)
+	CacheMarked(string) bool
 
 	Register(*Service)
 	Deregister()
+	DeregisterService(string)
+
+	RegisterCheck(*NodeCheck)
+	UpdateTTL(string, bool, string)
+
+	KVSync(string, string, map[string][]byte) error
+	KVGet(string, string) ([]byte, bool, error)
+
+	Ping(string) error
 }
 
 func DefaultCheck() *Check {
 	return &Check{
+		Name:     "",
 		TTL:      "",
 		Script:   "",
 		HTTP:     "",
+		TCP:      "",
 		Interval: "",
+		Timeout:  "",
+
+		Method:        "",
+		TLSSkipVerify: false,
+
+		DockerContainerID: "",
+		Shell:             "",
+		Args:              nil,
+
+		AliasService: "",
+
+		FailuresBeforeWarning:  0,
+		FailuresBeforeCritical: 0,
+
+		OutputMaxSize: 0,
+
+		Notes: "",
 	}
 }
@@ -3,8 +3,10 @@ package state
 import (
 	"bytes"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mesos/mesos-go/upid"
 )
@@ -56,9 +58,16 @@ type Status struct {
 // ContainerStatus holds container metadata as defined in the /state.json
 // Mesos HTTP endpoint.
 type ContainerStatus struct {
+	ContainerID  ContainerID   `json:"container_id,omitempty"`
 	NetworkInfos []NetworkInfo `json:"network_infos,omitempty"`
 }
 
+// ContainerID holds the Mesos container ID as defined in the /state.json
+// Mesos HTTP endpoint.
+type ContainerID struct {
+	Value string `json:"value"`
+}
+
 // NetworkInfo holds the network configuration for a single interface
 // as defined in the /state.json Mesos HTTP endpoint.
 type NetworkInfo struct {
@@ -79,37 +88,98 @@ type Task struct {
 	ID            string   `json:"id"`
 	Name          string   `json:"name"`
 	SlaveID       string   `json:"slave_id"`
+	ExecutorID    string   `json:"executor_id"`
 	State         string   `json:"state"`
 	Statuses      []Status `json:"statuses"`
 	Labels        []Label  `json:"labels"`
 	Resources     `json:"resources"`
 	DiscoveryInfo DiscoveryInfo `json:"discovery"`
+	HealthCheck   *HealthCheck  `json:"health_check,omitempty"`
+	Container     *Container    `json:"container,omitempty"`
+	Role          string        `json:"role"`
+
+	// Reservation roles of the task resources, only known from the
+	// operator API
+	ReservationRoles []string `json:"-"`
 
 	SlaveIP string `json:"-"`
 }
 
+// Container holds the container of a task as defined in the /state.json
+// Mesos HTTP endpoint, with the fields giving its image.
+type Container struct {
+	Type   string `json:"type"`
+	Docker *struct {
+		Image string `json:"image"`
+	} `json:"docker,omitempty"`
+	Mesos *struct {
+		Image *ContainerImage `json:"image,omitempty"`
+	} `json:"mesos,omitempty"`
+}
+
+// ContainerImage holds the image of a Mesos containerizer container.
+type ContainerImage struct {
+	Type   string `json:"type"`
+	Docker *struct {
+		Name string `json:"name"`
+	} `json:"docker,omitempty"`
+	Appc *struct {
+		Name string `json:"name"`
+	} `json:"appc,omitempty"`
+}
+
+// Image returns the image of the task container, from the Docker
+// containerizer or the Mesos one, or an empty string for tasks without
+// a container or image, like the command executor ones.
+func (t *Task) Image() string {
+	c := t.Container
+	if c == nil {
+		return ""
+	}
+
+	if c.Docker != nil && c.Docker.Image != "" {
+		return c.Docker.Image
+	}
+	if c.Mesos != nil && c.Mesos.Image != nil {
+		img := c.Mesos.Image
+		if img.Docker != nil && img.Docker.Name != "" {
+			return img.Docker.Name
+		}
+		if img.Appc != nil {
+			return img.Appc.Name
+		}
+	}
+
+	return ""
+}
+
 // HasDiscoveryInfo return whether the DiscoveryInfo was provided in the state.json
 func (t *Task) HasDiscoveryInfo() bool {
 	return t.DiscoveryInfo.Name != ""
 }
 
-// IP returns the first Task IP found in the given sources.
-func (t *Task) IP(srcs ...string) string {
-	if ips := t.IPs(srcs...); len(ips) > 0 {
+// IP returns the first Task IP found in the given sources, in the latest
+// status in one of the given states.
+func (t *Task) IP(states []string, srcs ...string) string {
+	if ips := t.IPs(states, srcs...); len(ips) > 0 {
 		return ips[0].String()
 	}
 	return ""
 }
 
 // IPs returns a slice of IPs sourced from the given sources with ascending
-// priority.
-func (t *Task) IPs(srcs ...string) (ips []net.IP) {
+// priority. Only the most recent status in one of the given states is
+// considered, TASK_RUNNING if none is given.
+func (t *Task) IPs(states []string, srcs ...string) (ips []net.IP) {
 	if t == nil {
 		return nil
 	}
+	if len(states) == 0 {
+		states = RunningStates
+	}
 	for i := range srcs {
 		if src, ok := sources[srcs[i]]; ok {
-			for _, srcIP := range src(t) {
+			for _, srcIP := range src(t, states) {
 				if ip := net.ParseIP(srcIP); len(ip) > 0 {
 					ips = append(ips, ip)
 				}
@@ -119,6 +189,55 @@ func (t *Task) IPs(srcs ...string) (ips []net.IP) {
 	return ips
 }
 
+// RunningSince returns the time of the most recent TASK_RUNNING status,
+// or the zero Time if the task never reported running.
+func (t *Task) RunningSince() time.Time {
+	ts := -1.0
+	for _, s := range t.Statuses {
+		if s.State == "TASK_RUNNING" && s.Timestamp > ts {
+			ts = s.Timestamp
+		}
+	}
+	if ts < 0 {
+		return time.Time{}
+	}
+
+	return unixTime(ts)
+}
+
+// StartedAt returns the time of the earliest TASK_RUNNING status, or the
+// zero Time if no running status has a timestamp.
+func (t *Task) StartedAt() time.Time {
+	ts := 0.0
+	for _, s := range t.Statuses {
+		if s.State == "TASK_RUNNING" && s.Timestamp > 0 && (ts == 0 || s.Timestamp < ts) {
+			ts = s.Timestamp
+		}
+	}
+	if ts == 0 {
+		return time.Time{}
+	}
+
+	return unixTime(ts)
+}
+
+// unixTime converts a Mesos timestamp in fractional seconds to a Time.
+func unixTime(ts float64) time.Time {
+	sec := int64(ts)
+	return time.Unix(sec, int64((ts-float64(sec))*1e9))
+}
+
+// ContainerID returns the Mesos container ID of the latest running status,
+// or an empty string if none is known.
+func (t *Task) ContainerID() string {
+	if ids := statusIPs(t.Statuses, RunningStates, func(s *Status) []string {
+		return []string{s.ContainerStatus.ContainerID.Value}
+	}); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
 // Label returns the label.Value of the key matching the passed in string
 func (t *Task) Label(name string) string {
 	for _, l := range t.Labels {
@@ -130,8 +249,26 @@ func (t *Task) Label(name string) string {
 	return ""
 }
 
+// Roles returns the sorted distinct roles the task resources are allocated
+// to and reserved for, without the default * role.
+func (t *Task) Roles() []string {
+	var roles []string
+	for _, r := range append([]string{t.Role}, t.ReservationRoles...) {
+		if r == "" || r == "*" {
+			continue
+		}
+		if i := sort.SearchStrings(roles, r); i == len(roles) || roles[i] != r {
+			roles = append(roles, "")
+			copy(roles[i+1:], roles[i:])
+			roles[i] = r
+		}
+	}
+
+	return roles
+}
+
 // sources maps the string representation of IP sources to their functions.
-var sources = map[string]func(*Task) []string{
+var sources = map[string]func(*Task, []string) []string{
 	"host":    hostIPs,
 	"mesos":   mesosIPs,
 	"docker":  dockerIPs,
@@ -140,12 +277,12 @@ var sources = map[string]func(*Task) []string{
 
 // hostIPs is an IPSource which returns the IP addresses of the slave a Task
 // runs on.
-func hostIPs(t *Task) []string { return []string{t.SlaveIP} }
+func hostIPs(t *Task, _ []string) []string { return []string{t.SlaveIP} }
 
 // networkInfoIPs returns IP addresses from a given Task's
 // []Status.ContainerStatus.[]NetworkInfos.IPAddress
-func networkInfoIPs(t *Task) []string {
-	return statusIPs(t.Statuses, func(s *Status) []string {
+func networkInfoIPs(t *Task, states []string) []string {
+	return statusIPs(t.Statuses, states, func(s *Status) []string {
 		ips := make([]string, len(s.ContainerStatus.NetworkInfos))
 		for _, netinfo := range s.ContainerStatus.NetworkInfos {
 			if len(netinfo.IPAddresses) > 0 {
@@ -173,26 +310,41 @@ const (
 
 // dockerIPs returns IP addresses from the values of all
 // Task.[]Status.[]Labels whose keys are equal to "Docker.NetworkSettings.IPAddress".
-func dockerIPs(t *Task) []string {
-	return statusIPs(t.Statuses, labels(DockerIPLabel))
+func dockerIPs(t *Task, states []string) []string {
+	return statusIPs(t.Statuses, states, labels(DockerIPLabel))
 }
 
 // mesosIPs returns IP addresses from the values of all
 // Task.[]Status.[]Labels whose keys are equal to
 // "MesosContainerizer.NetworkSettings.IPAddress".
-func mesosIPs(t *Task) []string {
-	return statusIPs(t.Statuses, labels(MesosIPLabel))
+func mesosIPs(t *Task, states []string) []string {
+	return statusIPs(t.Statuses, states, labels(MesosIPLabel))
+}
+
+// RunningStates holds the task states whose statuses are considered when
+// resolving task IPs by default.
+var RunningStates = []string{"TASK_RUNNING"}
+
+// isCurrent returns whether the given task state is one of states.
+func isCurrent(states []string, state string) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
 }
 
-// statusIPs returns the latest running status IPs extracted with the given src
-func statusIPs(st []Status, src func(*Status) []string) []string {
+// statusIPs returns the IPs extracted with the given src from the latest
+// status in one of the given states
+func statusIPs(st []Status, states []string, src func(*Status) []string) []string {
 	// the state.json we extract from mesos makes no guarantees re: the order
 	// of the task statuses so we should check the timestamps to avoid problems
 	// down the line. we can't rely on seeing the same sequence. (@joris)
 	// https://github.com/apache/mesos/blob/0.24.0/src/slave/slave.cpp#L5226-L5238
 	ts, j := -1.0, -1
 	for i := range st {
-		if st[i].State == "TASK_RUNNING" && st[i].Timestamp > ts {
+		if isCurrent(states, st[i].State) && st[i].Timestamp > ts {
 			ts, j = st[i].Timestamp, i
 		}
 	}
@@ -218,10 +370,14 @@ func labels(key string) func(*Status) []string {
 
 // Framework holds a framework as defined in the /state.json Mesos HTTP endpoint.
 type Framework struct {
-	Tasks    []Task `json:"tasks"`
-	PID      PID    `json:"pid"`
-	Name     string `json:"name"`
-	Hostname string `json:"hostname"`
+	ID             string `json:"id"`
+	Tasks          []Task `json:"tasks"`
+	CompletedTasks []Task `json:"completed_tasks"`
+	PID            PID    `json:"pid"`
+	Name           string `json:"name"`
+	Hostname       string `json:"hostname"`
+	Active         bool   `json:"active"`
+	WebuiURL       string `json:"webui_url"`
 }
 
 // HostPort returns the hostname and port where a framework's scheduler is
@@ -235,9 +391,95 @@ func (f Framework) HostPort() (string, string) {
 
 // Slave holds a slave as defined in the /state.json Mesos HTTP endpoint.
 type Slave struct {
-	ID       string `json:"id"`
+	ID         string                 `json:"id"`
+	Hostname   string                 `json:"hostname"`
+	PID        PID                    `json:"pid"`
+	DrainInfo  *DrainInfo             `json:"drain_info,omitempty"`
+	Attributes map[string]interface{} `json:"attributes"`
+
+	Resources     ScalarResources `json:"resources"`
+	UsedResources ScalarResources `json:"used_resources"`
+}
+
+// ScalarResources holds the scalar resources of an agent in the /state.json
+// Mesos HTTP endpoint, nil when missing. Memory and disk are in MB.
+type ScalarResources struct {
+	CPUs *float64 `json:"cpus"`
+	Mem  *float64 `json:"mem"`
+	Disk *float64 `json:"disk"`
+	GPUs *float64 `json:"gpus"`
+}
+
+// Attribute returns the values of a slave attribute: one for scalar and
+// text attributes, one per item for set attributes, rendered as {a,b} in
+// the /state.json Mesos HTTP endpoint. Ranges are returned as is.
+func (s Slave) Attribute(key string) []string {
+	switch v := s.Attributes[key].(type) {
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}
+	case string:
+		if strings.HasPrefix(v, "{") && strings.HasSuffix(v, "}") {
+			var vals []string
+			for _, item := range strings.Split(v[1:len(v)-1], ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					vals = append(vals, item)
+				}
+			}
+			return vals
+		}
+		return []string{v}
+	}
+
+	return nil
+}
+
+// DrainInfo holds the drain state of a slave as defined in the /state.json
+// Mesos HTTP endpoint.
+type DrainInfo struct {
+	State string `json:"state"`
+}
+
+// MaintenanceStatus holds the machines in maintenance as defined in the
+// /maintenance/status Mesos HTTP endpoint.
+type MaintenanceStatus struct {
+	DrainingMachines []DrainingMachine `json:"draining_machines"`
+	DownMachines     []MachineID       `json:"down_machines"`
+}
+
+// DrainingMachine holds a machine scheduled for maintenance as defined in
+// the /maintenance/status Mesos HTTP endpoint.
+type DrainingMachine struct {
+	ID MachineID `json:"id"`
+}
+
+// MachineID identifies a machine as defined in the /maintenance/status Mesos
+// HTTP endpoint.
+type MachineID struct {
 	Hostname string `json:"hostname"`
-	PID      PID    `json:"pid"`
+	IP       string `json:"ip"`
+}
+
+// InMaintenance returns whether the slave is draining or down for maintenance.
+func (s *State) InMaintenance(sl Slave) bool {
+	if sl.DrainInfo != nil {
+		return true
+	}
+
+	machines := s.Maintenance.DownMachines
+	for _, d := range s.Maintenance.DrainingMachines {
+		machines = append(machines, d.ID)
+	}
+
+	for _, mid := range machines {
+		if mid.Hostname != "" && mid.Hostname == sl.Hostname {
+			return true
+		}
+		if mid.IP != "" && sl.PID.UPID != nil && mid.IP == sl.PID.Host {
+			return true
+		}
+	}
+
+	return false
 }
 
 // PID holds a Mesos PID and implements the json.Unmarshaler interface.
@@ -254,6 +496,11 @@ type State struct {
 	Frameworks []Framework `json:"frameworks"`
 	Slaves     []Slave     `json:"slaves"`
 	Leader     string      `json:"leader"`
+	Version    string      `json:"version"`
+	Cluster    string      `json:"cluster"`
+
+	// Maintenance is loaded separately from the /maintenance/status endpoint
+	Maintenance MaintenanceStatus `json:"-"`
 }
 
 // DiscoveryInfo holds the discovery meta data for a task defined in the /state.json Mesos HTTP endpoint.
@@ -291,3 +538,34 @@ func (p *DiscoveryPort) Label(name string) string {
 
 	return ""
 }
+
+// HealthCheck holds the Mesos native health check of a task, e.g. a
+// Marathon MESOS_HTTP or MESOS_TCP health check, as defined in the
+// /state.json Mesos HTTP endpoint.
+type HealthCheck struct {
+	Type                string        `json:"type"`
+	DelaySeconds        float64       `json:"delay_seconds,omitempty"`
+	IntervalSeconds     float64       `json:"interval_seconds,omitempty"`
+	TimeoutSeconds      float64       `json:"timeout_seconds,omitempty"`
+	ConsecutiveFailures int           `json:"consecutive_failures,omitempty"`
+	HTTP                *HTTPCheck    `json:"http,omitempty"`
+	TCP                 *TCPCheck     `json:"tcp,omitempty"`
+	Command             *CommandCheck `json:"command,omitempty"`
+}
+
+// HTTPCheck holds the HTTP part of a Mesos health check.
+type HTTPCheck struct {
+	Scheme string `json:"scheme,omitempty"`
+	Port   int    `json:"port"`
+	Path   string `json:"path,omitempty"`
+}
+
+// TCPCheck holds the TCP part of a Mesos health check.
+type TCPCheck struct {
+	Port int `json:"port"`
+}
+
+// CommandCheck holds the command of a Mesos health check.
+type CommandCheck struct {
+	Value string `json:"value"`
+}
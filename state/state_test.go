@@ -5,9 +5,10 @@ import (
 	"net"
 	"reflect"
 	"testing"
+	"time"
 
-	"github.com/mesos/mesos-go/upid"
 	. "github.com/CiscoCloud/mesos-consul/state"
+	"github.com/mesos/mesos-go/upid"
 )
 
 func TestResources_Ports(t *testing.T) {
@@ -104,13 +105,174 @@ func TestTask_IPs(t *testing.T) {
 			want: ips("1.2.3.4", "2.3.4.5"),
 		},
 	} {
-		if got := tt.IPs(tt.srcs...); !reflect.DeepEqual(got, tt.want) {
+		if got := tt.IPs(nil, tt.srcs...); !reflect.DeepEqual(got, tt.want) {
 			t.Logf("%+v", tt.Task)
 			t.Errorf("test #%d: got %+v, want %+v", i, got, tt.want)
 		}
 	}
 }
 
+func TestTask_IPs_States(t *testing.T) {
+	restarted := task(
+		statuses(
+			status(state("TASK_STAGING"), netinfo("1.2.3.4"), timestamp(1)),
+			status(state("TASK_RUNNING"), netinfo("2.3.4.5"), timestamp(2)),
+			status(state("TASK_STAGING"), netinfo("3.4.5.6"), timestamp(3)),
+		),
+	)
+
+	for i, tt := range []struct {
+		states []string
+		want   []net.IP
+	}{
+		{[]string{"TASK_RUNNING"}, ips("2.3.4.5")},
+		{[]string{"TASK_STAGING"}, ips("3.4.5.6")},
+		{[]string{"TASK_RUNNING", "TASK_STAGING"}, ips("3.4.5.6")},
+		{[]string{"TASK_FINISHED"}, nil},
+	} {
+		if got := restarted.IPs(tt.states, "netinfo"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test #%d: got %+v, want %+v", i, got, tt.want)
+		}
+	}
+}
+
+func TestTask_RunningSince(t *testing.T) {
+	for i, tt := range []struct {
+		*Task
+		want time.Time
+	}{
+		{task(), time.Time{}},
+		{task(statuses(status(state("TASK_STAGING"), timestamp(10)))), time.Time{}},
+		{
+			Task: task(statuses(
+				status(state("TASK_RUNNING"), timestamp(10)),
+				status(state("TASK_RUNNING"), timestamp(30.5)),
+				status(state("TASK_STAGING"), timestamp(40)),
+			)),
+			want: time.Unix(30, 5e8),
+		},
+	} {
+		if got := tt.RunningSince(); !got.Equal(tt.want) {
+			t.Errorf("test #%d: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestTask_StartedAt(t *testing.T) {
+	for i, tt := range []struct {
+		*Task
+		want time.Time
+	}{
+		{task(), time.Time{}},
+		{task(statuses(status(state("TASK_RUNNING")))), time.Time{}},
+		{
+			Task: task(statuses(
+				status(state("TASK_STAGING"), timestamp(5)),
+				status(state("TASK_RUNNING"), timestamp(30.5)),
+				status(state("TASK_RUNNING"), timestamp(10)),
+			)),
+			want: time.Unix(10, 0),
+		},
+	} {
+		if got := tt.StartedAt(); !got.Equal(tt.want) {
+			t.Errorf("test #%d: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestSlave_Attribute(t *testing.T) {
+	var slave Slave
+	err := json.Unmarshal([]byte(`{"attributes": {"rack": "r1", "cores": 2.5, "zones": "{a, b}", "ports": "[1-2]"}}`), &slave)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range []struct {
+		key  string
+		want []string
+	}{
+		{"rack", []string{"r1"}},
+		{"cores", []string{"2.5"}},
+		{"zones", []string{"a", "b"}},
+		{"ports", []string{"[1-2]"}},
+		{"missing", nil},
+	} {
+		if got := slave.Attribute(tt.key); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test #%d: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestTask_Roles(t *testing.T) {
+	for i, tt := range []struct {
+		role         string
+		reservations []string
+		want         []string
+	}{
+		{"", nil, nil},
+		{"*", nil, nil},
+		{"team-a", nil, []string{"team-a"}},
+		{"eng/web", []string{"eng", "eng/web"}, []string{"eng", "eng/web"}},
+		{"b", []string{"a", "*", "b", "a"}, []string{"a", "b"}},
+	} {
+		task := Task{Role: tt.role, ReservationRoles: tt.reservations}
+		if got := task.Roles(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test #%d: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestTask_Image(t *testing.T) {
+	for i, tt := range []struct {
+		task string
+		want string
+	}{
+		{`{"id": "cmd.1"}`, ""},
+		{`{"container": {"type": "DOCKER", "docker": {"image": "nginx:1.25", "network": "BRIDGE"}}}`, "nginx:1.25"},
+		{`{"container": {"type": "MESOS", "mesos": {"image": {"type": "DOCKER", "docker": {"name": "registry/web:2"}}}}}`, "registry/web:2"},
+		{`{"container": {"type": "MESOS", "mesos": {"image": {"type": "APPC", "appc": {"name": "coreos.com/etcd"}}}}}`, "coreos.com/etcd"},
+		{`{"container": {"type": "MESOS", "volumes": []}}`, ""},
+		{`{"container": {"type": "MESOS", "mesos": {}}}`, ""},
+	} {
+		var task Task
+		if err := json.Unmarshal([]byte(tt.task), &task); err != nil {
+			t.Fatal(err)
+		}
+		if got := task.Image(); got != tt.want {
+			t.Errorf("test #%d: got %q, want %q", i, got, tt.want)
+		}
+	}
+}
+
+func TestState_InMaintenance(t *testing.T) {
+	slave := Slave{
+		Hostname: "agent1",
+		PID:      PID{UPID: &upid.UPID{ID: "slave(1)", Host: "10.0.0.1", Port: "5051"}},
+	}
+	draining := slave
+	draining.DrainInfo = &DrainInfo{State: "DRAINING"}
+
+	var byHostname, byIP State
+	byHostname.Maintenance.DownMachines = []MachineID{{Hostname: "agent1"}}
+	byIP.Maintenance.DrainingMachines = []DrainingMachine{{ID: MachineID{IP: "10.0.0.1"}}}
+
+	for i, tt := range []struct {
+		state State
+		slave Slave
+		want  bool
+	}{
+		{State{}, slave, false},
+		{State{}, draining, true},
+		{byHostname, slave, true},
+		{byIP, slave, true},
+		{byHostname, Slave{Hostname: "agent2"}, false},
+	} {
+		if got := tt.state.InMaintenance(tt.slave); got != tt.want {
+			t.Errorf("test #%d: got %t, want %t", i, got, tt.want)
+		}
+	}
+}
+
 // test helpers
 
 type (
@@ -0,0 +1,304 @@
+// Package tracing records the spans of the mesos-consul sync cycles and
+// exports them with OTLP over HTTP, in its JSON encoding.
+//
+// A nil Tracer and the nil Spans it starts are valid and record nothing,
+// so that callers don't check whether tracing is enabled.
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CiscoCloud/mesos-consul/logging"
+)
+
+// Logger of the tracing subsystem, see --log-levels
+var log = logging.New("tracing")
+
+// OTLP span kind and status codes
+const (
+	kindInternal = 1
+	statusError  = 2
+)
+
+// Tracer exports the spans of each trace to an OTLP collector once its
+// root span ends.
+type Tracer struct {
+	url     string
+	service string
+	client  *http.Client
+}
+
+// New returns a Tracer exporting to the OTLP/HTTP endpoint, e.g.
+// http://collector:4318, or nil when endpoint is empty.
+func New(endpoint, service string) *Tracer {
+	if endpoint == "" {
+		return nil
+	}
+
+	return &Tracer{
+		url:     strings.TrimRight(endpoint, "/") + "/v1/traces",
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Start starts the root span of a new trace.
+func (t *Tracer) Start(name string) *Span {
+	if t == nil {
+		return nil
+	}
+
+	tr := &trace{tracer: t, id: randomID(16)}
+	return tr.start(name, "")
+}
+
+// Span is a timed operation of a trace.
+type Span struct {
+	trace  *trace
+	id     string
+	parent string
+	name   string
+	start  time.Time
+	end    time.Time
+	attrs  map[string]string
+	events []event
+	err    error
+}
+
+type event struct {
+	name  string
+	time  time.Time
+	attrs map[string]string
+}
+
+// trace holds the spans of a trace until its root span ends
+type trace struct {
+	tracer *Tracer
+	id     string
+
+	sync.Mutex
+	spans []*Span
+}
+
+func (tr *trace) start(name, parent string) *Span {
+	s := &Span{
+		trace:  tr,
+		id:     randomID(8),
+		parent: parent,
+		name:   name,
+		start:  time.Now(),
+		attrs:  make(map[string]string),
+	}
+
+	tr.Lock()
+	tr.spans = append(tr.spans, s)
+	tr.Unlock()
+
+	return s
+}
+
+// Child starts a span of the same trace with s as its parent.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+
+	return s.trace.start(name, s.id)
+}
+
+// SetAttribute sets an attribute of the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+
+	s.trace.Lock()
+	s.attrs[key] = value
+	s.trace.Unlock()
+}
+
+// Event records a timestamped event, with attributes given as key, value
+// pairs.
+func (s *Span) Event(name string, kv ...string) {
+	if s == nil {
+		return
+	}
+
+	e := event{name: name, time: time.Now(), attrs: make(map[string]string)}
+	for i := 0; i+1 < len(kv); i += 2 {
+		e.attrs[kv[i]] = kv[i+1]
+	}
+
+	s.trace.Lock()
+	s.events = append(s.events, e)
+	s.trace.Unlock()
+}
+
+// SetError sets the error status of the span, when err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.trace.Lock()
+	s.err = err
+	s.trace.Unlock()
+}
+
+// End ends the span. Ending the root span exports the trace in the
+// background.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.trace.Lock()
+	s.end = time.Now()
+	s.trace.Unlock()
+
+	if s.parent == "" {
+		go s.trace.export()
+	}
+}
+
+// export sends the ended spans of the trace to the collector
+func (tr *trace) export() {
+	b, err := json.Marshal(tr.request())
+	if err != nil {
+		log.Errorf("Unable to encode trace %s: %s", tr.id, err)
+		return
+	}
+
+	resp, err := tr.tracer.client.Post(tr.tracer.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Warnf("Unable to export trace %s: %s", tr.id, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Warnf("Unable to export trace %s: %s", tr.id, resp.Status)
+	}
+}
+
+// OTLP/HTTP JSON request, with the fields used by mesos-consul
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Events       []otlpEvent     `json:"events,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpEvent struct {
+	Time       string          `json:"timeUnixNano"`
+	Name       string          `json:"name"`
+	Attributes []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func (tr *trace) request() otlpRequest {
+	tr.Lock()
+	defer tr.Unlock()
+
+	var scope otlpScopeSpans
+	scope.Scope.Name = "mesos-consul"
+	for _, s := range tr.spans {
+		if s.end.IsZero() {
+			continue
+		}
+
+		span := otlpSpan{
+			TraceID:      tr.id,
+			SpanID:       s.id,
+			ParentSpanID: s.parent,
+			Name:         s.name,
+			Kind:         kindInternal,
+			Start:        unixNano(s.start),
+			End:          unixNano(s.end),
+			Attributes:   attributes(s.attrs),
+		}
+		for _, e := range s.events {
+			span.Events = append(span.Events, otlpEvent{Time: unixNano(e.time), Name: e.name, Attributes: attributes(e.attrs)})
+		}
+		if s.err != nil {
+			span.Status = &otlpStatus{Code: statusError, Message: s.err.Error()}
+		}
+		scope.Spans = append(scope.Spans, span)
+	}
+
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = attributes(map[string]string{"service.name": tr.tracer.service})
+	rs.ScopeSpans = []otlpScopeSpans{scope}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+func attributes(m map[string]string) []otlpAttribute {
+	var attrs []otlpAttribute
+	for k, v := range m {
+		var a otlpAttribute
+		a.Key = k
+		a.Value.StringValue = v
+		attrs = append(attrs, a)
+	}
+
+	return attrs
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// randomID returns n random bytes, hex encoded
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("tracing: unable to read random bytes: %s", err))
+	}
+
+	return hex.EncodeToString(b)
+}
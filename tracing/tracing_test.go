@@ -0,0 +1,65 @@
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.NotFound(w, r)
+		}
+		requests <- req
+	}))
+	defer collector.Close()
+
+	root := New(collector.URL+"/", "mesos-consul").Start("refresh")
+	fetch := root.Child("state fetch")
+	fetch.SetError(errors.New("no leader"))
+	fetch.End()
+	pass := root.Child("registration pass")
+	pass.Event("registerTask", "task.id", "web.1")
+	pass.End()
+	root.Child("unfinished")
+	root.End()
+
+	req := <-requests
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("export() => %+v, want one resource and scope", req)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 3 {
+		t.Fatalf("export() => %d spans, want the 3 ended spans", len(spans))
+	}
+
+	r, f, p := spans[0], spans[1], spans[2]
+	if r.Name != "refresh" || r.ParentSpanID != "" || len(r.TraceID) != 32 {
+		t.Errorf("export() root span => %+v, want refresh without parent", r)
+	}
+	if f.TraceID != r.TraceID || f.ParentSpanID != r.SpanID || f.Status == nil || f.Status.Message != "no leader" {
+		t.Errorf("export() state fetch span => %+v, want child of the root with an error status", f)
+	}
+	if len(p.Events) != 1 || p.Events[0].Name != "registerTask" || p.Events[0].Attributes[0].Value.StringValue != "web.1" {
+		t.Errorf("export() registration pass events => %+v, want registerTask of web.1", p.Events)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	tracer := New("", "mesos-consul")
+	if tracer != nil {
+		t.Fatalf("New(\"\") => %v, want nil", tracer)
+	}
+
+	// Nil spans record nothing
+	span := tracer.Start("refresh")
+	span.Child("sweep").End()
+	span.Event("registerTask")
+	span.SetError(errors.New("failed"))
+	span.End()
+}